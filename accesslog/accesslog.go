@@ -0,0 +1,300 @@
+/*
+Package accesslog provides http.Handler middleware writing a line per request served by the next handler,
+in the Apache combined format, as logfmt or with a text/template.
+
+The requests are measured with trace.Measure, as for the trace records. The lines are written whole to the
+writer, one at a time, so that the writer can be shared by concurrent requests and several loggers.
+
+The upstream is the host of the request URL as seen by the next handler once served, that is set when the
+handler rewrites the URL before forwarding it, or the value returned by the Upstream option.
+
+Examples of an access log middleware:
+
+	// logs the requests forwarded to the upstream to stdout in the combined format
+	accesslog.New(fwd, os.Stdout)
+
+	// logs the method, path, status and duration as logfmt
+	accesslog.New(fwd, os.Stdout, accesslog.Logfmt("method", "path", "status", "duration"))
+*/
+package accesslog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/trace"
+)
+
+// Fields available for the logfmt lines, in their default order
+var Fields = []string{
+	"time", "remote_addr", "method", "path", "proto", "status", "bytes", "duration", "upstream", "x_forwarded_for",
+}
+
+// combinedTime is the time layout of the Apache combined format
+const combinedTime = "02/Jan/2006:15:04:05 -0700"
+
+// Entry is the data of a line, it is passed to the templates
+type Entry struct {
+	Time          time.Time
+	RemoteAddr    string
+	User          string
+	Method        string
+	Host          string
+	Path          string
+	Proto         string
+	Status        int
+	Bytes         int64
+	Duration      time.Duration
+	Upstream      string
+	XForwardedFor string
+	Referer       string
+	UserAgent     string
+}
+
+// AccessLog is a middleware writing a line per request
+type AccessLog struct {
+	next     http.Handler
+	writer   io.Writer
+	mutex    sync.Mutex
+	fields   []string
+	tmpl     *template.Template
+	upstream func(req *http.Request) string
+
+	clock timetools.TimeProvider
+	log   *log.Logger
+}
+
+type optSetter func(a *AccessLog) error
+
+// New creates a new AccessLog middleware writing the lines to writer, in the Apache combined format by default
+func New(next http.Handler, writer io.Writer, setters ...optSetter) (*AccessLog, error) {
+	if writer == nil {
+		return nil, fmt.Errorf("writer can not be nil")
+	}
+	a := &AccessLog{
+		next:   next,
+		writer: writer,
+		clock:  &timetools.RealTime{},
+		log:    log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Clock sets the clock the requests are timed with, defaults to the real time.
+// Intended for unit tests.
+func Clock(clock timetools.TimeProvider) optSetter {
+	return func(a *AccessLog) error {
+		a.clock = clock
+		return nil
+	}
+}
+
+// Logger defines the logger the access log will use to report the failures to write the lines.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(a *AccessLog) error {
+		a.log = l
+		return nil
+	}
+}
+
+// Logfmt writes the lines as logfmt with the given fields, all the Fields when none are given
+func Logfmt(fields ...string) optSetter {
+	return func(a *AccessLog) error {
+		if len(fields) == 0 {
+			fields = Fields
+		}
+		for _, f := range fields {
+			if !isField(f) {
+				return fmt.Errorf("unknown field %q, expected one of %v", f, Fields)
+			}
+		}
+		a.fields = fields
+		a.tmpl = nil
+		return nil
+	}
+}
+
+// Template writes the lines with a text/template executed with the Entry of the request, a new line is appended
+// when the template doesn't end with one
+func Template(text string) optSetter {
+	return func(a *AccessLog) error {
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		tmpl, err := template.New("accesslog").Parse(text)
+		if err != nil {
+			return err
+		}
+		a.tmpl = tmpl
+		a.fields = nil
+		return nil
+	}
+}
+
+// Upstream sets the function returning the upstream of a request, e.g. when it is chosen by a load balancer
+// working on a copy of the request. It is called once the request is served, an empty string falls back to the
+// host of the request URL.
+func Upstream(fn func(req *http.Request) string) optSetter {
+	return func(a *AccessLog) error {
+		a.upstream = fn
+		return nil
+	}
+}
+
+func (a *AccessLog) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// the next handler may rewrite the URL to the upstream
+	path := req.URL.RequestURI()
+	m := trace.Measure(a.next, w, req, false, a.clock, a.log)
+	e := a.newEntry(req, path, m)
+
+	buf := &bytes.Buffer{}
+	switch {
+	case a.tmpl != nil:
+		if err := a.tmpl.Execute(buf, e); err != nil {
+			a.log.Errorf("vulcand/oxy/accesslog: failed to execute template: %v", err)
+			return
+		}
+	case a.fields != nil:
+		writeLogfmt(buf, e, a.fields)
+	default:
+		writeCombined(buf, e)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.writer.Write(buf.Bytes()); err != nil {
+		a.log.Errorf("vulcand/oxy/accesslog: failed to write line: %v", err)
+	}
+}
+
+func (a *AccessLog) newEntry(req *http.Request, path string, m *trace.Measurement) *Entry {
+	e := &Entry{
+		Time:          m.Start.Local(),
+		RemoteAddr:    req.RemoteAddr,
+		Method:        req.Method,
+		Host:          req.Host,
+		Path:          path,
+		Proto:         req.Proto,
+		Status:        m.StatusCode,
+		Bytes:         m.BodyBytesWritten,
+		Duration:      m.Duration,
+		XForwardedFor: strings.Join(req.Header["X-Forwarded-For"], ", "),
+		Referer:       req.Referer(),
+		UserAgent:     req.UserAgent(),
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		e.RemoteAddr = host
+	}
+	if user, _, ok := req.BasicAuth(); ok {
+		e.User = user
+	}
+	if a.upstream != nil {
+		e.Upstream = a.upstream(m.Request)
+	}
+	if e.Upstream == "" && m.Request.URL != nil {
+		e.Upstream = m.Request.URL.Host
+	}
+	return e
+}
+
+// writeCombined writes the line in the Apache combined format
+func writeCombined(buf *bytes.Buffer, e *Entry) {
+	fmt.Fprintf(buf, "%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		dash(e.RemoteAddr), escape(dash(e.User)), e.Time.Format(combinedTime),
+		escape(e.Method), escape(e.Path), escape(e.Proto), e.Status, bytesOrDash(e.Bytes),
+		escape(dash(e.Referer)), escape(dash(e.UserAgent)))
+}
+
+// writeLogfmt writes the fields of the line as key=value pairs
+func writeLogfmt(buf *bytes.Buffer, e *Entry, fields []string) {
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(fieldValue(e, f)))
+	}
+	buf.WriteByte('\n')
+}
+
+func fieldValue(e *Entry, field string) string {
+	switch field {
+	case "time":
+		return e.Time.Format(time.RFC3339)
+	case "remote_addr":
+		return e.RemoteAddr
+	case "method":
+		return e.Method
+	case "path":
+		return e.Path
+	case "proto":
+		return e.Proto
+	case "status":
+		return strconv.Itoa(e.Status)
+	case "bytes":
+		return strconv.FormatInt(e.Bytes, 10)
+	case "duration":
+		return e.Duration.String()
+	case "upstream":
+		return e.Upstream
+	case "x_forwarded_for":
+		return e.XForwardedFor
+	}
+	return ""
+}
+
+func isField(field string) bool {
+	for _, f := range Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// logfmtValue quotes the values that are empty or contain spaces, quotes, equal signs or control characters
+func logfmtValue(v string) string {
+	if v == "" || strings.IndexFunc(v, func(r rune) bool { return r <= ' ' || r == '"' || r == '=' || r == 0x7f }) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// escape escapes the quotes and control characters of the quoted fields of the combined format
+func escape(v string) string {
+	return escaper.Replace(v)
+}
+
+func dash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+func bytesOrDash(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,142 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestCombined(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+
+	buf := &bytes.Buffer{}
+	a, err := New(handler, buf)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL+"/hello?q=1",
+		testutils.Header("User-Agent", `agent "1"`), testutils.Header("Referer", "http://example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	assert.Regexp(t,
+		regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /hello\?q=1 HTTP/1\.1" 201 5 "http://example\.com" "agent \\"1\\""\n$`),
+		buf.String())
+
+	// the user can't forge log lines
+	buf.Reset()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("bob\n127.0.0.1 - admin", "secret")
+	a.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), ` - bob\n127.0.0.1 - admin [`)
+}
+
+func TestClock(t *testing.T) {
+	clock := testutils.GetClock()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clock.Sleep(1500 * time.Millisecond)
+	})
+
+	buf := &bytes.Buffer{}
+	a, err := New(handler, buf, Clock(clock), Logfmt("time", "duration"))
+	require.NoError(t, err)
+
+	start := clock.UtcNow()
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "time="+start.Local().Format(time.RFC3339)+" duration=1.5s\n", buf.String())
+}
+
+func TestLogfmt(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	// the handler rewrites the URL to the upstream before forwarding the request
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(upstream.URL)
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	buf := &bytes.Buffer{}
+	a, err := New(handler, buf, Logfmt("method", "path", "status", "bytes", "upstream", "x_forwarded_for"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL+"/a%20b", testutils.Header("X-Forwarded-For", "10.0.0.1, 10.0.0.2"))
+	require.NoError(t, err)
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	assert.Equal(t, `method=GET path=/a%20b status=404 bytes=0 upstream=`+host+` x_forwarded_for="10.0.0.1, 10.0.0.2"`+"\n", buf.String())
+
+	// all the fields by default
+	buf.Reset()
+	a, err = New(handler, buf, Logfmt(), Upstream(func(req *http.Request) string { return "backend" }))
+	require.NoError(t, err)
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Regexp(t, `^time=\S+ remote_addr=192\.0\.2\.1 method=GET path=/ proto=HTTP/1\.1 status=404 bytes=0 duration=\S+ upstream=backend x_forwarded_for=""`+"\n$", buf.String())
+
+	_, err = New(handler, buf, Logfmt("method", "unknown"))
+	assert.Error(t, err)
+}
+
+func TestTemplate(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	buf := &bytes.Buffer{}
+	a, err := New(handler, buf, Template("{{.Method}} {{.Host}}{{.Path}} {{.Status}} {{.Bytes}}"))
+	require.NoError(t, err)
+
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://example.com/path", nil))
+	assert.Equal(t, "POST example.com/path 200 5\n", buf.String())
+
+	_, err = New(handler, buf, Template("{{.Method"))
+	assert.Error(t, err)
+	_, err = New(handler, nil)
+	assert.Error(t, err)
+}
+
+func TestConcurrentLines(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	// the buffer isn't safe for concurrent use, the lines are written one at a time
+	buf := &bytes.Buffer{}
+	a, err := New(handler, buf, Logfmt("method", "path", "status"))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/path", nil))
+		}()
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 50)
+	for _, line := range lines {
+		assert.Equal(t, "method=GET path=/path status=200", line)
+	}
+}
@@ -0,0 +1,132 @@
+package buffer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// RetryBudget limits the retries to ratio of the requests that didn't need a retry over the rolling window,
+// e.g. RetryBudget(0.2, 10*time.Second) allows 1 retry for every 5 requests served on their first attempt
+// in the last 10 seconds. Once the budget is exhausted retries are skipped and the failed response is returned,
+// so a broad backend outage isn't amplified by retry storms. The window is rounded to the second.
+// See RetryBudgetMinRetries to allow a few retries when little traffic succeeds.
+func RetryBudget(ratio float64, window time.Duration) optSetter {
+	return func(b *Buffer) error {
+		if ratio <= 0 {
+			return fmt.Errorf("retry budget ratio should be > 0, got %v", ratio)
+		}
+		if window < time.Second {
+			return fmt.Errorf("retry budget window should be >= 1s, got %v", window)
+		}
+		b.retryBudgetRatio = ratio
+		b.retryBudgetWindow = window
+		return nil
+	}
+}
+
+// RetryBudgetMinRetries allows min retries over the window of the RetryBudget whatever the ratio,
+// so that the requests still get retried when the traffic is low or right after start.
+func RetryBudgetMinRetries(min int) optSetter {
+	return func(b *Buffer) error {
+		if min < 0 {
+			return fmt.Errorf("retry budget min retries should be >= 0, got %v", min)
+		}
+		b.retryBudgetMinRetries = min
+		return nil
+	}
+}
+
+// RetryBudgetUtilization returns the fraction of the retry budget used over the rolling window,
+// 1 when it is exhausted. It is 0 when no RetryBudget is set.
+func (b *Buffer) RetryBudgetUtilization() float64 {
+	if b.retryBudget == nil {
+		return 0
+	}
+	return b.retryBudget.utilization()
+}
+
+// retryBudget counts the successful requests and the retries over a rolling window
+type retryBudget struct {
+	mutex     sync.Mutex
+	ratio     float64
+	min       int64
+	successes *memmetrics.RollingCounter
+	retries   *memmetrics.RollingCounter
+}
+
+func newRetryBudget(ratio float64, min int, window time.Duration, clock timetools.TimeProvider) (*retryBudget, error) {
+	buckets := int(window / time.Second)
+	successes, err := memmetrics.NewCounter(buckets, time.Second, memmetrics.CounterClock(clock))
+	if err != nil {
+		return nil, err
+	}
+	retries, err := memmetrics.NewCounter(buckets, time.Second, memmetrics.CounterClock(clock))
+	if err != nil {
+		return nil, err
+	}
+	return &retryBudget{ratio: ratio, min: int64(min), successes: successes, retries: retries}, nil
+}
+
+// recordSuccess records a request served without needing a retry
+func (r *retryBudget) recordSuccess() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.successes.Inc(1)
+}
+
+// withdraw records a retry if the budget allows it
+func (r *retryBudget) withdraw() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if float64(r.count()+1) > r.budget() {
+		return false
+	}
+	r.retries.Inc(1)
+	return true
+}
+
+// refund gives back a retry that was withdrawn but not made
+func (r *retryBudget) refund() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.retries.Inc(-1)
+}
+
+// count is the number of retries in the window, the refund of a retry withdrawn in an earlier bucket
+// can outlive it, it is then ignored
+func (r *retryBudget) count() int64 {
+	if n := r.retries.Count(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+func (r *retryBudget) budget() float64 {
+	budget := r.ratio * float64(r.successes.Count())
+	if min := float64(r.min); budget < min {
+		return min
+	}
+	return budget
+}
+
+func (r *retryBudget) utilization() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	retries := float64(r.count())
+	budget := r.budget()
+	if retries >= budget {
+		if retries == 0 {
+			return 0
+		}
+		return 1
+	}
+	return retries / budget
+}
@@ -32,6 +32,17 @@ Examples of a buffering middleware:
   // before returning the response
   buffer.New(handler, buffer.Retry(`IsNetworkError() && Attempts() <= 2`))
 
+  // Same as above, waiting 100ms, then 200ms between attempts, with full jitter
+  buffer.New(handler,
+    buffer.Retry(`IsNetworkError() && Attempts() <= 2`),
+    buffer.RetryBackoff(100 * time.Millisecond, time.Second, 1))
+
+  // Same as above, retries are skipped once they exceed 20% of the requests
+  // served on their first attempt over the last 10 seconds
+  buffer.New(handler,
+    buffer.Retry(`IsNetworkError() && Attempts() <= 2`),
+    buffer.RetryBudget(0.2, 10 * time.Second))
+
 */
 package buffer
 
@@ -40,11 +51,16 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"os"
 	"reflect"
+	"sync/atomic"
+	"time"
 
 	"github.com/mailgun/multibuf"
+	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/oxy/utils"
 )
@@ -66,15 +82,38 @@ type Buffer struct {
 	maxRequestBodyBytes int64
 	memRequestBodyBytes int64
 
+	spillDir     string
+	bytesSpilled int64
+
+	memBudget  int64
+	memInUse   int64
+	diskBudget int64
+	diskInUse  int64
+
 	maxResponseBodyBytes int64
 	memResponseBodyBytes int64
 
 	retryPredicate hpredicate
+	retryFunc      func(RetryContext) bool
+
+	skipBuffering func(*http.Request) bool
+
+	retryBackoffBase   time.Duration
+	retryBackoffMax    time.Duration
+	retryBackoffJitter float64
+
+	retryBudgetRatio      float64
+	retryBudgetWindow     time.Duration
+	retryBudgetMinRetries int
+	retryBudget           *retryBudget
+
+	idempotency *idempotencyCache
 
 	next       http.Handler
 	errHandler utils.ErrorHandler
 
-	log *log.Logger
+	clock timetools.TimeProvider
+	log   *log.Logger
 }
 
 // New returns a new buffer middleware. New() function supports optional functional arguments
@@ -88,16 +127,30 @@ func New(next http.Handler, setters ...optSetter) (*Buffer, error) {
 		maxResponseBodyBytes: DefaultMaxBodyBytes,
 		memResponseBodyBytes: DefaultMemBodyBytes,
 
-		log: log.StandardLogger(),
+		clock: &timetools.RealTime{},
+		log:   log.StandardLogger(),
 	}
 	for _, s := range setters {
 		if err := s(strm); err != nil {
 			return nil, err
 		}
 	}
+	if strm.retryPredicate != nil && strm.retryFunc != nil {
+		return nil, fmt.Errorf("the Retry and RetryPredicateFunc options can not be used together")
+	}
 	if strm.errHandler == nil {
 		strm.errHandler = errHandler
 	}
+	if strm.retryBudgetMinRetries > 0 && strm.retryBudgetWindow == 0 {
+		return nil, fmt.Errorf("the RetryBudgetMinRetries option requires the RetryBudget option")
+	}
+	if strm.retryBudgetWindow > 0 {
+		budget, err := newRetryBudget(strm.retryBudgetRatio, strm.retryBudgetMinRetries, strm.retryBudgetWindow, strm.clock)
+		if err != nil {
+			return nil, err
+		}
+		strm.retryBudget = budget
+	}
 
 	return strm, nil
 }
@@ -112,6 +165,15 @@ func Logger(l *log.Logger) optSetter {
 	}
 }
 
+// Clock sets the clock the retries are timed with, including the backoff delays and the retry budget window,
+// defaults to the real time. Intended for unit tests.
+func Clock(clock timetools.TimeProvider) optSetter {
+	return func(b *Buffer) error {
+		b.clock = clock
+		return nil
+	}
+}
+
 type optSetter func(b *Buffer) error
 
 // CondSetter Conditional setter.
@@ -132,11 +194,19 @@ func CondSetter(condition bool, setter optSetter) optSetter {
 // Attempts() - limits the amount of retry attempts
 // ResponseCode() - returns http response code
 // IsNetworkError() - tests if response code is related to networking error
+// BackoffMS() - returns the time spent waiting between attempts so far, in milliseconds (see RetryBackoff)
+// IsIdempotent() - tests if the request method is GET, HEAD, OPTIONS, PUT or DELETE, or if it carries an Idempotency-Key header
 //
 // Example of the predicate:
 //
 // `Attempts() <= 2 && ResponseCode() == 502`
+// `(IsNetworkError() || ResponseCode() == 503) && Attempts() <= 2`
+// `IsNetworkError() && IsIdempotent() && Attempts() < 3`
+//
+// A request failing with a network error may have reached the upstream, use IsIdempotent()
+// to avoid replaying non-idempotent requests such as POSTs that could be applied twice.
 //
+// The buffered request body is rewound before every attempt.
 func Retry(predicate string) optSetter {
 	return func(b *Buffer) error {
 		p, err := parseExpression(predicate)
@@ -148,6 +218,61 @@ func Retry(predicate string) optSetter {
 	}
 }
 
+// RetryContext describes the last attempt of a request to the retry predicate set with RetryPredicateFunc
+type RetryContext struct {
+	// Request is the request received by the buffer
+	Request *http.Request
+	// Attempts is the number of attempts made so far, starting at 1
+	Attempts int
+	// ResponseCode and ResponseHeader are the status code and headers of the last response
+	ResponseCode   int
+	ResponseHeader http.Header
+	// Err is set when the last attempt ended with a network error, see IsNetworkError() in Retry.
+	// The buffer only sees the responses of the next handler, the forwarder reports these errors with a 502 or 504.
+	Err error
+	// Elapsed is the time spent since the first attempt started, backoff delays included
+	Elapsed time.Duration
+}
+
+// RetryPredicateFunc replays the request while fn returns true, it is the Go alternative to the expressions of Retry
+// and can not be used together with it. The attempts are still limited to DefaultMaxRetryAttempts.
+func RetryPredicateFunc(fn func(ctx RetryContext) bool) optSetter {
+	return func(b *Buffer) error {
+		if fn == nil {
+			return fmt.Errorf("retry predicate func can not be nil")
+		}
+		b.retryFunc = fn
+		return nil
+	}
+}
+
+// RetryBackoff waits between retry attempts, the delay doubles from base on every retry up to max.
+// jitter is the randomized fraction of the delay, from 0 (no jitter) to 1 (full jitter).
+// Pending retries are aborted if the request context is done.
+func RetryBackoff(base, max time.Duration, jitter float64) optSetter {
+	return func(b *Buffer) error {
+		if base <= 0 || max < base {
+			return fmt.Errorf("backoff should satisfy 0 < base <= max, got base %v, max %v", base, max)
+		}
+		if jitter < 0 || jitter > 1 {
+			return fmt.Errorf("jitter should be between 0 and 1, got %v", jitter)
+		}
+		b.retryBackoffBase = base
+		b.retryBackoffMax = max
+		b.retryBackoffJitter = jitter
+		return nil
+	}
+}
+
+// SkipBufferingIf streams the body of the matching requests straight to the next handler instead
+// of buffering it, e.g. for large uploads. Skipped requests cannot be retried, their responses are still buffered.
+func SkipBufferingIf(skip func(*http.Request) bool) optSetter {
+	return func(b *Buffer) error {
+		b.skipBuffering = skip
+		return nil
+	}
+}
+
 // ErrorHandler sets error handler of the server
 func ErrorHandler(h utils.ErrorHandler) optSetter {
 	return func(b *Buffer) error {
@@ -179,6 +304,22 @@ func MemRequestBodyBytes(m int64) optSetter {
 	}
 }
 
+// SpillDir sets the directory where request bodies over MemRequestBodyBytes are spilled to,
+// it defaults to the system temporary directory. Spilled files are removed once the request is served.
+func SpillDir(path string) optSetter {
+	return func(b *Buffer) error {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("spill dir %q is not a directory", path)
+		}
+		b.spillDir = path
+		return nil
+	}
+}
+
 // MaxResponseBodyBytes sets the maximum request body size in bytes
 func MaxResponseBodyBytes(m int64) optSetter {
 	return func(b *Buffer) error {
@@ -202,6 +343,11 @@ func MemResponseBodyBytes(m int64) optSetter {
 	}
 }
 
+// BytesSpilled returns the total number of request body bytes spilled to disk.
+func (b *Buffer) BytesSpilled() int64 {
+	return atomic.LoadInt64(&b.bytesSpilled)
+}
+
 // Wrap sets the next handler to be called by buffer handler.
 func (b *Buffer) Wrap(next http.Handler) error {
 	b.next = next
@@ -215,17 +361,32 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		defer logEntry.Debug("vulcand/oxy/buffer: completed ServeHttp on request")
 	}
 
+	if b.idempotency != nil {
+		if key := req.Header.Get(IdempotencyKey); key != "" {
+			b.serveIdempotent(w, req, key)
+			return
+		}
+	}
+	b.serve(w, req)
+}
+
+func (b *Buffer) serve(w http.ResponseWriter, req *http.Request) {
 	if err := b.checkLimit(req); err != nil {
 		b.log.Errorf("vulcand/oxy/buffer: request body over limit, err: %v", err)
 		b.errHandler.ServeHTTP(w, req, err)
 		return
 	}
 
+	if b.skipBuffering != nil && b.skipBuffering(req) {
+		b.serveUnbuffered(w, req)
+		return
+	}
+
 	// Read the body while keeping limits in mind. This reader controls the maximum bytes
 	// to read into memory and disk. This reader returns an error if the total request size exceeds the
 	// predefined MaxSizeBytes. This can occur if we got chunked request, in this case ContentLength would be set to -1
 	// and the reader would be unbounded bufio in the http.Server
-	body, err := multibuf.New(req.Body, multibuf.MaxBytes(b.maxRequestBodyBytes), multibuf.MemBytes(b.memRequestBodyBytes))
+	body, err := b.readBody(req.Body)
 	if err != nil || body == nil {
 		b.log.Errorf("vulcand/oxy/buffer: error when reading request body, err: %v", err)
 		b.errHandler.ServeHTTP(w, req, err)
@@ -254,12 +415,15 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if totalSize == 0 {
+		body.Close()
 		body = nil
 	}
 
 	outreq := b.copyRequest(req, body, totalSize)
 
 	attempt := 1
+	var backoff time.Duration
+	start := b.clock.UtcNow()
 	for {
 		// We create a special writer that will limit the response size, buffer it to disk if necessary
 		writer, err := multibuf.NewWriterOnce(multibuf.MaxBytes(b.maxResponseBodyBytes), multibuf.MemBytes(b.memResponseBodyBytes))
@@ -296,8 +460,21 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			reader = rdr
 		}
 
-		if (b.retryPredicate == nil || attempt > DefaultMaxRetryAttempts) ||
-			!b.retryPredicate(&context{r: req, attempt: attempt, responseCode: bw.code}) {
+		retry := attempt <= DefaultMaxRetryAttempts &&
+			b.shouldRetry(&context{r: req, attempt: attempt, responseCode: bw.code, header: bw.Header(), backoff: backoff, start: start})
+
+		if b.retryBudget != nil {
+			if !retry {
+				if attempt == 1 {
+					b.retryBudget.recordSuccess()
+				}
+			} else if !b.retryBudget.withdraw() {
+				b.log.Debugf("vulcand/oxy/buffer: retry budget exhausted, not retrying Request(%v %v)", req.Method, req.URL)
+				retry = false
+			}
+		}
+
+		if !retry {
 			utils.CopyHeaders(w.Header(), bw.Header())
 			w.WriteHeader(bw.code)
 			if reader != nil {
@@ -306,6 +483,21 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		if b.retryBackoffBase > 0 {
+			delay := b.retryDelay(attempt)
+			select {
+			case <-b.clock.After(delay):
+			case <-req.Context().Done():
+				if b.retryBudget != nil {
+					b.retryBudget.refund()
+				}
+				b.log.Debugf("vulcand/oxy/buffer: retry Request(%v %v) aborted, err: %v", req.Method, req.URL, req.Context().Err())
+				b.errHandler.ServeHTTP(w, req, req.Context().Err())
+				return
+			}
+			backoff += delay
+		}
+
 		attempt++
 		if body != nil {
 			if _, err := body.Seek(0, 0); err != nil {
@@ -320,6 +512,87 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// shouldRetry evaluates the retry predicate set with Retry or RetryPredicateFunc
+func (b *Buffer) shouldRetry(c *context) bool {
+	switch {
+	case b.retryPredicate != nil:
+		return b.retryPredicate(c)
+	case b.retryFunc != nil:
+		ctx := RetryContext{
+			Request:        c.r,
+			Attempts:       c.attempt,
+			ResponseCode:   c.responseCode,
+			ResponseHeader: c.header,
+			Elapsed:        b.clock.UtcNow().Sub(c.start),
+		}
+		if isNetworkError()(c) {
+			ctx.Err = fmt.Errorf("network error: %v", http.StatusText(c.responseCode))
+		}
+		return b.retryFunc(ctx)
+	}
+	return false
+}
+
+// retryDelay returns the delay to wait for after the given attempt
+func (b *Buffer) retryDelay(attempt int) time.Duration {
+	delay := b.retryBackoffBase
+	for i := 1; i < attempt && delay < b.retryBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > b.retryBackoffMax {
+		delay = b.retryBackoffMax
+	}
+	return delay - time.Duration(rand.Float64()*b.retryBackoffJitter*float64(delay))
+}
+
+// serveUnbuffered forwards the request without buffering its body, the response is buffered
+// to enforce the response limits but the request is never retried.
+func (b *Buffer) serveUnbuffered(w http.ResponseWriter, req *http.Request) {
+	outreq := *req
+	if b.maxRequestBodyBytes > 0 && req.Body != nil {
+		// checkLimit only covers requests with a known content length
+		outreq.Body = http.MaxBytesReader(w, req.Body, b.maxRequestBodyBytes)
+	}
+
+	writer, err := multibuf.NewWriterOnce(multibuf.MaxBytes(b.maxResponseBodyBytes), multibuf.MemBytes(b.memResponseBodyBytes))
+	if err != nil {
+		b.log.Errorf("vulcand/oxy/buffer: failed create response writer, err: %v", err)
+		b.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	bw := &bufferWriter{
+		header:         make(http.Header),
+		buffer:         writer,
+		responseWriter: w,
+		log:            b.log,
+	}
+	defer bw.Close()
+
+	b.next.ServeHTTP(bw, &outreq)
+	if bw.hijacked {
+		b.log.Debugf("vulcand/oxy/buffer: connection was hijacked downstream. Not taking any action in buffer.")
+		return
+	}
+
+	var reader multibuf.MultiReader
+	if bw.expectBody(&outreq) {
+		reader, err = writer.Reader()
+		if err != nil {
+			b.log.Errorf("vulcand/oxy/buffer: failed to read response, err: %v", err)
+			b.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		defer reader.Close()
+	}
+
+	utils.CopyHeaders(w.Header(), bw.Header())
+	w.WriteHeader(bw.code)
+	if reader != nil {
+		io.Copy(w, reader)
+	}
+}
+
 func (b *Buffer) copyRequest(req *http.Request, body io.ReadCloser, bodySize int64) *http.Request {
 	o := *req
 	o.URL = utils.CopyURL(req.URL)
@@ -429,5 +702,15 @@ func (e *SizeErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err
 		w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
 		return
 	}
+	if err == ErrBufferBudgetExceeded {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+		return
+	}
+	if err == ErrIdempotencyKeyReused {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(http.StatusText(http.StatusUnprocessableEntity)))
+		return
+	}
 	utils.DefaultHandler.ServeHTTP(w, req, err)
 }
@@ -8,8 +8,12 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -88,6 +92,49 @@ func TestChunkedEncodingSuccess(t *testing.T) {
 	assert.EqualValues(t, len(reqBody), contentLength)
 }
 
+func TestSkipBuffering(t *testing.T) {
+	var reqBody string
+	var contentLength int64
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		reqBody = string(body)
+		contentLength = req.ContentLength
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	// forwarder will proxy the request to whatever destination
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	// this is our redirect to server
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr, SkipBufferingIf(func(req *http.Request) bool {
+		return req.URL.Path == "/upload"
+	}))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", testutils.ParseURI(proxy.URL).Host)
+	require.NoError(t, err)
+
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntest\r\n5\r\ntest1\r\n5\r\ntest2\r\n0\r\n\r\n")
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+	assert.Equal(t, "testtest1test2", reqBody)
+	// the body has been streamed, it is still chunked
+	assert.EqualValues(t, -1, contentLength)
+}
+
 func TestChunkedEncodingLimitReached(t *testing.T) {
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("hello"))
@@ -392,3 +439,277 @@ func TestNotNilBody(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 	assert.Equal(t, "hello", string(body))
 }
+
+func TestSpillDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oxy-spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var spilled []os.FileInfo
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		spilled, _ = ioutil.ReadDir(dir)
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	})
+
+	st, err := New(handler, MemRequestBodyBytes(4), SpillDir(dir))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Body("this request goes to disk"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "this request goes to disk", string(body))
+	assert.Len(t, spilled, 1)
+	assert.EqualValues(t, len("this request goes to disk")-4, st.BytesSpilled())
+
+	left, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, left)
+
+	// small requests stay in memory
+	re, _, err = testutils.Get(proxy.URL, testutils.Body("tiny"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.EqualValues(t, len("this request goes to disk")-4, st.BytesSpilled())
+}
+
+func TestSpillDirNotADirectory(t *testing.T) {
+	file, err := ioutil.TempFile("", "oxy-spill")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	file.Close()
+
+	_, err = New(http.NotFoundHandler(), SpillDir(file.Name()))
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), SpillDir(file.Name()+"-missing"))
+	assert.Error(t, err)
+}
+
+func TestSpillDirCleanup(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		handler http.HandlerFunc
+		setters []optSetter
+		request func(t *testing.T, addr string)
+	}{
+		{
+			desc: "handler panics",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				panic("boom")
+			},
+			request: func(t *testing.T, addr string) {
+				testutils.Get("http://"+addr, testutils.Body("this request goes to disk"))
+			},
+		},
+		{
+			desc: "client disconnects mid upload",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("hello"))
+			},
+			request: func(t *testing.T, addr string) {
+				conn, err := net.Dial("tcp", addr)
+				require.NoError(t, err)
+				fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nContent-Length: 100\r\n\r\nthis request goes to disk")
+				conn.Close()
+			},
+		},
+		{
+			desc: "body over the limit",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("hello"))
+			},
+			setters: []optSetter{MaxRequestBodyBytes(10)},
+			request: func(t *testing.T, addr string) {
+				conn, err := net.Dial("tcp", addr)
+				require.NoError(t, err)
+				defer conn.Close()
+				fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nTransfer-Encoding: chunked\r\n\r\n19\r\nthis request goes to disk\r\n0\r\n\r\n")
+				status, err := bufio.NewReader(conn).ReadString('\n')
+				require.NoError(t, err)
+				assert.Equal(t, "HTTP/1.1 413 Request Entity Too Large\r\n", status)
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "oxy-spill")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			setters := append([]optSetter{MemRequestBodyBytes(4), SpillDir(dir)}, test.setters...)
+			st, err := New(test.handler, setters...)
+			require.NoError(t, err)
+
+			proxy := httptest.NewServer(st)
+			defer proxy.Close()
+
+			test.request(t, testutils.ParseURI(proxy.URL).Host)
+
+			assert.Eventually(t, func() bool {
+				left, err := ioutil.ReadDir(dir)
+				return err == nil && len(left) == 0 && st.BytesSpilled() > 0
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestGlobalMemoryBudget(t *testing.T) {
+	const (
+		requests = 20
+		bodySize = 1000
+		budget   = 4000
+	)
+
+	dir, err := ioutil.TempDir("", "oxy-spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	arrived := &sync.WaitGroup{}
+	arrived.Add(requests)
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		arrived.Done()
+		<-release
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	})
+
+	st, err := New(handler, MemRequestBodyBytes(bodySize), GlobalMemoryBudget(budget), SpillDir(dir))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	body := strings.Repeat("a", bodySize)
+	done := &sync.WaitGroup{}
+	for i := 0; i < requests; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			re, out, err := testutils.Get(proxy.URL, testutils.Body(body))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, body, string(out))
+		}()
+	}
+
+	// all the bodies are buffered at once, the memory used is capped and the rest went to disk
+	arrived.Wait()
+	assert.Equal(t, int64(budget), st.BufferedMemoryBytes())
+	assert.Equal(t, int64(requests*bodySize-budget), st.BufferedDiskBytes())
+	assert.Equal(t, int64(requests*bodySize-budget), st.BytesSpilled())
+
+	close(release)
+	done.Wait()
+	// the bodies are released once the handler returns, which may be after the client got the response
+	require.Eventually(t, func() bool {
+		return st.BufferedMemoryBytes() == 0 && st.BufferedDiskBytes() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	left, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, left)
+
+	_, err = New(handler, GlobalMemoryBudget(0))
+	assert.Error(t, err)
+}
+
+func TestGlobalMemoryBudgetSmallBodies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oxy-spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	arrived, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		if string(body) == strings.Repeat("a", 1000) {
+			close(arrived)
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	})
+
+	st, err := New(handler, MemRequestBodyBytes(1000), GlobalMemoryBudget(1000), SpillDir(dir))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	// the first request holds the whole memory budget, a body of exactly the limit doesn't go to disk
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, body, err := testutils.Get(proxy.URL, testutils.Body(strings.Repeat("a", 1000)))
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("a", 1000), string(body))
+	}()
+	<-arrived
+	assert.Equal(t, int64(1000), st.BufferedMemoryBytes())
+	left, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, left)
+
+	// the empty and small bodies are kept in memory, the larger ones go to disk
+	for _, size := range []int{0, 10, minMemBodyBytes, minMemBodyBytes + 1} {
+		_, body, err := testutils.Get(proxy.URL, testutils.Body(strings.Repeat("b", size)))
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("b", size), string(body))
+	}
+	assert.Equal(t, int64(minMemBodyBytes+1), st.BytesSpilled())
+
+	close(release)
+	<-done
+	assert.Equal(t, int64(minMemBodyBytes+1), st.BytesSpilled())
+}
+
+func TestGlobalDiskBudget(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+
+	st, err := New(handler, MemRequestBodyBytes(10), GlobalMemoryBudget(10), GlobalDiskBudget(100))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	// the first request holds the memory budget and 90 bytes of the disk budget
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		re, _, err := testutils.Get(proxy.URL, testutils.Body(strings.Repeat("a", 100)))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}()
+	require.Eventually(t, func() bool { return st.BufferedDiskBytes() == 90 }, time.Second, 10*time.Millisecond)
+
+	re, _, err := testutils.Get(proxy.URL, testutils.Body(strings.Repeat("b", 50)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, int64(90), st.BufferedDiskBytes())
+
+	close(release)
+	<-done
+	require.Eventually(t, func() bool { return st.BufferedDiskBytes() == 0 }, time.Second, 10*time.Millisecond)
+
+	re, _, err = testutils.Get(proxy.URL, testutils.Body(strings.Repeat("b", 50)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+}
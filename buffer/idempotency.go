@@ -0,0 +1,236 @@
+package buffer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/vulcand/oxy/utils"
+)
+
+// IdempotencyKey is the request header identifying the repeated requests served from the idempotency cache
+const IdempotencyKey = "Idempotency-Key"
+
+// ErrIdempotencyKeyReused is returned when an Idempotency-Key is reused by a client for another request,
+// the default error handler answers with a 422
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused for another request")
+
+// CachedResponse is a response stored in the idempotency cache
+type CachedResponse struct {
+	// Request is the method and URI of the request the response was stored for
+	Request    string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Store stores the responses of the idempotency cache, it must be safe for concurrent use
+type Store interface {
+	// Get returns the response stored for the key, if it hasn't expired
+	Get(key string) (*CachedResponse, bool)
+	// Set stores the response for the key until the ttl expires
+	Set(key string, resp *CachedResponse, ttl time.Duration) error
+}
+
+// IdempotencyCache serves the requests carrying an Idempotency-Key header already seen within ttl with the
+// stored response instead of forwarding them again. Concurrent requests with the same key are coalesced
+// and only the first one is forwarded. Responses with a 5xx, 408, 409 or 429 status code are not stored.
+//
+// The keys are scoped by client, identified by the Authorization header or else by the remote IP, so that
+// a client can't read the responses of another one. A key reused by the client for a request with another
+// method or URI fails with ErrIdempotencyKeyReused.
+//
+// The responses of the requests with a key are kept in memory until they are stored, and the Store keeps
+// them for ttl: use MaxResponseBodyBytes and a bounded Store to limit the memory used.
+func IdempotencyCache(store Store, ttl time.Duration) optSetter {
+	return func(b *Buffer) error {
+		if store == nil {
+			return fmt.Errorf("idempotency store can not be nil")
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("idempotency ttl should be > 0, got %v", ttl)
+		}
+		b.idempotency = &idempotencyCache{store: store, ttl: ttl, inFlight: make(map[string]*idempotentCall)}
+		return nil
+	}
+}
+
+type idempotencyCache struct {
+	store    Store
+	ttl      time.Duration
+	mutex    sync.Mutex
+	inFlight map[string]*idempotentCall
+}
+
+// idempotentCall is a request being forwarded, the requests with the same key wait for its response
+type idempotentCall struct {
+	request string
+	done    chan struct{}
+	resp    *CachedResponse
+}
+
+func (b *Buffer) serveIdempotent(w http.ResponseWriter, req *http.Request, key string) {
+	c := b.idempotency
+	key = idempotencyStoreKey(req, key)
+	request := req.Method + " " + req.URL.RequestURI()
+	if resp, ok := c.store.Get(key); ok {
+		if resp.Request != request {
+			b.errHandler.ServeHTTP(w, req, ErrIdempotencyKeyReused)
+			return
+		}
+		b.log.Debugf("vulcand/oxy/buffer: serving Request(%v %v) from the idempotency cache", req.Method, req.URL)
+		writeCachedResponse(w, resp)
+		return
+	}
+
+	c.mutex.Lock()
+	if call, ok := c.inFlight[key]; ok {
+		c.mutex.Unlock()
+		if call.request != request {
+			b.errHandler.ServeHTTP(w, req, ErrIdempotencyKeyReused)
+			return
+		}
+		select {
+		case <-call.done:
+			if call.resp == nil {
+				// the first request failed without a response
+				b.serve(w, req)
+				return
+			}
+			writeCachedResponse(w, call.resp)
+		case <-req.Context().Done():
+			b.errHandler.ServeHTTP(w, req, req.Context().Err())
+		}
+		return
+	}
+	call := &idempotentCall{request: request, done: make(chan struct{})}
+	c.inFlight[key] = call
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.inFlight, key)
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+
+	rec := &responseRecorder{header: make(http.Header), code: http.StatusOK}
+	b.serve(rec, req)
+
+	// the waiting requests get the response even if it isn't stored
+	resp := &CachedResponse{Request: request, StatusCode: rec.code, Header: rec.header, Body: rec.body.Bytes()}
+	call.resp = resp
+	if cacheableStatus(rec.code) {
+		if err := c.store.Set(key, resp, c.ttl); err != nil {
+			b.log.Errorf("vulcand/oxy/buffer: failed to store the response of Request(%v %v), err: %v", req.Method, req.URL, err)
+		}
+	}
+	writeCachedResponse(w, resp)
+}
+
+// idempotencyStoreKey scopes the key by client, the identity is hashed not to keep the credentials in the Store
+func idempotencyStoreKey(req *http.Request, key string) string {
+	identity := req.Header.Get("Authorization")
+	if identity == "" {
+		identity = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			identity = host
+		}
+	}
+	sum := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(sum[:]) + ":" + key
+}
+
+func cacheableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return false
+	}
+	return code < http.StatusInternalServerError
+}
+
+func writeCachedResponse(w http.ResponseWriter, resp *CachedResponse) {
+	utils.CopyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
+}
+
+// responseRecorder keeps the response in memory
+type responseRecorder struct {
+	header      http.Header
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.code = code
+	r.wroteHeader = true
+}
+
+func (r *responseRecorder) Write(buf []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(buf)
+}
+
+// MemoryStore is an in-memory Store keeping up to capacity responses, the ones expiring first
+// are evicted when it is full. The ttl is rounded up to the second.
+type MemoryStore struct {
+	clock     timetools.TimeProvider
+	responses *ttlmap.TtlMap
+}
+
+// MemoryStoreOption represents an option you can pass to NewMemoryStore
+type MemoryStoreOption func(m *MemoryStore)
+
+// MemoryStoreClock sets the clock the responses expire on, defaults to the real time.
+// Intended for unit tests.
+func MemoryStoreClock(clock timetools.TimeProvider) MemoryStoreOption {
+	return func(m *MemoryStore) {
+		m.clock = clock
+	}
+}
+
+// NewMemoryStore creates a MemoryStore keeping up to capacity responses
+func NewMemoryStore(capacity int, options ...MemoryStoreOption) (*MemoryStore, error) {
+	m := &MemoryStore{clock: &timetools.RealTime{}}
+	for _, o := range options {
+		o(m)
+	}
+	responses, err := ttlmap.NewConcurrent(capacity, ttlmap.Clock(m.clock))
+	if err != nil {
+		return nil, err
+	}
+	m.responses = responses
+	return m, nil
+}
+
+// Get returns the response stored for the key
+func (m *MemoryStore) Get(key string) (*CachedResponse, bool) {
+	v, ok := m.responses.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*CachedResponse), true
+}
+
+// Set stores the response for the key
+func (m *MemoryStore) Set(key string, resp *CachedResponse, ttl time.Duration) error {
+	seconds := int((ttl + time.Second - 1) / time.Second)
+	return m.responses.Set(key, resp, seconds)
+}
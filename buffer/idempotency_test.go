@@ -0,0 +1,170 @@
+package buffer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Call", fmt.Sprint(n))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+
+	clock := testutils.GetClock()
+	store, err := NewMemoryStore(10, MemoryStoreClock(clock))
+	require.NoError(t, err)
+
+	st, err := New(handler, IdempotencyCache(store, 10*time.Second))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		re, body, err := testutils.Post(proxy.URL, testutils.Header(IdempotencyKey, "key-1"), testutils.Body("payload"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, re.StatusCode)
+		assert.Equal(t, "created", string(body))
+		assert.Equal(t, "1", re.Header.Get("X-Call"))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// requests without a key or with another key are forwarded
+	_, _, err = testutils.Post(proxy.URL, testutils.Body("payload"))
+	require.NoError(t, err)
+	re, _, err := testutils.Post(proxy.URL, testutils.Header(IdempotencyKey, "key-2"))
+	require.NoError(t, err)
+	assert.Equal(t, "3", re.Header.Get("X-Call"))
+
+	// failures are not stored
+	for i := 0; i < 2; i++ {
+		re, _, err = testutils.Post(proxy.URL+"/fail", testutils.Header(IdempotencyKey, "key-3"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+	}
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+
+	// the response expires after the ttl
+	clock.CurrentTime = clock.CurrentTime.Add(11 * time.Second)
+	re, _, err = testutils.Post(proxy.URL, testutils.Header(IdempotencyKey, "key-1"))
+	require.NoError(t, err)
+	assert.Equal(t, "6", re.Header.Get("X-Call"))
+
+	_, err = New(handler, IdempotencyCache(nil, time.Second))
+	assert.Error(t, err)
+	_, err = New(handler, IdempotencyCache(store, 0))
+	assert.Error(t, err)
+}
+
+func TestIdempotencyCacheScope(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("X-Call", fmt.Sprint(n))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello " + req.Header.Get("Authorization")))
+	})
+
+	store, err := NewMemoryStore(10)
+	require.NoError(t, err)
+
+	st, err := New(handler, IdempotencyCache(store, time.Minute))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	// the clients don't share the responses
+	for _, user := range []string{"Bearer a", "Bearer b", "Bearer a"} {
+		_, body, err := testutils.Post(proxy.URL+"/orders", testutils.Header(IdempotencyKey, "key"), testutils.Header("Authorization", user))
+		require.NoError(t, err)
+		assert.Equal(t, "hello "+user, string(body))
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// the key can't be reused for another request
+	re, _, err := testutils.Post(proxy.URL+"/payments", testutils.Header(IdempotencyKey, "key"), testutils.Header("Authorization", "Bearer a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, re.StatusCode)
+	re, _, err = testutils.MakeRequest(proxy.URL+"/orders", testutils.Method(http.MethodPut),
+		testutils.Header(IdempotencyKey, "key"), testutils.Header("Authorization", "Bearer a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, re.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// the clients without credentials are identified by their IP
+	req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+	req.Header.Set(IdempotencyKey, "key")
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	st.ServeHTTP(rec, req)
+	assert.Equal(t, "3", rec.Header().Get("X-Call"))
+
+	req.RemoteAddr = "192.0.2.1:5678"
+	rec = httptest.NewRecorder()
+	st.ServeHTTP(rec, req)
+	assert.Equal(t, "3", rec.Header().Get("X-Call"))
+
+	req.RemoteAddr = "192.0.2.2:1234"
+	rec = httptest.NewRecorder()
+	st.ServeHTTP(rec, req)
+	assert.Equal(t, "4", rec.Header().Get("X-Call"))
+}
+
+func TestIdempotencyCacheCoalescing(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+
+	store, err := NewMemoryStore(10)
+	require.NoError(t, err)
+
+	st, err := New(handler, IdempotencyCache(store, time.Minute))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, body, err := testutils.Post(proxy.URL, testutils.Header(IdempotencyKey, "key"))
+			if assert.NoError(t, err) {
+				bodies[i] = string(body)
+			}
+		}(i)
+	}
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, []string{"hello", "hello", "hello", "hello", "hello"}, bodies)
+}
@@ -0,0 +1,88 @@
+package buffer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// ErrBufferBudgetExceeded is returned when a request body can't be buffered within the GlobalDiskBudget,
+// the default error handler answers with a 503
+var ErrBufferBudgetExceeded = errors.New("buffer budget exceeded")
+
+// GlobalMemoryBudget caps the request body bytes held in memory across all the concurrent requests.
+// Once the budget is used, the bodies of new requests are spilled to disk earlier, past the share of the budget
+// they got, or right away when none is left. The bytes are released when the request is served.
+func GlobalMemoryBudget(bytes int64) optSetter {
+	return func(b *Buffer) error {
+		if bytes <= 0 {
+			return fmt.Errorf("memory budget should be > 0, got %v", bytes)
+		}
+		b.memBudget = bytes
+		return nil
+	}
+}
+
+// GlobalDiskBudget caps the request body bytes spilled to disk across all the concurrent requests,
+// the requests that would exceed it are rejected with ErrBufferBudgetExceeded.
+func GlobalDiskBudget(bytes int64) optSetter {
+	return func(b *Buffer) error {
+		if bytes <= 0 {
+			return fmt.Errorf("disk budget should be > 0, got %v", bytes)
+		}
+		b.diskBudget = bytes
+		return nil
+	}
+}
+
+// BufferedMemoryBytes returns the request body bytes currently held in memory by the concurrent requests
+func (b *Buffer) BufferedMemoryBytes() int64 {
+	return atomic.LoadInt64(&b.memInUse)
+}
+
+// BufferedDiskBytes returns the request body bytes currently spilled to disk by the concurrent requests
+func (b *Buffer) BufferedDiskBytes() int64 {
+	return atomic.LoadInt64(&b.diskInUse)
+}
+
+// reserveMemory reserves up to n bytes of the memory budget and returns the bytes reserved
+func (b *Buffer) reserveMemory(n int64) int64 {
+	if b.memBudget <= 0 {
+		atomic.AddInt64(&b.memInUse, n)
+		return n
+	}
+	for {
+		inUse := atomic.LoadInt64(&b.memInUse)
+		reserved := b.memBudget - inUse
+		if reserved <= 0 {
+			return 0
+		}
+		if reserved > n {
+			reserved = n
+		}
+		if atomic.CompareAndSwapInt64(&b.memInUse, inUse, inUse+reserved) {
+			return reserved
+		}
+	}
+}
+
+// budgetWriter accounts the bytes written to a spill file in the disk budget
+type budgetWriter struct {
+	w       io.Writer
+	b       *Buffer
+	written int64
+}
+
+func (bw *budgetWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if inUse := atomic.AddInt64(&bw.b.diskInUse, n); bw.b.diskBudget > 0 && inUse > bw.b.diskBudget {
+		atomic.AddInt64(&bw.b.diskInUse, -n)
+		return 0, ErrBufferBudgetExceeded
+	}
+	written, err := bw.w.Write(p)
+	// release the bytes that didn't make it to the file
+	atomic.AddInt64(&bw.b.diskInUse, int64(written)-n)
+	bw.written += int64(written)
+	return written, err
+}
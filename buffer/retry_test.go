@@ -1,9 +1,13 @@
 package buffer
 
 import (
+	gocontext "context"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -87,3 +91,424 @@ func newBufferMiddleware(t *testing.T, p string) (*roundrobin.RoundRobin, *Buffe
 
 	return lb, st
 }
+
+func TestRetryBackoff(t *testing.T) {
+	attempts := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(http.StatusText(http.StatusBadGateway)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+
+	st, err := New(handler, Retry(`IsNetworkError() && BackoffMS() < 1000`), RetryBackoff(20*time.Millisecond, time.Second, 0))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	start := time.Now()
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, 3, attempts)
+	// 20ms after the first attempt, 40ms after the second one
+	assert.True(t, time.Since(start) >= 60*time.Millisecond)
+}
+
+func TestRetryBackoffDelay(t *testing.T) {
+	st, err := New(nil, RetryBackoff(10*time.Millisecond, 50*time.Millisecond, 0))
+	require.NoError(t, err)
+
+	assert.Equal(t, 10*time.Millisecond, st.retryDelay(1))
+	assert.Equal(t, 20*time.Millisecond, st.retryDelay(2))
+	assert.Equal(t, 40*time.Millisecond, st.retryDelay(3))
+	assert.Equal(t, 50*time.Millisecond, st.retryDelay(4))
+	assert.Equal(t, 50*time.Millisecond, st.retryDelay(100))
+
+	st, err = New(nil, RetryBackoff(10*time.Millisecond, 50*time.Millisecond, 1))
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		delay := st.retryDelay(2)
+		assert.True(t, delay >= 0 && delay <= 20*time.Millisecond)
+	}
+
+	_, err = New(nil, RetryBackoff(time.Second, time.Millisecond, 0))
+	assert.Error(t, err)
+	_, err = New(nil, RetryBackoff(time.Millisecond, time.Second, 2))
+	assert.Error(t, err)
+}
+
+func TestRetryBackoffCanceled(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(http.StatusText(http.StatusBadGateway)))
+	})
+
+	st, err := New(handler, Retry(`IsNetworkError()`), RetryBackoff(time.Hour, time.Hour, 0))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		st.ServeHTTP(w, req)
+		close(done)
+	}))
+	defer proxy.Close()
+
+	// the client gives up while the retry is pending
+	client := &http.Client{Timeout: 20 * time.Millisecond}
+	_, err = client.Get(proxy.URL)
+	require.Error(t, err)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pending retry was not aborted")
+	}
+}
+
+func TestRetryOnResponseCode(t *testing.T) {
+	var bodies []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+
+		if len(bodies) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+
+	st, err := New(handler, Retry(`(IsNetworkError() || ResponseCode() == 503) && Attempts() <= 2`), MemRequestBodyBytes(1))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Body("some request parameters"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	// the buffered request body is replayed on every attempt
+	assert.Equal(t, []string{"some request parameters", "some request parameters", "some request parameters"}, bodies)
+}
+
+func TestNoRetryOnOtherResponseCode(t *testing.T) {
+	attempts := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+	})
+
+	st, err := New(handler, Retry(`(IsNetworkError() || ResponseCode() == 503) && Attempts() <= 2`))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryIdempotentOnly(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		method   string
+		key      string
+		attempts int
+	}{
+		{desc: "GET is retried", method: http.MethodGet, attempts: 3},
+		{desc: "PUT is retried", method: http.MethodPut, attempts: 3},
+		{desc: "DELETE is retried", method: http.MethodDelete, attempts: 3},
+		{desc: "POST is not retried", method: http.MethodPost, attempts: 1},
+		{desc: "PATCH is not retried", method: http.MethodPatch, attempts: 1},
+		{desc: "POST with an idempotency key is retried", method: http.MethodPost, key: "k1", attempts: 3},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			attempts := 0
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				attempts++
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte(http.StatusText(http.StatusBadGateway)))
+			})
+
+			st, err := New(handler, Retry(`IsNetworkError() && IsIdempotent() && Attempts() < 3`))
+			require.NoError(t, err)
+
+			proxy := httptest.NewServer(st)
+			defer proxy.Close()
+
+			opts := []testutils.ReqOption{testutils.Method(test.method), testutils.Body("some request parameters")}
+			if test.key != "" {
+				opts = append(opts, testutils.Header(IdempotencyKey, test.key))
+			}
+			re, _, err := testutils.MakeRequest(proxy.URL, opts...)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+			assert.Equal(t, test.attempts, attempts)
+		})
+	}
+}
+
+func TestRetryPredicateFunc(t *testing.T) {
+	attempts := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.Header().Set("X-Retryable", "true")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+
+	var contexts []RetryContext
+	st, err := New(handler, RetryPredicateFunc(func(ctx RetryContext) bool {
+		contexts = append(contexts, ctx)
+		return ctx.ResponseHeader.Get("X-Retryable") == "true" && ctx.Attempts < 5
+	}))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Body("some request parameters"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, 3, attempts)
+
+	require.Len(t, contexts, 3)
+	for i, ctx := range contexts {
+		assert.Equal(t, i+1, ctx.Attempts)
+		assert.Equal(t, http.MethodGet, ctx.Request.Method)
+		assert.NoError(t, ctx.Err)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, contexts[0].ResponseCode)
+	assert.Equal(t, http.StatusOK, contexts[2].ResponseCode)
+	assert.True(t, contexts[2].Elapsed >= contexts[0].Elapsed)
+}
+
+func TestRetryClock(t *testing.T) {
+	clock := testutils.GetClock()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clock.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(http.StatusText(http.StatusBadGateway)))
+	})
+
+	var elapsed []time.Duration
+	st, err := New(handler, RetryPredicateFunc(func(ctx RetryContext) bool {
+		elapsed = append(elapsed, ctx.Elapsed)
+		return ctx.Attempts < 3
+	}), RetryBackoff(time.Second, time.Minute, 0), Clock(clock))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost", strings.NewReader("some request parameters")))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+
+	// the backoff delays of 1s and 2s are waited for on the clock
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 1200 * time.Millisecond, 3300 * time.Millisecond}, elapsed)
+}
+
+func TestRetryPredicateFuncNetworkError(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(http.StatusText(http.StatusBadGateway)))
+	})
+
+	var lastErr error
+	st, err := New(handler, RetryPredicateFunc(func(ctx RetryContext) bool {
+		lastErr = ctx.Err
+		return false
+	}))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Error(t, lastErr)
+
+	_, err = New(handler, Retry(`IsNetworkError()`), RetryPredicateFunc(func(RetryContext) bool { return true }))
+	assert.Error(t, err)
+	_, err = New(handler, RetryPredicateFunc(nil))
+	assert.Error(t, err)
+}
+
+func TestSkipBufferingDisablesRetries(t *testing.T) {
+	attempts := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(http.StatusText(http.StatusBadGateway)))
+	})
+
+	st, err := New(handler, Retry(`IsNetworkError() && Attempts() <= 2`), SkipBufferingIf(func(req *http.Request) bool {
+		return req.URL.Path == "/upload"
+	}))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL+"/upload", testutils.Body("large upload"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, 1, attempts)
+
+	// other requests are still retried
+	attempts = 0
+	re, _, err = testutils.Get(proxy.URL, testutils.Body("small request"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetryBudget(t *testing.T) {
+	attempts := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			attempts++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+	st, err := New(handler, Retry(`ResponseCode() == 503 && Attempts() <= 2`), RetryBudget(0.5, 10*time.Second), Clock(clock))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	// no retry is allowed until requests succeed
+	re, _, err := testutils.Get(proxy.URL + "/fail")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, 1, attempts)
+
+	for i := 0; i < 4; i++ {
+		re, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+
+	// 4 successes allow 2 retries
+	attempts = 0
+	re, _, err = testutils.Get(proxy.URL + "/fail")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, float64(1), st.RetryBudgetUtilization())
+
+	attempts = 0
+	re, _, err = testutils.Get(proxy.URL + "/fail")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, 1, attempts)
+
+	// the budget is computed over the rolling window
+	clock.CurrentTime = clock.CurrentTime.Add(11 * time.Second)
+	assert.Equal(t, float64(0), st.RetryBudgetUtilization())
+
+	_, err = New(handler, RetryBudget(0, time.Second))
+	assert.Error(t, err)
+	_, err = New(handler, RetryBudget(0.2, time.Millisecond))
+	assert.Error(t, err)
+}
+
+func TestRetryBudgetMinRetries(t *testing.T) {
+	attempts := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+	})
+
+	clock := testutils.GetClock()
+	st, err := New(handler, Retry(`ResponseCode() == 503 && Attempts() <= 2`), RetryBudget(0.5, 10*time.Second),
+		RetryBudgetMinRetries(3), Clock(clock))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	// the floor allows retries before any request succeeds
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, 3, attempts)
+	assert.InDelta(t, 2.0/3, st.RetryBudgetUtilization(), 0.001)
+
+	attempts = 0
+	re, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, float64(1), st.RetryBudgetUtilization())
+
+	// and again once the window rolled over
+	clock.CurrentTime = clock.CurrentTime.Add(11 * time.Second)
+	attempts = 0
+	re, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	_, err = New(handler, RetryBudget(0.5, time.Second), RetryBudgetMinRetries(-1))
+	assert.Error(t, err)
+	_, err = New(handler, RetryBudgetMinRetries(1))
+	assert.Error(t, err)
+}
+
+func TestRetryBudgetRefund(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+	})
+
+	// the backoff never elapses, the fake clock isn't advanced
+	st, err := New(handler, Retry(`ResponseCode() == 503 && Attempts() <= 2`), RetryBudget(0.5, 10*time.Second),
+		RetryBudgetMinRetries(1), RetryBackoff(time.Second, time.Second, 0), Clock(testutils.NewFakeClock()))
+	require.NoError(t, err)
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", strings.NewReader(""))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		st.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	}()
+
+	require.Eventually(t, func() bool { return st.RetryBudgetUtilization() == 1 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	// the retry aborted during the backoff is given back
+	assert.Equal(t, float64(0), st.RetryBudgetUtilization())
+}
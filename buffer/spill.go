@@ -0,0 +1,184 @@
+package buffer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	"github.com/mailgun/multibuf"
+)
+
+const spillFilePrefix = "oxy-buffer-"
+
+// minMemBodyBytes is the size of the bodies kept in memory even when the GlobalMemoryBudget is exhausted
+const minMemBodyBytes = 512
+
+// spilledBody is a request body held in memory up to a limit, the excess is spilled to a temporary file.
+// Close removes the temporary file.
+type spilledBody struct {
+	mem  *bytes.Reader
+	file *os.File
+	size int64
+	r    io.Reader
+
+	// buffer and the bytes held in memory and on disk, released from the global budgets on Close
+	buffer   *Buffer
+	memBytes int64
+	disk     *budgetWriter
+}
+
+// readBody reads the request body keeping up to memRequestBodyBytes in memory and spilling the excess
+// to a temporary file in the spill directory. The temporary file is removed if reading fails,
+// e.g. when the client disconnects mid upload or the body exceeds maxRequestBodyBytes.
+// Only the share of GlobalMemoryBudget left is kept in memory, see reserveMemory, but the bodies up to
+// minMemBodyBytes never go to disk.
+func (b *Buffer) readBody(input io.Reader) (multibuf.MultiReader, error) {
+	memBytes := b.memRequestBodyBytes
+	if memBytes == 0 {
+		memBytes = DefaultMemBodyBytes
+	}
+	if b.maxRequestBodyBytes > 0 && b.maxRequestBodyBytes < memBytes {
+		memBytes = b.maxRequestBodyBytes
+	}
+
+	reserved := b.reserveMemory(memBytes)
+	// the small bodies are read past the budget, the larger ones then go to disk as a whole
+	var overBudget int64
+	if floor := min64(minMemBodyBytes, memBytes); reserved < floor {
+		overBudget = floor - reserved
+		atomic.AddInt64(&b.memInUse, overBudget)
+	}
+	memReader := &io.LimitedReader{R: input, N: reserved + overBudget}
+	buf, err := ioutil.ReadAll(memReader)
+	// release the share of the budget that wasn't used
+	atomic.AddInt64(&b.memInUse, int64(len(buf))-reserved-overBudget)
+	body := &spilledBody{mem: bytes.NewReader(buf), size: int64(len(buf)), buffer: b, memBytes: int64(len(buf))}
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if memReader.N > 0 {
+		body.r = body.mem
+		return body, nil
+	}
+
+	// the body may end right at the limit, there is nothing to spill then
+	peek := make([]byte, 1)
+	n, err := io.ReadFull(input, peek)
+	if err == io.EOF {
+		body.r = body.mem
+		return body, nil
+	}
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	input = io.MultiReader(bytes.NewReader(peek[:n]), input)
+	if overBudget > 0 {
+		input = io.MultiReader(bytes.NewReader(buf), input)
+		atomic.AddInt64(&b.memInUse, -body.memBytes)
+		body.mem, body.size, body.memBytes = bytes.NewReader(nil), 0, 0
+	}
+
+	// We have exceeded the memory capacity, the rest of the body goes to disk.
+	file, err := ioutil.TempFile(b.spillDir, spillFilePrefix)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	body.file = file
+	body.disk = &budgetWriter{w: file, b: b}
+
+	ok := false
+	defer func() {
+		if !ok {
+			if err := body.Close(); err != nil {
+				b.log.Errorf("vulcand/oxy/buffer: failed to remove spill file, err: %v", err)
+			}
+		}
+	}()
+
+	src := input
+	if b.maxRequestBodyBytes > 0 {
+		// Read one byte past the limit to detect bodies over the limit
+		src = io.LimitReader(input, b.maxRequestBodyBytes-body.size+1)
+	}
+
+	written, err := io.Copy(body.disk, src)
+	atomic.AddInt64(&b.bytesSpilled, written)
+	if err != nil {
+		return nil, err
+	}
+	body.size += written
+	if b.maxRequestBodyBytes > 0 && body.size > b.maxRequestBodyBytes {
+		return nil, &multibuf.MaxSizeReachedError{MaxSize: b.maxRequestBodyBytes}
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	body.r = io.MultiReader(body.mem, file)
+	ok = true
+	return body, nil
+}
+
+func (s *spilledBody) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// Seek only supports rewinding the body to the beginning.
+func (s *spilledBody) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, os.ErrInvalid
+	}
+	if _, err := s.mem.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if s.file == nil {
+		s.r = s.mem
+		return 0, nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	s.r = io.MultiReader(s.mem, s.file)
+	return 0, nil
+}
+
+func (s *spilledBody) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, s.r)
+}
+
+// Size returns the total size of the body.
+func (s *spilledBody) Size() (int64, error) {
+	return s.size, nil
+}
+
+// Close removes the temporary file, if any, and releases the bytes of the body from the global budgets.
+// It is safe to call Close more than once.
+func (s *spilledBody) Close() error {
+	if s.buffer != nil {
+		atomic.AddInt64(&s.buffer.memInUse, -s.memBytes)
+		s.memBytes = 0
+		if s.disk != nil {
+			atomic.AddInt64(&s.buffer.diskInUse, -s.disk.written)
+			s.disk.written = 0
+		}
+	}
+	if s.file == nil {
+		return nil
+	}
+	file := s.file
+	s.file = nil
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -3,6 +3,7 @@ package buffer
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/vulcand/predicate"
 )
@@ -17,6 +18,9 @@ type context struct {
 	r            *http.Request
 	attempt      int
 	responseCode int
+	header       http.Header
+	backoff      time.Duration
+	start        time.Time
 }
 
 type hpredicate func(*context) bool
@@ -39,6 +43,8 @@ func parseExpression(in string) (hpredicate, error) {
 			"IsNetworkError": isNetworkError,
 			"Attempts":       attempts,
 			"ResponseCode":   responseCode,
+			"BackoffMS":      backoffMS,
+			"IsIdempotent":   isIdempotent,
 		},
 	})
 	if err != nil {
@@ -79,6 +85,13 @@ func responseCode() toInt {
 	}
 }
 
+// BackoffMS returns mapper of the request to the time spent waiting between attempts, in milliseconds.
+func backoffMS() toInt {
+	return func(c *context) int {
+		return int(c.backoff / time.Millisecond)
+	}
+}
+
 // IsNetworkError returns a predicate that returns true if last attempt ended with network error.
 func isNetworkError() hpredicate {
 	return func(c *context) bool {
@@ -86,6 +99,19 @@ func isNetworkError() hpredicate {
 	}
 }
 
+// IsIdempotent returns a predicate that returns true if the request can be replayed safely:
+// its method is idempotent (GET, HEAD, OPTIONS, PUT or DELETE) or it carries an Idempotency-Key header.
+// A POST may have been partially processed by the upstream before the error, replaying it could apply it twice.
+func isIdempotent() hpredicate {
+	return func(c *context) bool {
+		switch c.r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+			return true
+		}
+		return c.r.Header.Get(IdempotencyKey) != ""
+	}
+}
+
 // and returns predicate by joining the passed predicates with logical 'and'
 func and(fns ...hpredicate) hpredicate {
 	return func(c *context) bool {
@@ -0,0 +1,548 @@
+/*
+Package cache provides http.Handler middleware caching the responses of the next handler
+following their Cache-Control and Expires headers, as a shared cache.
+
+Only GET requests are served from the cache. A response is stored when it has an explicit freshness
+lifetime (s-maxage, max-age or Expires) or is no-cache with a validator, and isn't no-store, private,
+setting a cookie or varying on all the request headers. Requests with an Authorization header are not cached.
+
+Requests upgrading the connection, e.g. websocket handshakes, are passed through.
+
+A fresh entry is served with the Age and X-Cache: HIT headers, or as a 304 Not Modified when it matches
+the If-None-Match or If-Modified-Since headers of the request. A stale entry with an ETag or a Last-Modified
+header is revalidated by the next handler with a conditional request, and served again if it is not modified.
+Responses from the next handler have the X-Cache: MISS header.
+
+Examples of a cache middleware:
+
+	// forwards the requests to the upstream and caches the responses in 128MB of memory
+	store, _ := cache.NewMemoryStore(128 * 1024 * 1024)
+	cache.New(fwd, cache.Store(store))
+*/
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultMaxBodyBytes is the default size of the largest response body cached
+const DefaultMaxBodyBytes = 1024 * 1024
+
+// CacheHeader tells whether the response was served from the cache
+const CacheHeader = "X-Cache"
+
+// Values of the CacheHeader
+const (
+	Hit  = "HIT"
+	Miss = "MISS"
+)
+
+// Cache is a middleware caching the responses of the next handler
+type Cache struct {
+	next         http.Handler
+	store        ResponseStore
+	maxBodyBytes int64
+	clock        timetools.TimeProvider
+
+	log *log.Logger
+}
+
+type optSetter func(c *Cache) error
+
+// New creates a new Cache middleware, the responses are kept in a MemoryStore of DefaultMaxBytes by default
+func New(next http.Handler, setters ...optSetter) (*Cache, error) {
+	c := &Cache{
+		next:         next,
+		maxBodyBytes: DefaultMaxBodyBytes,
+		clock:        &timetools.RealTime{},
+		log:          log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.store == nil {
+		store, err := NewMemoryStore(DefaultMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		c.store = store
+	}
+	return c, nil
+}
+
+// Logger defines the logger the cache will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(c *Cache) error {
+		c.log = l
+		return nil
+	}
+}
+
+// Store sets the store keeping the responses, e.g. to share them between several caches
+func Store(store ResponseStore) optSetter {
+	return func(c *Cache) error {
+		if store == nil {
+			return fmt.Errorf("store can not be nil")
+		}
+		c.store = store
+		return nil
+	}
+}
+
+// MaxBodyBytes sets the size of the largest response body cached, larger responses are passed through
+func MaxBodyBytes(n int64) optSetter {
+	return func(c *Cache) error {
+		if n <= 0 {
+			return fmt.Errorf("max body bytes should be > 0, got %v", n)
+		}
+		c.maxBodyBytes = n
+		return nil
+	}
+}
+
+// Clock sets the clock
+func Clock(clock timetools.TimeProvider) optSetter {
+	return func(c *Cache) error {
+		c.clock = clock
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by cache handler.
+func (c *Cache) Wrap(next http.Handler) {
+	c.next = next
+}
+
+func (c *Cache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := cacheKey(req)
+	if req.Method != http.MethodGet {
+		rw := &statusWriter{ResponseWriter: w}
+		c.next.ServeHTTP(rw, req)
+		// unsafe methods invalidate the cached response of the URL, CONNECT targets a host rather than a URL
+		if req.Method != http.MethodHead && req.Method != http.MethodOptions && req.Method != http.MethodConnect &&
+			rw.code < http.StatusBadRequest {
+			c.store.Delete(key)
+		}
+		return
+	}
+
+	reqCacheControl := parseCacheControl(req.Header)
+	if _, ok := reqCacheControl["no-store"]; ok || req.Header.Get("Authorization") != "" || isUpgrade(req) {
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	entryKey, entry := c.lookup(key, req)
+	if entry != nil {
+		_, noCache := reqCacheControl["no-cache"]
+		if !noCache && c.clock.UtcNow().Before(entry.Expires) {
+			c.log.Debugf("vulcand/oxy/cache: serving %v from the cache", key)
+			c.serveEntry(w, req, entry)
+			return
+		}
+		if !hasValidator(entry.Header) || hasConditions(req.Header) {
+			// the client revalidates its own copy, the response replaces the entry
+			entry = nil
+		}
+	}
+
+	outReq := req
+	if entry != nil {
+		outReq = req.Clone(req.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			outReq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			outReq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	rw := &responseWriter{w: w, header: make(http.Header), maxBodyBytes: c.maxBodyBytes, revalidating: entry != nil}
+	c.next.ServeHTTP(rw, outReq)
+	if rw.code == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	now := c.clock.UtcNow()
+	if rw.notModified {
+		c.log.Debugf("vulcand/oxy/cache: %v revalidated", key)
+		entry = revalidated(entry, rw.header, now)
+		c.store.Set(entryKey, entry)
+		c.serveEntry(w, req, entry)
+		return
+	}
+	if rw.overflow {
+		return
+	}
+	if stored := newEntry(rw, now); stored != nil {
+		c.save(key, req, stored)
+	}
+}
+
+// lookup returns the entry matching the request and its key, the variant of the request when the responses vary
+func (c *Cache) lookup(key string, req *http.Request) (string, *Entry) {
+	entry, ok := c.store.Get(key)
+	if !ok {
+		return key, nil
+	}
+	if entry.Vary == nil {
+		return key, entry
+	}
+	key = variantKey(key, entry.Vary, req)
+	if entry, ok = c.store.Get(key); !ok {
+		return key, nil
+	}
+	return key, entry
+}
+
+// save stores the response under the key of the request, and of its variant when it varies
+func (c *Cache) save(key string, req *http.Request, entry *Entry) {
+	vary := varyHeaders(entry.Header)
+	if len(vary) == 0 {
+		c.store.Set(key, entry)
+		return
+	}
+	c.store.Set(key, &Entry{Stored: entry.Stored, Expires: entry.Expires, Vary: vary})
+	c.store.Set(variantKey(key, vary, req), entry)
+}
+
+// serveEntry writes the entry, or a 304 when it matches the conditions of the request
+func (c *Cache) serveEntry(w http.ResponseWriter, req *http.Request, entry *Entry) {
+	age := c.clock.UtcNow().Sub(entry.Stored) + entry.Age
+	if age < 0 {
+		age = 0
+	}
+
+	if entry.StatusCode == http.StatusOK && notModified(req.Header, entry.Header) {
+		for _, name := range notModifiedHeaders {
+			if values, ok := entry.Header[name]; ok {
+				w.Header()[name] = append([]string(nil), values...)
+			}
+		}
+		w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+		w.Header().Set(CacheHeader, Hit)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	utils.CopyHeaders(w.Header(), entry.Header)
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	w.Header().Set(CacheHeader, Hit)
+	w.WriteHeader(entry.StatusCode)
+	if _, err := w.Write(entry.Body); err != nil {
+		c.log.Debugf("vulcand/oxy/cache: failed to write cached response: %v", err)
+	}
+}
+
+// notModifiedHeaders are the headers of a cached response sent with a 304
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Last-Modified", "Vary"}
+
+// cacheableStatus are the status codes of the responses that may be stored
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// newEntry returns the entry of a response from the next handler, nil when it can't be stored
+func newEntry(rw *responseWriter, now time.Time) *Entry {
+	if !cacheableStatus[rw.code] || rw.header.Get("Set-Cookie") != "" || rw.header.Get("Vary") == "*" {
+		return nil
+	}
+	cacheControl := parseCacheControl(rw.header)
+	if _, ok := cacheControl["no-store"]; ok {
+		return nil
+	}
+	if _, ok := cacheControl["private"]; ok {
+		return nil
+	}
+
+	lifetime, ok := freshnessLifetime(rw.header, cacheControl, now)
+	if _, noCache := cacheControl["no-cache"]; noCache {
+		lifetime, ok = 0, hasValidator(rw.header)
+	}
+	if !ok {
+		return nil
+	}
+
+	age := parseSeconds(rw.header.Get("Age"))
+	return &Entry{
+		StatusCode: rw.code,
+		Header:     rw.header,
+		Body:       rw.body.Bytes(),
+		Stored:     now,
+		Age:        age,
+		Expires:    now.Add(lifetime - age),
+	}
+}
+
+// revalidated returns a copy of the entry updated with the headers of the 304 revalidating it
+func revalidated(entry *Entry, header http.Header, now time.Time) *Entry {
+	updated := *entry
+	updated.Header = make(http.Header, len(entry.Header))
+	for name, values := range entry.Header {
+		updated.Header[name] = values
+	}
+	for name, values := range header {
+		updated.Header[name] = values
+	}
+
+	cacheControl := parseCacheControl(updated.Header)
+	lifetime, _ := freshnessLifetime(updated.Header, cacheControl, now)
+	if _, noCache := cacheControl["no-cache"]; noCache {
+		lifetime = 0
+	}
+	updated.Stored = now
+	updated.Age = parseSeconds(header.Get("Age"))
+	updated.Expires = now.Add(lifetime - updated.Age)
+	return &updated
+}
+
+// freshnessLifetime returns the time a response stays fresh, false when it has no explicit lifetime
+func freshnessLifetime(header http.Header, cacheControl map[string]string, now time.Time) (time.Duration, bool) {
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cacheControl[directive]; ok {
+			return parseSeconds(v), true
+		}
+	}
+	if v := header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// invalid dates, e.g. 0, mean already expired
+			return 0, true
+		}
+		date := now
+		if d, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = d
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+// notModified tells whether the conditions of the request match the cached response
+func notModified(reqHeader, header http.Header) bool {
+	if ifNoneMatch := reqHeader.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(reqHeader.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ifModifiedSince)
+}
+
+func hasValidator(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+func hasConditions(header http.Header) bool {
+	return header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != ""
+}
+
+// parseCacheControl returns the directives of the Cache-Control header with their lowercase names
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, arg = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = arg
+		}
+	}
+	return directives
+}
+
+// parseSeconds parses a delta-seconds value, invalid values are 0
+func parseSeconds(v string) time.Duration {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cacheKey is the key of the URL, the scheme is part of it so that the responses served over
+// plain HTTP and over TLS are kept apart
+func cacheKey(req *http.Request) string {
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + req.Host + req.URL.RequestURI()
+}
+
+// varyHeaders returns the sorted canonical names of the request headers the response varies on
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// variantKey is the key of the response matching the values of the vary headers of the request
+func variantKey(key string, vary []string, req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\n")
+		b.WriteString(name)
+		b.WriteString(":")
+		b.WriteString(strings.Join(req.Header[name], ","))
+	}
+	return b.String()
+}
+
+// isUpgrade tells whether the request asks to switch protocols, e.g. websocket handshakes. The next handler
+// needs the response writer of the server to hijack the connection.
+func isUpgrade(req *http.Request) bool {
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// responseWriter passes the response of the next handler to the client and keeps a copy of its body,
+// unless it is larger than maxBodyBytes. The 304 answering a revalidation is not passed.
+type responseWriter struct {
+	w            http.ResponseWriter
+	header       http.Header
+	code         int
+	body         bytes.Buffer
+	maxBodyBytes int64
+	overflow     bool
+	revalidating bool
+	notModified  bool
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.code != 0 {
+		return
+	}
+	rw.code = code
+	if rw.revalidating && code == http.StatusNotModified {
+		rw.notModified = true
+		return
+	}
+	utils.CopyHeaders(rw.w.Header(), rw.header)
+	rw.w.Header().Set(CacheHeader, Miss)
+	rw.w.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.code == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.notModified {
+		return len(p), nil
+	}
+	if !rw.overflow {
+		if int64(rw.body.Len()+len(p)) > rw.maxBodyBytes {
+			rw.overflow = true
+			rw.body = bytes.Buffer{}
+		} else {
+			rw.body.Write(p)
+		}
+	}
+	return rw.w.Write(p)
+}
+
+func (rw *responseWriter) Flush() {
+	if rw.code == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rw.w.(http.Flusher); ok && !rw.notModified {
+		f.Flush()
+	}
+}
+
+// statusWriter records the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.code == 0 {
+		sw.code = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker so that CONNECT tunnels and upgrades keep working
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := sw.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T doesn't implement http.Hijacker", sw.ResponseWriter)
+}
@@ -0,0 +1,401 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestCache(t *testing.T) {
+	var calls int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(fmt.Sprintf("hello %d", calls)))
+	})
+
+	clock := testutils.GetClock()
+	c, err := New(handler, Clock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL + "/path")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello 1", string(body))
+	assert.Equal(t, Miss, re.Header.Get(CacheHeader))
+
+	clock.Sleep(10 * time.Second)
+	re, body, err = testutils.Get(srv.URL + "/path")
+	require.NoError(t, err)
+	assert.Equal(t, "hello 1", string(body))
+	assert.Equal(t, Hit, re.Header.Get(CacheHeader))
+	assert.Equal(t, "10", re.Header.Get("Age"))
+	assert.Equal(t, "max-age=60", re.Header.Get("Cache-Control"))
+
+	// other URLs have their own entries
+	_, body, err = testutils.Get(srv.URL + "/path?q=1")
+	require.NoError(t, err)
+	assert.Equal(t, "hello 2", string(body))
+
+	// the client can bypass the cache
+	re, body, err = testutils.Get(srv.URL+"/path", testutils.Header("Cache-Control", "no-store"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello 3", string(body))
+	assert.Empty(t, re.Header.Get(CacheHeader))
+
+	clock.Sleep(time.Minute)
+	re, body, err = testutils.Get(srv.URL + "/path")
+	require.NoError(t, err)
+	assert.Equal(t, "hello 4", string(body))
+	assert.Equal(t, Miss, re.Header.Get(CacheHeader))
+}
+
+func TestCacheNotStored(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		handler http.HandlerFunc
+		request []testutils.ReqOption
+	}{
+		{
+			desc: "no freshness",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("hello"))
+			},
+		},
+		{
+			desc: "no-store",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60, no-store")
+				w.Write([]byte("hello"))
+			},
+		},
+		{
+			desc: "private",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Cache-Control", "private, max-age=60")
+				w.Write([]byte("hello"))
+			},
+		},
+		{
+			desc: "set cookie",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Set-Cookie", "session=1")
+				w.Write([]byte("hello"))
+			},
+		},
+		{
+			desc: "vary on all headers",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Vary", "*")
+				w.Write([]byte("hello"))
+			},
+		},
+		{
+			desc: "server error",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		},
+		{
+			desc: "body too large",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Write([]byte("hello world, this is a large body"))
+			},
+		},
+		{
+			desc: "authorization",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Write([]byte("hello"))
+			},
+			request: []testutils.ReqOption{testutils.Header("Authorization", "Bearer token")},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			store, err := NewMemoryStore(1024)
+			require.NoError(t, err)
+
+			c, err := New(test.handler, Store(store), MaxBodyBytes(16))
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(c)
+			defer srv.Close()
+
+			_, _, err = testutils.Get(srv.URL, test.request...)
+			require.NoError(t, err)
+			assert.Zero(t, store.Size())
+		})
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var calls, notModified int
+	etag := `"v1"`
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", etag)
+		if req.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello " + etag))
+	})
+
+	clock := testutils.GetClock()
+	c, err := New(handler, Clock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	_, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, `hello "v1"`, string(body))
+
+	// the stale entry is revalidated and served again
+	clock.Sleep(2 * time.Minute)
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, `hello "v1"`, string(body))
+	assert.Equal(t, Hit, re.Header.Get(CacheHeader))
+	assert.Equal(t, "0", re.Header.Get("Age"))
+	assert.Equal(t, 1, notModified)
+
+	// and is fresh again
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	// a modified response replaces the entry
+	etag = `"v2"`
+	clock.Sleep(2 * time.Minute)
+	re, body, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, `hello "v2"`, string(body))
+	assert.Equal(t, Miss, re.Header.Get(CacheHeader))
+
+	_, body, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, `hello "v2"`, string(body))
+	assert.Equal(t, 3, calls)
+
+	// the client revalidates its copy against the entry
+	re, body, err = testutils.Get(srv.URL, testutils.Header("If-None-Match", `"v1", W/"v2"`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotModified, re.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, `"v2"`, re.Header.Get("ETag"))
+	assert.Equal(t, Hit, re.Header.Get(CacheHeader))
+	assert.Equal(t, 3, calls)
+
+	// no-cache requests revalidate the entry
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Cache-Control", "no-cache"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, 2, notModified)
+}
+
+func TestCacheIfModifiedSince(t *testing.T) {
+	lastModified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Expires", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Write([]byte("hello"))
+	})
+
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("If-Modified-Since", lastModified.Format(http.TimeFormat)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotModified, re.StatusCode)
+
+	re, body, err := testutils.Get(srv.URL, testutils.Header("If-Modified-Since", lastModified.Add(-time.Hour).Format(http.TimeFormat)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, Hit, re.Header.Get(CacheHeader))
+}
+
+func TestCacheVary(t *testing.T) {
+	var calls int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("hello " + req.Header.Get("Accept-Language")))
+	})
+
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	for _, lang := range []string{"en", "fr", "en", "fr"} {
+		re, body, err := testutils.Get(srv.URL, testutils.Header("Accept-Language", lang))
+		require.NoError(t, err)
+		assert.Equal(t, "hello "+lang, string(body))
+		assert.Equal(t, "Accept-Language", re.Header.Get("Vary"))
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	var calls int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			calls++
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("hello"))
+	})
+
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	for _, method := range []string{http.MethodGet, http.MethodGet, http.MethodHead, http.MethodGet, http.MethodPost, http.MethodGet} {
+		re, _, err := testutils.MakeRequest(srv.URL, testutils.Method(method))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	assert.Equal(t, 2, calls)
+
+	_, err = New(handler, Store(nil))
+	assert.Error(t, err)
+	_, err = New(handler, MaxBodyBytes(0))
+	assert.Error(t, err)
+}
+
+func TestCacheWebsocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(msgType, msg)
+	})
+
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	conn, re, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, re.StatusCode)
+	assert.Empty(t, re.Header.Get(CacheHeader))
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+}
+
+func TestCacheConnect(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		io.Copy(conn, brw)
+	})
+
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	re, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	echo := make([]byte, 5)
+	_, err = io.ReadFull(br, echo)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(echo))
+}
+
+func TestCacheKeyScheme(t *testing.T) {
+	var calls int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		if req.TLS != nil {
+			w.Write([]byte("https"))
+			return
+		}
+		w.Write([]byte("http"))
+	})
+
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	for _, target := range []string{"http://example.com/a", "https://example.com/a", "http://example.com/a", "https://example.com/a"} {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, strings.SplitN(target, ":", 2)[0], rw.Body.String(), target)
+	}
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultMaxBytes is the default size of the MemoryStore
+const DefaultMaxBytes = 64 * 1024 * 1024
+
+// Entry is a cached response. Entries are not modified once stored, a revalidated response is stored as a new entry.
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Stored is the time the response was received or last revalidated
+	Stored time.Time
+	// Age is the age of the response when it was received, from its Age header
+	Age time.Duration
+	// Expires is the time the response becomes stale
+	Expires time.Time
+	// Vary is set on the entries of the URLs whose responses vary, they only
+	// hold the request headers selecting the entry of each variant
+	Vary []string
+}
+
+// ResponseStore keeps the cached responses. Implementations must be safe for concurrent use
+// and may evict entries at any time, stale entries are still looked up to be revalidated.
+type ResponseStore interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, e *Entry)
+	Delete(key string)
+}
+
+// MemoryStore is a ResponseStore keeping the entries in memory up to a size in bytes,
+// the least recently used entries are evicted first.
+type MemoryStore struct {
+	mutex    sync.Mutex
+	maxBytes int64
+	size     int64
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+// NewMemoryStore creates a MemoryStore holding up to maxBytes of entries
+func NewMemoryStore(maxBytes int64) (*MemoryStore, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("max bytes should be > 0, got %v", maxBytes)
+	}
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}, nil
+}
+
+// Get returns the entry of key and marks it as recently used
+func (s *MemoryStore) Get(key string) (*Entry, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, true
+}
+
+// Set stores the entry of key, evicting the least recently used entries to make room for it.
+// Entries larger than the store are not kept.
+func (s *MemoryStore) Set(key string, e *Entry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(key)
+	size := entrySize(key, e)
+	if size > s.maxBytes {
+		return
+	}
+	for s.size+size > s.maxBytes {
+		s.remove(s.order.Back().Value.(*memoryItem).key)
+	}
+	s.items[key] = s.order.PushFront(&memoryItem{key: key, entry: e, size: size})
+	s.size += size
+}
+
+// Delete removes the entry of key
+func (s *MemoryStore) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(key)
+}
+
+// Size returns the size in bytes of the entries
+func (s *MemoryStore) Size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.size
+}
+
+func (s *MemoryStore) remove(key string) {
+	el, ok := s.items[key]
+	if !ok {
+		return
+	}
+	s.order.Remove(el)
+	delete(s.items, key)
+	s.size -= el.Value.(*memoryItem).size
+}
+
+// entrySize approximates the memory used by an entry with its key and headers
+func entrySize(key string, e *Entry) int64 {
+	size := int64(len(key) + len(e.Body))
+	for name, values := range e.Header {
+		for _, v := range values {
+			size += int64(len(name) + len(v))
+		}
+	}
+	for _, name := range e.Vary {
+		size += int64(len(name))
+	}
+	return size
+}
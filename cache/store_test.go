@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store, err := NewMemoryStore(30)
+	require.NoError(t, err)
+
+	store.Set("a", &Entry{Body: []byte("0123456789")})
+	store.Set("b", &Entry{Body: []byte("0123456789")})
+	assert.EqualValues(t, 22, store.Size())
+
+	// a is the most recently used, b is evicted
+	_, ok := store.Get("a")
+	assert.True(t, ok)
+	store.Set("c", &Entry{Body: []byte("0123456789")})
+	_, ok = store.Get("b")
+	assert.False(t, ok)
+	_, ok = store.Get("a")
+	assert.True(t, ok)
+
+	// entries larger than the store are not kept
+	store.Set("d", &Entry{Body: make([]byte, 30)})
+	_, ok = store.Get("d")
+	assert.False(t, ok)
+
+	// replacing an entry updates the size
+	store.Set("a", &Entry{Body: []byte("01234")})
+	assert.EqualValues(t, 17, store.Size())
+
+	store.Delete("a")
+	store.Delete("c")
+	assert.Zero(t, store.Size())
+
+	_, err = NewMemoryStore(0)
+	assert.Error(t, err)
+}
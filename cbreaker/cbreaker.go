@@ -23,9 +23,14 @@
 // * OnTripped action is called on transition (Standby -> Tripped)
 // * OnStandby action is called on transition (Recovering -> Standby)
 //
+// OnTrippedWithMetrics gets a Snapshot of the metrics that made the condition match on transition to Tripped.
+//
+// Subscribe returns a channel receiving every transition with its time and reason, e.g. to feed dashboards.
+//
 package cbreaker
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
@@ -41,8 +46,10 @@ import (
 type CircuitBreaker struct {
 	m       *sync.RWMutex
 	metrics *memmetrics.RTMetrics
+	grpc    *grpcMetrics
 
-	condition hpredicate
+	condition  hpredicate
+	expression string
 
 	fallbackDuration time.Duration
 	recoveryDuration time.Duration
@@ -50,17 +57,44 @@ type CircuitBreaker struct {
 	onTripped SideEffect
 	onStandby SideEffect
 
+	onTrippedWithMetrics func(Snapshot)
+	// snapshot of the metrics being evaluated by the condition
+	snapshot *Snapshot
+
 	state cbState
 	until time.Time
 
 	rc *ratioController
 
+	recoveringMaxConcurrent int
+	// number of requests let through while recovering that are still in flight
+	probes int
+
 	checkPeriod time.Duration
 	lastCheck   time.Time
+	// watchStop is set while the state is evaluated on the clock, closing it stops the evaluation
+	// of this circuit breaker, done stops all the circuit breakers of the keys on Close
+	watchStop chan struct{}
+	done      chan struct{}
+	stop      *sync.Once
+
+	// rolling window of the metrics, the memmetrics defaults are used when metricsBuckets is 0
+	metricsBuckets    int
+	metricsResolution time.Duration
 
 	fallback http.Handler
 	next     http.Handler
 
+	// circuit breakers per key, when keyExtractor is set
+	keyExtractor func(*http.Request) string
+	maxKeys      int
+	breakers     *breakerCache
+
+	// key of the circuit breaker when created by a keyExtractor
+	key         string
+	events      *stateEvents
+	sideEffects *sideEffects
+
 	clock timetools.TimeProvider
 
 	log *log.Logger
@@ -77,6 +111,10 @@ func New(next http.Handler, expression string, options ...CircuitBreakerOption)
 		fallbackDuration: defaultFallbackDuration,
 		recoveryDuration: defaultRecoveryDuration,
 		fallback:         defaultFallback,
+		events:           newStateEvents(),
+		sideEffects:      &sideEffects{},
+		done:             make(chan struct{}),
+		stop:             &sync.Once{},
 		log:              log.StandardLogger(),
 	}
 
@@ -91,12 +129,27 @@ func New(next http.Handler, expression string, options ...CircuitBreakerOption)
 		return nil, err
 	}
 	cb.condition = condition
+	cb.expression = expression
 
-	mt, err := memmetrics.NewRTMetrics()
+	if window := time.Duration(cb.metricsBuckets) * cb.metricsResolution; cb.metricsBuckets > 0 && cb.checkPeriod >= window {
+		return nil, fmt.Errorf("check period %v should be shorter than the metrics window %v", cb.checkPeriod, window)
+	}
+
+	mt, err := cb.newMetrics()
 	if err != nil {
 		return nil, err
 	}
 	cb.metrics = mt
+	if cb.grpc, err = cb.newGrpcMetrics(mt); err != nil {
+		return nil, err
+	}
+
+	if cb.keyExtractor != nil {
+		if cb.maxKeys == 0 {
+			cb.maxKeys = defaultMaxKeys
+		}
+		cb.breakers = newBreakerCache(cb.maxKeys)
+	}
 
 	return cb, nil
 }
@@ -117,23 +170,52 @@ func (c *CircuitBreaker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		logEntry.Debug("vulcand/oxy/circuitbreaker: begin ServeHttp on request")
 		defer logEntry.Debug("vulcand/oxy/circuitbreaker: completed ServeHttp on request")
 	}
-	if c.activateFallback(w, req) {
-		c.fallback.ServeHTTP(w, req)
+
+	if c.keyExtractor == nil {
+		c.handle(w, req)
 		return
 	}
+
+	cb, err := c.breakerFor(c.keyExtractor(req))
+	if err != nil {
+		c.log.Errorf("vulcand/oxy/circuitbreaker: failed to create circuit breaker, err: %v", err)
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+		return
+	}
+	cb.handle(w, req)
+}
+
+func (c *CircuitBreaker) handle(w http.ResponseWriter, req *http.Request) {
+	fallback, probe, state := c.activateFallback(w, req)
+	if fallback {
+		// the state is only visible to the fallback, the original request is left untouched
+		c.fallback.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), stateKey, State(state))))
+		return
+	}
+	if probe {
+		// deferred to release the probe on every exit path, including panics
+		defer c.releaseProbe()
+	}
 	c.serve(w, req)
 }
 
 // Wrap sets the next handler to be called by circuit breaker handler.
 func (c *CircuitBreaker) Wrap(next http.Handler) {
 	c.next = next
+	if c.breakers != nil {
+		c.breakers.each(func(cb *CircuitBreaker) {
+			cb.next = next
+		})
+	}
 }
 
-// updateState updates internal state and returns true if fallback should be used and false otherwise
-func (c *CircuitBreaker) activateFallback(w http.ResponseWriter, req *http.Request) bool {
+// activateFallback updates internal state and returns true if fallback should be used and false otherwise,
+// probe is true if the request has been let through while recovering and counts against RecoveringMaxConcurrent,
+// state is the state of the circuit breaker when the fallback is used.
+func (c *CircuitBreaker) activateFallback(w http.ResponseWriter, req *http.Request) (fallback bool, probe bool, state cbState) {
 	// Quick check with read locks optimized for normal operation use-case
 	if c.isStandby() {
-		return false
+		return false, false, stateStandby
 	}
 	// Circuit breaker is in tripped or recovering state
 	c.m.Lock()
@@ -144,10 +226,10 @@ func (c *CircuitBreaker) activateFallback(w http.ResponseWriter, req *http.Reque
 	switch c.state {
 	case stateStandby:
 		// someone else has set it to standby just now
-		return false
+		return false, false, stateStandby
 	case stateTripped:
 		if c.clock.UtcNow().Before(c.until) {
-			return true
+			return true, false, stateTripped
 		}
 		// We have been in active state enough, enter recovering state
 		c.setRecovering()
@@ -155,16 +237,30 @@ func (c *CircuitBreaker) activateFallback(w http.ResponseWriter, req *http.Reque
 	case stateRecovering:
 		// We have been in recovering state enough, enter standby and allow request
 		if c.clock.UtcNow().After(c.until) {
-			c.setState(stateStandby, c.clock.UtcNow())
-			return false
+			c.setState(stateStandby, c.clock.UtcNow(), ReasonRecoveryElapsed)
+			return false, false, stateStandby
+		}
+		// too many requests are already probing the endpoint
+		if c.recoveringMaxConcurrent > 0 && c.probes >= c.recoveringMaxConcurrent {
+			return true, false, stateRecovering
 		}
 		// ratio controller allows this request
 		if c.rc.allowRequest() {
-			return false
+			if c.recoveringMaxConcurrent > 0 {
+				c.probes++
+				return false, true, stateRecovering
+			}
+			return false, false, stateRecovering
 		}
-		return true
+		return true, false, stateRecovering
 	}
-	return false
+	return false, false, stateStandby
+}
+
+func (c *CircuitBreaker) releaseProbe() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.probes--
 }
 
 func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request) {
@@ -175,6 +271,7 @@ func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request) {
 
 	latency := c.clock.UtcNow().Sub(start)
 	c.metrics.Record(p.StatusCode(), latency)
+	c.grpc.record(p.Header())
 
 	// Note that this call is less expensive than it looks -- checkCondition only performs the real check
 	// periodically. Because of that we can afford to call it here on every single response.
@@ -202,19 +299,65 @@ func (c *CircuitBreaker) exec(s SideEffect) {
 	if s == nil {
 		return
 	}
-	go func() {
+	c.sideEffects.run(func() {
 		if err := s.Exec(); err != nil {
 			c.log.Errorf("%v side effect failure: %v", c, err)
 		}
+	})
+}
+
+// Close stops the evaluation of the state on the clock and waits for the side effects in progress to complete,
+// the side effects of later state changes are not executed. The requests are still served.
+func (c *CircuitBreaker) Close() error {
+	c.stop.Do(func() { close(c.done) })
+	c.sideEffects.close()
+	return nil
+}
+
+// sideEffects runs the side effects in the background, it is shared by the circuit breakers of each key
+type sideEffects struct {
+	mutex  sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func (s *sideEffects) run(fn func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
 	}()
 }
 
-func (c *CircuitBreaker) setState(new cbState, until time.Time) {
+func (s *sideEffects) close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+}
+
+func (c *CircuitBreaker) setState(new cbState, until time.Time, reason string) {
 	c.log.Debugf("%v setting state to %v, until %v", c, new, until)
+	change := StateChange{From: State(c.state), To: State(new), Time: c.clock.UtcNow(), Reason: reason, Key: c.key}
+	if new == stateTripped {
+		change.Condition = c.expression
+	}
+	c.events.publish(change)
 	c.state = new
 	c.until = until
 	switch new {
 	case stateTripped:
+		if c.watchStop == nil {
+			c.watchStop = make(chan struct{})
+			go c.watch(c.watchStop, c.clock.After(c.watchPeriod()))
+		}
 		c.exec(c.onTripped)
 	case stateStandby:
 		c.exec(c.onStandby)
@@ -247,16 +390,98 @@ func (c *CircuitBreaker) checkAndSet() {
 		return
 	}
 
+	if c.onTrippedWithMetrics != nil {
+		// the condition records the values it evaluates into the snapshot
+		c.snapshot = c.newSnapshot()
+		defer func() { c.snapshot = nil }()
+	}
+
 	if !c.condition(c) {
 		return
 	}
 
-	c.setState(stateTripped, c.clock.UtcNow().Add(c.fallbackDuration))
+	c.setState(stateTripped, c.clock.UtcNow().Add(c.fallbackDuration), ReasonConditionMatched)
+	if c.snapshot != nil {
+		snapshot := *c.snapshot
+		c.sideEffects.run(func() { c.onTrippedWithMetrics(snapshot) })
+	}
 	c.metrics.Reset()
+	c.grpc.reset()
+}
+
+// watch evaluates the state on every tick of the clock until the circuit breaker is back to standby
+// or stop is closed, so that a tripped circuit breaker recovers without waiting for a request
+func (c *CircuitBreaker) watch(stop chan struct{}, tick <-chan time.Time) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-stop:
+			return
+		case <-tick:
+			if !c.evaluate(stop) {
+				return
+			}
+			tick = c.clock.After(c.watchPeriod())
+		}
+	}
+}
+
+// watchPeriod is the check period, or the default one when the condition is checked after every response
+func (c *CircuitBreaker) watchPeriod() time.Duration {
+	if c.checkPeriod == 0 {
+		return defaultCheckPeriod
+	}
+	return c.checkPeriod
+}
+
+// stopWatch stops the evaluation of the state on the clock, e.g. when the circuit breaker of a key is evicted
+func (c *CircuitBreaker) stopWatch() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.watchStop != nil {
+		close(c.watchStop)
+		c.watchStop = nil
+	}
+}
+
+// evaluate moves the circuit breaker to the next state once the fallback or the recovery duration has elapsed
+// and checks the condition, it returns false once the circuit breaker is back to standby or stop was closed
+func (c *CircuitBreaker) evaluate(stop chan struct{}) bool {
+	c.m.Lock()
+	if c.watchStop != stop {
+		c.m.Unlock()
+		return false
+	}
+	switch c.state {
+	case stateTripped:
+		if !c.clock.UtcNow().Before(c.until) {
+			c.setRecovering()
+		}
+	case stateRecovering:
+		if c.clock.UtcNow().After(c.until) {
+			c.setState(stateStandby, c.clock.UtcNow(), ReasonRecoveryElapsed)
+		}
+	}
+	c.m.Unlock()
+
+	c.checkAndSet()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.watchStop != stop {
+		return false
+	}
+	if c.state == stateStandby {
+		c.watchStop = nil
+		return false
+	}
+	return true
 }
 
 func (c *CircuitBreaker) setRecovering() {
-	c.setState(stateRecovering, c.clock.UtcNow().Add(c.recoveryDuration))
+	c.setState(stateRecovering, c.clock.UtcNow().Add(c.recoveryDuration), ReasonFallbackElapsed)
 	c.rc = newRatioController(c.clock, c.recoveryDuration, c.log)
 }
 
@@ -265,7 +490,8 @@ func (c *CircuitBreaker) setRecovering() {
 type CircuitBreakerOption func(*CircuitBreaker) error
 
 // Clock allows you to fake che CircuitBreaker's view of the current time.
-// Intended for unit tests.
+// Intended for unit tests. A tripped CircuitBreaker waits for the After of the clock between evaluations
+// of its state, it must only fire once the clock has moved by the duration, see testutils.FakeClock.
 func Clock(clock timetools.TimeProvider) CircuitBreakerOption {
 	return func(c *CircuitBreaker) error {
 		c.clock = clock
@@ -291,10 +517,61 @@ func RecoveryDuration(d time.Duration) CircuitBreakerOption {
 	}
 }
 
+// RecoveringMaxConcurrent limits the number of in-flight requests let through
+// during the Recovering state, the other requests are routed to the fallback.
+func RecoveringMaxConcurrent(n int) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if n < 0 {
+			return fmt.Errorf("recovering max concurrent should be >= 0, got %v", n)
+		}
+		c.recoveringMaxConcurrent = n
+		return nil
+	}
+}
+
+// MetricsWindow sets the rolling window of the metrics the condition is evaluated on to buckets of bucketDuration,
+// defaults to 10 buckets of 1 second. A shorter window reacts faster to a burst of errors, a longer one smooths
+// out short spikes. The latency histogram covers the same window, see memmetrics.RTWindow.
+// bucketDuration should be at least 1 second, the window at most 1 hour and longer than the CheckPeriod.
+func MetricsWindow(buckets int, bucketDuration time.Duration) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if buckets < 1 {
+			return fmt.Errorf("metrics window buckets should be >= 1, got %v", buckets)
+		}
+		if bucketDuration < time.Second {
+			return fmt.Errorf("metrics window bucket duration should be >= 1s, got %v", bucketDuration)
+		}
+		if window := time.Duration(buckets) * bucketDuration; window > maxMetricsWindow {
+			return fmt.Errorf("metrics window should be <= %v, got %v", maxMetricsWindow, window)
+		}
+		c.metricsBuckets = buckets
+		c.metricsResolution = bucketDuration
+		return nil
+	}
+}
+
+// newMetrics creates the metrics the condition is evaluated on
+func (c *CircuitBreaker) newMetrics() (*memmetrics.RTMetrics, error) {
+	if c.metricsBuckets == 0 {
+		return memmetrics.NewRTMetrics(memmetrics.RTClock(c.clock))
+	}
+	return memmetrics.NewRTMetrics(memmetrics.RTClock(c.clock), memmetrics.RTWindow(c.metricsBuckets, c.metricsResolution))
+}
+
 // CheckPeriod is how long the CircuitBreaker will wait between successive
-// checks of the breaker condition.
+// checks of the breaker condition, defaults to 100ms.
+//
+// The condition is checked after a response once the period has elapsed, starting with the
+// first response after construction, the state is left untouched between checks.
+// Once tripped, the state is also evaluated on the clock every period, zero meaning the default period,
+// until the CircuitBreaker is back to standby: it recovers even when no request comes in.
+// A shorter period trips the breaker sooner at the cost of evaluating the metrics more often,
+// zero checks the condition after every response.
 func CheckPeriod(d time.Duration) CircuitBreakerOption {
 	return func(c *CircuitBreaker) error {
+		if d < 0 {
+			return fmt.Errorf("check period should be >= 0, got %v", d)
+		}
 		c.checkPeriod = d
 		return nil
 	}
@@ -320,6 +597,7 @@ func OnStandby(s SideEffect) CircuitBreakerOption {
 
 // Fallback defines the http.Handler that the CircuitBreaker should route
 // requests to when it prevents a request from taking its normal path.
+// The fallback gets the state of the circuit breaker with StateFromContext.
 func Fallback(h http.Handler) CircuitBreakerOption {
 	return func(c *CircuitBreaker) error {
 		c.fallback = h
@@ -342,6 +620,31 @@ func (s cbState) String() string {
 	return "undefined"
 }
 
+// State is the state of the circuit breaker passed to the fallback
+type State int
+
+// States of the circuit breaker
+const (
+	StateStandby    = State(stateStandby)
+	StateTripped    = State(stateTripped)
+	StateRecovering = State(stateRecovering)
+)
+
+func (s State) String() string {
+	return cbState(s).String()
+}
+
+type contextKey int
+
+const stateKey contextKey = 0
+
+// StateFromContext returns the state of the circuit breaker that routed the request to the fallback,
+// ok is false outside of the fallback.
+func StateFromContext(ctx context.Context) (state State, ok bool) {
+	state, ok = ctx.Value(stateKey).(State)
+	return state, ok
+}
+
 const (
 	// CircuitBreaker is passing all requests and watching stats
 	stateStandby = iota
@@ -355,6 +658,7 @@ const (
 	defaultFallbackDuration = 10 * time.Second
 	defaultRecoveryDuration = 10 * time.Second
 	defaultCheckPeriod      = 100 * time.Millisecond
+	maxMetricsWindow        = time.Hour
 )
 
 var defaultFallback = &fallback{}
@@ -13,6 +13,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/oxy/testutils"
+	"go.uber.org/goleak"
 )
 
 const triggerNetRatio = `NetworkErrorRatio() > 0.5`
@@ -39,10 +40,11 @@ func TestFullCycle(t *testing.T) {
 		w.Write([]byte("hello"))
 	})
 
-	clock := testutils.GetClock()
+	clock := testutils.NewFakeClock()
 
 	cb, err := New(handler, triggerNetRatio, Clock(clock))
 	require.NoError(t, err)
+	defer cb.Close()
 
 	srv := httptest.NewServer(cb)
 	defer srv.Close()
@@ -51,28 +53,28 @@ func TestFullCycle(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 
-	cb.metrics = statsNetErrors(0.6)
-	clock.CurrentTime = clock.CurrentTime.Add(defaultCheckPeriod + time.Millisecond)
+	setMetrics(cb, statsNetErrors(0.6))
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
-	assert.Equal(t, cbState(stateTripped), cb.state)
+	assert.Equal(t, cbState(stateTripped), stateOf(cb))
 
 	// Some time has passed, but we are still in trapped state.
-	clock.CurrentTime = clock.CurrentTime.Add(9 * time.Second)
+	clock.Advance(9 * time.Second)
 	re, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
-	assert.Equal(t, cbState(stateTripped), cb.state)
+	assert.Equal(t, cbState(stateTripped), stateOf(cb))
 
 	// We should be in recovering state by now
-	clock.CurrentTime = clock.CurrentTime.Add(time.Second*1 + time.Millisecond)
+	clock.Advance(time.Second*1 + time.Millisecond)
 	re, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
-	assert.Equal(t, cbState(stateRecovering), cb.state)
+	assert.Equal(t, cbState(stateRecovering), stateOf(cb))
 
 	// 5 seconds after we should be allowing some requests to pass
-	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	clock.Advance(5 * time.Second)
 	allowed := 0
 	for i := 0; i < 100; i++ {
 		re, _, err = testutils.Get(srv.URL)
@@ -83,13 +85,94 @@ func TestFullCycle(t *testing.T) {
 	assert.NotEqual(t, 0, allowed)
 
 	// After some time, all is good and we should be in stand by mode again
-	clock.CurrentTime = clock.CurrentTime.Add(5*time.Second + time.Millisecond)
+	clock.Advance(5*time.Second + time.Millisecond)
 	re, _, err = testutils.Get(srv.URL)
-	assert.Equal(t, cbState(stateStandby), cb.state)
+	assert.Equal(t, cbState(stateStandby), stateOf(cb))
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 }
 
+func TestFallbackState(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, ok := StateFromContext(req.Context())
+		assert.False(t, ok)
+		w.Write([]byte("hello"))
+	})
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		state, ok := StateFromContext(req.Context())
+		require.True(t, ok)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(state.String()))
+	})
+
+	clock := testutils.NewFakeClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), Fallback(fallback))
+	require.NoError(t, err)
+	defer cb.Close()
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	setMetrics(cb, statsNetErrors(0.6))
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	re, body, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, "tripped", string(body))
+
+	// requests rejected while recovering
+	clock.Advance(defaultFallbackDuration + time.Millisecond)
+	re, body, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, "recovering", string(body))
+}
+
+func TestOnTrippedWithMetrics(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.NewFakeClock()
+	snapshots := make(chan Snapshot, 1)
+
+	cb, err := New(handler, `ResponseCodeRatio(500, 600, 0, 600) > 0.5 && LatencyAtQuantileMS(50.0) < 1000`,
+		Clock(clock), OnTrippedWithMetrics(func(s Snapshot) { snapshots <- s }))
+	require.NoError(t, err)
+	defer cb.Close()
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	setMetrics(cb, statsResponseCodes(statusCode{Code: 500, Count: 7}, statusCode{Code: 200, Count: 3}))
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), stateOf(cb))
+
+	select {
+	case s := <-snapshots:
+		assert.Equal(t, clock.UtcNow(), s.Time)
+		assert.EqualValues(t, 11, s.TotalCount)
+		assert.Equal(t, map[int]int64{500: 7, 200: 4}, s.StatusCodes)
+		assert.InDelta(t, 7.0/11.0, s.ResponseCodeRatios[CodeRatio{StartA: 500, EndA: 600, StartB: 0, EndB: 600}], 0.001)
+		assert.Equal(t, map[float64]int{50.0: 0}, s.LatencyAtQuantileMS)
+
+		// the snapshot is a copy of the metrics
+		s.StatusCodes[500] = 0
+		assert.Empty(t, cb.metrics.StatusCodesCounts())
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the snapshot")
+	}
+}
+
 func TestRedirectWithPath(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("hello"))
@@ -101,13 +184,14 @@ func TestRedirectWithPath(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	cb, err := New(handler, triggerNetRatio, Clock(testutils.GetClock()), Fallback(fallbackRedirectPath))
+	cb, err := New(handler, triggerNetRatio, Clock(testutils.NewFakeClock()), Fallback(fallbackRedirectPath))
 	require.NoError(t, err)
+	defer cb.Close()
 
 	srv := httptest.NewServer(cb)
 	defer srv.Close()
 
-	cb.metrics = statsNetErrors(0.6)
+	setMetrics(cb, statsNetErrors(0.6))
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 
@@ -131,13 +215,14 @@ func TestRedirect(t *testing.T) {
 	fallbackRedirect, err := NewRedirectFallback(Redirect{URL: "http://localhost:5000"})
 	require.NoError(t, err)
 
-	cb, err := New(handler, triggerNetRatio, Clock(testutils.GetClock()), Fallback(fallbackRedirect))
+	cb, err := New(handler, triggerNetRatio, Clock(testutils.NewFakeClock()), Fallback(fallbackRedirect))
 	require.NoError(t, err)
+	defer cb.Close()
 
 	srv := httptest.NewServer(cb)
 	defer srv.Close()
 
-	cb.metrics = statsNetErrors(0.6)
+	setMetrics(cb, statsNetErrors(0.6))
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 
@@ -158,29 +243,31 @@ func TestTriggerDuringRecovery(t *testing.T) {
 		w.Write([]byte("hello"))
 	})
 
-	clock := testutils.GetClock()
+	// the state is only evaluated by the requests, the recovery lets some of them through
+	clock := requestsClock{testutils.NewFakeClock()}
 
 	cb, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(time.Microsecond))
 	require.NoError(t, err)
+	defer cb.Close()
 
 	srv := httptest.NewServer(cb)
 	defer srv.Close()
 
-	cb.metrics = statsNetErrors(0.6)
+	setMetrics(cb, statsNetErrors(0.6))
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
-	assert.Equal(t, cbState(stateTripped), cb.state)
+	assert.Equal(t, cbState(stateTripped), stateOf(cb))
 
 	// We should be in recovering state by now
-	clock.CurrentTime = clock.CurrentTime.Add(10*time.Second + time.Millisecond)
+	clock.Advance(10*time.Second + time.Millisecond)
 	re, _, err := testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
-	assert.Equal(t, cbState(stateRecovering), cb.state)
+	assert.Equal(t, cbState(stateRecovering), stateOf(cb))
 
 	// We have matched error condition during recovery state and are going back to tripped state
-	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
-	cb.metrics = statsNetErrors(0.6)
+	clock.Advance(5 * time.Second)
+	setMetrics(cb, statsNetErrors(0.6))
 	allowed := 0
 	for i := 0; i < 100; i++ {
 		re, _, err = testutils.Get(srv.URL)
@@ -189,7 +276,217 @@ func TestTriggerDuringRecovery(t *testing.T) {
 		}
 	}
 	assert.NotEqual(t, 0, allowed)
-	assert.Equal(t, cbState(stateTripped), cb.state)
+	assert.Equal(t, cbState(stateTripped), stateOf(cb))
+}
+
+func TestCheckPeriod(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	serve := func(cb *CircuitBreaker) {
+		cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	}
+
+	clock := testutils.NewFakeClock()
+
+	// the first response after construction is checked right away
+	cb, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(time.Minute))
+	require.NoError(t, err)
+	defer cb.Close()
+	setMetrics(cb, statsNetErrors(0.6))
+	serve(cb)
+	assert.Equal(t, cbState(stateTripped), stateOf(cb))
+
+	// then the condition is only checked once per period
+	cb, err = New(handler, triggerNetRatio, Clock(clock), CheckPeriod(time.Minute))
+	require.NoError(t, err)
+	defer cb.Close()
+	serve(cb)
+	setMetrics(cb, statsNetErrors(0.6))
+
+	clock.Advance(30 * time.Second)
+	serve(cb)
+	assert.Equal(t, cbState(stateStandby), stateOf(cb))
+
+	clock.Advance(30*time.Second + time.Millisecond)
+	serve(cb)
+	assert.Equal(t, cbState(stateTripped), stateOf(cb))
+
+	_, err = New(handler, triggerNetRatio, CheckPeriod(-time.Second))
+	assert.Error(t, err)
+}
+
+func TestMetricsWindow(t *testing.T) {
+	failing := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	serve := func(cb *CircuitBreaker) {
+		cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	}
+
+	// the same traffic goes through both breakers: successes, then a burst of errors a few seconds later
+	clock := testutils.NewFakeClock()
+	short, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(0), MetricsWindow(2, time.Second))
+	require.NoError(t, err)
+	defer short.Close()
+	long, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(0))
+	require.NoError(t, err)
+	defer long.Close()
+
+	for i := 0; i < 10; i++ {
+		serve(short)
+		serve(long)
+	}
+	clock.Advance(3 * time.Second)
+
+	failing = true
+	for i := 0; i < 6; i++ {
+		serve(short)
+		serve(long)
+	}
+
+	// the successes are out of the short window only, the errors dominate it
+	assert.Equal(t, cbState(stateTripped), stateOf(short))
+	assert.Equal(t, cbState(stateStandby), stateOf(long))
+	assert.Equal(t, 2*time.Second, short.metrics.CounterWindowSize())
+
+	// keyed breakers share the window
+	keyed, err := New(handler, triggerNetRatio, Clock(clock), MetricsWindow(5, 2*time.Second), KeyExtractor(func(req *http.Request) string {
+		return req.Host
+	}))
+	require.NoError(t, err)
+	defer keyed.Close()
+	serve(keyed)
+	cb, err := keyed.breakerFor("localhost")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, cb.metrics.CounterWindowSize())
+
+	for _, opt := range []CircuitBreakerOption{
+		MetricsWindow(0, time.Second),
+		MetricsWindow(10, time.Millisecond),
+		MetricsWindow(7200, time.Second),
+	} {
+		_, err = New(handler, triggerNetRatio, opt)
+		assert.Error(t, err)
+	}
+	_, err = New(handler, triggerNetRatio, MetricsWindow(2, time.Second), CheckPeriod(5*time.Second))
+	assert.Error(t, err)
+}
+
+func TestCheckPeriodTimer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	newTripped := func() (*CircuitBreaker, <-chan StateChange) {
+		cb, err := New(handler, triggerNetRatio, CheckPeriod(10*time.Millisecond),
+			FallbackDuration(50*time.Millisecond), RecoveryDuration(50*time.Millisecond))
+		require.NoError(t, err)
+		ch := cb.Subscribe()
+		setMetrics(cb, statsNetErrors(0.6))
+		cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+		assert.Equal(t, StateTripped, (<-ch).To)
+		return cb, ch
+	}
+
+	// the tripped circuit breaker recovers without requests
+	cb, ch := newTripped()
+	for _, state := range []State{StateRecovering, StateStandby} {
+		select {
+		case change := <-ch:
+			assert.Equal(t, state, change.To)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for state %v", state)
+		}
+	}
+	require.NoError(t, cb.Close())
+
+	// the timer is stopped on close
+	cb, ch = newTripped()
+	require.NoError(t, cb.Close())
+	select {
+	case change := <-ch:
+		t.Fatalf("unexpected state change %v", change)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRecoveringMaxConcurrent(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		entered <- struct{}{}
+		<-unblock
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.NewFakeClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), RecoveringMaxConcurrent(1))
+	require.NoError(t, err)
+	defer cb.Close()
+
+	cb.setRecovering()
+	clock.Advance(9 * time.Second)
+
+	// send requests until one of them is let through by the ratio controller
+	done := make(chan int)
+	go func() {
+		for {
+			rw := httptest.NewRecorder()
+			cb.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+			if rw.Code == http.StatusOK {
+				done <- rw.Code
+				return
+			}
+		}
+	}()
+	<-entered
+
+	// the probe is in flight, every other request goes to the fallback
+	for i := 0; i < 20; i++ {
+		rw := httptest.NewRecorder()
+		cb.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	}
+
+	close(unblock)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, 0, cb.probes)
+}
+
+func TestRecoveringMaxConcurrentReleaseOnPanic(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	})
+
+	clock := testutils.NewFakeClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), RecoveringMaxConcurrent(1))
+	require.NoError(t, err)
+	defer cb.Close()
+
+	cb.setRecovering()
+	clock.Advance(9 * time.Second)
+
+	panicked := 0
+	for i := 0; i < 10; i++ {
+		func() {
+			defer func() {
+				if recover() != nil {
+					panicked++
+				}
+			}()
+			cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+		}()
+	}
+
+	assert.True(t, panicked > 1)
+	assert.Equal(t, 0, cb.probes)
 }
 
 func TestSideEffects(t *testing.T) {
@@ -234,19 +531,20 @@ func TestSideEffects(t *testing.T) {
 		w.Write([]byte("hello"))
 	})
 
-	clock := testutils.GetClock()
+	clock := testutils.NewFakeClock()
 
 	cb, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(time.Microsecond), OnTripped(onTripped), OnStandby(onStandby))
 	require.NoError(t, err)
+	defer cb.Close()
 
 	srv := httptest.NewServer(cb)
 	defer srv.Close()
 
-	cb.metrics = statsNetErrors(0.6)
+	setMetrics(cb, statsNetErrors(0.6))
 
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
-	assert.Equal(t, cbState(stateTripped), cb.state)
+	assert.Equal(t, cbState(stateTripped), stateOf(cb))
 
 	select {
 	case req := <-srv1Chan:
@@ -259,17 +557,17 @@ func TestSideEffects(t *testing.T) {
 	}
 
 	// Transition to recovering state
-	clock.CurrentTime = clock.CurrentTime.Add(10*time.Second + time.Millisecond)
-	cb.metrics = statsOK()
+	clock.Advance(10*time.Second + time.Millisecond)
+	setMetrics(cb, statsOK())
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
-	assert.Equal(t, cbState(stateRecovering), cb.state)
+	assert.Equal(t, cbState(stateRecovering), stateOf(cb))
 
 	// Going back to standby
-	clock.CurrentTime = clock.CurrentTime.Add(10*time.Second + time.Millisecond)
+	clock.Advance(10*time.Second + time.Millisecond)
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
-	assert.Equal(t, cbState(stateStandby), cb.state)
+	assert.Equal(t, cbState(stateStandby), stateOf(cb))
 
 	select {
 	case req := <-srv2Chan:
@@ -281,6 +579,99 @@ func TestSideEffects(t *testing.T) {
 	}
 }
 
+type blockingSideEffect struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSideEffect) Exec() error {
+	s.started <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	onTripped := &blockingSideEffect{started: make(chan struct{}, 1), release: make(chan struct{})}
+	onStandby := &blockingSideEffect{started: make(chan struct{}, 1), release: make(chan struct{})}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.NewFakeClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(time.Microsecond), OnTripped(onTripped), OnStandby(onStandby))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	setMetrics(cb, statsNetErrors(0.6))
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), stateOf(cb))
+
+	select {
+	case <-onTripped.started:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for side effect to kick off")
+	}
+
+	// Close waits for the side effect in progress
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		assert.NoError(t, cb.Close())
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close did not wait for the side effect")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(onTripped.release)
+	<-closed
+
+	// the side effects of the next state changes are skipped
+	clock.Advance(10*time.Second + time.Millisecond)
+	setMetrics(cb, statsOK())
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	clock.Advance(10*time.Second + time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateStandby), stateOf(cb))
+
+	select {
+	case <-onStandby.started:
+		t.Error("unexpected side effect after Close")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// requestsClock is a clock whose ticks never fire, the state of the circuit breakers is only evaluated by the requests
+type requestsClock struct {
+	*testutils.FakeClock
+}
+
+func (requestsClock) After(time.Duration) <-chan time.Time {
+	return nil
+}
+
+// setMetrics replaces the metrics of the circuit breaker, they may be evaluated on the clock concurrently
+func setMetrics(cb *CircuitBreaker, m *memmetrics.RTMetrics) {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	cb.metrics = m
+}
+
+// stateOf returns the state of the circuit breaker, it may be changed on the clock concurrently
+func stateOf(cb *CircuitBreaker) cbState {
+	cb.m.RLock()
+	defer cb.m.RUnlock()
+	return cb.state
+}
+
 func statsOK() *memmetrics.RTMetrics {
 	m, err := memmetrics.NewRTMetrics()
 	if err != nil {
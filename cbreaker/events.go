@@ -0,0 +1,83 @@
+package cbreaker
+
+import (
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is the number of state changes buffered for each subscriber,
+// the changes a slow subscriber can't receive are dropped
+const subscriberBuffer = 16
+
+// Reasons of the state changes
+const (
+	ReasonConditionMatched = "condition matched"
+	ReasonFallbackElapsed  = "fallback duration elapsed"
+	ReasonRecoveryElapsed  = "recovery duration elapsed"
+)
+
+// StateChange is a transition of the circuit breaker state
+type StateChange struct {
+	From   State
+	To     State
+	Time   time.Time
+	Reason string
+	// Condition is the expression of the condition that matched on transitions to Tripped
+	Condition string
+	// Key is the key of the circuit breaker when a KeyExtractor is set
+	Key string
+}
+
+// Subscribe returns a channel receiving every state change, including the ones of the
+// circuit breakers of each key. Changes are dropped rather than blocking requests when the
+// channel is full, Unsubscribe must be called once the channel isn't read anymore.
+func (c *CircuitBreaker) Subscribe() <-chan StateChange {
+	return c.events.subscribe()
+}
+
+// Unsubscribe stops sending state changes to the channel returned by Subscribe and closes it
+func (c *CircuitBreaker) Unsubscribe(ch <-chan StateChange) {
+	c.events.unsubscribe(ch)
+}
+
+// stateEvents dispatches the state changes to the subscribers, it is shared by the circuit breakers of each key
+type stateEvents struct {
+	mutex       sync.Mutex
+	subscribers map[<-chan StateChange]chan StateChange
+}
+
+func newStateEvents() *stateEvents {
+	return &stateEvents{subscribers: make(map[<-chan StateChange]chan StateChange)}
+}
+
+func (e *stateEvents) subscribe() <-chan StateChange {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	ch := make(chan StateChange, subscriberBuffer)
+	e.subscribers[ch] = ch
+	return ch
+}
+
+func (e *stateEvents) unsubscribe(ch <-chan StateChange) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if sub, ok := e.subscribers[ch]; ok {
+		delete(e.subscribers, ch)
+		close(sub)
+	}
+}
+
+// publish sends the change to the subscribers without waiting for them
+func (e *stateEvents) publish(change StateChange) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, sub := range e.subscribers {
+		select {
+		case sub <- change:
+		default:
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestSubscribe(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.NewFakeClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock))
+	require.NoError(t, err)
+	defer cb.Close()
+
+	first, second := cb.Subscribe(), cb.Subscribe()
+
+	serve := func() {
+		cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	}
+
+	setMetrics(cb, statsNetErrors(0.6))
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	serve()
+	tripped := clock.UtcNow()
+
+	clock.Advance(defaultFallbackDuration + time.Millisecond)
+	serve()
+	recovering := clock.UtcNow()
+
+	clock.Advance(defaultRecoveryDuration + time.Millisecond)
+	serve()
+	standby := clock.UtcNow()
+
+	expected := []StateChange{
+		{From: StateStandby, To: StateTripped, Time: tripped, Reason: ReasonConditionMatched, Condition: triggerNetRatio},
+		{From: StateTripped, To: StateRecovering, Time: recovering, Reason: ReasonFallbackElapsed},
+		{From: StateRecovering, To: StateStandby, Time: standby, Reason: ReasonRecoveryElapsed},
+	}
+	for _, ch := range []<-chan StateChange{first, second} {
+		for _, change := range expected {
+			assert.Equal(t, change, <-ch)
+		}
+	}
+
+	cb.Unsubscribe(first)
+	_, ok := <-first
+	assert.False(t, ok)
+
+	// unsubscribing twice is a no-op
+	cb.Unsubscribe(first)
+	cb.Unsubscribe(second)
+}
+
+func TestSubscribeSlowConsumer(t *testing.T) {
+	cb, err := New(http.NotFoundHandler(), triggerNetRatio)
+	require.NoError(t, err)
+	defer cb.Close()
+
+	ch := cb.Subscribe()
+	defer cb.Unsubscribe(ch)
+
+	// the changes that don't fit in the buffer are dropped instead of blocking
+	for i := 0; i < subscriberBuffer*2; i++ {
+		cb.m.Lock()
+		cb.setState(stateTripped, time.Now(), ReasonConditionMatched)
+		cb.m.Unlock()
+	}
+	assert.Len(t, ch, subscriberBuffer)
+}
+
+func TestSubscribeKeys(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	clock := testutils.NewFakeClock()
+
+	cb, err := New(handler, `ResponseCodeRatio(500, 600, 0, 600) > 0.5`, Clock(clock), KeyExtractor(backendKey))
+	require.NoError(t, err)
+	defer cb.Close()
+
+	ch := cb.Subscribe()
+	defer cb.Unsubscribe(ch)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Header.Set("X-Backend", "bad")
+		cb.ServeHTTP(httptest.NewRecorder(), req)
+		clock.Advance(defaultCheckPeriod + time.Millisecond)
+	}
+
+	change := <-ch
+	assert.Equal(t, "bad", change.Key)
+	assert.Equal(t, StateTripped, change.To)
+}
@@ -2,9 +2,13 @@ package cbreaker
 
 import (
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/oxy/utils"
@@ -55,6 +59,64 @@ func (f *ResponseFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// StaticFallbackOption configures the handlers returned by StaticFallback and StaticFileFallback
+type StaticFallbackOption func(f *staticFallback)
+
+// RetryAfter sets the Retry-After header of the static responses, rounded up to the second
+func RetryAfter(d time.Duration) StaticFallbackOption {
+	return func(f *staticFallback) {
+		f.retryAfter = d
+	}
+}
+
+// staticFallback answers every request with the same response
+type staticFallback struct {
+	r          Response
+	retryAfter time.Duration
+}
+
+// StaticFallback returns a fallback handler answering every request with the same response, e.g. a maintenance
+// page, to be set with the Fallback option. The status code defaults to 503 when 0.
+func StaticFallback(statusCode int, contentType string, body []byte, opts ...StaticFallbackOption) http.Handler {
+	if statusCode == 0 {
+		statusCode = http.StatusServiceUnavailable
+	}
+	f := &staticFallback{r: Response{StatusCode: statusCode, ContentType: contentType, Body: body}}
+	for _, o := range opts {
+		o(f)
+	}
+	return f
+}
+
+// StaticFileFallback returns a fallback handler answering every request with a 503 and the content of the file,
+// e.g. a maintenance page. The file is read once, when the handler is created, and its content type is guessed
+// from its extension or content.
+func StaticFileFallback(path string, opts ...StaticFallbackOption) (http.Handler, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return StaticFallback(http.StatusServiceUnavailable, contentType, body, opts...), nil
+}
+
+func (f *staticFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if f.r.ContentType != "" {
+		w.Header().Set("Content-Type", f.r.ContentType)
+	}
+	if f.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64((f.retryAfter+time.Second-1)/time.Second), 10))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(f.r.Body)))
+	w.WriteHeader(f.r.StatusCode)
+	if _, err := w.Write(f.r.Body); err != nil {
+		log.Debugf("vulcand/oxy/fallback/static: failed to write response, err: %v", err)
+	}
+}
+
 // Redirect redirect model
 type Redirect struct {
 	URL          string
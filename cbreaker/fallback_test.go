@@ -0,0 +1,75 @@
+package cbreaker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestStaticFallback(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	fallback := StaticFallback(0, "text/plain", []byte("down for maintenance"), RetryAfter(1500*time.Millisecond))
+	clock := testutils.NewFakeClock()
+	cb, err := New(handler, triggerNetRatio, Clock(clock), Fallback(fallback))
+	require.NoError(t, err)
+	defer cb.Close()
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	setMetrics(cb, statsNetErrors(0.6))
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, "down for maintenance", string(body))
+	assert.Equal(t, "text/plain", re.Header.Get("Content-Type"))
+	assert.Equal(t, "2", re.Header.Get("Retry-After"))
+
+	w := httptest.NewRecorder()
+	StaticFallback(http.StatusTeapot, "", nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Empty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("Content-Length"))
+}
+
+func TestStaticFileFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fallback")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "maintenance.html")
+	require.NoError(t, ioutil.WriteFile(path, []byte("<html>maintenance</html>"), 0600))
+
+	fallback, err := StaticFileFallback(path, RetryAfter(time.Minute))
+	require.NoError(t, err)
+
+	// the file is read once
+	require.NoError(t, os.Remove(path))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		fallback.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "<html>maintenance</html>", w.Body.String())
+		assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	}
+
+	_, err = StaticFileFallback(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,96 @@
+package cbreaker
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// grpcStatusHeader carries the status of the gRPC calls, as a trailer or in the headers of trailers-only responses
+const grpcStatusHeader = "Grpc-Status"
+
+// grpcMetrics counts the gRPC responses and the ones failing on the backend side over the window of the metrics
+type grpcMetrics struct {
+	total  *memmetrics.RollingCounter
+	errors *memmetrics.RollingCounter
+}
+
+// newGrpcMetrics creates the gRPC counters with the same window as the metrics
+func (c *CircuitBreaker) newGrpcMetrics(mt *memmetrics.RTMetrics) (*grpcMetrics, error) {
+	buckets, resolution := c.metricsBuckets, c.metricsResolution
+	if buckets == 0 {
+		buckets, resolution = int(mt.CounterWindowSize()/time.Second), time.Second
+	}
+	total, err := memmetrics.NewCounter(buckets, resolution, memmetrics.CounterClock(c.clock))
+	if err != nil {
+		return nil, err
+	}
+	errors, err := memmetrics.NewCounter(buckets, resolution, memmetrics.CounterClock(c.clock))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcMetrics{total: total, errors: errors}, nil
+}
+
+// record counts the response when it has a gRPC status. The trailers are read from the header of the
+// response writer, where they are set once the body is written, announced or with the http.TrailerPrefix.
+func (g *grpcMetrics) record(h http.Header) {
+	status, ok := grpcStatus(h)
+	if !ok {
+		return
+	}
+	g.total.Inc(1)
+	if isGrpcServerError(status) {
+		g.errors.Inc(1)
+	}
+}
+
+// errorRatio returns the ratio of the gRPC responses failing on the backend side
+func (g *grpcMetrics) errorRatio() float64 {
+	total := g.total.Count()
+	if total == 0 {
+		return 0
+	}
+	return float64(g.errors.Count()) / float64(total)
+}
+
+func (g *grpcMetrics) reset() {
+	g.total.Reset()
+	g.errors.Reset()
+}
+
+func grpcStatus(h http.Header) (int, bool) {
+	value := h.Get(grpcStatusHeader)
+	if value == "" {
+		// the keys with the trailer prefix are not canonical, Get doesn't find them
+		for key, values := range h {
+			if len(values) > 0 && strings.EqualFold(key, http.TrailerPrefix+grpcStatusHeader) {
+				value = values[0]
+				break
+			}
+		}
+	}
+	if value == "" {
+		return 0, false
+	}
+	status, err := strconv.Atoi(value)
+	if err != nil {
+		// clients read invalid statuses as Unknown
+		return 2, true
+	}
+	return status, true
+}
+
+// isGrpcServerError tells whether the gRPC status code is a failure of the backend, the codes mapped to 5xx
+// status codes: Unknown, DeadlineExceeded, Unimplemented, Internal, Unavailable and DataLoss. The other codes,
+// e.g. NotFound or InvalidArgument, are answers to the request and don't count as errors.
+func isGrpcServerError(status int) bool {
+	switch status {
+	case 2, 4, 12, 13, 14, 15:
+		return true
+	}
+	return false
+}
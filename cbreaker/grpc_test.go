@@ -0,0 +1,80 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestGrpcErrorRatio(t *testing.T) {
+	// OK, Unavailable, NotFound, Internal, OK, Unknown, OK, OK, InvalidArgument, OK
+	statuses := []int{0, 14, 5, 13, 0, 2, 0, 0, 3, 0}
+	var calls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := strconv.Itoa(statuses[calls%len(statuses)])
+		w.Header().Set("Content-Type", "application/grpc")
+		switch calls % 3 {
+		case 0:
+			// trailers-only response
+			w.Header().Set("Grpc-Status", status)
+		case 1:
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Write([]byte("message"))
+			w.Header().Set("Grpc-Status", status)
+		default:
+			// unannounced trailers need a chunked response
+			w.Write([]byte("message"))
+			w.(http.Flusher).Flush()
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", status)
+		}
+		calls++
+	}))
+	defer backend.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	clock := testutils.NewFakeClock()
+	snapshots := make(chan Snapshot, 1)
+	cb, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		fwd.ServeHTTP(w, req)
+	}), "GrpcErrorRatio() > 0.25", Clock(clock), OnTrippedWithMetrics(func(s Snapshot) { snapshots <- s }))
+	require.NoError(t, err)
+	defer cb.Close()
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	for i := range statuses {
+		re, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, strconv.Itoa(statuses[i]), re.Header.Get("Grpc-Status")+re.Trailer.Get("Grpc-Status"))
+	}
+	assert.InDelta(t, 0.3, cb.grpc.errorRatio(), 0.001)
+
+	// the responses without a grpc status are not counted
+	cb.grpc.record(http.Header{})
+	assert.InDelta(t, 0.3, cb.grpc.errorRatio(), 0.001)
+
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), stateOf(cb))
+
+	select {
+	case s := <-snapshots:
+		assert.InDelta(t, 3.0/11.0, s.GrpcErrorRatio, 0.001)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the snapshot")
+	}
+	assert.Zero(t, cb.grpc.errorRatio())
+}
@@ -0,0 +1,137 @@
+package cbreaker
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const defaultMaxKeys = 1000
+
+// KeyExtractor makes the circuit breaker keep an independent state (metrics, trip status and recovery)
+// per key returned by extract, e.g. the backend a request is routed to.
+func KeyExtractor(extract func(*http.Request) string) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.keyExtractor = extract
+		return nil
+	}
+}
+
+// MaxKeys sets the number of keys tracked when a KeyExtractor is set, defaults to 1000.
+// The state of the least recently used key is dropped once the limit is reached.
+func MaxKeys(n int) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if n < 1 {
+			return fmt.Errorf("max keys should be >= 1, got %v", n)
+		}
+		c.maxKeys = n
+		return nil
+	}
+}
+
+// breakerFor returns the circuit breaker of the key, creating it if needed
+func (c *CircuitBreaker) breakerFor(key string) (*CircuitBreaker, error) {
+	return c.breakers.get(key, func() (*CircuitBreaker, error) {
+		return c.newKeyBreaker(key)
+	})
+}
+
+// newKeyBreaker creates a circuit breaker sharing the configuration of c with its own state
+func (c *CircuitBreaker) newKeyBreaker(key string) (*CircuitBreaker, error) {
+	mt, err := c.newMetrics()
+	if err != nil {
+		return nil, err
+	}
+	grpc, err := c.newGrpcMetrics(mt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CircuitBreaker{
+		m:                       &sync.RWMutex{},
+		metrics:                 mt,
+		grpc:                    grpc,
+		condition:               c.condition,
+		expression:              c.expression,
+		fallbackDuration:        c.fallbackDuration,
+		recoveryDuration:        c.recoveryDuration,
+		onTripped:               c.onTripped,
+		onStandby:               c.onStandby,
+		onTrippedWithMetrics:    c.onTrippedWithMetrics,
+		recoveringMaxConcurrent: c.recoveringMaxConcurrent,
+		checkPeriod:             c.checkPeriod,
+		metricsBuckets:          c.metricsBuckets,
+		metricsResolution:       c.metricsResolution,
+		fallback:                c.fallback,
+		next:                    c.next,
+		key:                     key,
+		events:                  c.events,
+		sideEffects:             c.sideEffects,
+		done:                    c.done,
+		stop:                    c.stop,
+		clock:                   c.clock,
+		log:                     c.log,
+	}, nil
+}
+
+// breakerCache keeps the circuit breakers of the most recently used keys
+type breakerCache struct {
+	mutex    sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+type breakerEntry struct {
+	key string
+	cb  *CircuitBreaker
+}
+
+func newBreakerCache(capacity int) *breakerCache {
+	return &breakerCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (b *breakerCache) get(key string, create func() (*CircuitBreaker, error)) (*CircuitBreaker, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if e, ok := b.items[key]; ok {
+		b.order.MoveToFront(e)
+		return e.Value.(*breakerEntry).cb, nil
+	}
+
+	cb, err := create()
+	if err != nil {
+		return nil, err
+	}
+	b.items[key] = b.order.PushFront(&breakerEntry{key: key, cb: cb})
+
+	if b.order.Len() > b.capacity {
+		oldest := b.order.Back()
+		b.order.Remove(oldest)
+		delete(b.items, oldest.Value.(*breakerEntry).key)
+		oldest.Value.(*breakerEntry).cb.stopWatch()
+	}
+	return cb, nil
+}
+
+func (b *breakerCache) each(fn func(*CircuitBreaker)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for e := b.order.Front(); e != nil; e = e.Next() {
+		fn(e.Value.(*breakerEntry).cb)
+	}
+}
+
+func (b *breakerCache) len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.order.Len()
+}
@@ -0,0 +1,132 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func backendKey(req *http.Request) string {
+	return req.Header.Get("X-Backend")
+}
+
+func TestKeyExtractor(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if backendKey(req) == "bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.NewFakeClock()
+
+	cb, err := New(handler, `ResponseCodeRatio(500, 600, 0, 600) > 0.5`, Clock(clock), KeyExtractor(backendKey))
+	require.NoError(t, err)
+	defer cb.Close()
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	for i := 0; i < 5; i++ {
+		_, _, err := testutils.Get(srv.URL, testutils.Header("X-Backend", "bad"))
+		require.NoError(t, err)
+
+		re, _, err := testutils.Get(srv.URL, testutils.Header("X-Backend", "good"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+
+		clock.Advance(defaultCheckPeriod + time.Millisecond)
+	}
+
+	// only the circuit of the failing backend is tripped
+	re, _, err := testutils.Get(srv.URL, testutils.Header("X-Backend", "bad"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	re, body, err := testutils.Get(srv.URL, testutils.Header("X-Backend", "good"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	// the global state is untouched
+	assert.Equal(t, cbState(stateStandby), stateOf(cb))
+
+	bad, err := cb.breakerFor("bad")
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), stateOf(bad))
+}
+
+func TestMaxKeys(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	cb, err := New(handler, triggerNetRatio, KeyExtractor(backendKey), MaxKeys(2))
+	require.NoError(t, err)
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Header.Set("X-Backend", key)
+		cb.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Equal(t, 2, cb.breakers.len())
+
+	// b is the least recently used key
+	_, ok := cb.breakers.items["b"]
+	assert.False(t, ok)
+	_, ok = cb.breakers.items["a"]
+	assert.True(t, ok)
+
+	_, err = New(handler, triggerNetRatio, MaxKeys(0))
+	assert.Error(t, err)
+}
+
+func TestMaxKeysEvictionStopsWatch(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.NewFakeClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), KeyExtractor(backendKey), MaxKeys(1))
+	require.NoError(t, err)
+	defer cb.Close()
+	ch := cb.Subscribe()
+
+	serve := func(key string) {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Header.Set("X-Backend", key)
+		cb.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	a, err := cb.breakerFor("a")
+	require.NoError(t, err)
+	setMetrics(a, statsNetErrors(0.6))
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	serve("a")
+	assert.Equal(t, StateTripped, (<-ch).To)
+
+	// the tripped circuit breaker recovers on the clock without requests
+	clock.Advance(defaultFallbackDuration + time.Millisecond)
+	select {
+	case change := <-ch:
+		assert.Equal(t, StateRecovering, change.To)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the recovery")
+	}
+
+	// evicting the key stops the evaluation of its state
+	serve("b")
+	clock.Advance(defaultRecoveryDuration + time.Millisecond)
+	select {
+	case change := <-ch:
+		t.Fatalf("unexpected state change %v", change)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -26,6 +26,8 @@ func parseExpression(in string) (hpredicate, error) {
 			"LatencyAtQuantileMS": latencyAtQuantile,
 			"NetworkErrorRatio":   networkErrorRatio,
 			"ResponseCodeRatio":   responseCodeRatio,
+			"RequestCount":        requestCount,
+			"GrpcErrorRatio":      grpcErrorRatio,
 		},
 	})
 	if err != nil {
@@ -52,7 +54,11 @@ func latencyAtQuantile(quantile float64) toInt {
 			c.log.Errorf("Failed to get latency histogram, for %v error: %v", c, err)
 			return 0
 		}
-		return int(h.LatencyAtQuantile(quantile) / time.Millisecond)
+		value := int(h.LatencyAtQuantile(quantile) / time.Millisecond)
+		if c.snapshot != nil {
+			c.snapshot.LatencyAtQuantileMS[quantile] = value
+		}
+		return value
 	}
 }
 
@@ -64,7 +70,31 @@ func networkErrorRatio() toFloat64 {
 
 func responseCodeRatio(startA, endA, startB, endB int) toFloat64 {
 	return func(c *CircuitBreaker) float64 {
-		return c.metrics.ResponseCodeRatio(startA, endA, startB, endB)
+		value := c.metrics.ResponseCodeRatio(startA, endA, startB, endB)
+		if c.snapshot != nil {
+			c.snapshot.ResponseCodeRatios[CodeRatio{StartA: startA, EndA: endA, StartB: startB, EndB: endB}] = value
+		}
+		return value
+	}
+}
+
+// grpcErrorRatio returns the ratio of the gRPC responses with a grpc-status reporting a failure of the backend,
+// read from the trailers, over the gRPC responses
+func grpcErrorRatio() toFloat64 {
+	return func(c *CircuitBreaker) float64 {
+		value := c.grpc.errorRatio()
+		if c.snapshot != nil {
+			c.snapshot.GrpcErrorRatio = value
+		}
+		return value
+	}
+}
+
+// requestCount returns the number of requests recorded in the metrics window,
+// it can be used as a guard to avoid tripping on a handful of requests.
+func requestCount() toInt {
+	return func(c *CircuitBreaker) int {
+		return int(c.metrics.TotalCount())
 	}
 }
 
@@ -45,6 +45,21 @@ func TestTripped(t *testing.T) {
 			metrics:    statsResponseCodes(statusCode{Code: 200, Count: 5}, statusCode{Code: 500, Count: 4}),
 			expected:   false,
 		},
+		{
+			expression: "NetworkErrorRatio() > 0.5 && RequestCount() > 50",
+			metrics:    statsNetErrors(0.6),
+			expected:   true,
+		},
+		{
+			expression: "NetworkErrorRatio() > 0.5 && RequestCount() > 100",
+			metrics:    statsNetErrors(0.6),
+			expected:   false,
+		},
+		{
+			expression: "LatencyAtQuantileMS(50.0) > 50 && RequestCount() >= 100",
+			metrics:    statsLatencyAtQuantile(50, time.Millisecond*51),
+			expected:   false,
+		},
 		{
 			// quantile not defined
 			expression: "LatencyAtQuantileMS(40.0) > 50",
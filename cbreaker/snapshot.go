@@ -0,0 +1,46 @@
+package cbreaker
+
+import (
+	"time"
+)
+
+// Snapshot holds the metrics of the circuit breaker at the time it tripped
+type Snapshot struct {
+	Time              time.Time
+	TotalCount        int64
+	NetworkErrorRatio float64
+	// StatusCodes holds the number of responses per status code
+	StatusCodes map[int]int64
+	// ResponseCodeRatios holds the response code ratios evaluated by the condition
+	ResponseCodeRatios map[CodeRatio]float64
+	// GrpcErrorRatio is the gRPC error ratio when evaluated by the condition
+	GrpcErrorRatio float64
+	// LatencyAtQuantileMS holds the latencies in milliseconds evaluated by the condition, keyed by quantile
+	LatencyAtQuantileMS map[float64]int
+}
+
+// CodeRatio identifies a ResponseCodeRatio(startA, endA, startB, endB) of the condition
+type CodeRatio struct {
+	StartA, EndA, StartB, EndB int
+}
+
+// OnTrippedWithMetrics sets a callback to run when entering the Tripped state with
+// a snapshot of the metrics that made the condition match.
+func OnTrippedWithMetrics(fn func(Snapshot)) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.onTrippedWithMetrics = fn
+		return nil
+	}
+}
+
+// newSnapshot copies the current metrics, the values evaluated by the condition are added while it runs.
+func (c *CircuitBreaker) newSnapshot() *Snapshot {
+	return &Snapshot{
+		Time:                c.clock.UtcNow(),
+		TotalCount:          c.metrics.TotalCount(),
+		NetworkErrorRatio:   c.metrics.NetworkErrorRatio(),
+		StatusCodes:         c.metrics.StatusCodesCounts(),
+		ResponseCodeRatios:  make(map[CodeRatio]float64),
+		LatencyAtQuantileMS: make(map[float64]int),
+	}
+}
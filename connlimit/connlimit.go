@@ -2,6 +2,8 @@
 package connlimit
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
@@ -20,11 +22,17 @@ type ConnLimiter struct {
 	totalConnections int64
 	next             http.Handler
 
+	draining bool
+	// idle is closed once all the connections are released while draining
+	idle chan struct{}
+
 	errHandler utils.ErrorHandler
 	log        *log.Logger
 }
 
-// New creates a new ConnLimiter
+// New creates a new ConnLimiter, the connections are counted per token returned by extract and
+// each one consumes the amount returned along with the token, see utils.TokenExtractor.
+// Connections with a zero amount are not counted, they are only rejected while draining.
 func New(next http.Handler, extract utils.SourceExtractor, maxConnections int64, options ...ConnLimitOption) (*ConnLimiter, error) {
 	if extract == nil {
 		return nil, fmt.Errorf("Extract function can not be nil")
@@ -84,12 +92,54 @@ func (cl *ConnLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	cl.next.ServeHTTP(w, r)
 }
 
+// Drain stops accepting new connections, that are rejected with a 503, and blocks until
+// the active connections are released or the context is done.
+func (cl *ConnLimiter) Drain(ctx context.Context) error {
+	cl.mutex.Lock()
+	cl.draining = true
+	if cl.totalConnections == 0 {
+		cl.mutex.Unlock()
+		return nil
+	}
+	if cl.idle == nil {
+		cl.idle = make(chan struct{})
+	}
+	idle := cl.idle
+	cl.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ActiveConnections returns the number of active connections
+func (cl *ConnLimiter) ActiveConnections() int {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return int(cl.totalConnections)
+}
+
 func (cl *ConnLimiter) acquire(token string, amount int64) error {
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
 
+	if cl.draining {
+		return ErrDraining
+	}
+
+	if amount < 0 {
+		return fmt.Errorf("amount of connections should be >= 0, got %d", amount)
+	}
+	if amount == 0 {
+		return nil
+	}
+
+	// the amount is the cost of the connection
 	connections := cl.connections[token]
-	if connections >= cl.maxConnections {
+	if connections+amount > cl.maxConnections {
 		return &MaxConnError{max: cl.maxConnections}
 	}
 
@@ -99,6 +149,10 @@ func (cl *ConnLimiter) acquire(token string, amount int64) error {
 }
 
 func (cl *ConnLimiter) release(token string, amount int64) {
+	if amount == 0 {
+		return
+	}
+
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
 
@@ -109,8 +163,16 @@ func (cl *ConnLimiter) release(token string, amount int64) {
 	if cl.connections[token] == 0 {
 		delete(cl.connections, token)
 	}
+
+	if cl.idle != nil && cl.totalConnections == 0 {
+		close(cl.idle)
+		cl.idle = nil
+	}
 }
 
+// ErrDraining is returned for connections rejected while draining
+var ErrDraining = errors.New("connection limiter is draining")
+
 // MaxConnError maximum connections reached error
 type MaxConnError struct {
 	max int64
@@ -137,6 +199,11 @@ func (e *ConnErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if err == ErrDraining {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	utils.DefaultHandler.ServeHTTP(w, req, err)
 }
 
@@ -1,10 +1,12 @@
 package connlimit
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -99,6 +101,83 @@ func TestFaultyExtract(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
 }
 
+func TestDrain(t *testing.T) {
+	proceed := make(chan bool)
+	wait := make(chan bool)
+	finish := make(chan bool)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proceed <- true
+		<-wait
+		w.Write([]byte("hello"))
+	})
+
+	cl, err := New(handler, headerLimit, 10)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	go func() {
+		re, _, errGet := testutils.Get(srv.URL, testutils.Header("Limit", "a"))
+		require.NoError(t, errGet)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		finish <- true
+	}()
+
+	<-proceed
+	assert.Equal(t, 1, cl.ActiveConnections())
+
+	drained := make(chan error)
+	go func() {
+		drained <- cl.Drain(context.Background())
+	}()
+
+	// new connections are rejected once draining
+	assert.Eventually(t, func() bool {
+		re, _, errGet := testutils.Get(srv.URL, testutils.Header("Limit", "b"))
+		return errGet == nil && re.StatusCode == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+
+	select {
+	case <-drained:
+		t.Fatal("drain returned with an active connection")
+	default:
+	}
+
+	close(wait)
+	<-finish
+
+	require.NoError(t, <-drained)
+	assert.Equal(t, 0, cl.ActiveConnections())
+}
+
+func TestDrainTimeout(t *testing.T) {
+	wait := make(chan bool)
+	proceed := make(chan bool)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proceed <- true
+		<-wait
+	})
+
+	cl, err := New(handler, headerLimit, 10)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	go testutils.Get(srv.URL, testutils.Header("Limit", "a"))
+	<-proceed
+	defer close(wait)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, cl.Drain(ctx))
+	assert.Equal(t, 1, cl.ActiveConnections())
+}
+
 func headerLimiter(req *http.Request) (string, int64, error) {
 	return req.Header.Get("Limit"), 1, nil
 }
@@ -109,3 +188,133 @@ func faultyExtractor(_ *http.Request) (string, int64, error) {
 
 var headerLimit = utils.ExtractorFunc(headerLimiter)
 var faultyExtract = utils.ExtractorFunc(faultyExtractor)
+
+// Clients behind the same proxy are limited separately when the X-Forwarded-For header is trusted
+func TestForwardedForLimit(t *testing.T) {
+	wait := make(chan bool)
+	proceed := make(chan bool)
+	finish := make(chan bool)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Wait") != "" {
+			proceed <- true
+			<-wait
+		}
+		w.Write([]byte("hello"))
+	})
+
+	extractor, err := utils.NewForwardedForExtractor(0)
+	require.NoError(t, err)
+
+	cl, err := New(handler, extractor, 1)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	go func() {
+		re, _, errGet := testutils.Get(srv.URL, testutils.Header("X-Forwarded-For", "1.1.1.1"), testutils.Header("Wait", "yes"))
+		require.NoError(t, errGet)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		finish <- true
+	}()
+
+	<-proceed
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("X-Forwarded-For", "6.6.6.6, 1.1.1.1"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("X-Forwarded-For", "2.2.2.2"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	close(wait)
+	<-finish
+}
+
+func TestTokenExtractorAmount(t *testing.T) {
+	wait := make(chan bool)
+	proceed := make(chan bool)
+	finish := make(chan bool)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Wait") != "" {
+			proceed <- true
+			<-wait
+		}
+		w.Write([]byte("hello"))
+	})
+
+	extractor := utils.NewHeaderTokenExtractor("X-Tenant", "default")
+	extractor.Amount = func(req *http.Request, token string) int64 {
+		if req.Method == http.MethodPost {
+			return 2
+		}
+		return 1
+	}
+
+	cl, err := New(handler, extractor, 2)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	go func() {
+		re, _, errGet := testutils.Get(srv.URL, testutils.Header("X-Tenant", "a"), testutils.Header("Wait", "yes"))
+		require.NoError(t, errGet)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		finish <- true
+	}()
+
+	<-proceed
+	assert.Equal(t, 1, cl.ActiveConnections())
+
+	// the connection costs more than the amount left
+	re, _, err := testutils.Post(srv.URL, testutils.Header("X-Tenant", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("X-Tenant", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// requests without a tenant share the default bucket
+	re, _, err = testutils.Post(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	close(wait)
+	<-finish
+	assert.Equal(t, 0, cl.ActiveConnections())
+}
+
+func TestTokenExtractorZeroAmount(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	extractor := utils.NewHeaderTokenExtractor("X-Tenant", "default")
+	extractor.Amount = func(req *http.Request, token string) int64 {
+		if req.Method == http.MethodPost {
+			return -1
+		}
+		return 0
+	}
+
+	cl, err := New(handler, extractor, 0)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	// free requests are not counted against the limit
+	re, _, err := testutils.Get(srv.URL, testutils.Header("X-Tenant", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, 0, cl.ActiveConnections())
+
+	re, _, err = testutils.Post(srv.URL, testutils.Header("X-Tenant", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+}
@@ -0,0 +1,94 @@
+package forward
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrResponseBodyTooLarge is reported when an upstream response body exceeds MaxResponseBodyBytes
+var ErrResponseBodyTooLarge = errors.New("response body too large")
+
+// limitResponseBody enforces the response body limit. Buffered responses are read
+// before anything is sent to the client, streamed responses are aborted once the limit is exceeded.
+func (f *httpForwarder) limitResponseBody(resp *http.Response) error {
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+
+	if resp.ContentLength > f.maxResponseBodyBytes {
+		resp.Body.Close()
+		f.responseBodyOverflow(resp.Request)
+		return ErrResponseBodyTooLarge
+	}
+
+	// flushInterval is only 0 when responses are not streamed
+	if f.flushInterval != 0 {
+		resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: f.maxResponseBodyBytes, onOverflow: func() {
+			f.responseBodyOverflow(resp.Request)
+		}}
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.maxResponseBodyBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	if int64(len(body)) > f.maxResponseBodyBytes {
+		resp.Body.Close()
+		f.responseBodyOverflow(resp.Request)
+		return ErrResponseBodyTooLarge
+	}
+
+	resp.Body = &struct {
+		io.Reader
+		io.Closer
+	}{Reader: bytes.NewReader(body), Closer: resp.Body}
+	return nil
+}
+
+func (f *httpForwarder) responseBodyOverflow(req *http.Request) {
+	f.logEvent(log.WarnLevel, "response body too large",
+		[]interface{}{"upstream", req.URL.Host, "url", req.URL.String(), "limit", f.maxResponseBodyBytes},
+		"vulcand/oxy/forward/http: response body of %v exceeds %d bytes", req.URL, f.maxResponseBodyBytes)
+	if f.responseBodyOverflowHook != nil {
+		f.responseBodyOverflowHook(req)
+	}
+}
+
+// limitedBody fails with ErrResponseBodyTooLarge once more than remaining bytes have been read
+type limitedBody struct {
+	io.ReadCloser
+	remaining  int64
+	onOverflow func()
+	overflowed bool
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.overflowed {
+		return 0, ErrResponseBodyTooLarge
+	}
+
+	if l.remaining <= 0 {
+		// The limit is reached, the body is only valid if it ends here
+		n, err := l.ReadCloser.Read(make([]byte, 1))
+		if n == 0 && err != nil {
+			return 0, err
+		}
+		l.overflowed = true
+		l.onOverflow()
+		return 0, ErrResponseBodyTooLarge
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
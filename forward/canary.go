@@ -0,0 +1,94 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+)
+
+// canaryBuckets is the resolution of the split, a hundredth of a percent
+const canaryBuckets = 10000
+
+// canarySplit sends a share of the requests to a canary upstream instead of the stable one
+type canarySplit struct {
+	canary  *url.URL
+	stable  *url.URL
+	percent float64
+	header  string
+	random  func() float64
+}
+
+// CanarySplit forwards percent of the requests to the canary upstream and the rest to the stable one,
+// replacing the scheme and host of the request URL. Requests are split at random unless CanaryStickyHeader is set.
+// CanaryFromContext tells which side served a request, e.g. from a ResponseModifier.
+func CanarySplit(canary, stable *url.URL, percent float64) optSetter {
+	return func(f *Forwarder) error {
+		if canary == nil || stable == nil {
+			return errors.New("canary and stable upstreams can not be nil")
+		}
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("canary percent should be in [0, 100], got %v", percent)
+		}
+		if f.canary == nil {
+			f.canary = &canarySplit{random: rand.Float64}
+		}
+		f.canary.canary = canary
+		f.canary.stable = stable
+		f.canary.percent = percent
+		return nil
+	}
+}
+
+// CanaryStickyHeader makes the canary split sticky: the side is chosen from a hash of the value of the header,
+// so that a client sending the same value always hits the same side. Requests without the header are split at random.
+func CanaryStickyHeader(header string) optSetter {
+	return func(f *Forwarder) error {
+		if header == "" {
+			return errors.New("canary sticky header can not be empty")
+		}
+		if f.canary == nil {
+			f.canary = &canarySplit{random: rand.Float64}
+		}
+		f.canary.header = http.CanonicalHeaderKey(header)
+		return nil
+	}
+}
+
+// CanaryFromContext returns whether the request was forwarded to the canary upstream,
+// ok is false when no canary split applied to the request
+func CanaryFromContext(ctx context.Context) (canary bool, ok bool) {
+	canary, ok = ctx.Value(canaryKey).(bool)
+	return canary, ok
+}
+
+// route points the request to the side of the split it falls on and records the side in its context
+func (c *canarySplit) route(req *http.Request) *http.Request {
+	toCanary := c.isCanary(req)
+	target := c.stable
+	if toCanary {
+		target = c.canary
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), canaryKey, toCanary))
+	u := *req.URL
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	req.URL = &u
+	return req
+}
+
+func (c *canarySplit) isCanary(req *http.Request) bool {
+	threshold := int(c.percent * canaryBuckets / 100)
+	if c.header != "" {
+		if value := req.Header.Get(c.header); value != "" {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(value))
+			return int(h.Sum32()%canaryBuckets) < threshold
+		}
+	}
+	return int(c.random()*canaryBuckets) < threshold
+}
@@ -0,0 +1,194 @@
+package forward
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultCoalesceMaxBodyBytes is the default size of the largest response body shared by coalesced requests
+const defaultCoalesceMaxBodyBytes = 1024 * 1024
+
+// coalescer collapses the concurrent requests with the same key into a single upstream request
+type coalescer struct {
+	group        singleflight.Group
+	keyFn        func(*http.Request) string
+	methods      map[string]bool
+	maxBodyBytes int64
+}
+
+// CoalesceRequests forwards a single request to the upstream for the concurrent requests with the same key,
+// and sends its response to all of them, e.g. to protect an expensive upstream from cache miss stampedes.
+// keyFn returns the key of a request, the requests with an empty key are forwarded as is; if keyFn is nil
+// the requests are keyed by method, host and URI. Only GET and HEAD requests are coalesced, see CoalesceMethods,
+// and the requests with a Cookie or an Authorization header are never coalesced as their responses are private.
+// The shared responses are buffered in memory up to CoalesceMaxBodyBytes: the larger responses are passed
+// to the first request only and the other requests are forwarded on their own. They are aborted for all
+// the requests if the first one is canceled or if the upstream aborts the response.
+func CoalesceRequests(keyFn func(*http.Request) string) optSetter {
+	return func(f *Forwarder) error {
+		if keyFn == nil {
+			keyFn = defaultCoalesceKey
+		}
+		c := f.httpForwarder.coalescer
+		if c == nil {
+			c = &coalescer{}
+			f.httpForwarder.coalescer = c
+		}
+		if c.methods == nil {
+			c.methods = map[string]bool{http.MethodGet: true, http.MethodHead: true}
+		}
+		if c.maxBodyBytes == 0 {
+			c.maxBodyBytes = defaultCoalesceMaxBodyBytes
+		}
+		c.keyFn = keyFn
+		return nil
+	}
+}
+
+// CoalesceMaxBodyBytes sets the size of the largest response body shared by the requests coalesced by
+// CoalesceRequests, defaults to 1MB.
+func CoalesceMaxBodyBytes(n int64) optSetter {
+	return func(f *Forwarder) error {
+		if n <= 0 {
+			return fmt.Errorf("coalesce max body bytes should be > 0, got %v", n)
+		}
+		if f.httpForwarder.coalescer == nil {
+			f.httpForwarder.coalescer = &coalescer{}
+		}
+		f.httpForwarder.coalescer.maxBodyBytes = n
+		return nil
+	}
+}
+
+// CoalesceMethods sets the methods of the requests coalesced by CoalesceRequests, defaults to GET and HEAD.
+func CoalesceMethods(methods ...string) optSetter {
+	return func(f *Forwarder) error {
+		if f.httpForwarder.coalescer == nil {
+			f.httpForwarder.coalescer = &coalescer{}
+		}
+		f.httpForwarder.coalescer.methods = make(map[string]bool)
+		for _, m := range methods {
+			f.httpForwarder.coalescer.methods[m] = true
+		}
+		return nil
+	}
+}
+
+func defaultCoalesceKey(req *http.Request) string {
+	return req.Method + " " + req.Host + " " + req.URL.RequestURI()
+}
+
+// key returns the key of the request if it can be coalesced
+func (c *coalescer) key(req *http.Request) (string, bool) {
+	if !c.methods[req.Method] || req.Header.Get("Cookie") != "" || req.Header.Get("Authorization") != "" {
+		return "", false
+	}
+	key := c.keyFn(req)
+	return key, key != ""
+}
+
+// serveCoalesced forwards the request unless a request with the same key is already in flight,
+// the response of the upstream is buffered and sent to all the requests waiting for it.
+func (f *httpForwarder) serveCoalesced(w http.ResponseWriter, req *http.Request, ctx *handlerContext, key string) {
+	leader := false
+	v, err, shared := f.coalescer.group.Do(key, func() (v interface{}, err error) {
+		leader = true
+		rec := &responseRecorder{w: w, header: make(http.Header), code: http.StatusOK, maxBodyBytes: f.coalescer.maxBodyBytes}
+		// the singleflight group doesn't recover the panics, e.g. http.ErrAbortHandler raised when the upstream
+		// aborts the response, the key would never be released
+		defer func() {
+			if p := recover(); p != nil {
+				err = &coalescedPanic{value: p}
+			}
+		}()
+		f.forwardHTTP(rec, req, ctx)
+		return rec, nil
+	})
+	if shared {
+		f.logEvent(log.DebugLevel, "coalesced request", []interface{}{"url", req.URL.String()},
+			"vulcand/oxy/forward/http: coalesced request %v", req.URL)
+	}
+
+	if p, ok := err.(*coalescedPanic); ok {
+		if leader {
+			panic(p.value)
+		}
+		// the shared response is incomplete, the connections of the other requests are aborted too
+		panic(http.ErrAbortHandler)
+	}
+
+	rec := v.(*responseRecorder)
+	if rec.passthrough {
+		if !leader {
+			// the response was too large to be shared
+			f.forwardHTTP(w, req, ctx)
+		}
+		return
+	}
+	utils.CopyHeaders(w.Header(), rec.header)
+	w.WriteHeader(rec.code)
+	w.Write(rec.body.Bytes())
+}
+
+// coalescedPanic reports the panic of the request forwarded for the coalesced requests
+type coalescedPanic struct {
+	value interface{}
+}
+
+func (p *coalescedPanic) Error() string {
+	return fmt.Sprintf("coalesced request panicked: %v", p.value)
+}
+
+// responseRecorder keeps the response in memory, once larger than maxBodyBytes it is passed to w instead
+type responseRecorder struct {
+	w            http.ResponseWriter
+	header       http.Header
+	code         int
+	wroteHeader  bool
+	body         bytes.Buffer
+	maxBodyBytes int64
+	passthrough  bool
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.code = code
+	r.wroteHeader = true
+}
+
+func (r *responseRecorder) Write(buf []byte) (int, error) {
+	r.wroteHeader = true
+	if r.passthrough {
+		return r.w.Write(buf)
+	}
+	if int64(r.body.Len()+len(buf)) <= r.maxBodyBytes {
+		return r.body.Write(buf)
+	}
+
+	r.passthrough = true
+	utils.CopyHeaders(r.w.Header(), r.header)
+	r.w.WriteHeader(r.code)
+	if _, err := r.w.Write(r.body.Bytes()); err != nil {
+		return 0, err
+	}
+	r.body.Reset()
+	return r.w.Write(buf)
+}
+
+// Flush flushes the response passed to w
+func (r *responseRecorder) Flush() {
+	if fl, ok := r.w.(http.Flusher); r.passthrough && ok {
+		fl.Flush()
+	}
+}
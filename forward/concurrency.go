@@ -0,0 +1,69 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxConcurrentRequests limits the number of requests, websocket connections included, forwarded at the same time.
+// Requests over the limit are rejected with a 503, or wait for MaxConcurrentRequestsWait if it is set.
+func MaxConcurrentRequests(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n < 1 {
+			return fmt.Errorf("max concurrent requests should be >= 1, got %v", n)
+		}
+		f.maxConcurrentRequests = n
+		return nil
+	}
+}
+
+// MaxConcurrentRequestsWait sets how long requests over MaxConcurrentRequests wait for a slot before being
+// rejected with a 503, they are rejected immediately by default.
+func MaxConcurrentRequestsWait(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("max concurrent requests wait should be >= 0, got %v", d)
+		}
+		f.concurrencyWait = d
+		return nil
+	}
+}
+
+// InFlight returns the number of requests being forwarded, it is only tracked when MaxConcurrentRequests is set
+func (f *Forwarder) InFlight() int {
+	return int(atomic.LoadInt32(&f.inFlight))
+}
+
+// acquireSlot waits for a slot to forward the request, it must be released with releaseSlot when it succeeds
+func (f *Forwarder) acquireSlot(ctx context.Context) bool {
+	if !f.concurrency.TryAcquire(1) {
+		if f.concurrencyWait == 0 {
+			return false
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, f.concurrencyWait)
+		defer cancel()
+		if err := f.concurrency.Acquire(ctx, 1); err != nil {
+			return false
+		}
+	}
+	atomic.AddInt32(&f.inFlight, 1)
+	return true
+}
+
+func (f *Forwarder) releaseSlot() {
+	atomic.AddInt32(&f.inFlight, -1)
+	f.concurrency.Release(1)
+}
+
+func (f *Forwarder) rejectOverLimit(w http.ResponseWriter, req *http.Request) {
+	f.logEvent(log.WarnLevel, "too many concurrent requests", []interface{}{"url", req.URL.String(), "limit", f.maxConcurrentRequests},
+		"vulcand/oxy/forward: rejecting %v, %d requests in flight", req.URL, f.maxConcurrentRequests)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+}
@@ -0,0 +1,173 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// connectDialTimeout bounds the time to open the tunnel to the requested host
+const connectDialTimeout = 30 * time.Second
+
+// ConnectTunnelEvent describes a closed CONNECT tunnel
+type ConnectTunnelEvent struct {
+	// Request is the CONNECT request received from the client
+	Request *http.Request
+	Opened  time.Time
+	Closed  time.Time
+	// BytesToUpstream and BytesToClient count the bytes copied in each direction
+	BytesToUpstream int64
+	BytesToClient   int64
+	// Err is the error that ended the tunnel, nil when both sides closed it
+	Err error
+}
+
+// AllowConnect makes the forwarder handle CONNECT requests as a forward proxy would: the client connection is
+// hijacked and tunneled to the requested host:port once authorize accepts it, other hosts get a 403.
+// The forwarder passes CONNECT requests to the upstream like any other request by default.
+func AllowConnect(authorize func(host string) bool) optSetter {
+	return func(f *Forwarder) error {
+		if authorize == nil {
+			return errors.New("connect authorize function can not be nil")
+		}
+		f.httpForwarder.connectAuthorize = authorize
+		return nil
+	}
+}
+
+// ConnectTunnelObserver sets a callback called once a CONNECT tunnel is closed.
+// The callback may be called concurrently from several tunnels.
+func ConnectTunnelObserver(fn func(ev ConnectTunnelEvent)) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.connectObserver = fn
+		return nil
+	}
+}
+
+// isConnectTunnel tells whether the request opens a tunnel handled by the forwarder
+func (f *httpForwarder) isConnectTunnel(req *http.Request) bool {
+	return f.connectAuthorize != nil && req.Method == http.MethodConnect
+}
+
+// serveConnect tunnels the client connection to the host of the CONNECT request
+func (f *httpForwarder) serveConnect(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
+	if f.debugEnabled() {
+		f.logEvent(log.DebugLevel, "connect tunnel begin", []interface{}{"upstream", req.Host},
+			"vulcand/oxy/forward/connect: begin ServeHttp on request to %v", req.Host)
+		defer f.logEvent(log.DebugLevel, "connect tunnel completed", []interface{}{"upstream", req.Host},
+			"vulcand/oxy/forward/connect: completed ServeHttp on request to %v", req.Host)
+	}
+
+	host := req.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !f.connectAuthorize(host) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		f.logEvent(log.ErrorLevel, "connect hijack unsupported", []interface{}{"upstream", req.Host},
+			"vulcand/oxy/forward/connect: the connection to the client can not be hijacked")
+		ctx.errHandler.ServeHTTP(w, req, errors.New("connect tunnels require a hijackable connection"))
+		return
+	}
+
+	dialer := &net.Dialer{Timeout: connectDialTimeout}
+	targetConn, err := dialer.DialContext(req.Context(), "tcp", host)
+	if err != nil {
+		f.logEvent(log.ErrorLevel, "connect dial failed", []interface{}{"upstream", host, "error", err},
+			"vulcand/oxy/forward/connect: Error dialing %q: %v", host, err)
+		ctx.errHandler.ServeHTTP(w, req, classifyError(err))
+		return
+	}
+	defer targetConn.Close()
+
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		f.logEvent(log.ErrorLevel, "connect hijack failed", []interface{}{"upstream", host, "error", err},
+			"vulcand/oxy/forward/connect: Failed to hijack responseWriter")
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer clientConn.Close()
+
+	opened := time.Now().UTC()
+	if _, err = io.WriteString(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		f.logEvent(log.ErrorLevel, "connect response failed", []interface{}{"upstream", host, "error", err},
+			"vulcand/oxy/forward/connect: Failed to write the response to %v: %v", host, err)
+		return
+	}
+
+	var toUpstream, toClient int64
+	var errUpstream, errClient error
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// the reader holds what the client sent after the request, e.g. the start of its TLS handshake
+		if toUpstream, errUpstream = f.tunnel(targetConn, brw.Reader); errUpstream != nil {
+			clientConn.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if toClient, errClient = f.tunnel(clientConn, targetConn); errClient != nil {
+			targetConn.Close()
+		}
+	}()
+	wg.Wait()
+
+	err = errUpstream
+	if err == nil {
+		err = errClient
+	}
+	if err != nil {
+		f.logEvent(log.DebugLevel, "connect tunnel failed", []interface{}{"upstream", host, "error", err},
+			"vulcand/oxy/forward/connect: Error in the tunnel to %v: %v", host, err)
+	}
+
+	if f.transferObserver != nil {
+		f.transferObserver(req, toUpstream, toClient)
+	}
+	if f.connectObserver != nil {
+		f.connectObserver(ConnectTunnelEvent{
+			Request:         req,
+			Opened:          opened,
+			Closed:          time.Now().UTC(),
+			BytesToUpstream: toUpstream,
+			BytesToClient:   toClient,
+			Err:             err,
+		})
+	}
+}
+
+// closeWriter is implemented by the TCP and TLS connections
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// tunnel copies src to dst, once src is done the write side of dst is closed so that the
+// other direction keeps flowing until its peer closes too, on errors the caller closes both sides
+func (f *httpForwarder) tunnel(dst net.Conn, src io.Reader) (int64, error) {
+	n, err := f.copyBuffer(dst, src)
+	if cw, ok := dst.(closeWriter); ok && err == nil {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
+		// the other direction failed and closed the connection
+		err = nil
+	}
+	return n, err
+}
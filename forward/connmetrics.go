@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ConnEventType is the type of an upstream connection event
+type ConnEventType int
+
+// Upstream connection event types
+const (
+	// ConnEventNew a new connection has been opened to the upstream
+	ConnEventNew ConnEventType = iota
+	// ConnEventReused an idle connection has been reused from the transport pool
+	ConnEventReused
+	// ConnEventClosed the connection has been closed, or could not be returned to the idle pool
+	// of a transport set with the RoundTripper option
+	ConnEventClosed
+)
+
+// String returns the name of the event type
+func (t ConnEventType) String() string {
+	switch t {
+	case ConnEventNew:
+		return "new-conn"
+	case ConnEventReused:
+		return "reused-conn"
+	case ConnEventClosed:
+		return "conn-closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnEvent describes what happened to the upstream connection used by a proxied request
+type ConnEvent struct {
+	Type ConnEventType
+	// Host is the upstream host (host:port) the connection is attached to
+	Host string
+	// IdleTime is how long a reused connection had been idle, if known
+	IdleTime time.Duration
+}
+
+// traceConnEvents attaches a httptrace.ClientTrace reporting connection events to the request context
+func (f *httpForwarder) traceConnEvents(req *http.Request) *http.Request {
+	host := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			event := ConnEvent{Type: ConnEventNew, Host: host}
+			if info.Reused {
+				event.Type = ConnEventReused
+				event.IdleTime = info.IdleTime
+			}
+			f.connMetrics(event)
+		},
+	}
+	if !f.connClosedReported {
+		trace.PutIdleConn = func(err error) {
+			if err != nil {
+				f.connMetrics(ConnEvent{Type: ConnEventClosed, Host: host})
+			}
+		}
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// connClosedDialer reports the closing of the connections opened by dial, whether the transport
+// drops them after a request or once idle
+func (f *httpForwarder) connClosedDialer(dial dialContextFunc) dialContextFunc {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	f.connClosedReported = true
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &connClosedReporter{Conn: conn, host: addr, report: f.connMetrics}, nil
+	}
+}
+
+// connClosedReporter reports a ConnEventClosed on the first Close of the connection
+type connClosedReporter struct {
+	net.Conn
+	host   string
+	report func(ConnEvent)
+	once   sync.Once
+}
+
+func (c *connClosedReporter) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.report(ConnEvent{Type: ConnEventClosed, Host: c.host})
+	})
+	return err
+}
@@ -0,0 +1,125 @@
+package forward
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DecompressResponse decodes gzip and deflate encoded response bodies before they are passed to the
+// ResponseModifier and sent to the client, the Content-Encoding and Content-Length headers are removed.
+// Bodies are decoded on the fly so streamed responses aren't buffered.
+// Brotli isn't supported: br is removed from the Accept-Encoding header sent upstream, responses encoded
+// with br or another unsupported coding, alone or stacked on gzip or deflate, are forwarded as is.
+func DecompressResponse(enabled bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.decompressResponse = enabled
+		return nil
+	}
+}
+
+// withoutBrotli removes br from the Accept-Encoding header of the request, so that the upstream picks
+// an encoding that can be decoded, identity is requested when no other encoding is left
+func withoutBrotli(h http.Header) {
+	values, ok := h["Accept-Encoding"]
+	if !ok {
+		return
+	}
+	var kept []string
+	for _, value := range values {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.TrimSpace(coding)
+			name := coding
+			if i := strings.Index(name, ";"); i >= 0 {
+				name = name[:i]
+			}
+			if coding == "" || strings.EqualFold(strings.TrimSpace(name), "br") {
+				continue
+			}
+			kept = append(kept, coding)
+		}
+	}
+	if len(kept) == 0 {
+		kept = []string{"identity"}
+	}
+	h.Set("Accept-Encoding", strings.Join(kept, ", "))
+}
+
+// decompressBody replaces the body of the response by its decoded content
+func (f *httpForwarder) decompressBody(resp *http.Response) error {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+
+	// stacked encodings are listed in the order they were applied, they are forwarded as is
+	// since the outer one might not be decodable
+	encoding := strings.ToLower(strings.TrimSpace(strings.Join(resp.Header[ContentEncoding], ",")))
+	switch encoding {
+	case "gzip", "x-gzip", "deflate":
+	case "", "identity":
+		return nil
+	default:
+		if f.debugEnabled() {
+			f.logEvent(log.DebugLevel, "response encoding not decompressed", []interface{}{"url", resp.Request.URL.String(), "encoding", encoding},
+				"vulcand/oxy/forward/http: response of %v is not decompressed, unsupported encoding %q", resp.Request.URL, encoding)
+		}
+		return nil
+	}
+
+	resp.Body = &decompressedBody{body: resp.Body, encoding: encoding}
+	resp.Header.Del(ContentEncoding)
+	resp.Header.Del(ContentLength)
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// decompressedBody decodes the body when it is first read, so that waiting for the
+// compression header doesn't delay the response headers
+type decompressedBody struct {
+	body     io.ReadCloser
+	encoding string
+	reader   io.ReadCloser
+	err      error
+}
+
+func (d *decompressedBody) Read(p []byte) (int, error) {
+	if d.reader == nil && d.err == nil {
+		d.reader, d.err = newDecompressor(d.body, d.encoding)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.reader.Read(p)
+}
+
+func (d *decompressedBody) Close() error {
+	if d.reader != nil {
+		d.reader.Close()
+	}
+	return d.body.Close()
+}
+
+func newDecompressor(r io.Reader, encoding string) (io.ReadCloser, error) {
+	if encoding != "deflate" {
+		return gzip.NewReader(r)
+	}
+
+	// deflate is meant to be zlib wrapped, but some servers send raw deflate data
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err == nil && isZlibHeader(header) {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+func isZlibHeader(h []byte) bool {
+	return h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0
+}
@@ -0,0 +1,80 @@
+package forward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Upstream failure modes reported to the ErrorHandler, check them with errors.Is
+var (
+	// ErrDNS the upstream host name could not be resolved
+	ErrDNS = errors.New("upstream DNS resolution failed")
+	// ErrConnRefused the upstream refused the connection
+	ErrConnRefused = errors.New("upstream connection refused")
+	// ErrTLSHandshake the TLS handshake with the upstream failed
+	ErrTLSHandshake = errors.New("upstream TLS handshake failed")
+	// ErrResponseHeaderTimeout the upstream did not send the response headers in time
+	ErrResponseHeaderTimeout = errors.New("upstream response header timeout")
+)
+
+// UpstreamError is the error passed to the ErrorHandler when the failure mode of a round trip is known.
+// It matches its Kind with errors.Is and unwraps to the error of the transport.
+type UpstreamError struct {
+	// Kind is one of ErrDNS, ErrConnRefused, ErrTLSHandshake or ErrResponseHeaderTimeout
+	Kind error
+	Err  error
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the transport
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// Is checks whether target is the kind of the error
+func (e *UpstreamError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// classifyError wraps the errors of the transport whose failure mode is known in an UpstreamError
+func classifyError(err error) error {
+	if kind := errorKind(err); kind != nil {
+		return &UpstreamError{Kind: kind, Err: err}
+	}
+	return err
+}
+
+func errorKind(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrConnRefused
+	}
+
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &certErr) {
+		return ErrTLSHandshake
+	}
+
+	msg := err.Error()
+	// the alerts of the upstream and the handshake timeout are not exported as types
+	if strings.Contains(msg, "tls: ") {
+		return ErrTLSHandshake
+	}
+	if strings.Contains(msg, "timeout awaiting response headers") {
+		return ErrResponseHeaderTimeout
+	}
+	return nil
+}
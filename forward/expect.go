@@ -0,0 +1,33 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// expectsContinue tells whether the client waits for a 100 Continue before sending the body of the request
+func expectsContinue(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody && strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+// expectContinueBody is the body of a request expecting a 100 Continue, it is only read once the upstream
+// asked for it. Closing the body of the server drains it, which would block on a client still waiting for the
+// 100 Continue when the upstream rejected the request, so an unread body is left to the server instead.
+type expectContinueBody struct {
+	io.ReadCloser
+	read int32
+}
+
+func (b *expectContinueBody) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&b.read, 1)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *expectContinueBody) Close() error {
+	if atomic.LoadInt32(&b.read) == 0 {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
@@ -18,11 +18,14 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/oxy/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/sync/semaphore"
 )
 
 // OxyLogger interface of the internal
@@ -49,7 +52,8 @@ type WsHook func(req *http.Request, messageType int, reader io.Reader) (io.Reade
 
 type optSetter func(f *Forwarder) error
 
-// PassHostHeader specifies if a client's Host header field should be delegated
+// PassHostHeader specifies if a client's Host header field should be delegated,
+// WithPassHostHeader overrides it per request
 func PassHostHeader(b bool) optSetter {
 	return func(f *Forwarder) error {
 		f.httpForwarder.passHost = b
@@ -57,8 +61,25 @@ func PassHostHeader(b bool) optSetter {
 	}
 }
 
+// WithPassHostHeader returns a context overriding the PassHostHeader option of the Forwarder for the
+// requests using it, e.g. to decide per route in a router in front of a single Forwarder.
+// The context value wins over the option when set.
+func WithPassHostHeader(ctx context.Context, pass bool) context.Context {
+	return context.WithValue(ctx, passHostKey, pass)
+}
+
+// passHostHeader tells whether the client's Host header is delegated for the request
+func (f *httpForwarder) passHostHeader(req *http.Request) bool {
+	if pass, ok := req.Context().Value(passHostKey).(bool); ok {
+		return pass
+	}
+	return f.passHost
+}
+
 // RoundTripper sets a new http.RoundTripper
-// Forwarder will use http.DefaultTransport as a default round tripper
+// Forwarder will use http.DefaultTransport as a default round tripper.
+// Requests with "Expect: 100-continue" only wait for the upstream before sending their body when
+// the transport has an ExpectContinueTimeout, as http.DefaultTransport does.
 func RoundTripper(r http.RoundTripper) optSetter {
 	return func(f *Forwarder) error {
 		f.httpForwarder.roundTripper = r
@@ -66,6 +87,66 @@ func RoundTripper(r http.RoundTripper) optSetter {
 	}
 }
 
+// DialContext sets the function opening the connections to the upstreams, e.g. to resolve their names with a
+// custom resolver, it is installed on a transport built from http.DefaultTransport so the other defaults are kept.
+// The upstream TLS options and the PROXY protocol apply on top of the connections it returns, h2c upstreams and
+// websockets are dialed with it too unless WebsocketNetDialContext is set. It is ignored when a RoundTripper is set.
+func DialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) optSetter {
+	return func(f *Forwarder) error {
+		if dial == nil {
+			return errors.New("dial context function can not be nil")
+		}
+		f.httpForwarder.dialContext = dial
+		return nil
+	}
+}
+
+// MaxIdleConns sets the MaxIdleConns of the transport built by the Forwarder, it is ignored when a RoundTripper is set
+func MaxIdleConns(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n < 0 {
+			return fmt.Errorf("max idle conns should be >= 0, got %v", n)
+		}
+		f.httpForwarder.keepAlive.maxIdleConns = &n
+		f.httpForwarder.keepAlive.set = true
+		return nil
+	}
+}
+
+// MaxIdleConnsPerHost sets the MaxIdleConnsPerHost of the transport built by the Forwarder,
+// it is ignored when a RoundTripper is set
+func MaxIdleConnsPerHost(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n < 0 {
+			return fmt.Errorf("max idle conns per host should be >= 0, got %v", n)
+		}
+		f.httpForwarder.keepAlive.maxIdleConnsPerHost = &n
+		f.httpForwarder.keepAlive.set = true
+		return nil
+	}
+}
+
+// IdleConnTimeout sets the IdleConnTimeout of the transport built by the Forwarder, it is ignored when a RoundTripper is set
+func IdleConnTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("idle conn timeout should be >= 0, got %v", d)
+		}
+		f.httpForwarder.keepAlive.idleConnTimeout = &d
+		f.httpForwarder.keepAlive.set = true
+		return nil
+	}
+}
+
+// DisableKeepAlives sets the DisableKeepAlives of the transport built by the Forwarder, it is ignored when a RoundTripper is set
+func DisableKeepAlives(disable bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.keepAlive.disable = disable
+		f.httpForwarder.keepAlive.set = true
+		return nil
+	}
+}
+
 // Rewriter defines a request rewriter for the HTTP forwarder
 func Rewriter(r ReqRewriter) optSetter {
 	return func(f *Forwarder) error {
@@ -102,6 +183,9 @@ func ErrorHandler(h utils.ErrorHandler) optSetter {
 }
 
 // BufferPool specifies a buffer pool for httputil.ReverseProxy.
+// The buffers are used to copy response bodies to the client, websocket messages, CONNECT tunnels
+// and mirrored responses, and are returned to the pool even when the copy is aborted,
+// request bodies are written by the round tripper.
 func BufferPool(pool httputil.BufferPool) optSetter {
 	return func(f *Forwarder) error {
 		f.bufferPool = pool
@@ -136,6 +220,16 @@ func Logger(l log.FieldLogger) optSetter {
 	}
 }
 
+// StructuredLogging routes the events of the proxy (round trips, proxy and websocket errors) through l
+// with fields such as the upstream host, the status and the duration, instead of the Logger.
+// Debug events are always passed to l, which is expected to filter them by level.
+func StructuredLogging(l StructuredLogger) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.structuredLog = l
+		return nil
+	}
+}
+
 // StateListener defines a state listener for the HTTP forwarder
 func StateListener(stateListener UrlForwardingStateListener) optSetter {
 	return func(f *Forwarder) error {
@@ -168,6 +262,62 @@ func WebsocketMessageSentHook(hook WsHook) optSetter {
 	}
 }
 
+// WebsocketMaxMessageSize sets the maximum size in bytes of a websocket message read from the client
+// or the backend, the connection is closed with a 1009 (message too big) close code once it is exceeded.
+func WebsocketMaxMessageSize(size int64) optSetter {
+	return func(f *Forwarder) error {
+		if size < 1 {
+			return fmt.Errorf("websocket max message size should be >= 1, got %v", size)
+		}
+		f.httpForwarder.websocketMaxMessageSize = size
+		return nil
+	}
+}
+
+// WebsocketCompression enables the permessage-deflate extension, it is negotiated with the backend
+// when offered by the client and with the client when accepted by the backend. It is stripped otherwise.
+func WebsocketCompression(enabled bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.websocketCompression = enabled
+		return nil
+	}
+}
+
+// WebsocketConnObserver sets a callback called once when a websocket connection is opened
+// and once when it is closed. The callback may be called concurrently from several connections.
+func WebsocketConnObserver(fn func(ev WSConnEvent)) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.websocketConnObserver = fn
+		return nil
+	}
+}
+
+// WebsocketHandshakeTimeout bounds the time to dial the upstream and complete the websocket handshake with it,
+// 45s by default. The client gets a 504 once it elapses and the upstream connection is closed,
+// the messages exchanged once the connection is upgraded are not subject to it.
+func WebsocketHandshakeTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d <= 0 {
+			return fmt.Errorf("websocket handshake timeout should be > 0, got %v", d)
+		}
+		f.websocketDialer.HandshakeTimeout = d
+		return nil
+	}
+}
+
+// WebsocketMaxHandshakeHeaderBytes limits the size of the headers of the websocket handshakes: client requests
+// exceeding it are rejected with a 431 before dialing the upstream, upstream responses with a 502.
+// They are reported to the ErrorHandler with a HeaderTooLargeError.
+func WebsocketMaxHandshakeHeaderBytes(limit int) optSetter {
+	return func(f *Forwarder) error {
+		if limit <= 0 {
+			return fmt.Errorf("websocket max handshake header bytes should be > 0, got %v", limit)
+		}
+		f.httpForwarder.websocketHandshakeHeaderBytes = limit
+		return nil
+	}
+}
+
 // ResponseModifier defines a response modifier for the HTTP forwarder
 func ResponseModifier(responseModifier func(*http.Response) error) optSetter {
 	return func(f *Forwarder) error {
@@ -184,7 +334,103 @@ func StreamingFlushInterval(flushInterval time.Duration) optSetter {
 	}
 }
 
-// ErrorHandlingRoundTripper a error handling round tripper
+// FlushInterval is a shorthand for Stream(true) and StreamingFlushInterval(flushInterval), a negative
+// value flushes after each write, e.g. for Server-Sent Events or long polling.
+// Flushing is skipped when the ResponseWriter doesn't implement http.Flusher.
+func FlushInterval(flushInterval time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if err := Stream(true)(f); err != nil {
+			return err
+		}
+		return StreamingFlushInterval(flushInterval)(f)
+	}
+}
+
+// PreserveHeaders specifies hop-by-hop header names that should be passed to the
+// upstream instead of being stripped. Names are matched case-insensitively.
+func PreserveHeaders(names []string) optSetter {
+	return func(f *Forwarder) error {
+		for _, name := range names {
+			f.httpForwarder.preserveHeaders = append(f.httpForwarder.preserveHeaders, http.CanonicalHeaderKey(name))
+		}
+		return nil
+	}
+}
+
+// EnableH2C enables cleartext HTTP/2 (h2c) forwarding for upstreams using the "h2c" URL scheme,
+// other upstreams keep being forwarded using the configured round tripper.
+func EnableH2C() optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.h2cTransport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}
+		return nil
+	}
+}
+
+// UnixSocketHost sets the host sent to upstreams using the "unix" URL scheme, e.g. unix:///var/run/app.sock,
+// defaults to localhost. It is used as the Host header unless PassHostHeader is set, and as the
+// X-Forwarded-Host header when the client request has no host.
+func UnixSocketHost(host string) optSetter {
+	return func(f *Forwarder) error {
+		if host == "" {
+			return errors.New("unix socket host can not be empty")
+		}
+		f.httpForwarder.unixSocketHost = host
+		return nil
+	}
+}
+
+// RequestTimeout sets a deadline on the context of every proxied HTTP request,
+// websocket connections are not affected. A deadline already carried by the incoming
+// request context is honored as well, whichever expires first wins.
+func RequestTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("request timeout should be >= 0, got %v", d)
+		}
+		f.httpForwarder.requestTimeout = d
+		return nil
+	}
+}
+
+// ConnMetrics sets a callback reporting whether upstream connections are opened, reused or closed.
+// The callback may be called concurrently from several requests, and from the transport when it closes
+// idle connections. A transport set with the RoundTripper option only reports the connections it could
+// not return to its idle pool as closed.
+func ConnMetrics(fn func(ConnEvent)) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.connMetrics = fn
+		return nil
+	}
+}
+
+// MaxResponseBodyBytes limits the size of upstream response bodies. Buffered responses exceeding
+// the limit are reported to the ErrorHandler with ErrResponseBodyTooLarge before anything is sent
+// to the client, streamed responses are aborted.
+func MaxResponseBodyBytes(limit int64) optSetter {
+	return func(f *Forwarder) error {
+		if limit < 0 {
+			return fmt.Errorf("max response body bytes should be >= 0, got %v", limit)
+		}
+		f.httpForwarder.maxResponseBodyBytes = limit
+		return nil
+	}
+}
+
+// ResponseBodyOverflowHook defines a hook called when a response body exceeds MaxResponseBodyBytes
+func ResponseBodyOverflowHook(hook func(req *http.Request)) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.responseBodyOverflowHook = hook
+		return nil
+	}
+}
+
+// ErrorHandlingRoundTripper a error handling round tripper, the errors with a known failure mode
+// are passed to the error handler as an UpstreamError
 type ErrorHandlingRoundTripper struct {
 	http.RoundTripper
 	errorHandler utils.ErrorHandler
@@ -196,7 +442,7 @@ func (rt ErrorHandlingRoundTripper) RoundTrip(req *http.Request) (*http.Response
 	if err != nil {
 		// We use the recorder from httptest because there isn't another `public` implementation of a recorder.
 		recorder := httptest.NewRecorder()
-		rt.errorHandler.ServeHTTP(recorder, req, err)
+		rt.errorHandler.ServeHTTP(recorder, req, classifyError(err))
 		res = recorder.Result()
 		err = nil
 	}
@@ -210,6 +456,13 @@ type Forwarder struct {
 	*handlerContext
 	stateListener UrlForwardingStateListener
 	stream        bool
+
+	maxConcurrentRequests int
+	concurrencyWait       time.Duration
+	concurrency           *semaphore.Weighted
+	inFlight              int32
+
+	canary *canarySplit
 }
 
 // handlerContext defines a handler context for error reporting and logging
@@ -226,19 +479,92 @@ type httpForwarder struct {
 	flushInterval  time.Duration
 	modifyResponse func(*http.Response) error
 
+	decompressResponse bool
+
+	allowServerPush bool
+
+	defaultUserAgent string
+	setUserAgent     bool
+
+	stripPrefix string
+	addPrefix   string
+
+	storeOriginalURL bool
+
+	requestIDHeader string
+
+	bodyInspector         func(req *http.Request, body []byte) error
+	bodyInspectorMaxBytes int64
+
+	preserveHeaders []string
+
+	h2cTransport *http2.Transport
+	dialContext  func(ctx context.Context, network, addr string) (net.Conn, error)
+	keepAlive    keepAliveOptions
+
+	unixSocketHost string
+
+	upstreamTLS   upstreamTLS
+	proxyProtocol int
+
+	mirror *mirror
+
+	// ownedTransport and unixTransport are the transports created by the Forwarder, closed by Close
+	ownedTransport *http.Transport
+	unixTransport  *unixRoundTripper
+
+	coalescer *coalescer
+
+	requestTimeout time.Duration
+
+	connMetrics        func(ConnEvent)
+	connClosedReported bool
+
+	maxResponseBodyBytes     int64
+	maxRequestHeaderBytes    int
+	maxResponseHeaderBytes   int
+	responseBodyOverflowHook func(req *http.Request)
+
 	tlsClientConfig *tls.Config
 
-	log OxyLogger
+	log           OxyLogger
+	structuredLog StructuredLogger
 
 	bufferPool                    httputil.BufferPool
 	websocketConnectionClosedHook func(req *http.Request, conn net.Conn)
 	websocketMessageReceivedHook  WsHook
 	websocketMessageSentHook      WsHook
 	websocketDialer               *websocket.Dialer
+	websocketMaxMessageSize       int64
+	websocketCompression          bool
+	websocketConnObserver         func(ev WSConnEvent)
+	// websocketHandshakeHeaderBytes limits the headers of the handshake request and response when > 0
+	websocketHandshakeHeaderBytes int
+	connectAuthorize              func(host string) bool
+	connectObserver               func(ev ConnectTunnelEvent)
+	transferObserver              func(req *http.Request, reqBytes, respBytes int64)
+	dropInformational             bool
+	upgradeHTTP10                 bool
 }
 
 const defaultFlushInterval = time.Duration(100) * time.Millisecond
 
+type contextKey int
+
+// Request context keys used to pass state between the director and the round trippers
+const (
+	preservedHeadersKey contextKey = iota
+	h2cUpstreamKey
+	unixSocketKey
+	serverNameKey
+	proxyProtocolKey
+	bodyTruncatedKey
+	originalURLKey
+	canaryKey
+	passHostKey
+	requestIDKey
+)
+
 // Connection states
 const (
 	StateConnected = iota
@@ -251,7 +577,10 @@ type UrlForwardingStateListener func(*url.URL, int)
 // New creates an instance of Forwarder based on the provided list of configuration options
 func New(setters ...optSetter) (*Forwarder, error) {
 	f := &Forwarder{
-		httpForwarder:  &httpForwarder{log: &internalLogger{Logger: log.StandardLogger()}},
+		httpForwarder: &httpForwarder{
+			log:                   &internalLogger{Logger: log.StandardLogger()},
+			bodyInspectorMaxBytes: defaultInspectorMaxBodyBytes,
+		},
 		handlerContext: &handlerContext{},
 	}
 
@@ -272,6 +601,12 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		f.flushInterval = defaultFlushInterval
 	}
 
+	if f.maxConcurrentRequests > 0 {
+		f.concurrency = semaphore.NewWeighted(int64(f.maxConcurrentRequests))
+	} else if f.concurrencyWait > 0 {
+		return nil, errors.New("max concurrent requests wait set without max concurrent requests")
+	}
+
 	if f.httpForwarder.rewriter == nil {
 		h, err := os.Hostname()
 		if err != nil {
@@ -280,8 +615,27 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		f.httpForwarder.rewriter = &HeaderRewriter{TrustForwardHeader: true, Hostname: h}
 	}
 
+	ownTransport := f.httpForwarder.upstreamTLS.isSet() || f.httpForwarder.proxyProtocol != 0 || f.httpForwarder.dialContext != nil ||
+		f.httpForwarder.keepAlive.set
 	if f.httpForwarder.roundTripper == nil {
-		f.httpForwarder.roundTripper = http.DefaultTransport
+		if ownTransport || f.httpForwarder.maxResponseHeaderBytes > 0 || f.httpForwarder.connMetrics != nil {
+			f.httpForwarder.roundTripper = f.httpForwarder.newTransport()
+		} else {
+			f.httpForwarder.roundTripper = http.DefaultTransport
+		}
+	} else if ownTransport {
+		f.log.Warn("vulcand/oxy/forward: the upstream TLS, PROXY protocol, dial context and keep-alive options are ignored when a RoundTripper is set")
+	}
+
+	if dial := f.httpForwarder.dialContext; dial != nil {
+		if f.httpForwarder.h2cTransport != nil {
+			f.httpForwarder.h2cTransport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, addr)
+			}
+		}
+		if f.websocketDialer.NetDialContext == nil {
+			f.websocketDialer.NetDialContext = dial
+		}
 	}
 
 	if f.errHandler == nil {
@@ -289,7 +643,11 @@ func New(setters ...optSetter) (*Forwarder, error) {
 	}
 
 	if f.tlsClientConfig == nil {
-		if ht, ok := f.httpForwarder.roundTripper.(*http.Transport); ok {
+		ht, ok := f.httpForwarder.roundTripper.(*http.Transport)
+		if rt, isServerName := f.httpForwarder.roundTripper.(*serverNameRoundTripper); isServerName {
+			ht, ok = rt.Transport, true
+		}
+		if ok {
 			f.tlsClientConfig = ht.TLSClientConfig
 			if f.websocketDialer.TLSClientConfig == nil && ht.TLSClientConfig != nil {
 				_ = WebsocketTLSClientConfig(ht.TLSClientConfig)(f)
@@ -297,6 +655,92 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		}
 	}
 
+	if f.httpForwarder.unixSocketHost == "" {
+		f.httpForwarder.unixSocketHost = defaultUnixSocketHost
+	}
+	f.httpForwarder.unixTransport = newUnixRoundTripper(f.httpForwarder.roundTripper)
+	f.httpForwarder.roundTripper = f.httpForwarder.unixTransport
+
+	if f.httpForwarder.h2cTransport != nil {
+		f.httpForwarder.roundTripper = &h2cRoundTripper{RoundTripper: f.httpForwarder.roundTripper, h2c: f.httpForwarder.h2cTransport}
+	}
+
+	f.httpForwarder.roundTripper = &informationalRoundTripper{
+		RoundTripper: f.httpForwarder.roundTripper,
+		dropAll:      f.httpForwarder.dropInformational,
+	}
+
+	if len(f.httpForwarder.preserveHeaders) > 0 {
+		f.httpForwarder.roundTripper = &preserveHeadersRoundTripper{RoundTripper: f.httpForwarder.roundTripper}
+	}
+
+	if f.httpForwarder.maxResponseBodyBytes > 0 {
+		modifyResponse := f.httpForwarder.modifyResponse
+		f.httpForwarder.modifyResponse = func(resp *http.Response) error {
+			if err := f.limitResponseBody(resp); err != nil {
+				return err
+			}
+			if modifyResponse != nil {
+				return modifyResponse(resp)
+			}
+			return nil
+		}
+	}
+
+	if f.httpForwarder.decompressResponse {
+		// decoding first also applies the response body limit to the decoded content
+		modifyResponse := f.httpForwarder.modifyResponse
+		f.httpForwarder.modifyResponse = func(resp *http.Response) error {
+			if err := f.decompressBody(resp); err != nil {
+				return err
+			}
+			if modifyResponse != nil {
+				return modifyResponse(resp)
+			}
+			return nil
+		}
+	}
+
+	if name := f.httpForwarder.requestIDHeader; name != "" {
+		// the ID is already set on the response, the upstream one would be added next to it
+		modifyResponse := f.httpForwarder.modifyResponse
+		f.httpForwarder.modifyResponse = func(resp *http.Response) error {
+			if modifyResponse != nil {
+				if err := modifyResponse(resp); err != nil {
+					return err
+				}
+			}
+			resp.Header.Del(name)
+			return nil
+		}
+	}
+
+	if m := f.httpForwarder.mirror; m != nil {
+		if m.target == nil {
+			return nil, errors.New("mirror max body bytes set without a mirror target")
+		}
+		m.inFlight = make(chan struct{}, mirrorMaxInFlight)
+		m.ctx, m.cancel = context.WithCancel(context.Background())
+		// the errors of the shadow upstream are not reported to the error handler
+		m.roundTripper = f.httpForwarder.roundTripper
+	}
+
+	if c := f.httpForwarder.coalescer; c != nil && c.keyFn == nil {
+		return nil, errors.New("coalesce options set without coalescing requests")
+	}
+
+	if f.canary != nil && f.canary.canary == nil {
+		return nil, errors.New("canary sticky header set without a canary split")
+	}
+
+	if f.httpForwarder.maxResponseHeaderBytes > 0 {
+		f.httpForwarder.roundTripper = &headerLimitRoundTripper{
+			RoundTripper: f.httpForwarder.roundTripper,
+			limit:        f.httpForwarder.maxResponseHeaderBytes,
+			f:            f.httpForwarder,
+		}
+	}
+
 	f.httpForwarder.roundTripper = ErrorHandlingRoundTripper{
 		RoundTripper: f.httpForwarder.roundTripper,
 		errorHandler: f.errHandler,
@@ -307,6 +751,83 @@ func New(setters ...optSetter) (*Forwarder, error) {
 	return f, nil
 }
 
+// newTransport creates the transport owned by the forwarder, configured with the upstream TLS and PROXY protocol options
+func (f *httpForwarder) newTransport() http.RoundTripper {
+	t := &http.Transport{}
+	if dt, ok := http.DefaultTransport.(*http.Transport); ok {
+		t = dt.Clone()
+	}
+
+	if f.dialContext != nil {
+		t.DialContext = f.dialContext
+	}
+	f.keepAlive.configure(t)
+	if f.maxResponseHeaderBytes > 0 {
+		t.MaxResponseHeaderBytes = int64(f.maxResponseHeaderBytes + responseHeaderSlack)
+	}
+	f.ownedTransport = t
+
+	if f.proxyProtocol != 0 {
+		// the header describes a single client connection, so upstream connections can't be shared
+		t.DisableKeepAlives = true
+		t.DialContext = proxyProtocolDialer(t.DialContext, f.proxyProtocol)
+	}
+	if f.connMetrics != nil {
+		t.DialContext = f.connClosedDialer(t.DialContext)
+	}
+
+	return f.upstreamTLS.configure(t)
+}
+
+// keepAliveOptions tunes the idle connections of the transport built by the Forwarder,
+// the fields left nil keep the values of http.DefaultTransport
+type keepAliveOptions struct {
+	set                 bool
+	maxIdleConns        *int
+	maxIdleConnsPerHost *int
+	idleConnTimeout     *time.Duration
+	disable             bool
+}
+
+func (k keepAliveOptions) configure(t *http.Transport) {
+	if k.maxIdleConns != nil {
+		t.MaxIdleConns = *k.maxIdleConns
+	}
+	if k.maxIdleConnsPerHost != nil {
+		t.MaxIdleConnsPerHost = *k.maxIdleConnsPerHost
+	}
+	if k.idleConnTimeout != nil {
+		t.IdleConnTimeout = *k.idleConnTimeout
+	}
+	if k.disable {
+		t.DisableKeepAlives = true
+	}
+}
+
+// Close cancels the mirrored requests in flight, waits for them to complete and closes the idle connections
+// of the transports created by the Forwarder, e.g. when the proxy pipeline is rebuilt on a configuration reload.
+// The requests being served are not interrupted: drain them first with http.Server.Shutdown.
+// A RoundTripper set with the RoundTripper option is left open, as is http.DefaultTransport.
+func (f *Forwarder) Close() error {
+	if m := f.httpForwarder.mirror; m != nil {
+		m.close()
+	}
+	if t := f.httpForwarder.ownedTransport; t != nil {
+		t.CloseIdleConnections()
+	}
+	if u := f.httpForwarder.unixTransport; u != nil {
+		u.closeIdleConnections()
+		// the transports per server name are owned by the forwarder too
+		if s, ok := u.RoundTripper.(*serverNameRoundTripper); ok {
+			s.CloseIdleConnections()
+		}
+	}
+	if t := f.httpForwarder.h2cTransport; t != nil {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
 // ServeHTTP decides which forwarder to use based on the specified
 // request and delegates to the proper implementation
 func (f *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -316,13 +837,45 @@ func (f *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		defer logEntry.Debug("vulcand/oxy/forward: completed ServeHttp on request")
 	}
 
+	if f.httpForwarder.requestIDHeader != "" {
+		req = f.httpForwarder.withRequestID(w, req)
+	}
+
+	if f.httpForwarder.maxRequestHeaderBytes > 0 && !f.httpForwarder.checkRequestHeader(w, req, f.handlerContext, f.httpForwarder.maxRequestHeaderBytes) {
+		return
+	}
+
+	if f.concurrency != nil {
+		if !f.acquireSlot(req.Context()) {
+			f.rejectOverLimit(w, req)
+			return
+		}
+		// released once websocket connections are closed too, as serveWebSocket returns when they are
+		defer f.releaseSlot()
+	}
+
+	if f.httpForwarder.storeOriginalURL {
+		req = f.httpForwarder.withOriginalURL(req)
+	}
+
+	if f.canary != nil {
+		req = f.canary.route(req)
+	}
+
 	if f.stateListener != nil {
 		f.stateListener(req.URL, StateConnected)
 		defer f.stateListener(req.URL, StateDisconnected)
 	}
-	if IsWebsocketRequest(req) {
+	if f.httpForwarder.isConnectTunnel(req) {
+		f.httpForwarder.serveConnect(w, req, f.handlerContext)
+	} else if IsWebsocketRequest(req) {
 		f.httpForwarder.serveWebSocket(w, req, f.handlerContext)
 	} else {
+		if f.httpForwarder.transferObserver != nil {
+			var done func()
+			w, req, done = f.httpForwarder.countTransfer(w, req)
+			defer done()
+		}
 		f.httpForwarder.serveHTTP(w, req, f.handlerContext)
 	}
 }
@@ -349,12 +902,29 @@ func (f *httpForwarder) modifyRequest(outReq *http.Request, target *url.URL) {
 	outReq.URL.Scheme = target.Scheme
 	outReq.URL.Host = target.Host
 
+	if f.h2cTransport != nil && target.Scheme == h2cScheme {
+		outReq.URL.Scheme = "http"
+		*outReq = *outReq.WithContext(context.WithValue(outReq.Context(), h2cUpstreamKey, true))
+	}
+
+	isUnix := target.Scheme == unixScheme
+	if isUnix {
+		outReq.URL.Scheme = "http"
+		outReq.URL.Host = f.unixSocketHost
+		*outReq = *outReq.WithContext(context.WithValue(outReq.Context(), unixSocketKey, target.Path))
+	}
+
 	u := f.getUrlFromRequest(outReq)
+	if isUnix && outReq.RequestURI == "" {
+		// the path of the target is the socket, not the path to request
+		u = &url.URL{Path: "/", RawQuery: u.RawQuery}
+	}
 
 	outReq.URL.Path = u.Path
 	outReq.URL.RawPath = u.RawPath
 	outReq.URL.RawQuery = u.RawQuery
 	outReq.RequestURI = "" // Outgoing request should not have RequestURI
+	f.rewritePath(outReq.URL)
 
 	outReq.Proto = "HTTP/1.1"
 	outReq.ProtoMajor = 1
@@ -363,11 +933,41 @@ func (f *httpForwarder) modifyRequest(outReq *http.Request, target *url.URL) {
 	if f.rewriter != nil {
 		f.rewriter.Rewrite(outReq)
 	}
+	f.withDefaultUserAgent(outReq)
+	if f.decompressResponse {
+		withoutBrotli(outReq.Header)
+	}
+
+	f.stashPreservedHeaders(outReq)
+	f.upstreamTLS.withServerName(outReq)
+	if f.proxyProtocol != 0 {
+		withProxyProtocolAddrs(outReq)
+	}
 
 	// Do not pass client Host header unless optsetter PassHostHeader is set.
-	if !f.passHost {
+	passHost := f.passHostHeader(outReq)
+	if !passHost {
 		outReq.Host = target.Host
 	}
+
+	if isUnix {
+		if !passHost || outReq.Host == "" {
+			outReq.Host = f.unixSocketHost
+		}
+		if outReq.Header.Get(XForwardedHost) == "" {
+			outReq.Header.Set(XForwardedHost, f.unixSocketHost)
+		}
+	}
+}
+
+// copyBuffer copies src to dst with a buffer of the pool when one is set
+func (f *httpForwarder) copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	if f.bufferPool == nil {
+		return io.Copy(dst, src)
+	}
+	buf := f.bufferPool.Get()
+	defer f.bufferPool.Put(buf)
+	return io.CopyBuffer(dst, src, buf)
 }
 
 // serveHTTP forwards websocket traffic
@@ -378,14 +978,24 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 		defer logEntry.Debug("vulcand/oxy/forward/websocket: completed ServeHttp on request")
 	}
 
+	limit := f.websocketHandshakeHeaderBytes
+	if limit > 0 && !f.checkRequestHeader(w, req, ctx, limit) {
+		return
+	}
+
 	outReq := f.copyWebSocketRequest(req)
 
-	targetConn, resp, err := f.websocketDialer.DialContext(outReq.Context(), outReq.URL.String(), outReq.Header)
+	dialer := *f.websocketDialer
+	dialer.EnableCompression = f.websocketCompression && hasPermessageDeflate(req.Header)
+
+	targetConn, resp, err := dialer.DialContext(outReq.Context(), outReq.URL.String(), outReq.Header)
 	if err != nil {
 		if resp == nil {
-			ctx.errHandler.ServeHTTP(w, req, err)
+			ctx.errHandler.ServeHTTP(w, req, classifyError(err))
 		} else {
-			f.log.Errorf("vulcand/oxy/forward/websocket: Error dialing %q: %v with resp: %d %s", outReq.Host, err, resp.StatusCode, resp.Status)
+			f.logEvent(log.ErrorLevel, "websocket dial failed",
+				[]interface{}{"upstream", outReq.URL.Host, "url", outReq.URL.String(), "status", resp.StatusCode, "error", err},
+				"vulcand/oxy/forward/websocket: Error dialing %q: %v with resp: %d %s", outReq.Host, err, resp.StatusCode, resp.Status)
 			hijacker, ok := w.(http.Hijacker)
 			if !ok {
 				f.log.Errorf("vulcand/oxy/forward/websocket: %s can not be hijack", reflect.TypeOf(w))
@@ -416,37 +1026,94 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 		return
 	}
 
+	if size := headerSize(resp.Header); limit > 0 && size > limit {
+		targetConn.Close()
+		f.logEvent(log.WarnLevel, "websocket handshake headers too large", []interface{}{"upstream", outReq.URL.Host, "size", size, "limit", limit},
+			"vulcand/oxy/forward/websocket: handshake response of %q has %d bytes of headers, exceeding %d", outReq.Host, size, limit)
+		ctx.errHandler.ServeHTTP(w, req, &HeaderTooLargeError{Response: true, Size: size, Limit: limit})
+		return
+	}
+
 	// Only the targetConn choose to CheckOrigin or not
 	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
 		return true
 	}}
+	// the client is offered compression only when the backend accepted it
+	upgrader.EnableCompression = dialer.EnableCompression && hasPermessageDeflate(resp.Header)
 
 	utils.RemoveHeaders(resp.Header, WebsocketUpgradeHeaders...)
+	if f.requestIDHeader != "" {
+		// the handshake response is written from its headers only
+		resp.Header.Set(f.requestIDHeader, req.Header.Get(f.requestIDHeader))
+	}
 	utils.CopyHeaders(resp.Header, w.Header())
 
 	underlyingConn, err := upgrader.Upgrade(w, req, resp.Header)
 	if err != nil {
-		f.log.Errorf("vulcand/oxy/forward/websocket: Error while upgrading connection : %v", err)
+		f.logEvent(log.ErrorLevel, "websocket upgrade failed", []interface{}{"upstream", outReq.URL.Host, "error", err},
+			"vulcand/oxy/forward/websocket: Error while upgrading connection : %v", err)
 		return
 	}
+	// counters of the bytes copied in each direction, only set when observed
+	var toUpstream, toClient *int64
+	var opened time.Time
+	var closeErr error
+	wg := &sync.WaitGroup{}
+	if f.websocketConnObserver != nil || f.transferObserver != nil {
+		toUpstream, toClient = new(int64), new(int64)
+	}
+	if f.websocketConnObserver != nil {
+		opened = time.Now().UTC()
+		f.websocketConnObserver(WSConnEvent{Type: WSConnOpened, Request: req, Opened: opened})
+	}
+
 	defer func() {
 		underlyingConn.Close()
 		targetConn.Close()
 		if f.websocketConnectionClosedHook != nil {
 			f.websocketConnectionClosedHook(req, underlyingConn.UnderlyingConn())
 		}
+		if toUpstream != nil {
+			// both copies are over once the connections are closed, the counters are final
+			wg.Wait()
+		}
+		if f.transferObserver != nil {
+			f.transferObserver(req, *toUpstream, *toClient)
+		}
+		if f.websocketConnObserver != nil {
+			f.websocketConnObserver(WSConnEvent{
+				Type:            WSConnClosed,
+				Request:         req,
+				Opened:          opened,
+				Closed:          time.Now().UTC(),
+				BytesToUpstream: *toUpstream,
+				BytesToClient:   *toClient,
+				Err:             closeError(closeErr),
+			})
+		}
 	}()
 
+	if f.websocketMaxMessageSize > 0 {
+		underlyingConn.SetReadLimit(f.websocketMaxMessageSize)
+		targetConn.SetReadLimit(f.websocketMaxMessageSize)
+	}
+
 	errClient := make(chan error, 1)
 	errBackend := make(chan error, 1)
-	replicateWebsocketConn := func(dst, src *websocket.Conn, websocketMessageHook WsHook, errc chan error) {
+	// fromUpstream is set when src is the upstream connection, the client then gets a close frame
+	// even when the upstream went away without one
+	replicateWebsocketConn := func(dst, src *websocket.Conn, fromUpstream bool, websocketMessageHook WsHook, errc chan error, counter *int64) {
+		defer wg.Done()
 
 		forward := func(messageType int, reader io.Reader) error {
 			writer, err := dst.NextWriter(messageType)
 			if err != nil {
 				return err
 			}
-			_, err = io.Copy(writer, reader)
+			n, err := f.copyBuffer(writer, reader)
+			if counter != nil && (messageType == websocket.TextMessage || messageType == websocket.BinaryMessage) {
+				*counter += n
+			}
 			if err != nil {
 				return err
 			}
@@ -466,7 +1133,10 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 
 			if err != nil {
 				m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err))
-				if e, ok := err.(*websocket.CloseError); ok {
+				if err == websocket.ErrReadLimit {
+					// the sender got a 1009 close frame from the websocket library, the peer gets the same
+					m = websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+				} else if e, ok := err.(*websocket.CloseError); ok {
 					if e.Code != websocket.CloseNoStatusReceived {
 						m = nil
 						// Following codes are not valid on the wire so just close the
@@ -475,13 +1145,20 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 							e.Code != websocket.CloseTLSHandshake {
 
 							m = websocket.FormatCloseMessage(e.Code, e.Text)
+						} else if fromUpstream && e.Code == websocket.CloseAbnormalClosure {
+							m = websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+						} else if fromUpstream {
+							m = websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "")
 						}
 					}
+				} else if fromUpstream {
+					m = websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "")
 				}
-				errc <- err
+				// the close frame is forwarded before signaling, serveWebSocket closes the connections once signaled
 				if m != nil {
 					forward(websocket.CloseMessage, bytes.NewReader([]byte(m)))
 				}
+				errc <- err
 				break
 			}
 			if websocketMessageHook != nil {
@@ -492,25 +1169,34 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 			}
 			err = forward(msgType, reader)
 			if err != nil {
+				if err == websocket.ErrReadLimit {
+					// the message was split in several frames, the limit was hit while copying it
+					dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseMessageTooBig, ""), time.Now().Add(time.Second))
+				}
 				errc <- err
 				break
 			}
 		}
 	}
 
-	go replicateWebsocketConn(underlyingConn, targetConn, f.websocketMessageSentHook, errClient)
-	go replicateWebsocketConn(targetConn, underlyingConn, f.websocketMessageReceivedHook, errBackend)
+	wg.Add(2)
+	go replicateWebsocketConn(underlyingConn, targetConn, true, f.websocketMessageSentHook, errClient, toClient)
+	go replicateWebsocketConn(targetConn, underlyingConn, false, f.websocketMessageReceivedHook, errBackend, toUpstream)
 
-	var message string
+	var message, direction string
 	select {
 	case err = <-errClient:
 		message = "vulcand/oxy/forward/websocket: Error when copying from backend to client: %v"
+		direction = "upstream->client"
 	case err = <-errBackend:
 		message = "vulcand/oxy/forward/websocket: Error when copying from client to backend: %v"
+		direction = "client->upstream"
 
 	}
+	closeErr = err
 	if e, ok := err.(*websocket.CloseError); !ok || e.Code == websocket.CloseAbnormalClosure {
-		f.log.Errorf(message, err)
+		f.logEvent(log.ErrorLevel, "websocket copy failed",
+			[]interface{}{"upstream", outReq.URL.Host, "direction", direction, "error", err}, message, err)
 	}
 }
 
@@ -536,9 +1222,10 @@ func (f *httpForwarder) copyWebSocketRequest(req *http.Request) (outReq *http.Re
 	outReq.URL.RawPath = u.RawPath
 	outReq.URL.RawQuery = u.RawQuery
 	outReq.RequestURI = "" // Outgoing request should not have RequestURI
+	f.rewritePath(outReq.URL)
 
 	outReq.URL.Host = req.URL.Host
-	if !f.passHost {
+	if !f.passHostHeader(req) {
 		outReq.Host = req.URL.Host
 	}
 
@@ -551,6 +1238,7 @@ func (f *httpForwarder) copyWebSocketRequest(req *http.Request) (outReq *http.Re
 	if f.rewriter != nil {
 		f.rewriter.Rewrite(outReq)
 	}
+	f.withDefaultUserAgent(outReq)
 	return outReq
 }
 
@@ -562,10 +1250,49 @@ func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ct
 		defer logEntry.Debug("vulcand/oxy/forward/http: completed ServeHttp on request")
 	}
 
+	if f.coalescer != nil {
+		if key, ok := f.coalescer.key(inReq); ok {
+			f.serveCoalesced(w, inReq, ctx, key)
+			return
+		}
+	}
+	f.forwardHTTP(w, inReq, ctx)
+}
+
+// forwardHTTP forwards the request to the upstream
+func (f *httpForwarder) forwardHTTP(w http.ResponseWriter, inReq *http.Request, ctx *handlerContext) {
 	start := time.Now().UTC()
 
+	if f.bodyInspector != nil {
+		var err error
+		inReq, err = f.inspectRequestBody(inReq)
+		if err != nil {
+			ctx.errHandler.ServeHTTP(w, inReq, err)
+			return
+		}
+	}
+
+	if f.mirror != nil {
+		inReq = f.mirrorRequest(inReq)
+	}
+
 	outReq := new(http.Request)
 	*outReq = *inReq // includes shallow copies of maps, but we handle this in Director
+	if expectsContinue(inReq) {
+		outReq.Body = &expectContinueBody{ReadCloser: inReq.Body}
+	}
+
+	if f.requestTimeout > 0 {
+		// Cancelling the context aborts the upstream round trip, so slow backends don't leak goroutines
+		timeoutCtx, cancel := context.WithTimeout(inReq.Context(), f.requestTimeout)
+		defer cancel()
+		outReq = outReq.WithContext(timeoutCtx)
+	}
+
+	if f.connMetrics != nil {
+		outReq = f.traceConnEvents(outReq)
+	}
+	outReq = f.relayInformational(w, outReq)
 
 	revproxy := httputil.ReverseProxy{
 		Director: func(req *http.Request) {
@@ -577,21 +1304,30 @@ func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ct
 		BufferPool:     f.bufferPool,
 	}
 
-	if f.log.GetLevel() >= log.DebugLevel {
-		pw := utils.NewProxyWriter(w)
-		revproxy.ServeHTTP(pw, outReq)
+	if f.allowServerPush {
+		revproxy.ModifyResponse = f.pushPreloads(w, inReq, revproxy.ModifyResponse)
+	}
 
-		if inReq.TLS != nil {
-			f.log.Debugf("vulcand/oxy/forward/http: Round trip: %v, code: %v, Length: %v, duration: %v tls:version: %x, tls:resume:%t, tls:csuite:%x, tls:server:%v",
-				inReq.URL, pw.StatusCode(), pw.GetLength(), time.Now().UTC().Sub(start),
-				inReq.TLS.Version,
-				inReq.TLS.DidResume,
-				inReq.TLS.CipherSuite,
-				inReq.TLS.ServerName)
-		} else {
-			f.log.Debugf("vulcand/oxy/forward/http: Round trip: %v, code: %v, Length: %v, duration: %v",
-				inReq.URL, pw.StatusCode(), pw.GetLength(), time.Now().UTC().Sub(start))
+	if !f.upgradeHTTP10 {
+		revproxy.ModifyResponse = f.http10Framing(w, revproxy.ModifyResponse)
+	}
+
+	if f.maxResponseBodyBytes > 0 {
+		revproxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			if err == ErrResponseBodyTooLarge {
+				ctx.errHandler.ServeHTTP(w, req, err)
+				return
+			}
+			f.logEvent(log.ErrorLevel, "error while proxying", []interface{}{"upstream", req.URL.Host, "url", req.URL.String(), "error", err},
+				"vulcand/oxy/forward/http: error while proxying %v: %v", req.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
 		}
+	}
+
+	if f.debugEnabled() {
+		pw := utils.NewProxyWriter(w)
+		revproxy.ServeHTTP(pw, outReq)
+		f.logRoundTrip(inReq, pw, time.Now().UTC().Sub(start))
 	} else {
 		revproxy.ServeHTTP(w, outReq)
 	}
@@ -608,16 +1344,32 @@ func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ct
 }
 
 // IsWebsocketRequest determines if the specified HTTP request is a
-// websocket handshake request
+// websocket handshake request: its Connection header lists the upgrade token and its Upgrade header
+// the websocket protocol, case-insensitively and whether the tokens are comma-separated or repeated
+// in several header fields. Middleware can use it to skip the requests the Forwarder tunnels.
 func IsWebsocketRequest(req *http.Request) bool {
 	containsHeader := func(name, value string) bool {
-		items := strings.Split(req.Header.Get(name), ",")
-		for _, item := range items {
-			if value == strings.ToLower(strings.TrimSpace(item)) {
-				return true
+		for _, field := range req.Header[name] {
+			for _, item := range strings.Split(field, ",") {
+				if value == strings.ToLower(strings.TrimSpace(item)) {
+					return true
+				}
 			}
 		}
 		return false
 	}
 	return containsHeader(Connection, "upgrade") && containsHeader(Upgrade, "websocket")
 }
+
+// hasPermessageDeflate checks whether the permessage-deflate extension is listed in the headers
+func hasPermessageDeflate(h http.Header) bool {
+	for _, value := range h[SecWebsocketExtensions] {
+		for _, ext := range strings.Split(value, ",") {
+			name := strings.Split(ext, ";")[0]
+			if strings.ToLower(strings.TrimSpace(name)) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
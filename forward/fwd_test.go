@@ -1,12 +1,36 @@
 package forward
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -14,8 +38,142 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/oxy/utils"
+	"go.uber.org/goleak"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
 )
 
+func TestXRealIPHeader(t *testing.T) {
+	tests := []struct {
+		Description     string
+		TrustForward    bool
+		SetRealIP       bool
+		DisableRealIP   bool
+		RemoteAddr      string
+		IncomingRealIP  string
+		ExpectedRealIPs []string
+	}{
+		{
+			Description:     "disabled",
+			DisableRealIP:   true,
+			TrustForward:    true,
+			RemoteAddr:      "10.13.14.15:1234",
+			ExpectedRealIPs: nil,
+		},
+		{
+			Description:     "set ipv4",
+			SetRealIP:       true,
+			RemoteAddr:      "10.13.14.15:1234",
+			ExpectedRealIPs: []string{"10.13.14.15"},
+		},
+		{
+			Description:     "set ipv6",
+			SetRealIP:       true,
+			RemoteAddr:      "[2001:db8::1]:1234",
+			ExpectedRealIPs: []string{"2001:db8::1"},
+		},
+		{
+			Description:     "set wins over disabled",
+			SetRealIP:       true,
+			DisableRealIP:   true,
+			RemoteAddr:      "10.13.14.15:1234",
+			ExpectedRealIPs: []string{"10.13.14.15"},
+		},
+		{
+			Description:     "set untrusted overwrites incoming header",
+			SetRealIP:       true,
+			RemoteAddr:      "[2001:db8::1]:1234",
+			IncomingRealIP:  "192.168.1.1",
+			ExpectedRealIPs: []string{"2001:db8::1"},
+		},
+		{
+			Description:     "set trusted keeps incoming header",
+			SetRealIP:       true,
+			TrustForward:    true,
+			RemoteAddr:      "10.13.14.15:1234",
+			IncomingRealIP:  "192.168.1.1",
+			ExpectedRealIPs: []string{"192.168.1.1"},
+		},
+		{
+			Description:     "untrusted ipv4",
+			RemoteAddr:      "10.13.14.15:1234",
+			ExpectedRealIPs: []string{"10.13.14.15"},
+		},
+		{
+			Description:     "untrusted ipv6",
+			RemoteAddr:      "[2001:db8::1]:1234",
+			ExpectedRealIPs: []string{"2001:db8::1"},
+		},
+		{
+			Description:     "untrusted overwrites incoming header",
+			RemoteAddr:      "10.13.14.15:1234",
+			IncomingRealIP:  "192.168.1.1",
+			ExpectedRealIPs: []string{"10.13.14.15"},
+		},
+		{
+			Description:     "untrusted disabled removes incoming header",
+			DisableRealIP:   true,
+			RemoteAddr:      "10.13.14.15:1234",
+			IncomingRealIP:  "192.168.1.1",
+			ExpectedRealIPs: nil,
+		},
+		{
+			Description:     "trusted ipv4",
+			TrustForward:    true,
+			RemoteAddr:      "10.13.14.15:1234",
+			ExpectedRealIPs: []string{"10.13.14.15"},
+		},
+		{
+			Description:     "trusted ipv6 with zone",
+			TrustForward:    true,
+			RemoteAddr:      "[fe80::1%eth0]:1234",
+			ExpectedRealIPs: []string{"fe80::1"},
+		},
+		{
+			Description:     "trusted keeps incoming header",
+			TrustForward:    true,
+			RemoteAddr:      "[2001:db8::1]:1234",
+			IncomingRealIP:  "192.168.1.1",
+			ExpectedRealIPs: []string{"192.168.1.1"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.Description, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := New(Rewriter(&HeaderRewriter{TrustForwardHeader: test.TrustForward, SetRealIP: test.SetRealIP, DisableRealIP: test.DisableRealIP}))
+			require.NoError(t, err)
+
+			r, err := http.NewRequest(http.MethodGet, "http://xrealip.com", nil)
+			require.NoError(t, err)
+			r.RemoteAddr = test.RemoteAddr
+			if test.IncomingRealIP != "" {
+				r.Header.Set(XRealIp, test.IncomingRealIP)
+			}
+			backendUrl, err := url.Parse("http://backend.com")
+			require.NoError(t, err)
+			f.modifyRequest(r, backendUrl)
+			require.Equal(t, test.ExpectedRealIPs, r.Header[XRealIp])
+		})
+	}
+}
+
+func TestDefaultRewriterSetsRealIP(t *testing.T) {
+	f, err := New()
+	require.NoError(t, err)
+
+	r, err := http.NewRequest(http.MethodGet, "http://xrealip.com", nil)
+	require.NoError(t, err)
+	r.RemoteAddr = "10.13.14.15:1234"
+	backendUrl, err := url.Parse("http://backend.com")
+	require.NoError(t, err)
+	f.modifyRequest(r, backendUrl)
+	assert.Equal(t, "10.13.14.15", r.Header.Get(XRealIp))
+}
+
 // Makes sure hop-by-hop headers are removed
 func TestForwardHopHeaders(t *testing.T) {
 	called := false
@@ -54,6 +212,40 @@ func TestForwardHopHeaders(t *testing.T) {
 	assert.Equal(t, expectedHost, outHost)
 }
 
+func TestForwardPreserveHeaders(t *testing.T) {
+	var outHeaders http.Header
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outHeaders = req.Header
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(PreserveHeaders([]string{"x-mesh-hop", "keep-alive"}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	headers := http.Header{
+		Connection:    []string{"X-Mesh-Hop, X-Mesh-Drop"},
+		KeepAlive:     []string{"timeout=600"},
+		"X-Mesh-Hop":  []string{"a"},
+		"X-Mesh-Drop": []string{"b"},
+	}
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Headers(headers))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "", outHeaders.Get(Connection))
+	assert.Equal(t, "timeout=600", outHeaders.Get(KeepAlive))
+	assert.Equal(t, "a", outHeaders.Get("X-Mesh-Hop"))
+	assert.Equal(t, "", outHeaders.Get("X-Mesh-Drop"))
+}
+
 func TestDefaultErrHandler(t *testing.T) {
 	f, err := New()
 	require.NoError(t, err)
@@ -188,6 +380,92 @@ func TestForwardedHeaders(t *testing.T) {
 	assert.Equal(t, "hello", outHeaders.Get(XForwardedServer))
 }
 
+func TestMaxForwardedForEntries(t *testing.T) {
+	var outHeaders http.Header
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outHeaders = req.Header
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(Rewriter(&HeaderRewriter{TrustForwardHeader: true, MaxForwardedForEntries: 2}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL, testutils.Header(XForwardedFor, "192.168.1.1, 192.168.1.2, 192.168.1.3"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	// the client address is appended to the most recent incoming address
+	assert.Equal(t, "192.168.1.3, 127.0.0.1", outHeaders.Get(XForwardedFor))
+}
+
+func TestDefaultUserAgent(t *testing.T) {
+	tests := []struct {
+		Description string
+		Options     []optSetter
+		ClientUA    string
+		ExpectedUA  []string
+	}{
+		{
+			Description: "empty default sends none",
+			Options:     []optSetter{DefaultUserAgent("")},
+			ExpectedUA:  nil,
+		},
+		{
+			Description: "custom default",
+			Options:     []optSetter{DefaultUserAgent("oxy")},
+			ExpectedUA:  []string{"oxy"},
+		},
+		{
+			Description: "client user agent is kept",
+			Options:     []optSetter{DefaultUserAgent("oxy")},
+			ClientUA:    "curl/7.64.1",
+			ExpectedUA:  []string{"curl/7.64.1"},
+		},
+		{
+			Description: "h2c upstream with empty default",
+			Options:     []optSetter{DefaultUserAgent(""), EnableH2C()},
+			ExpectedUA:  nil,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.Description, func(t *testing.T) {
+			t.Parallel()
+
+			var outUA []string
+			srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				outUA = req.Header[UserAgent]
+				w.Write([]byte("hello"))
+			}), &http2.Server{}))
+			defer srv.Close()
+
+			f, err := New(test.Options...)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.URL = testutils.ParseURI(srv.URL)
+			if f.httpForwarder.h2cTransport != nil {
+				req.URL.Scheme = "h2c"
+			}
+			if test.ClientUA != "" {
+				req.Header.Set(UserAgent, test.ClientUA)
+			}
+
+			rw := httptest.NewRecorder()
+			f.ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, test.ExpectedUA, outUA)
+		})
+	}
+}
+
 func TestCustomRewriter(t *testing.T) {
 	var outHeaders http.Header
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
@@ -241,13 +519,18 @@ func TestCustomTransportTimeout(t *testing.T) {
 	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
 }
 
-func TestCustomLogger(t *testing.T) {
+func TestRequestTimeout(t *testing.T) {
+	upstreamCanceled := make(chan struct{})
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		w.Write([]byte("hello"))
+		select {
+		case <-req.Context().Done():
+			close(upstreamCanceled)
+		case <-time.After(time.Second):
+		}
 	})
 	defer srv.Close()
 
-	f, err := New()
+	f, err := New(RequestTimeout(10 * time.Millisecond))
 	require.NoError(t, err)
 
 	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
@@ -258,89 +541,93 @@ func TestCustomLogger(t *testing.T) {
 
 	re, _, err := testutils.Get(proxy.URL)
 	require.NoError(t, err)
-	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+
+	select {
+	case <-upstreamCanceled:
+	case <-time.After(time.Second):
+		t.Error("upstream request was not canceled")
+	}
 }
 
-func TestRouteForwarding(t *testing.T) {
-	var outPath string
+func TestIncomingContextDeadline(t *testing.T) {
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		outPath = req.RequestURI
-		w.Write([]byte("hello"))
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
 	})
 	defer srv.Close()
 
-	f, err := New()
+	var handlerErr error
+	f, err := New(ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		handlerErr = err
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+	})))
 	require.NoError(t, err)
 
 	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		req.URL = testutils.ParseURI(srv.URL)
-		f.ServeHTTP(w, req)
+		ctx, cancel := context.WithTimeout(req.Context(), 10*time.Millisecond)
+		defer cancel()
+		f.ServeHTTP(w, req.WithContext(ctx))
 	})
 	defer proxy.Close()
 
-	tests := []struct {
-		Path  string
-		Query string
-
-		ExpectedPath string
-	}{
-		{"/hello", "", "/hello"},
-		{"//hello", "", "//hello"},
-		{"///hello", "", "///hello"},
-		{"/hello", "abc=def&def=123", "/hello?abc=def&def=123"},
-		{"/log/http%3A%2F%2Fwww.site.com%2Fsomething?a=b", "", "/log/http%3A%2F%2Fwww.site.com%2Fsomething?a=b"},
-	}
-
-	for _, test := range tests {
-		proxyURL := proxy.URL + test.Path
-		if test.Query != "" {
-			proxyURL = proxyURL + "?" + test.Query
-		}
-		request, err := http.NewRequest("GET", proxyURL, nil)
-		require.NoError(t, err)
-
-		re, err := http.DefaultClient.Do(request)
-		require.NoError(t, err)
-		assert.Equal(t, http.StatusOK, re.StatusCode)
-		assert.Equal(t, test.ExpectedPath, outPath)
-	}
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+	assert.True(t, errors.Is(handlerErr, context.DeadlineExceeded))
 }
 
-func TestForwardedProto(t *testing.T) {
-	var proto string
+func TestConnMetrics(t *testing.T) {
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		proto = req.Header.Get(XForwardedProto)
 		w.Write([]byte("hello"))
 	})
 	defer srv.Close()
 
-	f, err := New()
+	var mu sync.Mutex
+	var events []ConnEvent
+	f, err := New(ConnMetrics(func(event ConnEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}))
 	require.NoError(t, err)
 
-	proxy := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		req.URL = testutils.ParseURI(srv.URL)
 		f.ServeHTTP(w, req)
 	})
-	tproxy := httptest.NewUnstartedServer(proxy)
-	tproxy.StartTLS()
-	defer tproxy.Close()
+	defer proxy.Close()
 
-	re, _, err := testutils.Get(tproxy.URL)
-	require.NoError(t, err)
-	assert.Equal(t, http.StatusOK, re.StatusCode)
-	assert.Equal(t, "https", proto)
+	for i := 0; i < 2; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, events, 2)
+	assert.Equal(t, ConnEventNew, events[0].Type)
+	assert.Equal(t, ConnEventReused, events[1].Type)
+	assert.Equal(t, testutils.ParseURI(srv.URL).Host, events[1].Host)
 }
 
-func TestChunkedResponseConversion(t *testing.T) {
+func TestConnMetricsClosed(t *testing.T) {
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		h := w.(http.Hijacker)
-		conn, _, _ := h.Hijack()
-		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntest\r\n5\r\ntest1\r\n5\r\ntest2\r\n0\r\n\r\n")
-		conn.Close()
+		w.Write([]byte("hello"))
 	})
 	defer srv.Close()
 
-	f, err := New()
+	closed := make(chan ConnEvent, 1)
+	f, err := New(ConnMetrics(func(event ConnEvent) {
+		if event.Type == ConnEventClosed {
+			closed <- event
+		}
+	}))
 	require.NoError(t, err)
 
 	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
@@ -349,86 +636,2769 @@ func TestChunkedResponseConversion(t *testing.T) {
 	})
 	defer proxy.Close()
 
-	re, body, err := testutils.Get(proxy.URL)
+	re, _, err := testutils.Get(proxy.URL)
 	require.NoError(t, err)
-	assert.Equal(t, "testtest1test2", string(body))
 	assert.Equal(t, http.StatusOK, re.StatusCode)
-	assert.Equal(t, fmt.Sprintf("%d", len("testtest1test2")), re.Header.Get("Content-Length"))
+
+	// the connection went back to the idle pool
+	select {
+	case event := <-closed:
+		t.Fatalf("unexpected event %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// and is reported once the transport closes it
+	require.NoError(t, f.Close())
+	select {
+	case event := <-closed:
+		assert.Equal(t, testutils.ParseURI(srv.URL).Host, event.Host)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the closed connection was not reported")
+	}
 }
 
-func TestContextWithValueInErrHandler(t *testing.T) {
-	var originalPBool *bool
-	originalBool := false
-	originalPBool = &originalBool
+type countingPool struct {
+	mu   sync.Mutex
+	gets int
+	puts int
+}
 
-	f, err := New(ErrorHandler(utils.ErrorHandlerFunc(func(rw http.ResponseWriter, req *http.Request, err error) {
-		test, isBool := req.Context().Value("test").(*bool)
-		if isBool {
-			*test = true
-		}
-		if err != nil {
-			rw.WriteHeader(http.StatusBadGateway)
-		}
-	})))
-	require.NoError(t, err)
+func (p *countingPool) Get() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gets++
+	return make([]byte, 32*1024)
+}
 
-	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		// We need a network error
-		req.URL = testutils.ParseURI("http://localhost:63450")
-		newReq := req.WithContext(context.WithValue(req.Context(), "test", originalPBool))
-		f.ServeHTTP(w, newReq)
-	})
-	defer proxy.Close()
+func (p *countingPool) Put(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.puts++
+}
 
-	re, _, err := testutils.Get(proxy.URL)
-	require.NoError(t, err)
-	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
-	assert.True(t, *originalPBool)
+func (p *countingPool) counts() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.gets, p.puts
 }
 
-func TestTeTrailer(t *testing.T) {
-	var teHeader string
+func TestBufferPool(t *testing.T) {
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		teHeader = req.Header.Get(Te)
 		w.Write([]byte("hello"))
 	})
 	defer srv.Close()
 
-	f, err := New()
+	pool := &countingPool{}
+	f, err := New(BufferPool(pool))
 	require.NoError(t, err)
 
-	proxy := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		req.URL = testutils.ParseURI(srv.URL)
 		f.ServeHTTP(w, req)
 	})
-	tproxy := httptest.NewUnstartedServer(proxy)
-	tproxy.StartTLS()
-	defer tproxy.Close()
+	defer proxy.Close()
 
-	re, _, err := testutils.Get(tproxy.URL, testutils.Header("Te", "trailers"))
+	re, body, err := testutils.Get(proxy.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, re.StatusCode)
-	assert.Equal(t, "trailers", teHeader)
+	assert.Equal(t, "hello", string(body))
+
+	gets, puts := pool.counts()
+	assert.Equal(t, 1, gets)
+	assert.Equal(t, 1, puts)
 }
 
-func TestUnannouncedTrailer(t *testing.T) {
-	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		rw.WriteHeader(200)
-		rw.(http.Flusher).Flush()
+func TestBufferPoolClientDisconnect(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		chunk := make([]byte, 32*1024)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
+	defer srv.Close()
 
-		rw.Header().Add(http.TrailerPrefix+"X-Trailer", "foo")
-	}))
+	pool := &countingPool{}
+	f, err := New(BufferPool(pool), Stream(true))
+	require.NoError(t, err)
 
-	proxy, err := New()
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	_, err = re.Body.Read(make([]byte, 1024))
+	require.NoError(t, err)
+
+	// abort the copy mid-stream
+	require.NoError(t, re.Body.Close())
+
+	assert.Eventually(t, func() bool {
+		gets, puts := pool.counts()
+		return gets == 1 && puts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMaxResponseBodyBytes(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		contentLength bool
+		size          int
+		stream        bool
+		expectedCode  int
+		overflow      bool
+	}{
+		{desc: "under the limit", size: 1024, expectedCode: http.StatusOK},
+		{desc: "content length over the limit", contentLength: true, size: 2048, expectedCode: http.StatusTeapot, overflow: true},
+		{desc: "chunked over the limit", size: 2048, expectedCode: http.StatusTeapot, overflow: true},
+		{desc: "streamed under the limit", size: 1024, stream: true, expectedCode: http.StatusOK},
+		{desc: "streamed content length over the limit", contentLength: true, size: 2048, stream: true, expectedCode: http.StatusTeapot, overflow: true},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				if test.contentLength {
+					w.Header().Set("Content-Length", strconv.Itoa(test.size))
+				}
+				w.Write(make([]byte, test.size))
+			})
+			defer srv.Close()
+
+			var handlerErr error
+			var overflowed bool
+			f, err := New(
+				Stream(test.stream),
+				MaxResponseBodyBytes(1024),
+				ResponseBodyOverflowHook(func(req *http.Request) { overflowed = true }),
+				ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+					handlerErr = err
+					w.WriteHeader(http.StatusTeapot)
+				})),
+			)
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, body, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedCode, re.StatusCode)
+			assert.Equal(t, test.overflow, overflowed)
+			if test.overflow {
+				assert.Equal(t, ErrResponseBodyTooLarge, handlerErr)
+				assert.Empty(t, body)
+			} else {
+				assert.NoError(t, handlerErr)
+				assert.Len(t, body, test.size)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		requestHeader  int
+		responseHeader int
+		expectedCode   int
+		forwarded      bool
+	}{
+		{desc: "under the limits", requestHeader: 100, responseHeader: 100, expectedCode: http.StatusOK, forwarded: true},
+		{desc: "request headers over the limit", requestHeader: 1024, responseHeader: 100, expectedCode: http.StatusRequestHeaderFieldsTooLarge},
+		{desc: "response headers over the limit", requestHeader: 100, responseHeader: 1024, expectedCode: http.StatusBadGateway, forwarded: true},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var forwarded bool
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				forwarded = true
+				w.Header().Set("X-Large", strings.Repeat("a", test.responseHeader))
+				w.Write([]byte("hello"))
+			})
+			defer srv.Close()
+
+			f, err := New(MaxRequestHeaderBytes(512), MaxResponseHeaderBytes(512))
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, body, err := testutils.Get(proxy.URL, testutils.Header("X-Large", strings.Repeat("a", test.requestHeader)))
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedCode, re.StatusCode)
+			assert.Equal(t, test.forwarded, forwarded)
+			if test.expectedCode != http.StatusOK {
+				assert.Empty(t, re.Header.Get("X-Large"))
+				assert.NotEqual(t, "hello", string(body))
+			}
+		})
+	}
+
+	var handlerErr error
+	f, err := New(MaxRequestHeaderBytes(512), ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		handlerErr = err
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.Header.Set("X-Large", strings.Repeat("a", 1024))
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	var tooLarge *HeaderTooLargeError
+	require.True(t, errors.As(handlerErr, &tooLarge))
+	assert.False(t, tooLarge.Response)
+	assert.Equal(t, 512, tooLarge.Limit)
+
+	// the transport of the forwarder stops reading the responses past the limit
+	f, err = New(MaxResponseHeaderBytes(512))
+	require.NoError(t, err)
+	require.NotNil(t, f.httpForwarder.ownedTransport)
+	assert.Equal(t, int64(512+responseHeaderSlack), f.httpForwarder.ownedTransport.MaxResponseHeaderBytes)
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Large", strings.Repeat("a", 64*1024))
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, srv.URL, nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Empty(t, w.Header().Get("X-Large"))
+
+	_, err = New(MaxRequestHeaderBytes(0))
+	assert.Error(t, err)
+	_, err = New(MaxResponseHeaderBytes(-1))
+	assert.Error(t, err)
+}
+
+func TestMaxResponseBodyBytesStreamAborted(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(make([]byte, 512))
+		w.(http.Flusher).Flush()
+		w.Write(make([]byte, 2048))
+	})
+	defer srv.Close()
+
+	overflowed := make(chan struct{})
+	f, err := New(
+		Stream(true),
+		MaxResponseBodyBytes(1024),
+		ResponseBodyOverflowHook(func(req *http.Request) { close(overflowed) }),
+	)
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	defer re.Body.Close()
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the client sees a truncated body, not a complete response
+	body, err := ioutil.ReadAll(re.Body)
+	assert.Error(t, err)
+	assert.True(t, len(body) <= 1024)
+
+	select {
+	case <-overflowed:
+	case <-time.After(time.Second):
+		t.Error("overflow hook not called")
+	}
+}
+
+func TestCustomLogger(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+}
+
+func TestRouteForwarding(t *testing.T) {
+	var outPath string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outPath = req.RequestURI
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	tests := []struct {
+		Path  string
+		Query string
+
+		ExpectedPath string
+	}{
+		{"/hello", "", "/hello"},
+		{"//hello", "", "//hello"},
+		{"///hello", "", "///hello"},
+		{"/hello", "abc=def&def=123", "/hello?abc=def&def=123"},
+		{"/log/http%3A%2F%2Fwww.site.com%2Fsomething?a=b", "", "/log/http%3A%2F%2Fwww.site.com%2Fsomething?a=b"},
+	}
+
+	for _, test := range tests {
+		proxyURL := proxy.URL + test.Path
+		if test.Query != "" {
+			proxyURL = proxyURL + "?" + test.Query
+		}
+		request, err := http.NewRequest("GET", proxyURL, nil)
+		require.NoError(t, err)
+
+		re, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, test.ExpectedPath, outPath)
+	}
+}
+
+func TestPathPrefixes(t *testing.T) {
+	var outPath string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outPath = req.RequestURI
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		Description  string
+		Options      []optSetter
+		Path         string
+		ExpectedPath string
+	}{
+		{"strip", []optSetter{StripPrefix("/api")}, "/api/hello?a=b", "/hello?a=b"},
+		{"strip whole path", []optSetter{StripPrefix("/api")}, "/api", "/"},
+		{"strip not matching", []optSetter{StripPrefix("/api")}, "/hello", "/hello"},
+		{"strip keeps double slashes", []optSetter{StripPrefix("/api")}, "/api//hello", "//hello"},
+		{"strip keeps encoded segments", []optSetter{StripPrefix("/api")}, "/api/log/http%3A%2F%2Fwww.site.com%2Fsomething?a=b", "/log/http%3A%2F%2Fwww.site.com%2Fsomething?a=b"},
+		{"add", []optSetter{AddPrefix("/v1/")}, "/hello?abc=def&def=123", "/v1/hello?abc=def&def=123"},
+		{"add keeps encoded segments", []optSetter{AddPrefix("/v1")}, "/log/a%2Fb", "/v1/log/a%2Fb"},
+		{"strip and add", []optSetter{StripPrefix("/api"), AddPrefix("/v2")}, "/api/hello", "/v2/hello"},
+	}
+
+	for _, test := range tests {
+		f, err := New(test.Options...)
+		require.NoError(t, err)
+
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(srv.URL)
+			f.ServeHTTP(w, req)
+		})
+
+		re, err := http.Get(proxy.URL + test.Path)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode, test.Description)
+		assert.Equal(t, test.ExpectedPath, outPath, test.Description)
+		proxy.Close()
+	}
+
+	_, err := New(StripPrefix(""))
+	assert.Error(t, err)
+	_, err = New(AddPrefix("v1"))
+	assert.Error(t, err)
+}
+
+func TestStoreOriginalURL(t *testing.T) {
+	var outURI string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outURI = req.RequestURI
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	var original *url.URL
+	f, err := New(StoreOriginalURL(true), StripPrefix("/api"), ResponseModifier(func(resp *http.Response) error {
+		original = OriginalURLFromContext(resp.Request.Context())
+		return nil
+	}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL + "/api/log/a%2Fb?a=b")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "/log/a%2Fb?a=b", outURI)
+	require.NotNil(t, original)
+	assert.Equal(t, proxy.URL+"/api/log/a%2Fb?a=b", original.String())
+
+	// nothing is stored by default
+	f, err = New(ResponseModifier(func(resp *http.Response) error {
+		original = OriginalURLFromContext(resp.Request.Context())
+		return nil
+	}))
+	require.NoError(t, err)
+
+	re, _, err = testutils.Get(proxy.URL + "/api")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Nil(t, original)
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	var outID string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outID = req.Header.Get("X-Request-Id")
+		// echoed by the upstream, it is not duplicated
+		w.Header().Set("X-Request-Id", outID)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	var ctxID string
+	f, err := New(RequestIDHeader("x-request-id"), ResponseModifier(func(resp *http.Response) error {
+		ctxID = RequestIDFromContext(resp.Request.Context())
+		return nil
+	}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// generated
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, outID)
+	assert.Equal(t, []string{outID}, re.Header["X-Request-Id"])
+	assert.Equal(t, outID, ctxID)
+
+	generated := outID
+	_, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.NotEqual(t, generated, outID)
+
+	// passed through
+	re, _, err = testutils.Get(proxy.URL, testutils.Header("X-Request-Id", "client-id"))
+	require.NoError(t, err)
+	assert.Equal(t, "client-id", outID)
+	assert.Equal(t, []string{"client-id"}, re.Header["X-Request-Id"])
+	assert.Equal(t, "client-id", ctxID)
+
+	_, err = New(RequestIDHeader(""))
+	assert.Error(t, err)
+}
+
+func TestCanarySplit(t *testing.T) {
+	stable := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("stable"))
+	})
+	defer stable.Close()
+	canary := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("canary"))
+	})
+	defer canary.Close()
+
+	var served []bool
+	modifier := ResponseModifier(func(resp *http.Response) error {
+		isCanary, ok := CanaryFromContext(resp.Request.Context())
+		require.True(t, ok)
+		served = append(served, isCanary)
+		return nil
+	})
+
+	f, err := New(CanarySplit(testutils.ParseURI(canary.URL), testutils.ParseURI(stable.URL), 30), modifier)
+	require.NoError(t, err)
+	rolls := []float64{0.1, 0.2999, 0.3, 0.9}
+	f.canary.random = func() float64 {
+		r := rolls[0]
+		rolls = rolls[1:]
+		return r
+	}
+
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		bodies = append(bodies, string(body))
+	}
+	assert.Equal(t, []string{"canary", "canary", "stable", "stable"}, bodies)
+	assert.Equal(t, []bool{true, true, false, false}, served)
+
+	// the side only depends on the sticky header when it is sent
+	f, err = New(CanarySplit(testutils.ParseURI(canary.URL), testutils.ParseURI(stable.URL), 50), CanaryStickyHeader("X-Client-Id"))
+	require.NoError(t, err)
+	f.canary.random = func() float64 {
+		t.Fatal("sticky requests should not be split at random")
+		return 0
+	}
+	sticky := httptest.NewServer(f)
+	defer sticky.Close()
+
+	sides := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("client-%d", i)
+		_, first, err := testutils.Get(sticky.URL, testutils.Header("X-Client-Id", id))
+		require.NoError(t, err)
+		for j := 0; j < 3; j++ {
+			_, body, err := testutils.Get(sticky.URL, testutils.Header("X-Client-Id", id))
+			require.NoError(t, err)
+			assert.Equal(t, string(first), string(body))
+		}
+		sides[string(first)] = true
+	}
+	assert.Equal(t, map[string]bool{"canary": true, "stable": true}, sides)
+
+	// requests are not marked without a split
+	marked := true
+	f, err = New(ResponseModifier(func(resp *http.Response) error {
+		_, marked = CanaryFromContext(resp.Request.Context())
+		return nil
+	}))
+	require.NoError(t, err)
+	plain := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(stable.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer plain.Close()
+	_, _, err = testutils.Get(plain.URL)
+	require.NoError(t, err)
+	assert.False(t, marked)
+
+	_, err = New(CanarySplit(testutils.ParseURI(canary.URL), testutils.ParseURI(stable.URL), 101))
+	assert.Error(t, err)
+	_, err = New(CanaryStickyHeader("X-Client-Id"))
+	assert.Error(t, err)
+}
+
+func TestWithPassHostHeader(t *testing.T) {
+	var outHost string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outHost = req.Host
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	testCases := []struct {
+		desc     string
+		option   bool
+		override *bool
+		passed   bool
+	}{
+		{desc: "option false", option: false, passed: false},
+		{desc: "option true", option: true, passed: true},
+		{desc: "context overrides false option", option: false, override: boolPtr(true), passed: true},
+		{desc: "context overrides true option", option: true, override: boolPtr(false), passed: false},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(PassHostHeader(test.option))
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				if test.override != nil {
+					req = req.WithContext(WithPassHostHeader(req.Context(), *test.override))
+				}
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, _, err := testutils.Get(proxy.URL, testutils.Host("example.com"))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			if test.passed {
+				assert.Equal(t, "example.com", outHost)
+			} else {
+				assert.Equal(t, testutils.ParseURI(srv.URL).Host, outHost)
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestAllowConnect(t *testing.T) {
+	// a raw TCP upstream echoing what it reads until the client is done
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	upstream := ln.Addr().String()
+
+	events := make(chan ConnectTunnelEvent, 1)
+	f, err := New(AllowConnect(func(host string) bool {
+		return host == upstream
+	}), ConnectTunnelObserver(func(ev ConnectTunnelEvent) {
+		events <- ev
+	}))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	conn, br, resp := connectThrough(t, proxy, upstream)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	echo, err := ioutil.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(echo))
+	conn.Close()
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, upstream, ev.Request.Host)
+		assert.EqualValues(t, 5, ev.BytesToUpstream)
+		assert.EqualValues(t, 5, ev.BytesToClient)
+		assert.NoError(t, ev.Err)
+		assert.False(t, ev.Closed.Before(ev.Opened))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tunnel was not closed")
+	}
+
+	// hosts that are not authorized are refused
+	conn, _, resp = connectThrough(t, proxy, "127.0.0.1:1")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	conn.Close()
+
+	// so are hosts without a port
+	conn, _, resp = connectThrough(t, proxy, "example.com")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	conn.Close()
+
+	// upstreams that can not be reached get a bad gateway
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := closed.Addr().String()
+	closed.Close()
+	f, err = New(AllowConnect(func(string) bool { return true }))
+	require.NoError(t, err)
+	allowAll := httptest.NewServer(f)
+	defer allowAll.Close()
+	conn, _, resp = connectThrough(t, allowAll, unreachable)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	conn.Close()
+}
+
+func TestAllowConnectBufferPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	upstream := ln.Addr().String()
+
+	pool := &countingPool{}
+	events := make(chan ConnectTunnelEvent, 1)
+	f, err := New(AllowConnect(func(string) bool { return true }), BufferPool(pool), ConnectTunnelObserver(func(ev ConnectTunnelEvent) {
+		events <- ev
+	}))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	conn, br, resp := connectThrough(t, proxy, upstream)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	echo, err := ioutil.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(echo))
+	conn.Close()
+
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tunnel was not closed")
+	}
+
+	// one buffer per direction of the tunnel
+	gets, puts := pool.counts()
+	assert.Equal(t, 2, gets)
+	assert.Equal(t, 2, puts)
+}
+
+// connectThrough sends a CONNECT request for host to the proxy
+func connectThrough(t *testing.T, proxy *httptest.Server, host string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	return conn, br, resp
+}
+
+func TestTransferObserver(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		// streamed in several chunks
+		for i := 0; i < 3; i++ {
+			w.Write(body)
+			w.(http.Flusher).Flush()
+		}
+	})
+	defer srv.Close()
+
+	type transfer struct {
+		req, resp int64
+	}
+	transfers := make(chan transfer, 1)
+	f, err := New(Stream(true), TransferObserver(func(req *http.Request, reqBytes, respBytes int64) {
+		transfers <- transfer{req: reqBytes, resp: respBytes}
+	}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// a chunked request body
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("hello "))
+		pw.Write([]byte("world"))
+		pw.Close()
+	}()
+	req, err := http.NewRequest(http.MethodPost, proxy.URL, pr)
+	require.NoError(t, err)
+	re, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunked"}, re.TransferEncoding)
+	assert.Equal(t, strings.Repeat("hello world", 3), string(body))
+	assert.Equal(t, transfer{req: 11, resp: 33}, <-transfers)
+
+	re, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, transfer{}, <-transfers)
+
+	// CONNECT tunnels are reported once closed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+		conn.Write([]byte("bye"))
+	}()
+
+	f, err = New(AllowConnect(func(string) bool { return true }), TransferObserver(func(req *http.Request, reqBytes, respBytes int64) {
+		transfers <- transfer{req: reqBytes, resp: respBytes}
+	}))
+	require.NoError(t, err)
+	tunnelProxy := httptest.NewServer(f)
+	defer tunnelProxy.Close()
+
+	conn, br, resp := connectThrough(t, tunnelProxy, ln.Addr().String())
+	defer conn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	_, err = ioutil.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, transfer{req: 4, resp: 3}, <-transfers)
+}
+
+func TestForwardInformationalResponses(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	testCases := []struct {
+		desc    string
+		options []optSetter
+		hints   []string
+	}{
+		{desc: "relayed by default", hints: []string{"</style.css>; rel=preload; as=style"}},
+		{desc: "dropped", options: []optSetter{ForwardInformationalResponses(false)}},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(test.options...)
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			var hints []string
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					assert.Equal(t, http.StatusEarlyHints, code)
+					hints = append(hints, header["Link"]...)
+					return nil
+				},
+			}
+			req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+			require.NoError(t, err)
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+			re, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(re.Body)
+			re.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, "hello", string(body))
+			assert.Empty(t, re.Header.Get("Link"))
+			assert.Equal(t, test.hints, hints)
+		})
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		accept  bool
+		options []optSetter
+	}{
+		{desc: "upstream rejects the body", accept: false},
+		{desc: "upstream accepts the body", accept: true},
+		{desc: "rejected without relaying 1xx", accept: false, options: []optSetter{ForwardInformationalResponses(false)}},
+		{desc: "accepted without relaying 1xx", accept: true, options: []optSetter{ForwardInformationalResponses(false)}},
+		{desc: "rejected when mirroring", accept: false, options: []optSetter{Mirror(testutils.ParseURI("http://127.0.0.1:1"), 1)}},
+		{desc: "accepted when mirroring", accept: true, options: []optSetter{Mirror(testutils.ParseURI("http://127.0.0.1:1"), 1)}},
+		{desc: "accepted with a round tripper", accept: true, options: []optSetter{RoundTripper(&http.Transport{ExpectContinueTimeout: time.Second})}},
+		// the body is sent right away, the client still gets a single 100 Continue
+		{desc: "accepted with a round tripper not waiting", accept: true, options: []optSetter{RoundTripper(&http.Transport{})}},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			// a raw upstream, so that what it receives before answering the expectation is visible
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer ln.Close()
+
+			received := make(chan string, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					received <- err.Error()
+					return
+				}
+				if req.Header.Get("Expect") != "100-continue" {
+					received <- "no expectation"
+					return
+				}
+				if !test.accept {
+					conn.Write([]byte("HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+					// nothing of the body should follow
+					conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+					leaked, _ := ioutil.ReadAll(br)
+					received <- string(leaked)
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+				body, _ := ioutil.ReadAll(req.Body)
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"))
+				received <- string(body)
+			}()
+
+			f, err := New(test.options...)
+			require.NoError(t, err)
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI("http://" + ln.Addr().String())
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: %s\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n", proxy.Listener.Addr())
+
+			br := bufio.NewReader(conn)
+			req := &http.Request{Method: http.MethodPost}
+			re, err := http.ReadResponse(br, req)
+			require.NoError(t, err)
+
+			if !test.accept {
+				assert.Equal(t, http.StatusExpectationFailed, re.StatusCode)
+				assert.Equal(t, "", <-received)
+				return
+			}
+
+			// the client only sends the body once the upstream asked for it
+			assert.Equal(t, http.StatusContinue, re.StatusCode)
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+			re, err = http.ReadResponse(br, req)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			body, err := ioutil.ReadAll(re.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "ok", string(body))
+			assert.Equal(t, "hello", <-received)
+		})
+	}
+}
+
+func TestHTTP10Upstream(t *testing.T) {
+	body := strings.Repeat("legacy ", 10000)
+
+	// an HTTP/1.0 upstream delimiting the body by closing the connection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\nConnection: keep-alive\r\nKeep-Alive: timeout=5\r\n\r\n"))
+				for i := 0; i < len(body); i += 4096 {
+					end := i + 4096
+					if end > len(body) {
+						end = len(body)
+					}
+					conn.Write([]byte(body[i:end]))
+				}
+			}()
+		}
+	}()
+
+	testCases := []struct {
+		desc    string
+		options []optSetter
+		closed  bool
+	}{
+		{desc: "connection closed by default", closed: true},
+		{desc: "upgraded", options: []optSetter{UpgradeHTTP10Responses(true)}, closed: false},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(test.options...)
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI("http://" + ln.Addr().String())
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			// a client keeping its connections alive
+			transport := &http.Transport{}
+			defer transport.CloseIdleConnections()
+			re, err := (&http.Client{Transport: transport}).Get(proxy.URL)
+			require.NoError(t, err)
+			got, err := ioutil.ReadAll(re.Body)
+			re.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, body, string(got))
+			assert.Equal(t, "HTTP/1.1", re.Proto)
+			assert.Equal(t, []string{"chunked"}, re.TransferEncoding)
+			assert.Empty(t, re.Header.Get(KeepAlive))
+			assert.Equal(t, test.closed, re.Close)
+		})
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	})
+	defer srv.Close()
+	h2cSrv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}), &http2.Server{}))
+	defer h2cSrv.Close()
+
+	// the upstream names are resolved by the dialer only
+	addrs := map[string]string{
+		"backend.internal:80": srv.Listener.Addr().String(),
+		"h2c.internal:80":     h2cSrv.Listener.Addr().String(),
+	}
+	var dialed []string
+	var mu sync.Mutex
+	f, err := New(EnableH2C(), DialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		target, ok := addrs[addr]
+		if !ok {
+			return nil, fmt.Errorf("unknown upstream %v", addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, target)
+	}))
+	require.NoError(t, err)
+
+	for upstream, proto := range map[string]string{"http://backend.internal:80": "HTTP/1.1", "h2c://h2c.internal:80": "HTTP/2.0"} {
+		upstream := upstream
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(upstream)
+			f.ServeHTTP(w, req)
+		})
+
+		re, body, err := testutils.Get(proxy.URL)
+		proxy.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, proto, string(body))
+	}
+
+	mu.Lock()
+	assert.ElementsMatch(t, []string{"backend.internal:80", "h2c.internal:80"}, dialed)
+	mu.Unlock()
+
+	_, err = New(DialContext(nil))
+	assert.Error(t, err)
+}
+
+func TestKeepAliveOptions(t *testing.T) {
+	transportOf := func(f *Forwarder) *http.Transport {
+		rt := f.httpForwarder.roundTripper
+		for {
+			switch r := rt.(type) {
+			case *http.Transport:
+				return r
+			case ErrorHandlingRoundTripper:
+				rt = r.RoundTripper
+			case *informationalRoundTripper:
+				rt = r.RoundTripper
+			case *preserveHeadersRoundTripper:
+				rt = r.RoundTripper
+			case *h2cRoundTripper:
+				rt = r.RoundTripper
+			case *unixRoundTripper:
+				rt = r.RoundTripper
+			default:
+				return nil
+			}
+		}
+	}
+
+	f, err := New(MaxIdleConns(10), MaxIdleConnsPerHost(0), IdleConnTimeout(5*time.Second), DisableKeepAlives(true))
+	require.NoError(t, err)
+	tr := transportOf(f)
+	require.NotNil(t, tr)
+	assert.Equal(t, 10, tr.MaxIdleConns)
+	assert.Equal(t, 0, tr.MaxIdleConnsPerHost)
+	assert.Equal(t, 5*time.Second, tr.IdleConnTimeout)
+	assert.True(t, tr.DisableKeepAlives)
+	// the default transport is left untouched
+	assert.Equal(t, 100, http.DefaultTransport.(*http.Transport).MaxIdleConns)
+	assert.False(t, http.DefaultTransport.(*http.Transport).DisableKeepAlives)
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	// the options are ignored with a user RoundTripper
+	rt := &http.Transport{MaxIdleConns: 3}
+	f, err = New(RoundTripper(rt), MaxIdleConns(10), DisableKeepAlives(true))
+	require.NoError(t, err)
+	assert.Equal(t, rt, transportOf(f))
+	assert.Equal(t, 3, rt.MaxIdleConns)
+	assert.False(t, rt.DisableKeepAlives)
+
+	for _, opt := range []optSetter{MaxIdleConns(-1), MaxIdleConnsPerHost(-1), IdleConnTimeout(-time.Second)} {
+		_, err = New(opt)
+		assert.Error(t, err)
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	var proto string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		proto = req.Header.Get(XForwardedProto)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	tproxy := httptest.NewUnstartedServer(proxy)
+	tproxy.StartTLS()
+	defer tproxy.Close()
+
+	re, _, err := testutils.Get(tproxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "https", proto)
+}
+
+func TestChunkedResponseConversion(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		h := w.(http.Hijacker)
+		conn, _, _ := h.Hijack()
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntest\r\n5\r\ntest1\r\n5\r\ntest2\r\n0\r\n\r\n")
+		conn.Close()
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "testtest1test2", string(body))
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, fmt.Sprintf("%d", len("testtest1test2")), re.Header.Get("Content-Length"))
+}
+
+func TestContextWithValueInErrHandler(t *testing.T) {
+	var originalPBool *bool
+	originalBool := false
+	originalPBool = &originalBool
+
+	f, err := New(ErrorHandler(utils.ErrorHandlerFunc(func(rw http.ResponseWriter, req *http.Request, err error) {
+		test, isBool := req.Context().Value("test").(*bool)
+		if isBool {
+			*test = true
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+	})))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		// We need a network error
+		req.URL = testutils.ParseURI("http://localhost:63450")
+		newReq := req.WithContext(context.WithValue(req.Context(), "test", originalPBool))
+		f.ServeHTTP(w, newReq)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.True(t, *originalPBool)
+}
+
+func TestTeTrailer(t *testing.T) {
+	var teHeader string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		teHeader = req.Header.Get(Te)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	tproxy := httptest.NewUnstartedServer(proxy)
+	tproxy.StartTLS()
+	defer tproxy.Close()
+
+	re, _, err := testutils.Get(tproxy.URL, testutils.Header("Te", "trailers"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "trailers", teHeader)
+}
+
+func TestUnannouncedTrailer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(200)
+		rw.(http.Flusher).Flush()
+
+		rw.Header().Add(http.TrailerPrefix+"X-Trailer", "foo")
+	}))
+
+	proxy, err := New()
 	require.Nil(t, err)
 
-	proxySrv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		proxy.ServeHTTP(rw, req)
+	}))
+
+	resp, _ := http.Get(proxySrv.URL)
+	ioutil.ReadAll(resp.Body)
+
+	require.Equal(t, resp.Trailer.Get("X-Trailer"), "foo")
+}
+
+func TestFlushInterval(t *testing.T) {
+	received := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "16")
+		w.Write([]byte("event 1\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("event 2\n"))
+	})
+	defer srv.Close()
+
+	f, err := New(FlushInterval(-1))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	start := time.Now()
+	re, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	defer re.Body.Close()
+
+	// the first event reaches the client before the upstream sends the second one
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(re.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "event 1\n", string(buf))
+	assert.True(t, time.Since(start) < time.Second)
+	close(received)
+
+	rest, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "event 2\n", string(rest))
+}
+
+func TestFlushIntervalWithoutFlusher(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		w.Header().Add(http.TrailerPrefix+"X-Trailer", "foo")
+	})
+	defer srv.Close()
+
+	for _, interval := range []time.Duration{-1, time.Millisecond} {
+		f, err := New(FlushInterval(interval))
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		// hides the Flush method of the recorder
+		w := struct{ http.ResponseWriter }{rec}
+		req := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+		req.RequestURI = ""
+		f.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "hello", rec.Body.String())
+		assert.Equal(t, "foo", rec.Result().Trailer.Get("X-Trailer"))
+	}
+}
+
+func TestH2CUpstream(t *testing.T) {
+	var proto string
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		proto = req.Proto
+		rw.Header().Set("Trailer", "X-Trailer")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("hello"))
+		rw.Header().Set("X-Trailer", "foo")
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	f, err := New(EnableH2C())
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Scheme = "h2c"
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "HTTP/2.0", proto)
+	assert.Equal(t, "foo", resp.Trailer.Get("X-Trailer"))
+}
+
+func TestServerPushRefusedByDefault(t *testing.T) {
+	pushErr := make(chan error, 1)
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		pusher, ok := rw.(http.Pusher)
+		require.True(t, ok)
+		pushErr <- pusher.Push("/style.css", nil)
+		rw.Write([]byte("hello"))
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	f, err := New(EnableH2C())
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Scheme = "h2c"
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, http.ErrNotSupported, <-pushErr)
+}
+
+// pushPromiseServer starts an HTTP/2 upstream sending a push promise before every response,
+// ignoring the settings of the client
+func pushPromiseServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				preface := make([]byte, len(http2.ClientPreface))
+				if _, err := io.ReadFull(conn, preface); err != nil {
+					return
+				}
+
+				framer := http2.NewFramer(conn, conn)
+				framer.WriteSettings()
+				var buf bytes.Buffer
+				enc := hpack.NewEncoder(&buf)
+				for {
+					frame, err := framer.ReadFrame()
+					if err != nil {
+						return
+					}
+					switch frame := frame.(type) {
+					case *http2.SettingsFrame:
+						if !frame.IsAck() {
+							framer.WriteSettingsAck()
+						}
+					case *http2.HeadersFrame:
+						buf.Reset()
+						enc.WriteField(hpack.HeaderField{Name: ":method", Value: http.MethodGet})
+						enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+						enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+						enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/style.css"})
+						framer.WritePushPromise(http2.PushPromiseParam{
+							StreamID:      frame.StreamID,
+							PromiseID:     frame.StreamID + 1,
+							BlockFragment: buf.Bytes(),
+							EndHeaders:    true,
+						})
+
+						buf.Reset()
+						enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+						framer.WriteHeaders(http2.HeadersFrameParam{StreamID: frame.StreamID, BlockFragment: buf.Bytes(), EndHeaders: true})
+						framer.WriteData(frame.StreamID, true, []byte("hello"))
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestServerPushPromiseFromUpstream(t *testing.T) {
+	l := pushPromiseServer(t)
+	defer l.Close()
+
+	var proxyErr error
+	f, err := New(EnableH2C(), ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		proxyErr = err
+		w.WriteHeader(http.StatusBadGateway)
+	})))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("h2c://" + l.Addr().String())
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// the promise is a protocol error, the request fails instead of leaking the pushed stream
+	for i := 0; i < 2; i++ {
+		proxyErr = nil
+		re, _, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+
+		var connErr http2.ConnectionError
+		require.True(t, errors.As(proxyErr, &connErr), "unexpected error %v", proxyErr)
+		assert.Equal(t, http2.ConnectionError(http2.ErrCodeProtocol), connErr)
+	}
+}
+
+// pushRecorder records the resources pushed to the client
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed  []string
+	headers []http.Header
+}
+
+func (p *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	p.pushed = append(p.pushed, target)
+	p.headers = append(p.headers, opts.Header)
+	return nil
+}
+
+func TestAllowServerPush(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Link", "</style.css>; rel=preload; as=style, </font.woff>; rel=preload; nopush")
+		w.Header().Add("Link", `</app.js>; rel="preload"; as=script, <https://cdn.example.com/lib.js>; rel=preload, </next>; rel=next`)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.URL = testutils.ParseURI(srv.URL)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Authorization", "secret")
+		return req
+	}
+
+	f, err := New(AllowServerPush(true))
+	require.NoError(t, err)
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	f.ServeHTTP(rw, newRequest())
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "hello", rw.Body.String())
+	assert.Equal(t, []string{"/style.css", "/app.js"}, rw.pushed)
+	assert.Equal(t, http.Header{"Accept-Encoding": {"gzip"}}, rw.headers[0])
+
+	// the links are only forwarded when push is not allowed
+	f, err = New()
+	require.NoError(t, err)
+
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	f.ServeHTTP(rw, newRequest())
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Empty(t, rw.pushed)
+	assert.Len(t, rw.Header()["Link"], 2)
+}
+
+func TestH2CDisabledKeepsHTTP1(t *testing.T) {
+	var proto string
+	srv := testutils.NewHandler(func(rw http.ResponseWriter, req *http.Request) {
+		proto = req.Proto
+		rw.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(EnableH2C())
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "HTTP/1.1", proto)
+}
+
+// newUnixServer starts a server listening on a unix socket in dir
+func newUnixServer(t *testing.T, dir, name string, handler http.HandlerFunc) (*httptest.Server, string) {
+	socket := filepath.Join(dir, name)
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: handler}}
+	srv.Start()
+	return srv, socket
+}
+
+func TestUnixSocketUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var outHost, outXFHost, outURI string
+	srvA, socketA := newUnixServer(t, dir, "a.sock", func(w http.ResponseWriter, req *http.Request) {
+		outHost, outXFHost, outURI = req.Host, req.Header.Get(XForwardedHost), req.RequestURI
+		w.Write([]byte("a"))
+	})
+	defer srvA.Close()
+
+	srvB, socketB := newUnixServer(t, dir, "b.sock", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("b"))
+	})
+	defer srvB.Close()
+
+	f, err := New(UnixSocketHost("app.internal"))
+	require.NoError(t, err)
+
+	target := socketA
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("unix://" + target)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL+"/path?q=1", testutils.Host("example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "a", string(body))
+	assert.Equal(t, "app.internal", outHost)
+	assert.Equal(t, "example.com", outXFHost)
+	assert.Equal(t, "/path?q=1", outURI)
+
+	// each socket has its own connections
+	target = socketB
+	re, body, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "b", string(body))
+}
+
+func TestUnixSocketUpstreamRequestWithoutHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var outHost, outXFHost, outURI string
+	srv, socket := newUnixServer(t, dir, "app.sock", func(w http.ResponseWriter, req *http.Request) {
+		outHost, outXFHost, outURI = req.Host, req.Header.Get(XForwardedHost), req.RequestURI
+	})
+	defer srv.Close()
+
+	f, err := New(PassHostHeader(true))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "unix://"+socket, nil)
+	req.RequestURI = ""
+	req.Host = ""
+	rw := httptest.NewRecorder()
+	f.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "localhost", outHost)
+	assert.Equal(t, "localhost", outXFHost)
+	assert.Equal(t, "/", outURI)
+
+	_, err = New(UnixSocketHost(""))
+	assert.Error(t, err)
+}
+
+type logEvent struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// recordingLogger is a StructuredLogger keeping the events in memory
+type recordingLogger struct {
+	mu     sync.Mutex
+	events []logEvent
+}
+
+func (r *recordingLogger) record(level, msg string, keysAndValues []interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fields := make(map[string]interface{})
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[keysAndValues[i].(string)] = keysAndValues[i+1]
+	}
+	r.events = append(r.events, logEvent{level: level, msg: msg, fields: fields})
+}
+
+func (r *recordingLogger) Debug(msg string, kv ...interface{}) { r.record("debug", msg, kv) }
+func (r *recordingLogger) Info(msg string, kv ...interface{})  { r.record("info", msg, kv) }
+func (r *recordingLogger) Warn(msg string, kv ...interface{})  { r.record("warn", msg, kv) }
+func (r *recordingLogger) Error(msg string, kv ...interface{}) { r.record("error", msg, kv) }
+
+func TestStructuredLogging(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/large" {
+			w.Write(make([]byte, 2048))
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	logger := &recordingLogger{}
+	f, err := New(StructuredLogging(logger), MaxResponseBodyBytes(1024))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	re, _, err = testutils.Get(proxy.URL + "/large")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	require.Len(t, logger.events, 3)
+
+	roundTrip := logger.events[0]
+	assert.Equal(t, "debug", roundTrip.level)
+	assert.Equal(t, "round trip", roundTrip.msg)
+	assert.Equal(t, testutils.ParseURI(srv.URL).Host, roundTrip.fields["upstream"])
+	assert.Equal(t, http.StatusOK, roundTrip.fields["status"])
+	assert.EqualValues(t, 5, roundTrip.fields["length"])
+	assert.IsType(t, time.Duration(0), roundTrip.fields["duration"])
+
+	tooLarge := logger.events[1]
+	assert.Equal(t, "warn", tooLarge.level)
+	assert.Equal(t, "response body too large", tooLarge.msg)
+	assert.EqualValues(t, 1024, tooLarge.fields["limit"])
+
+	assert.Equal(t, "round trip", logger.events[2].msg)
+	assert.Equal(t, http.StatusInternalServerError, logger.events[2].fields["status"])
+}
+
+func TestUpstreamErrorKinds(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+
+	tlsSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsSrv.Close()
+
+	slow := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	defer slow.Close()
+
+	testCases := []struct {
+		desc     string
+		url      string
+		options  []optSetter
+		expected error
+	}{
+		{desc: "connection refused", url: closedURL, expected: ErrConnRefused},
+		{desc: "dns", url: "http://oxy-upstream.invalid", expected: ErrDNS},
+		{desc: "tls handshake", url: tlsSrv.URL, expected: ErrTLSHandshake},
+		{
+			desc:     "response header timeout",
+			url:      slow.URL,
+			options:  []optSetter{RoundTripper(&http.Transport{ResponseHeaderTimeout: 5 * time.Millisecond})},
+			expected: ErrResponseHeaderTimeout,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var handlerErr error
+			options := append(test.options, ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+				handlerErr = err
+				utils.DefaultHandler.ServeHTTP(w, req, err)
+			})))
+			f, err := New(options...)
+			require.NoError(t, err)
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			req.RequestURI = ""
+			f.ServeHTTP(rw, req)
+
+			require.Error(t, handlerErr)
+			assert.True(t, errors.Is(handlerErr, test.expected), "unexpected error: %v", handlerErr)
+
+			var upstreamErr *UpstreamError
+			require.True(t, errors.As(handlerErr, &upstreamErr))
+			assert.Equal(t, test.expected, upstreamErr.Kind)
+		})
+	}
+}
+
+func TestMirror(t *testing.T) {
+	type mirrored struct {
+		uri, body, marker string
+	}
+	shadowReqs := make(chan mirrored, 10)
+	shadow := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		shadowReqs <- mirrored{uri: req.RequestURI, body: string(body), marker: req.Header.Get(XOxyMirror)}
+		// a slow shadow upstream doesn't delay the client
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer shadow.Close()
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	})
+	defer srv.Close()
+
+	f, err := New(Mirror(testutils.ParseURI(shadow.URL), 1), MirrorMaxBodyBytes(8))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	start := time.Now()
+	re, body, err := testutils.MakeRequest(proxy.URL+"/path?q=1", testutils.Method(http.MethodPost), testutils.Body("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+
+	select {
+	case m := <-shadowReqs:
+		assert.Equal(t, mirrored{uri: "/path?q=1", body: "hello", marker: "1"}, m)
+	case <-time.After(time.Second):
+		t.Fatal("request not mirrored")
+	}
+
+	// bodies over the limit are forwarded but not mirrored
+	re, body, err = testutils.MakeRequest(proxy.URL, testutils.Method(http.MethodPost), testutils.Body("a large body"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "a large body", string(body))
+
+	select {
+	case m := <-shadowReqs:
+		t.Errorf("unexpected mirrored request: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorShadowDown(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	logger := &recordingLogger{}
+	f, err := New(Mirror(testutils.ParseURI(closed.URL), 1), StructuredLogging(logger))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	// the failure of the mirrored request is logged through the structured logger
+	require.NoError(t, f.Close())
+	logger.mu.Lock()
+	var failed *logEvent
+	for i := range logger.events {
+		if logger.events[i].msg == "mirrored request failed" {
+			failed = &logger.events[i]
+		}
+	}
+	logger.mu.Unlock()
+	require.NotNil(t, failed)
+	assert.Equal(t, "debug", failed.level)
+	assert.Equal(t, testutils.ParseURI(closed.URL).Host, failed.fields["upstream"])
+
+	_, err = New(Mirror(testutils.ParseURI(closed.URL), 0))
+	assert.Error(t, err)
+	_, err = New(MirrorMaxBodyBytes(10))
+	assert.Error(t, err)
+}
+
+func TestClose(t *testing.T) {
+	// the servers and idle connections of the other tests are still around,
+	// a mirrored request that isn't canceled waits in persistConn.roundTrip
+	defer goleak.VerifyNone(t,
+		goleak.IgnoreTopFunction("internal/poll.runtime_pollWait"),
+		goleak.IgnoreTopFunction("net/http.(*persistConn).readLoop"),
+		goleak.IgnoreTopFunction("net/http.(*persistConn).writeLoop"),
+		goleak.IgnoreTopFunction("golang.org/x/net/http2.(*serverConn).serve"))
+
+	shadowReqs := make(chan struct{}, 1)
+	canceled := make(chan struct{}, 1)
+	shadow := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		shadowReqs <- struct{}{}
+		// blocks until Close cancels the mirrored request
+		<-req.Context().Done()
+		canceled <- struct{}{}
+	})
+	defer shadow.Close()
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(Mirror(testutils.ParseURI(shadow.URL), 1), MaxIdleConns(10))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	select {
+	case <-shadowReqs:
+	case <-time.After(time.Second):
+		t.Fatal("request not mirrored")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, f.Close())
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not cancel the mirrored request")
+	}
+
+	// requests are still forwarded but no longer mirrored
+	re, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	select {
+	case <-shadowReqs:
+		t.Error("unexpected mirrored request")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, f.Close())
+}
+
+// newNamedTLSServer starts a TLS server whose certificate is only valid for name, not for its IP address
+func newNamedTLSServer(t *testing.T, name string, handler http.HandlerFunc) (*httptest.Server, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv.StartTLS()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return srv, pool
+}
+
+func TestUpstreamTLSServerName(t *testing.T) {
+	var serverNames []string
+	var mu sync.Mutex
+	srv, pool := newNamedTLSServer(t, "backend.internal", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		serverNames = append(serverNames, req.TLS.ServerName)
+		mu.Unlock()
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	testCases := []struct {
+		desc         string
+		options      []optSetter
+		header       string
+		expectedCode int
+	}{
+		{
+			desc:         "certificate not valid for the dial host",
+			options:      []optSetter{UpstreamTLSConfig(&tls.Config{RootCAs: pool})},
+			expectedCode: http.StatusInternalServerError,
+		},
+		{
+			desc:         "static server name",
+			options:      []optSetter{UpstreamTLSConfig(&tls.Config{RootCAs: pool}), UpstreamTLSServerName("backend.internal")},
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc: "server name per request",
+			options: []optSetter{UpstreamTLSConfig(&tls.Config{RootCAs: pool}), UpstreamTLSServerNameFunc(func(req *http.Request) string {
+				return req.Header.Get("X-Backend")
+			})},
+			header:       "backend.internal",
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc: "server name per request not matching",
+			options: []optSetter{UpstreamTLSConfig(&tls.Config{RootCAs: pool}), UpstreamTLSServerNameFunc(func(req *http.Request) string {
+				return req.Header.Get("X-Backend")
+			})},
+			header:       "other.internal",
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			mu.Lock()
+			serverNames = nil
+			mu.Unlock()
+
+			f, err := New(test.options...)
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, _, err := testutils.Get(proxy.URL, testutils.Header("X-Backend", test.header))
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedCode, re.StatusCode)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if test.expectedCode == http.StatusOK {
+				assert.Equal(t, []string{"backend.internal"}, serverNames)
+			} else {
+				assert.Empty(t, serverNames)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSServerNameTransports(t *testing.T) {
+	var remoteAddrs []string
+	var mu sync.Mutex
+	srv, pool := newNamedTLSServer(t, "backend.internal", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		remoteAddrs = append(remoteAddrs, req.RemoteAddr)
+		mu.Unlock()
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(UpstreamTLSConfig(&tls.Config{RootCAs: pool}), UpstreamTLSServerNameFunc(func(req *http.Request) string {
+		return "backend.internal"
+	}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		req.URL = testutils.ParseURI(srv.URL)
-		proxy.ServeHTTP(rw, req)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		re, _, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	// Close closes the idle connections of the transport of the server name
+	require.NoError(t, f.Close())
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, remoteAddrs, 3)
+	assert.Equal(t, remoteAddrs[0], remoteAddrs[1])
+	assert.NotEqual(t, remoteAddrs[1], remoteAddrs[2])
+
+	// the transports are bounded, the least recently used is evicted
+	rt := &serverNameRoundTripper{Transport: &http.Transport{TLSClientConfig: &tls.Config{}}}
+	first := rt.transport("0")
+	for i := 1; i < maxServerNameTransports; i++ {
+		rt.transport(strconv.Itoa(i))
+	}
+	assert.Same(t, first, rt.transport("0"))
+	rt.transport("new")
+	assert.Len(t, rt.transports, maxServerNameTransports)
+	assert.NotContains(t, rt.transports, "1")
+	assert.Contains(t, rt.transports, "0")
+	assert.Equal(t, "new", rt.transport("new").TLSClientConfig.ServerName)
+}
+
+func TestUpstreamTLSServerNameTransportEvicted(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
 	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	srv.Start()
+	defer srv.Close()
 
-	resp, _ := http.Get(proxySrv.URL)
-	ioutil.ReadAll(resp.Body)
+	rt := &serverNameRoundTripper{Transport: &http.Transport{TLSClientConfig: &tls.Config{}}}
 
-	require.Equal(t, resp.Trailer.Get("X-Trailer"), "foo")
+	// a round trip got the transport right before it is evicted
+	e := rt.acquire("0")
+	for i := 1; i <= maxServerNameTransports; i++ {
+		rt.transport(strconv.Itoa(i))
+	}
+	require.NotContains(t, rt.transports, "0")
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	re, err := e.transport.RoundTrip(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	re.Body.Close()
+
+	select {
+	case <-closed:
+		t.Fatal("the connection was closed before the round trip was released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the connection is closed once the evicted transport is drained
+	rt.release(e)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection of the evicted transport was not closed")
+	}
+}
+
+// proxyProtocolListener reads the PROXY protocol header of the accepted connections before serving them
+type proxyProtocolListener struct {
+	net.Listener
+	headers chan []byte
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	var header []byte
+	if sig, _ := r.Peek(12); bytes.Equal(sig, proxyProtocolV2Signature) {
+		header = make([]byte, 16)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+		if _, err := io.ReadFull(r, addrs); err != nil {
+			return nil, err
+		}
+		header = append(header, addrs...)
+	} else {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		header = []byte(line)
+	}
+	l.headers <- header
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		version := version
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			ppl := &proxyProtocolListener{Listener: l, headers: make(chan []byte, 10)}
+
+			srv := &httptest.Server{Listener: ppl, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("hello"))
+			})}}
+			srv.Start()
+			defer srv.Close()
+
+			f, err := New(SendProxyProtocol(version))
+			require.NoError(t, err)
+
+			var clientAddr string
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				clientAddr = req.RemoteAddr
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, body, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, "hello", string(body))
+
+			src, err := net.ResolveTCPAddr("tcp", clientAddr)
+			require.NoError(t, err)
+			dst := proxy.Listener.Addr().(*net.TCPAddr)
+
+			header := <-ppl.headers
+			if version == 1 {
+				assert.Equal(t, fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n", src.Port, dst.Port), string(header))
+				return
+			}
+
+			expected := append([]byte{}, proxyProtocolV2Signature...)
+			expected = append(expected, 0x21, 0x11, 0x00, 12, 127, 0, 0, 1, 127, 0, 0, 1)
+			expected = append(expected, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+			assert.Equal(t, expected, header)
+		})
+	}
+
+	_, err := New(SendProxyProtocol(3))
+	assert.Error(t, err)
+}
+
+func TestDecompressResponse(t *testing.T) {
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte("hello gzip"))
+	gw.Close()
+
+	var zlibbed bytes.Buffer
+	zw := zlib.NewWriter(&zlibbed)
+	zw.Write([]byte("hello zlib"))
+	zw.Close()
+
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	fw.Write([]byte("hello deflate"))
+	fw.Close()
+
+	testCases := []struct {
+		desc             string
+		encoding         string
+		extraEncoding    string
+		body             []byte
+		enabled          bool
+		expectedBody     string
+		expectedEncoding string
+		expectedAccept   string
+	}{
+		{desc: "gzip", encoding: "gzip", body: gzipped.Bytes(), enabled: true, expectedBody: "hello gzip", expectedAccept: "gzip, deflate"},
+		{desc: "zlib wrapped deflate", encoding: "deflate", body: zlibbed.Bytes(), enabled: true, expectedBody: "hello zlib", expectedAccept: "gzip, deflate"},
+		{desc: "raw deflate", encoding: "deflate", body: deflated.Bytes(), enabled: true, expectedBody: "hello deflate", expectedAccept: "gzip, deflate"},
+		{desc: "unsupported encoding", encoding: "br", body: []byte("brotli"), enabled: true, expectedBody: "brotli", expectedEncoding: "br", expectedAccept: "gzip, deflate"},
+		{desc: "disabled", encoding: "gzip", body: gzipped.Bytes(), expectedBody: gzipped.String(), expectedEncoding: "gzip", expectedAccept: "gzip, deflate, br"},
+		{desc: "br stacked on gzip", encoding: "gzip, br", body: []byte("brotli"), enabled: true, expectedBody: "brotli", expectedEncoding: "gzip, br", expectedAccept: "gzip, deflate"},
+		{desc: "br stacked on gzip in separate headers", encoding: "gzip", extraEncoding: "br", body: []byte("brotli"), enabled: true, expectedBody: "brotli", expectedEncoding: "gzip", expectedAccept: "gzip, deflate"},
+		{desc: "unknown encoding", encoding: "zstd", body: []byte("zstd"), enabled: true, expectedBody: "zstd", expectedEncoding: "zstd", expectedAccept: "gzip, deflate"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var outAccept string
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				outAccept = req.Header.Get("Accept-Encoding")
+				w.Header().Set(ContentEncoding, test.encoding)
+				if test.extraEncoding != "" {
+					w.Header().Add(ContentEncoding, test.extraEncoding)
+				}
+				w.Header().Set(ContentLength, strconv.Itoa(len(test.body)))
+				w.Write(test.body)
+			})
+			defer srv.Close()
+
+			var modifiedBody string
+			f, err := New(DecompressResponse(test.enabled), ResponseModifier(func(resp *http.Response) error {
+				body, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					return err
+				}
+				modifiedBody = string(body)
+				resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+				return nil
+			}))
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			// the client doesn't decode the response when it sets Accept-Encoding itself
+			re, body, err := testutils.Get(proxy.URL, testutils.Header("Accept-Encoding", "gzip, deflate, br"))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, test.expectedBody, modifiedBody)
+			assert.Equal(t, test.expectedBody, string(body))
+			assert.Equal(t, test.expectedEncoding, re.Header.Get(ContentEncoding))
+			assert.Equal(t, test.expectedAccept, outAccept)
+			if test.expectedEncoding == "" {
+				assert.Equal(t, int64(-1), re.ContentLength)
+			}
+		})
+	}
+}
+
+func TestWithoutBrotli(t *testing.T) {
+	testCases := []struct {
+		accept   []string
+		expected []string
+	}{
+		{accept: nil, expected: nil},
+		{accept: []string{"gzip, br;q=1.0, deflate;q=0.5"}, expected: []string{"gzip, deflate;q=0.5"}},
+		{accept: []string{"BR", "gzip"}, expected: []string{"gzip"}},
+		{accept: []string{"br"}, expected: []string{"identity"}},
+	}
+	for _, test := range testCases {
+		h := http.Header{}
+		if test.accept != nil {
+			h["Accept-Encoding"] = test.accept
+		}
+		withoutBrotli(h)
+		assert.Equal(t, test.expected, h["Accept-Encoding"], "accept %v", test.accept)
+	}
+}
+
+func TestDecompressStreamedResponse(t *testing.T) {
+	next := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ContentEncoding, "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte("first\n"))
+		gw.Flush()
+		w.(http.Flusher).Flush()
+		<-next
+		gw.Write([]byte("second\n"))
+		gw.Close()
+	})
+	defer srv.Close()
+
+	f, err := New(DecompressResponse(true), FlushInterval(-1))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	re, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer re.Body.Close()
+
+	// the first line is decoded before the upstream sends the rest of the body
+	r := bufio.NewReader(re.Body)
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", line)
+
+	close(next)
+	rest, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", string(rest))
+}
+
+func TestRequestBodyInspector(t *testing.T) {
+	var upstreamBody string
+	var upstreamCalled int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&upstreamCalled, 1)
+		body, _ := ioutil.ReadAll(req.Body)
+		upstreamBody = string(body)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	var inspected string
+	var truncated bool
+	f, err := New(RequestBodyInspectorMaxBytes(5), RequestBodyInspector(func(req *http.Request, body []byte) error {
+		inspected = string(body)
+		truncated = RequestBodyTruncated(req)
+		if strings.Contains(inspected, "evil") {
+			return errors.New("rejected")
+		}
+		return nil
+	}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Post(proxy.URL, testutils.Body("small"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "small", inspected)
+	assert.False(t, truncated)
+	assert.Equal(t, "small", upstreamBody)
+
+	// the inspector gets the beginning of larger bodies, the upstream gets the whole body
+	re, _, err = testutils.Post(proxy.URL, testutils.Body("larger body"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "large", inspected)
+	assert.True(t, truncated)
+	assert.Equal(t, "larger body", upstreamBody)
+
+	re, _, err = testutils.Post(proxy.URL, testutils.Body("evil"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&upstreamCalled))
+
+	_, err = New(RequestBodyInspectorMaxBytes(-1))
+	assert.Error(t, err)
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	testCases := []struct {
+		desc         string
+		wait         time.Duration
+		releaseAfter time.Duration
+		expected     int
+	}{
+		{desc: "fast fail", expected: http.StatusServiceUnavailable},
+		{desc: "wait timeout", wait: 50 * time.Millisecond, expected: http.StatusServiceUnavailable},
+		{desc: "wait for a slot", wait: 5 * time.Second, releaseAfter: 50 * time.Millisecond, expected: http.StatusOK},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(MaxConcurrentRequests(1), MaxConcurrentRequestsWait(test.wait))
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				testutils.Get(proxy.URL + "/slow")
+			}()
+			<-started
+			assert.Equal(t, 1, f.InFlight())
+
+			if test.releaseAfter > 0 {
+				time.AfterFunc(test.releaseAfter, func() { release <- struct{}{} })
+			}
+
+			re, _, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, re.StatusCode)
+
+			if test.releaseAfter == 0 {
+				release <- struct{}{}
+			}
+			<-done
+			assert.Equal(t, 0, f.InFlight())
+		})
+	}
+
+	_, err := New(MaxConcurrentRequests(0))
+	assert.Error(t, err)
+
+	_, err = New(MaxConcurrentRequestsWait(time.Second))
+	assert.Error(t, err)
+}
+
+func TestMaxConcurrentRequestsReleasedOnPanic(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(MaxConcurrentRequests(1), ResponseModifier(func(*http.Response) error {
+		panic("boom")
+	}))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	req.URL = testutils.ParseURI(srv.URL)
+	assert.Panics(t, func() {
+		f.ServeHTTP(httptest.NewRecorder(), req)
+	})
+	assert.Equal(t, 0, f.InFlight())
+}
+
+func TestCoalesceRequests(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		w.Header().Set("X-Call", strconv.Itoa(int(n)))
+		w.Write([]byte("hello " + req.Method))
+	})
+	defer srv.Close()
+
+	f, err := New(CoalesceRequests(nil), CoalesceMethods(http.MethodGet, http.MethodPost))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			re, body, err := testutils.Get(proxy.URL + "/slow")
+			if assert.NoError(t, err) {
+				assert.Equal(t, "1", re.Header.Get("X-Call"))
+				bodies[i] = string(body)
+			}
+		}(i)
+	}
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// every client reads the whole shared body
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, []string{"hello GET", "hello GET", "hello GET", "hello GET", "hello GET"}, bodies)
+
+	// the following requests are forwarded again
+	re, _, err := testutils.Get(proxy.URL + "/slow")
+	require.NoError(t, err)
+	assert.Equal(t, "2", re.Header.Get("X-Call"))
+
+	// only the configured methods are coalesced
+	_, body, err := testutils.Post(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "hello POST", string(body))
+
+	_, body, err = testutils.MakeRequest(proxy.URL, testutils.Method(http.MethodPut))
+	require.NoError(t, err)
+	assert.Equal(t, "hello PUT", string(body))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	_, err = New(CoalesceMethods(http.MethodGet))
+	assert.Error(t, err)
+	_, err = New(CoalesceMaxBodyBytes(1))
+	assert.Error(t, err)
+	_, err = New(CoalesceRequests(nil), CoalesceMaxBodyBytes(0))
+	assert.Error(t, err)
+}
+
+func TestCoalesceRequestsPrivate(t *testing.T) {
+	var calls int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("hello " + req.Header.Get("Cookie") + req.Header.Get("Authorization")))
+	})
+	defer srv.Close()
+
+	f, err := New(CoalesceRequests(func(req *http.Request) string { return "key" }))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// the responses of the requests with credentials are never shared
+	var wg sync.WaitGroup
+	users := []testutils.ReqOption{
+		testutils.Header("Cookie", "user=a"), testutils.Header("Cookie", "user=b"),
+		testutils.Header("Authorization", "Bearer c"), testutils.Header("Authorization", "Bearer d"),
+	}
+	bodies := make([]string, len(users))
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, body, err := testutils.Get(proxy.URL, users[i])
+			if assert.NoError(t, err) {
+				bodies[i] = string(body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, []string{"hello user=a", "hello user=b", "hello Bearer c", "hello Bearer d"}, bodies)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
+
+func TestCoalesceRequestsLargeBody(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+		w.Write([]byte(strings.Repeat("a", 100)))
+	})
+	defer srv.Close()
+
+	f, err := New(CoalesceRequests(nil), CoalesceMaxBodyBytes(10))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// the responses larger than the limit are passed through, the other requests are forwarded on their own
+	var wg sync.WaitGroup
+	bodies := make([]string, 3)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, body, err := testutils.Get(proxy.URL)
+			if assert.NoError(t, err) {
+				bodies[i] = string(body)
+			}
+		}(i)
+	}
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for _, body := range bodies {
+		assert.Equal(t, strings.Repeat("a", 100), body)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestCoalesceRequestsAborted(t *testing.T) {
+	var calls int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// the upstream aborts the response in the middle of the body
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(CoalesceRequests(nil))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	_, _, err = testutils.Get(proxy.URL)
+	require.Error(t, err)
+
+	// the key is released
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, body, err := testutils.Get(proxy.URL)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "hello", string(body))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the response")
+	}
 }
@@ -2,12 +2,14 @@ package forward
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -545,6 +547,41 @@ func TestDetectsWebSocketRequest(t *testing.T) {
 	assert.Equal(t, "ok", resp)
 }
 
+func TestIsWebsocketRequest(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		connection []string
+		upgrade    []string
+		expected   bool
+	}{
+		{desc: "upgrade", connection: []string{"Upgrade"}, upgrade: []string{"websocket"}, expected: true},
+		{desc: "mixed case", connection: []string{"UPGRADE"}, upgrade: []string{"WebSocket"}, expected: true},
+		{desc: "comma-separated connection tokens", connection: []string{"keep-alive, Upgrade"}, upgrade: []string{"websocket"}, expected: true},
+		{desc: "repeated connection fields", connection: []string{"keep-alive", "Upgrade"}, upgrade: []string{"websocket"}, expected: true},
+		{desc: "several upgrade protocols", connection: []string{"Upgrade"}, upgrade: []string{"h2c, WebSocket"}, expected: true},
+		{desc: "no connection upgrade", connection: []string{"keep-alive"}, upgrade: []string{"websocket"}},
+		{desc: "other protocol", connection: []string{"Upgrade"}, upgrade: []string{"h2c"}},
+		{desc: "token prefix", connection: []string{"Upgrade-Insecure"}, upgrade: []string{"websocket2"}},
+		{desc: "no headers"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/ws", nil)
+			for _, v := range test.connection {
+				req.Header.Add(Connection, v)
+			}
+			for _, v := range test.upgrade {
+				req.Header.Add(Upgrade, v)
+			}
+			assert.Equal(t, test.expected, IsWebsocketRequest(req))
+		})
+	}
+}
+
 func TestWebSocketUpgradeFailed(t *testing.T) {
 	f, err := New()
 	require.NoError(t, err)
@@ -717,6 +754,287 @@ func TestWebSocketTransferTLSConfig(t *testing.T) {
 	assert.Equal(t, "ok", resp)
 }
 
+func TestWebSocketMaxMessageSize(t *testing.T) {
+	f, err := New(WebsocketMaxMessageSize(8))
+	require.NoError(t, err)
+
+	backendErr := make(chan error, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				backendErr <- err
+				return
+			}
+			conn.WriteMessage(mt, msg)
+		}
+	})
+	defer srv.Close()
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	conn, resp, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err, "Error during Dial with response: %+v", resp)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("small")))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "small", string(msg))
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("this message is too big")))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseMessageTooBig), "unexpected error: %v", err)
+
+	select {
+	case err := <-backendErr:
+		assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseMessageTooBig), "unexpected error: %v", err)
+	case <-time.After(time.Second):
+		t.Error("backend connection not closed")
+	}
+
+	_, err = New(WebsocketMaxMessageSize(0))
+	assert.Error(t, err)
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		compression bool
+	}{
+		{desc: "enabled", compression: true},
+		{desc: "disabled", compression: false},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(WebsocketCompression(test.compression))
+			require.NoError(t, err)
+
+			var backendExtensions string
+			upgrader := gorillawebsocket.Upgrader{EnableCompression: true}
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				if !IsWebsocketRequest(req) {
+					w.Write([]byte("hello"))
+					return
+				}
+				backendExtensions = req.Header.Get(SecWebsocketExtensions)
+				conn, err := upgrader.Upgrade(w, req, nil)
+				require.NoError(t, err)
+				defer conn.Close()
+				mt, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				conn.WriteMessage(mt, msg)
+			})
+			defer srv.Close()
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			dialer := gorillawebsocket.Dialer{EnableCompression: true}
+			conn, resp, err := dialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+			require.NoError(t, err, "Error during Dial with response: %+v", resp)
+			defer conn.Close()
+
+			assert.Equal(t, test.compression, hasPermessageDeflate(resp.Header))
+			assert.Equal(t, test.compression, backendExtensions != "")
+
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("hello")))
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(msg))
+
+			// plain HTTP requests are unaffected
+			re, body, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, "hello", string(body))
+		})
+	}
+}
+
+func TestWebsocketConnObserver(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		normalClosure bool
+	}{
+		{desc: "normal closure", normalClosure: true},
+		{desc: "client closes abruptly", normalClosure: false},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			events := make(chan WSConnEvent, 2)
+			f, err := New(WebsocketConnObserver(func(ev WSConnEvent) { events <- ev }))
+			require.NoError(t, err)
+
+			upgrader := gorillawebsocket.Upgrader{}
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				conn, err := upgrader.Upgrade(w, req, nil)
+				require.NoError(t, err)
+				defer conn.Close()
+				for {
+					mt, msg, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					conn.WriteMessage(mt, msg)
+					conn.WriteMessage(mt, msg)
+				}
+			})
+			defer srv.Close()
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+			require.NoError(t, err, "Error during Dial with response: %+v", resp)
+
+			opened := <-events
+			assert.Equal(t, WSConnOpened, opened.Type)
+			assert.Equal(t, "/ws", opened.Request.RequestURI)
+			assert.False(t, opened.Opened.IsZero())
+			assert.True(t, opened.Closed.IsZero())
+
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("hello")))
+			for i := 0; i < 2; i++ {
+				_, _, err = conn.ReadMessage()
+				require.NoError(t, err)
+			}
+
+			if test.normalClosure {
+				msg := gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "")
+				require.NoError(t, conn.WriteControl(gorillawebsocket.CloseMessage, msg, time.Now().Add(time.Second)))
+			}
+			conn.Close()
+
+			select {
+			case closed := <-events:
+				assert.Equal(t, WSConnClosed, closed.Type)
+				assert.Equal(t, opened.Opened, closed.Opened)
+				assert.False(t, closed.Closed.Before(closed.Opened))
+				assert.Equal(t, int64(5), closed.BytesToUpstream)
+				assert.Equal(t, int64(10), closed.BytesToClient)
+				if test.normalClosure {
+					assert.NoError(t, closed.Err)
+				} else {
+					assert.Error(t, closed.Err)
+				}
+			case <-time.After(time.Second):
+				t.Error("close event not received")
+			}
+		})
+	}
+}
+
+func TestWebsocketTransferObserver(t *testing.T) {
+	type transfer struct {
+		req, resp int64
+	}
+	transfers := make(chan transfer, 1)
+	f, err := New(TransferObserver(func(req *http.Request, reqBytes, respBytes int64) {
+		transfers <- transfer{req: reqBytes, resp: respBytes}
+	}))
+	require.NoError(t, err)
+
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, append(msg, msg...))
+		}
+	})
+	defer srv.Close()
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	conn, resp, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err, "Error during Dial with response: %+v", resp)
+
+	for _, msg := range []string{"hello", "world!"} {
+		require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte(msg)))
+		_, _, err = conn.ReadMessage()
+		require.NoError(t, err)
+	}
+	msg := gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "")
+	require.NoError(t, conn.WriteControl(gorillawebsocket.CloseMessage, msg, time.Now().Add(time.Second)))
+	conn.Close()
+
+	select {
+	case tr := <-transfers:
+		assert.Equal(t, transfer{req: 11, resp: 22}, tr)
+	case <-time.After(time.Second):
+		t.Error("transfer not reported")
+	}
+}
+
+func TestWebsocketDialContext(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(mt, msg)
+	})
+	defer srv.Close()
+
+	f, err := New(DialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != "backend.internal:80" {
+			return nil, fmt.Errorf("unknown upstream %v", addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, srv.Listener.Addr().String())
+	}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://backend.internal:80")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	conn, resp, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err, "Error during Dial with response: %+v", resp)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("hello")))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+}
+
 const dialTimeout = time.Second
 
 type websocketRequestOpt func(w *websocketRequest)
@@ -798,3 +1116,286 @@ func (w *websocketRequest) open() (*websocket.Conn, net.Conn, error) {
 	}
 	return conn, client, err
 }
+
+func TestWebSocketMaxConcurrentRequests(t *testing.T) {
+	f, err := New(MaxConcurrentRequests(1))
+	require.NoError(t, err)
+
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		c, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, message); err != nil {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	webSocketURL := "ws://" + proxy.Listener.Addr().String() + "/ws"
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(webSocketURL, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("ping")))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(msg))
+
+	// the slot is held as long as the connection is open
+	assert.Equal(t, 1, f.InFlight())
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(webSocketURL, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	conn.Close()
+	assert.Eventually(t, func() bool { return f.InFlight() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestWebSocketDefaultUserAgent(t *testing.T) {
+	f, err := New(DefaultUserAgent(""))
+	require.NoError(t, err)
+
+	var outUA []string
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outUA = req.Header[UserAgent]
+		c, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		c.Close()
+	})
+	defer srv.Close()
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	// the empty value prevents the client from sending its own user agent
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", http.Header{UserAgent: {""}})
+	require.NoError(t, err)
+	conn.Close()
+
+	assert.Nil(t, outUA)
+}
+
+func TestWebSocketUpstreamDropped(t *testing.T) {
+	f, err := New()
+	require.NoError(t, err)
+
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		c, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		// the upstream goes away without a close frame after the first message
+		c.ReadMessage()
+		c.UnderlyingConn().Close()
+	})
+	defer srv.Close()
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("ping")))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseGoingAway), "unexpected error: %v", err)
+}
+
+func TestWebSocketClientClosePropagated(t *testing.T) {
+	f, err := New()
+	require.NoError(t, err)
+
+	upstreamErr := make(chan error, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		c, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _, err = c.ReadMessage()
+		upstreamErr <- err
+	})
+	defer srv.Close()
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msg := gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseGoingAway, "bye")
+	require.NoError(t, conn.WriteControl(gorillawebsocket.CloseMessage, msg, time.Now().Add(time.Second)))
+
+	// the upstream replies to the close frame, which is sent back to the client
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseGoingAway), "unexpected error: %v", err)
+
+	err = <-upstreamErr
+	closeErr, ok := err.(*gorillawebsocket.CloseError)
+	require.True(t, ok, "unexpected error: %v", err)
+	assert.Equal(t, gorillawebsocket.CloseGoingAway, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Text)
+}
+
+func TestWebSocketHandshakeTimeout(t *testing.T) {
+	t.Run("stalling dial", func(t *testing.T) {
+		f, err := New(WebsocketHandshakeTimeout(100*time.Millisecond), WebsocketNetDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}))
+		require.NoError(t, err)
+
+		proxy := createProxyWithForwarder(f, "http://127.0.0.1:1")
+		defer proxy.Close()
+
+		start := time.Now()
+		_, resp, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+		require.Error(t, err)
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+		assert.True(t, time.Since(start) < time.Second)
+	})
+
+	t.Run("stalling upstream handshake", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		// the upstream accepts the connection but never answers the handshake
+		closed := make(chan struct{})
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Read(make([]byte, 4096))
+			// the half-open connection is closed by the forwarder
+			for {
+				if _, err := conn.Read(make([]byte, 4096)); err != nil {
+					close(closed)
+					return
+				}
+			}
+		}()
+
+		f, err := New(WebsocketHandshakeTimeout(100 * time.Millisecond))
+		require.NoError(t, err)
+
+		proxy := createProxyWithForwarder(f, "http://"+ln.Addr().String())
+		defer proxy.Close()
+
+		_, resp, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+		require.Error(t, err)
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Error("upstream connection not closed")
+		}
+	})
+
+	t.Run("data phase", func(t *testing.T) {
+		upgrader := gorillawebsocket.Upgrader{}
+		srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			c, err := upgrader.Upgrade(w, req, nil)
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			mt, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.WriteMessage(mt, message)
+		})
+		defer srv.Close()
+
+		f, err := New(WebsocketHandshakeTimeout(100 * time.Millisecond))
+		require.NoError(t, err)
+
+		proxy := createProxyWithForwarder(f, srv.URL)
+		defer proxy.Close()
+
+		conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		time.Sleep(300 * time.Millisecond)
+		require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("ping")))
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(msg))
+	})
+
+	_, err := New(WebsocketHandshakeTimeout(0))
+	assert.Error(t, err)
+}
+
+func TestWebSocketMaxHandshakeHeaderBytes(t *testing.T) {
+	var dialed bool
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		dialed = true
+		var header http.Header
+		if req.URL.Path == "/large" {
+			header = http.Header{"X-Large": {strings.Repeat("a", 1024)}}
+		}
+		c, err := upgrader.Upgrade(w, req, header)
+		if err != nil {
+			return
+		}
+		c.Close()
+	})
+	defer srv.Close()
+
+	f, err := New(WebsocketMaxHandshakeHeaderBytes(512))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+	wsURL := "ws://" + proxy.Listener.Addr().String()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL+"/ws", nil)
+	require.NoError(t, err)
+	conn.Close()
+
+	dialed = false
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL+"/ws", http.Header{"X-Large": {strings.Repeat("a", 1024)}})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	assert.False(t, dialed)
+
+	_, resp, err = gorillawebsocket.DefaultDialer.Dial(wsURL+"/large", nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	_, err = New(WebsocketMaxHandshakeHeaderBytes(0))
+	assert.Error(t, err)
+}
@@ -0,0 +1,37 @@
+package forward
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cScheme is the upstream URL scheme used to select cleartext HTTP/2 forwarding
+const h2cScheme = "h2c"
+
+// h2cRoundTripper sends requests targeting h2c upstreams through the HTTP/2 transport
+// and all the other requests through the regular round tripper
+type h2cRoundTripper struct {
+	http.RoundTripper
+	h2c *http2.Transport
+}
+
+func (h *h2cRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	isH2C, _ := req.Context().Value(h2cUpstreamKey).(bool)
+	if !isH2C {
+		return h.RoundTripper.RoundTrip(req)
+	}
+
+	resp, err := h.h2c.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// HTTP/2 responses can carry both a Content-Length and trailers, HTTP/1.1 clients can only
+	// receive trailers with chunked encoding, so the length is dropped to force it.
+	if len(resp.Trailer) > 0 {
+		resp.Header.Del(ContentLength)
+		resp.ContentLength = -1
+	}
+	return resp, nil
+}
@@ -0,0 +1,117 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HeaderTooLargeError is reported to the ErrorHandler when the headers of a request exceed MaxRequestHeaderBytes
+// or the headers of an upstream response exceed MaxResponseHeaderBytes, or WebsocketMaxHandshakeHeaderBytes for both
+type HeaderTooLargeError struct {
+	// Response is set when the headers of the upstream response are too large
+	Response bool
+	Size     int
+	Limit    int
+}
+
+func (e *HeaderTooLargeError) Error() string {
+	if e.Response {
+		return fmt.Sprintf("response headers too large: %d bytes, limit %d", e.Size, e.Limit)
+	}
+	return fmt.Sprintf("request headers too large: %d bytes, limit %d", e.Size, e.Limit)
+}
+
+// StatusCode is the status code answered by the default error handler, 431 for the requests and 502 for the responses
+func (e *HeaderTooLargeError) StatusCode() int {
+	if e.Response {
+		return http.StatusBadGateway
+	}
+	return http.StatusRequestHeaderFieldsTooLarge
+}
+
+// MaxRequestHeaderBytes rejects the requests whose headers, names and values with the Host, exceed limit bytes.
+// They are reported to the ErrorHandler with a HeaderTooLargeError before anything is sent upstream.
+//
+// Unlike http.Server.MaxHeaderBytes, that bounds what the server reads for all its handlers, the limit is
+// enforced by the forwarder only, e.g. to allow larger headers on other routes, and applies to the requests
+// whatever the server they come from.
+func MaxRequestHeaderBytes(limit int) optSetter {
+	return func(f *Forwarder) error {
+		if limit <= 0 {
+			return fmt.Errorf("max request header bytes should be > 0, got %v", limit)
+		}
+		f.httpForwarder.maxRequestHeaderBytes = limit
+		return nil
+	}
+}
+
+// MaxResponseHeaderBytes rejects the upstream responses whose headers exceed limit bytes, they are reported
+// to the ErrorHandler with a HeaderTooLargeError and nothing is sent to the client.
+//
+// The transport created by the Forwarder stops reading the responses a few kilobytes past the limit, as it counts
+// the status line too. A transport set with the RoundTripper option reads up to its own
+// Transport.MaxResponseHeaderBytes before the headers are checked.
+func MaxResponseHeaderBytes(limit int) optSetter {
+	return func(f *Forwarder) error {
+		if limit <= 0 {
+			return fmt.Errorf("max response header bytes should be > 0, got %v", limit)
+		}
+		f.httpForwarder.maxResponseHeaderBytes = limit
+		return nil
+	}
+}
+
+// responseHeaderSlack is read by the transport past MaxResponseHeaderBytes, so that the status line and
+// the header framing it counts too don't fail the responses that are within the limit
+const responseHeaderSlack = 4096
+
+// checkRequestHeader reports the requests whose headers exceed limit to the error handler
+func (f *httpForwarder) checkRequestHeader(w http.ResponseWriter, req *http.Request, ctx *handlerContext, limit int) bool {
+	size := headerSize(req.Header) + len("Host: \r\n") + len(req.Host)
+	if size <= limit {
+		return true
+	}
+	f.logEvent(log.WarnLevel, "request headers too large", []interface{}{"url", req.URL.String(), "size", size, "limit", limit},
+		"vulcand/oxy/forward: rejecting %v, %d bytes of headers exceed %d", req.URL, size, limit)
+	ctx.errHandler.ServeHTTP(w, req, &HeaderTooLargeError{Size: size, Limit: limit})
+	return false
+}
+
+// headerLimitRoundTripper fails the round trips whose response headers exceed the limit
+type headerLimitRoundTripper struct {
+	http.RoundTripper
+	limit int
+	f     *httpForwarder
+}
+
+func (rt *headerLimitRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.RoundTripper.RoundTrip(req)
+	if err != nil {
+		if strings.Contains(err.Error(), "server response headers exceeded") {
+			// the transport stopped reading the headers, at least that many bytes were received
+			return nil, &HeaderTooLargeError{Response: true, Size: rt.limit + responseHeaderSlack, Limit: rt.limit}
+		}
+		return nil, err
+	}
+	if size := headerSize(resp.Header); size > rt.limit {
+		resp.Body.Close()
+		rt.f.logEvent(log.WarnLevel, "response headers too large", []interface{}{"upstream", req.URL.Host, "url", req.URL.String(), "size", size, "limit", rt.limit},
+			"vulcand/oxy/forward/http: response of %v has %d bytes of headers, exceeding %d", req.URL, size, rt.limit)
+		return nil, &HeaderTooLargeError{Response: true, Size: size, Limit: rt.limit}
+	}
+	return resp, nil
+}
+
+// headerSize returns the size of the header lines, "Name: value\r\n"
+func headerSize(h http.Header) int {
+	size := 0
+	for name, values := range h {
+		for _, v := range values {
+			size += len(name) + len(v) + len(": \r\n")
+		}
+	}
+	return size
+}
@@ -8,6 +8,7 @@ const (
 	XForwardedPort         = "X-Forwarded-Port"
 	XForwardedServer       = "X-Forwarded-Server"
 	XRealIp                = "X-Real-Ip"
+	Forwarded              = "Forwarded"
 	Connection             = "Connection"
 	KeepAlive              = "Keep-Alive"
 	ProxyAuthenticate      = "Proxy-Authenticate"
@@ -17,10 +18,13 @@ const (
 	TransferEncoding       = "Transfer-Encoding"
 	Upgrade                = "Upgrade"
 	ContentLength          = "Content-Length"
+	ContentEncoding        = "Content-Encoding"
+	UserAgent              = "User-Agent"
 	SecWebsocketKey        = "Sec-Websocket-Key"
 	SecWebsocketVersion    = "Sec-Websocket-Version"
 	SecWebsocketExtensions = "Sec-Websocket-Extensions"
 	SecWebsocketAccept     = "Sec-Websocket-Accept"
+	XOxyMirror             = "X-Oxy-Mirror" // set on the requests mirrored to a shadow upstream
 )
 
 // HopHeaders Hop-by-hop headers. These are removed when sent to the backend.
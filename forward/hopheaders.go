@@ -0,0 +1,40 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+)
+
+// stashPreservedHeaders saves the values of the preserved hop-by-hop headers in the request context,
+// httputil.ReverseProxy strips them after the director has been called.
+func (f *httpForwarder) stashPreservedHeaders(outReq *http.Request) {
+	if len(f.preserveHeaders) == 0 {
+		return
+	}
+
+	preserved := make(http.Header)
+	for _, name := range f.preserveHeaders {
+		if values, ok := outReq.Header[name]; ok {
+			preserved[name] = append([]string(nil), values...)
+		}
+	}
+
+	if len(preserved) > 0 {
+		*outReq = *outReq.WithContext(context.WithValue(outReq.Context(), preservedHeadersKey, preserved))
+	}
+}
+
+// preserveHeadersRoundTripper restores the preserved hop-by-hop headers
+// right before the request is sent to the upstream
+type preserveHeadersRoundTripper struct {
+	http.RoundTripper
+}
+
+func (p *preserveHeadersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if preserved, ok := req.Context().Value(preservedHeadersKey).(http.Header); ok {
+		for name, values := range preserved {
+			req.Header[name] = values
+		}
+	}
+	return p.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,38 @@
+package forward
+
+import (
+	"net/http"
+)
+
+// UpgradeHTTP10Responses controls the framing of the responses of HTTP/1.0 upstreams delimited by the
+// connection close, defaults to false. Their body is always streamed until the upstream closes the connection,
+// by default the connection to the client is closed after the response as well. When enabled, HTTP/1.1
+// clients get the response with chunked framing instead and their connection is kept alive.
+func UpgradeHTTP10Responses(upgrade bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.upgradeHTTP10 = upgrade
+		return nil
+	}
+}
+
+// closeDelimited tells whether the end of the response body is only marked by the upstream closing the connection
+func closeDelimited(resp *http.Response) bool {
+	return !resp.ProtoAtLeast(1, 1) && resp.ContentLength < 0 && len(resp.TransferEncoding) == 0
+}
+
+// http10Framing wraps modifyResponse so that the client connection is closed after the close delimited
+// responses, the ReverseProxy removes the Connection header of the upstream response
+func (f *httpForwarder) http10Framing(w http.ResponseWriter, modifyResponse func(*http.Response) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if modifyResponse != nil {
+			if err := modifyResponse(resp); err != nil {
+				return err
+			}
+		}
+
+		if closeDelimited(resp) {
+			w.Header().Set(Connection, "close")
+		}
+		return nil
+	}
+}
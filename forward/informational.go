@@ -0,0 +1,63 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// ForwardInformationalResponses controls whether the 1xx informational responses of the upstream, e.g. 103 Early Hints
+// and their Link headers, are relayed to the client before the final response, defaults to true.
+// Some clients mishandle early hints, the upstream 1xx responses are then dropped.
+// Relaying them requires Go 1.19 or later.
+func ForwardInformationalResponses(forward bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.dropInformational = !forward
+		return nil
+	}
+}
+
+// informationalRoundTripper filters the 1xx responses reported to the Got1xxResponse hooks.
+// The 100 Continue of the upstream is never relayed: the transport only sends the body once it is received,
+// and reading the body answers the expectation of the client, relaying it would send a second one.
+// When dropAll is set no 1xx response is reported, the transport then discards them.
+type informationalRoundTripper struct {
+	http.RoundTripper
+	dropAll bool
+}
+
+func (i *informationalRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (!i.dropAll && !expectsContinue(req)) || httptrace.ContextClientTrace(req.Context()) == nil {
+		return i.RoundTripper.RoundTrip(req)
+	}
+	return i.RoundTripper.RoundTrip(req.WithContext(&filtered1xxContext{Context: req.Context(), dropAll: i.dropAll}))
+}
+
+// filtered1xxContext returns the client trace of its parent with a filtered Got1xxResponse hook
+type filtered1xxContext struct {
+	context.Context
+	dropAll bool
+}
+
+func (c *filtered1xxContext) Value(key interface{}) interface{} {
+	v := c.Context.Value(key)
+	trace, ok := v.(*httptrace.ClientTrace)
+	if !ok || trace.Got1xxResponse == nil {
+		return v
+	}
+
+	filtered := *trace
+	if c.dropAll {
+		filtered.Got1xxResponse = nil
+		return &filtered
+	}
+	got1xx := trace.Got1xxResponse
+	filtered.Got1xxResponse = func(code int, header textproto.MIMEHeader) error {
+		if code == http.StatusContinue {
+			return nil
+		}
+		return got1xx(code, header)
+	}
+	return &filtered
+}
@@ -0,0 +1,36 @@
+//go:build go1.19 && !go1.20
+// +build go1.19,!go1.20
+
+package forward
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// relayInformational relays the 1xx responses of the upstream to the client, the ReverseProxy does it
+// itself from Go 1.20 on
+func (f *httpForwarder) relayInformational(w http.ResponseWriter, outReq *http.Request) *http.Request {
+	if f.dropInformational {
+		return outReq
+	}
+
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			h := w.Header()
+			for k, vv := range header {
+				for _, v := range vv {
+					h.Add(k, v)
+				}
+			}
+			w.WriteHeader(code)
+			// the headers of a 1xx response are not cleared by WriteHeader
+			for k := range h {
+				delete(h, k)
+			}
+			return nil
+		},
+	}
+	return outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), trace))
+}
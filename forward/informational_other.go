@@ -0,0 +1,12 @@
+//go:build !go1.19 || go1.20
+// +build !go1.19 go1.20
+
+package forward
+
+import "net/http"
+
+// relayInformational leaves the 1xx responses to the ReverseProxy, which relays them from Go 1.20 on,
+// the ResponseWriter can not send them before Go 1.19
+func (f *httpForwarder) relayInformational(w http.ResponseWriter, outReq *http.Request) *http.Request {
+	return outReq
+}
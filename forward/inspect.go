@@ -0,0 +1,65 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const defaultInspectorMaxBodyBytes = 1 << 20
+
+// RequestBodyInspector calls fn with the request body before the request is forwarded, the body is
+// still sent to the upstream. Bodies larger than RequestBodyInspectorMaxBytes are truncated, see
+// RequestBodyTruncated. The request is rejected through the ErrorHandler when fn returns an error.
+// Reading the body answers the "Expect: 100-continue" of the client before the upstream is reached.
+func RequestBodyInspector(fn func(req *http.Request, body []byte) error) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.bodyInspector = fn
+		return nil
+	}
+}
+
+// RequestBodyInspectorMaxBytes sets the size of the request body buffered for the inspector, defaults to 1MB.
+func RequestBodyInspectorMaxBytes(n int64) optSetter {
+	return func(f *Forwarder) error {
+		if n < 0 {
+			return fmt.Errorf("inspector max body bytes should be >= 0, got %v", n)
+		}
+		f.httpForwarder.bodyInspectorMaxBytes = n
+		return nil
+	}
+}
+
+// RequestBodyTruncated tells the inspector whether the body it received is only a prefix of the request body
+func RequestBodyTruncated(req *http.Request) bool {
+	truncated, _ := req.Context().Value(bodyTruncatedKey).(bool)
+	return truncated
+}
+
+// inspectRequestBody buffers the beginning of the body for the inspector,
+// it returns the request to forward which reads the whole body.
+func (f *httpForwarder) inspectRequestBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, f.bodyInspector(req, nil)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, f.bodyInspectorMaxBytes+1))
+	if err != nil {
+		return req, err
+	}
+
+	truncated := int64(len(buf)) > f.bodyInspectorMaxBytes
+	outReq := req.WithContext(context.WithValue(req.Context(), bodyTruncatedKey, truncated))
+	outReq.Body = &struct {
+		io.Reader
+		io.Closer
+	}{Reader: io.MultiReader(bytes.NewReader(buf), req.Body), Closer: req.Body}
+
+	if truncated {
+		buf = buf[:f.bodyInspectorMaxBytes]
+	}
+	return outReq, f.bodyInspector(outReq, buf)
+}
@@ -0,0 +1,82 @@
+package forward
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// StructuredLogger is a leveled logger taking alternating keys and values, *slog.Logger implements it.
+type StructuredLogger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// logEvent logs an event of the proxy with its fields through the structured logger when one is set,
+// the formatted message is logged through the logrus logger otherwise.
+func (f *httpForwarder) logEvent(level log.Level, msg string, fields []interface{}, format string, args ...interface{}) {
+	if f.structuredLog == nil {
+		switch level {
+		case log.DebugLevel, log.TraceLevel:
+			f.log.Debugf(format, args...)
+		case log.InfoLevel:
+			f.log.Infof(format, args...)
+		case log.WarnLevel:
+			f.log.Warnf(format, args...)
+		default:
+			f.log.Errorf(format, args...)
+		}
+		return
+	}
+
+	switch level {
+	case log.DebugLevel, log.TraceLevel:
+		f.structuredLog.Debug(msg, fields...)
+	case log.InfoLevel:
+		f.structuredLog.Info(msg, fields...)
+	case log.WarnLevel:
+		f.structuredLog.Warn(msg, fields...)
+	default:
+		f.structuredLog.Error(msg, fields...)
+	}
+}
+
+// debugEnabled checks whether the debug events are logged, they are always passed to a structured logger
+func (f *httpForwarder) debugEnabled() bool {
+	return f.structuredLog != nil || f.log.GetLevel() >= log.DebugLevel
+}
+
+// logRoundTrip logs the result of a proxied request
+func (f *httpForwarder) logRoundTrip(req *http.Request, pw *utils.ProxyWriter, duration time.Duration) {
+	fields := []interface{}{
+		"upstream", req.URL.Host,
+		"url", req.URL.String(),
+		"status", pw.StatusCode(),
+		"length", pw.GetLength(),
+		"duration", duration,
+	}
+	if req.TLS == nil {
+		f.logEvent(log.DebugLevel, "round trip", fields,
+			"vulcand/oxy/forward/http: Round trip: %v, code: %v, Length: %v, duration: %v",
+			req.URL, pw.StatusCode(), pw.GetLength(), duration)
+		return
+	}
+
+	fields = append(fields,
+		"tls.version", req.TLS.Version,
+		"tls.resume", req.TLS.DidResume,
+		"tls.cipher_suite", req.TLS.CipherSuite,
+		"tls.server", req.TLS.ServerName,
+	)
+	f.logEvent(log.DebugLevel, "round trip", fields,
+		"vulcand/oxy/forward/http: Round trip: %v, code: %v, Length: %v, duration: %v tls:version: %x, tls:resume:%t, tls:csuite:%x, tls:server:%v",
+		req.URL, pw.StatusCode(), pw.GetLength(), duration,
+		req.TLS.Version,
+		req.TLS.DidResume,
+		req.TLS.CipherSuite,
+		req.TLS.ServerName)
+}
@@ -0,0 +1,193 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	defaultMirrorMaxBodyBytes = 1 << 20
+	// mirrorMaxInFlight bounds the shadow requests in flight, requests are not mirrored above it
+	mirrorMaxInFlight = 100
+	mirrorTimeout     = 30 * time.Second
+)
+
+// mirror sends a copy of a fraction of the requests to a shadow upstream and discards the responses
+type mirror struct {
+	target       *url.URL
+	fraction     float64
+	maxBodyBytes int64
+	inFlight     chan struct{}
+	roundTripper http.RoundTripper
+
+	// ctx is canceled by close, the mirrored requests are derived from it
+	ctx    context.Context
+	cancel context.CancelFunc
+	mutex  sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Mirror sends a copy of a fraction (0 < fraction <= 1) of the requests to the shadow target asynchronously,
+// the responses of the shadow upstream are discarded and never affect the client. The mirrored requests
+// carry the X-Oxy-Mirror header, bodies larger than MirrorMaxBodyBytes are not mirrored, nor are the requests
+// expecting a 100 Continue as buffering their body would answer the expectation before the upstream does.
+func Mirror(target *url.URL, fraction float64) optSetter {
+	return func(f *Forwarder) error {
+		if target == nil {
+			return fmt.Errorf("mirror target can not be nil")
+		}
+		if fraction <= 0 || fraction > 1 {
+			return fmt.Errorf("mirror fraction should be in (0, 1], got %v", fraction)
+		}
+		if f.httpForwarder.mirror == nil {
+			f.httpForwarder.mirror = &mirror{maxBodyBytes: defaultMirrorMaxBodyBytes}
+		}
+		f.httpForwarder.mirror.target = utils.CopyURL(target)
+		f.httpForwarder.mirror.fraction = fraction
+		return nil
+	}
+}
+
+// MirrorMaxBodyBytes sets the size of the request bodies buffered to be mirrored, defaults to 1MB.
+// Requests with a larger body are forwarded without being mirrored.
+func MirrorMaxBodyBytes(n int64) optSetter {
+	return func(f *Forwarder) error {
+		if n < 0 {
+			return fmt.Errorf("mirror max body bytes should be >= 0, got %v", n)
+		}
+		if f.httpForwarder.mirror == nil {
+			f.httpForwarder.mirror = &mirror{}
+		}
+		f.httpForwarder.mirror.maxBodyBytes = n
+		return nil
+	}
+}
+
+// mirrorRequest sends a copy of the request to the shadow upstream if it is sampled,
+// it returns the request to forward whose body may have been buffered.
+func (f *httpForwarder) mirrorRequest(req *http.Request) *http.Request {
+	m := f.mirror
+	if rand.Float64() >= m.fraction || expectsContinue(req) {
+		return req
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		buf, err := ioutil.ReadAll(io.LimitReader(req.Body, m.maxBodyBytes+1))
+		// the upstream gets the whole body whatever happens
+		outReq := *req
+		outReq.Body = &struct {
+			io.Reader
+			io.Closer
+		}{Reader: io.MultiReader(bytes.NewReader(buf), req.Body), Closer: req.Body}
+		req = &outReq
+
+		if err != nil || int64(len(buf)) > m.maxBodyBytes {
+			return req
+		}
+		body = buf
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		f.logEvent(log.WarnLevel, "too many mirrored requests", []interface{}{"url", req.URL.String()},
+			"vulcand/oxy/forward/mirror: too many mirrored requests in flight, skipping %v", req.URL)
+		return req
+	}
+
+	shadow, err := m.newRequest(req, body)
+	if err != nil {
+		<-m.inFlight
+		f.logEvent(log.ErrorLevel, "mirrored request creation failed", []interface{}{"url", req.URL.String(), "error", err},
+			"vulcand/oxy/forward/mirror: failed to create mirrored request: %v", err)
+		return req
+	}
+
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		shadow.cancel()
+		<-m.inFlight
+		return req
+	}
+	m.wg.Add(1)
+	m.mutex.Unlock()
+
+	go func() {
+		defer m.wg.Done()
+		defer func() { <-m.inFlight }()
+		defer shadow.cancel()
+
+		resp, err := m.roundTripper.RoundTrip(shadow.req)
+		if err != nil {
+			f.logEvent(log.DebugLevel, "mirrored request failed", []interface{}{"upstream", m.target.Host, "error", err},
+				"vulcand/oxy/forward/mirror: mirrored request to %v failed: %v", m.target, err)
+			return
+		}
+		f.copyBuffer(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		f.logEvent(log.DebugLevel, "mirrored request", []interface{}{"upstream", m.target.Host, "url", shadow.req.URL.String(), "status", resp.StatusCode},
+			"vulcand/oxy/forward/mirror: mirrored request to %v, code: %v", shadow.req.URL, resp.StatusCode)
+	}()
+	return req
+}
+
+type shadowRequest struct {
+	req    *http.Request
+	cancel context.CancelFunc
+}
+
+// close cancels the mirrored requests in flight and waits for them, the requests are no longer mirrored
+func (m *mirror) close() {
+	m.mutex.Lock()
+	m.closed = true
+	m.mutex.Unlock()
+
+	m.cancel()
+	m.wg.Wait()
+}
+
+// newRequest copies the request for the shadow upstream, it is not canceled with the original request
+// but with the Forwarder
+func (m *mirror) newRequest(req *http.Request, body []byte) (*shadowRequest, error) {
+	u := utils.CopyURL(req.URL)
+	if req.RequestURI != "" {
+		parsed, err := url.ParseRequestURI(req.RequestURI)
+		if err != nil {
+			return nil, err
+		}
+		u = parsed
+	}
+	u.Scheme = m.target.Scheme
+	u.Host = m.target.Host
+
+	ctx, cancel := context.WithTimeout(m.ctx, mirrorTimeout)
+	shadow, err := http.NewRequest(req.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	shadow = shadow.WithContext(ctx)
+	if body == nil {
+		shadow.Body = http.NoBody
+	}
+
+	shadow.Header = make(http.Header)
+	utils.CopyHeaders(shadow.Header, req.Header)
+	utils.RemoveHeaders(shadow.Header, HopHeaders...)
+	shadow.Header.Set(XOxyMirror, "1")
+	return &shadowRequest{req: shadow, cancel: cancel}, nil
+}
@@ -0,0 +1,47 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// StoreOriginalURL stores the URL requested by the client in the request context, where
+// OriginalURLFromContext reads it, e.g. from a ResponseModifier after the URL has been rewritten
+func StoreOriginalURL(enabled bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.storeOriginalURL = enabled
+		return nil
+	}
+}
+
+// OriginalURLFromContext returns the URL requested by the client, or nil when StoreOriginalURL is not enabled
+func OriginalURLFromContext(ctx context.Context) *url.URL {
+	u, _ := ctx.Value(originalURLKey).(*url.URL)
+	return u
+}
+
+// withOriginalURL stores the URL requested by the client, it is read from the request line
+// when available as handlers in front of the Forwarder usually replace the URL by the upstream one
+func (f *httpForwarder) withOriginalURL(req *http.Request) *http.Request {
+	var u *url.URL
+	if req.RequestURI != "" {
+		if parsed, err := url.ParseRequestURI(req.RequestURI); err == nil {
+			u = parsed
+		}
+	}
+
+	if u == nil {
+		u = utils.CopyURL(req.URL)
+	} else if u.Host == "" {
+		u.Host = req.Host
+		if req.TLS != nil {
+			u.Scheme = "https"
+		} else {
+			u.Scheme = "http"
+		}
+	}
+	return req.WithContext(context.WithValue(req.Context(), originalURLKey, u))
+}
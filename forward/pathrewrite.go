@@ -0,0 +1,58 @@
+package forward
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StripPrefix removes the prefix from the path of the requests sent upstream, requests not matching
+// it are forwarded untouched. The prefix is matched against the escaped path, so that encoded
+// segments like %2F are kept as is.
+func StripPrefix(prefix string) optSetter {
+	return func(f *Forwarder) error {
+		if prefix == "" {
+			return errors.New("strip prefix can not be empty")
+		}
+		f.httpForwarder.stripPrefix = (&url.URL{Path: prefix}).EscapedPath()
+		return nil
+	}
+}
+
+// AddPrefix adds the prefix to the path of the requests sent upstream, after StripPrefix is applied
+func AddPrefix(prefix string) optSetter {
+	return func(f *Forwarder) error {
+		if !strings.HasPrefix(prefix, "/") {
+			return errors.New("add prefix should start with /")
+		}
+		f.httpForwarder.addPrefix = strings.TrimSuffix((&url.URL{Path: prefix}).EscapedPath(), "/")
+		return nil
+	}
+}
+
+// rewritePath applies the configured prefixes to the escaped path of u
+func (f *httpForwarder) rewritePath(u *url.URL) {
+	if f.stripPrefix == "" && f.addPrefix == "" {
+		return
+	}
+
+	escaped := u.EscapedPath()
+	if f.stripPrefix != "" && strings.HasPrefix(escaped, f.stripPrefix) {
+		escaped = strings.TrimPrefix(escaped, f.stripPrefix)
+		if !strings.HasPrefix(escaped, "/") {
+			escaped = "/" + escaped
+		}
+	}
+	escaped = f.addPrefix + escaped
+
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		f.logEvent(log.WarnLevel, "path rewrite failed", []interface{}{"path", escaped, "error", err},
+			"vulcand/oxy/forward: error when rewriting path %q: %s", escaped, err)
+		return
+	}
+	u.Path = path
+	u.RawPath = escaped
+}
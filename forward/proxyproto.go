@@ -0,0 +1,105 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// proxyProtocolV2Signature starts the binary header of the PROXY protocol v2
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// SendProxyProtocol sends a PROXY protocol header of the given version (1 for the text format, 2 for the binary one)
+// carrying the address of the client and the address it connected to on each new TCP connection to the upstreams.
+// Upstream connections are not reused, since the header describes a single client connection.
+// It is a no-op for unix socket upstreams and it only applies when no RoundTripper is set.
+func SendProxyProtocol(version int) optSetter {
+	return func(f *Forwarder) error {
+		if version != 1 && version != 2 {
+			return fmt.Errorf("unsupported PROXY protocol version: %d", version)
+		}
+		f.httpForwarder.proxyProtocol = version
+		return nil
+	}
+}
+
+// proxyProtocolAddrs are the addresses of the client connection
+type proxyProtocolAddrs struct {
+	src, dst *net.TCPAddr
+}
+
+// withProxyProtocolAddrs stores the addresses of the client connection for the dialer
+func withProxyProtocolAddrs(req *http.Request) {
+	var addrs proxyProtocolAddrs
+	if src, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		addrs.src = src
+	}
+	if dst, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		addrs.dst = dst
+	}
+	*req = *req.WithContext(context.WithValue(req.Context(), proxyProtocolKey, addrs))
+}
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyProtocolDialer writes the PROXY protocol header on the TCP connections established by dial
+func proxyProtocolDialer(dial dialContextFunc, version int) dialContextFunc {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil || !strings.HasPrefix(network, "tcp") {
+			return conn, err
+		}
+
+		addrs, _ := ctx.Value(proxyProtocolKey).(proxyProtocolAddrs)
+		header := proxyProtocolV1Header(addrs)
+		if version == 2 {
+			header = proxyProtocolV2Header(addrs)
+		}
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func proxyProtocolV1Header(addrs proxyProtocolAddrs) []byte {
+	if addrs.src == nil || addrs.dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family, src, dst := "TCP4", addrs.src.IP.To4(), addrs.dst.IP.To4()
+	if src == nil || dst == nil {
+		family, src, dst = "TCP6", addrs.src.IP.To16(), addrs.dst.IP.To16()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src, dst, addrs.src.Port, addrs.dst.Port))
+}
+
+func proxyProtocolV2Header(addrs proxyProtocolAddrs) []byte {
+	buf := bytes.NewBuffer(append([]byte{}, proxyProtocolV2Signature...))
+	if addrs.src == nil || addrs.dst == nil {
+		// LOCAL command, the receiver uses the addresses of the connection
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	// PROXY command over TCP/IPv4 or TCP/IPv6
+	family, src, dst := byte(0x11), addrs.src.IP.To4(), addrs.dst.IP.To4()
+	if src == nil || dst == nil {
+		family, src, dst = 0x21, addrs.src.IP.To16(), addrs.dst.IP.To16()
+	}
+	buf.Write([]byte{0x21, family})
+	binary.Write(buf, binary.BigEndian, uint16(2*len(src)+4))
+	buf.Write(src)
+	buf.Write(dst)
+	binary.Write(buf, binary.BigEndian, uint16(addrs.src.Port))
+	binary.Write(buf, binary.BigEndian, uint16(addrs.dst.Port))
+	return buf.Bytes()
+}
@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pushHeaders are the request headers copied to the requests of the pushed resources
+var pushHeaders = []string{"Accept-Encoding", "Accept-Language", "Cookie", "User-Agent"}
+
+// AllowServerPush controls HTTP/2 server push, defaults to false.
+// The upstream transports never accept pushed streams: they advertise push as disabled, so
+// http.Pusher reports http.ErrNotSupported to Go upstreams and the response is forwarded as usual,
+// an upstream sending a push promise anyway violates the protocol and gets its connection closed.
+// When enabled, the resources an upstream would push, announced with "Link: <path>; rel=preload"
+// headers, are pushed to HTTP/2 clients through the forwarder itself.
+func AllowServerPush(allow bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.allowServerPush = allow
+		return nil
+	}
+}
+
+// pushPreloads wraps modifyResponse so that the preload links of the response are pushed to the client
+func (f *httpForwarder) pushPreloads(w http.ResponseWriter, inReq *http.Request, modifyResponse func(*http.Response) error) func(*http.Response) error {
+	pusher, ok := w.(http.Pusher)
+	if !ok {
+		return modifyResponse
+	}
+
+	return func(resp *http.Response) error {
+		if modifyResponse != nil {
+			if err := modifyResponse(resp); err != nil {
+				return err
+			}
+		}
+
+		for _, target := range preloadTargets(resp.Header) {
+			opts := &http.PushOptions{Header: http.Header{}}
+			for _, name := range pushHeaders {
+				if values, ok := inReq.Header[name]; ok {
+					opts.Header[name] = values
+				}
+			}
+			if err := pusher.Push(target, opts); err != nil {
+				if f.debugEnabled() {
+					f.logEvent(log.DebugLevel, "server push failed", []interface{}{"url", inReq.URL.String(), "target", target, "error", err},
+						"vulcand/oxy/forward/http: failed to push %v for %v: %v", target, inReq.URL, err)
+				}
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// preloadTargets returns the absolute paths of the "Link" headers with the preload relation, links
+// marked with nopush and links to other hosts are skipped
+func preloadTargets(h http.Header) []string {
+	var targets []string
+	for _, value := range h["Link"] {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			target = target[1 : len(target)-1]
+			if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+				continue
+			}
+
+			preload, nopush := false, false
+			for _, param := range parts[1:] {
+				param = strings.ToLower(strings.TrimSpace(param))
+				switch {
+				case param == "nopush":
+					nopush = true
+				case strings.HasPrefix(param, "rel="):
+					for _, rel := range strings.Fields(strings.Trim(strings.TrimPrefix(param, "rel="), `"`)) {
+						if rel == "preload" {
+							preload = true
+						}
+					}
+				}
+			}
+			if preload && !nopush {
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
@@ -0,0 +1,59 @@
+package forward
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader makes sure every forwarded request carries a correlation ID in the header name: the ID sent
+// by the client is passed through unchanged, otherwise a random UUID (version 4) is generated.
+//
+// The ID is set on the incoming request, so that the handlers in front of the Forwarder such as trace see it,
+// on the response to the client, and in the request context where RequestIDFromContext reads it, e.g. from
+// a ResponseModifier.
+func RequestIDHeader(name string) optSetter {
+	return func(f *Forwarder) error {
+		if name == "" {
+			return fmt.Errorf("request id header can not be empty")
+		}
+		f.httpForwarder.requestIDHeader = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
+// RequestIDFromContext returns the correlation ID of the request, or an empty string when RequestIDHeader is not set
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// withRequestID sets the correlation ID of the request, generating it when the client didn't send one
+func (f *httpForwarder) withRequestID(w http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get(f.requestIDHeader)
+	if id == "" {
+		var err error
+		if id, err = newRequestID(); err != nil {
+			f.logEvent(log.ErrorLevel, "request id generation failed", []interface{}{"error", err},
+				"vulcand/oxy/forward: failed to generate request id: %v", err)
+			return req
+		}
+		req.Header.Set(f.requestIDHeader, id)
+	}
+	w.Header().Set(f.requestIDHeader, id)
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey, id))
+}
+
+// newRequestID returns a random UUID
+func newRequestID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
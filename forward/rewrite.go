@@ -3,6 +3,7 @@ package forward
 import (
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/vulcand/oxy/utils"
@@ -11,7 +12,30 @@ import (
 // HeaderRewriter is responsible for removing hop-by-hop headers and setting forwarding headers
 type HeaderRewriter struct {
 	TrustForwardHeader bool
-	Hostname           string
+	// TrustedProxies restricts the trust of the forwarded headers to the requests whose immediate peer,
+	// the RemoteAddr, is in one of the ranges, e.g. the subnet of the ingress. The forwarded headers of
+	// the other peers are removed and regenerated. Setting them trusts the peers in range even when
+	// TrustForwardHeader is false.
+	TrustedProxies []*net.IPNet
+	Hostname       string
+	// EmitForwarded appends a RFC 7239 Forwarded element describing this hop,
+	// the incoming Forwarded chain is kept only when the forwarded headers are trusted
+	EmitForwarded bool
+	// SetRealIP sets the X-Real-Ip header to the IP of the immediate client, an incoming X-Real-Ip is kept
+	// when the forwarded headers are trusted. It is the default unless DisableRealIP is set, SetRealIP wins over it.
+	SetRealIP bool
+	// DisableRealIP stops setting the X-Real-Ip header to the IP of the immediate client, an incoming
+	// X-Real-Ip is kept when the forwarded headers are trusted and removed otherwise either way
+	DisableRealIP bool
+	// StrictForwardedProto replaces X-Forwarded-Proto values other than http, https, ws and wss
+	// by the scheme of the client connection, unknown values are passed through by default
+	StrictForwardedProto bool
+	// MaxForwardedForEntries caps the number of addresses of the X-Forwarded-For header sent upstream,
+	// the most recent ones, closest to this hop, are kept. Zero means no limit.
+	MaxForwardedForEntries int
+	// MaxForwardedForBytes caps the length of the trusted incoming X-Forwarded-For header,
+	// the oldest addresses are dropped until it fits. Zero means no limit.
+	MaxForwardedForBytes int
 }
 
 // clean up IP in case if it is ipv6 address and it has {zone} information in it, like "[fe80::d806:a55d:eb1b:49cc%vEthernet (vmxnet3 Ethernet Adapter - Virtual Switch)]:64692"
@@ -21,8 +45,17 @@ func ipv6fix(clientIP string) string {
 
 // Rewrite rewrite request headers
 func (rw *HeaderRewriter) Rewrite(req *http.Request) {
-	if !rw.TrustForwardHeader {
+	if !rw.trustForwardHeader(req) {
 		utils.RemoveHeaders(req.Header, XHeaders...)
+		if rw.EmitForwarded {
+			req.Header.Del(Forwarded)
+		}
+	} else {
+		rw.trimForwardedFor(req)
+	}
+
+	if rw.EmitForwarded {
+		appendForwarded(req)
 	}
 
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
@@ -36,12 +69,22 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 			}
 		}
 
-		if req.Header.Get(XRealIp) == "" {
+		if (rw.SetRealIP || !rw.DisableRealIP) && req.Header.Get(XRealIp) == "" {
 			req.Header.Set(XRealIp, clientIP)
 		}
 	}
 
 	xfProto := req.Header.Get(XForwardedProto)
+	if rw.StrictForwardedProto && xfProto != "" {
+		xfProto = strings.ToLower(strings.TrimSpace(xfProto))
+		switch xfProto {
+		case "http", "https", "ws", "wss":
+			req.Header.Set(XForwardedProto, xfProto)
+		default:
+			req.Header.Del(XForwardedProto)
+			xfProto = ""
+		}
+	}
 	if xfProto == "" {
 		if req.TLS != nil {
 			req.Header.Set(XForwardedProto, "https")
@@ -71,6 +114,121 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 	}
 }
 
+// trustForwardHeader tells whether the forwarded headers of the request are kept
+func (rw *HeaderRewriter) trustForwardHeader(req *http.Request) bool {
+	if len(rw.TrustedProxies) == 0 {
+		return rw.TrustForwardHeader
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(ipv6fix(host))
+	if ip == nil {
+		return false
+	}
+	for _, network := range rw.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimForwardedFor drops the oldest addresses of the incoming X-Forwarded-For header so that it fits
+// the limits once the address of the client is appended
+func (rw *HeaderRewriter) trimForwardedFor(req *http.Request) {
+	prior, ok := req.Header[XForwardedFor]
+	if !ok || prior == nil || rw.MaxForwardedForEntries <= 0 && rw.MaxForwardedForBytes <= 0 {
+		return
+	}
+
+	var entries []string
+	for _, value := range prior {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if rw.MaxForwardedForEntries > 0 && len(entries) > rw.MaxForwardedForEntries-1 {
+		entries = entries[len(entries)-(rw.MaxForwardedForEntries-1):]
+	}
+	if rw.MaxForwardedForBytes > 0 {
+		for len(entries) > 0 && len(strings.Join(entries, ", ")) > rw.MaxForwardedForBytes {
+			entries = entries[1:]
+		}
+	}
+
+	if len(entries) == 0 {
+		req.Header.Del(XForwardedFor)
+		return
+	}
+	req.Header.Set(XForwardedFor, strings.Join(entries, ", "))
+}
+
+// appendForwarded appends an element with the for, host and proto parameters to the Forwarded header
+func appendForwarded(req *http.Request) {
+	var pairs []string
+	if req.RemoteAddr != "" {
+		pairs = append(pairs, "for="+forwardedNode(req.RemoteAddr))
+	}
+	if req.Host != "" {
+		pairs = append(pairs, "host="+forwardedValue(req.Host))
+	}
+	if req.TLS != nil {
+		pairs = append(pairs, "proto=https")
+	} else {
+		pairs = append(pairs, "proto=http")
+	}
+
+	element := strings.Join(pairs, ";")
+	if prior, ok := req.Header[Forwarded]; ok && len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	req.Header.Set(Forwarded, element)
+}
+
+// forwardedNode formats the node identifier of the client, IPv6 addresses are bracketed and quoted
+// as required by RFC 7239, obfuscated identifiers (e.g. "_hidden" or "unknown") are kept untouched
+func forwardedNode(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	host = ipv6fix(host)
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return forwardedValue(host)
+	case ip.To4() != nil:
+		return host
+	default:
+		return `"[` + host + `]"`
+	}
+}
+
+// forwardedValue returns the value as a token if possible, or as a quoted string otherwise
+func forwardedValue(value string) string {
+	for _, r := range value {
+		if !isTokenChar(r) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// isTokenChar reports whether r is allowed in a token as defined by RFC 7230
+func isTokenChar(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
 func forwardedPort(req *http.Request) string {
 	if req == nil {
 		return ""
@@ -1,9 +1,13 @@
 package forward
 
 import (
+	"crypto/tls"
+	"net"
+	"net/http"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIPv6Fix(t *testing.T) {
@@ -59,3 +63,256 @@ func TestIPv6Fix(t *testing.T) {
 		})
 	}
 }
+
+func TestForwardedHeaderEmission(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		trust      bool
+		remoteAddr string
+		host       string
+		tls        bool
+		prior      []string
+		expected   string
+	}{
+		{
+			desc:       "ipv4",
+			remoteAddr: "10.13.14.15:1234",
+			host:       "example.com",
+			expected:   "for=10.13.14.15;host=example.com;proto=http",
+		},
+		{
+			desc:       "ipv6 is bracketed and quoted",
+			remoteAddr: "[2001:db8:cafe::17]:4711",
+			host:       "example.com",
+			tls:        true,
+			expected:   `for="[2001:db8:cafe::17]";host=example.com;proto=https`,
+		},
+		{
+			desc:       "host with port is quoted",
+			remoteAddr: "10.13.14.15:1234",
+			host:       "example.com:8080",
+			expected:   `for=10.13.14.15;host="example.com:8080";proto=http`,
+		},
+		{
+			desc:       "obfuscated identifier",
+			remoteAddr: "_hidden",
+			host:       "example.com",
+			expected:   "for=_hidden;host=example.com;proto=http",
+		},
+		{
+			desc:       "trusted chain is preserved",
+			trust:      true,
+			remoteAddr: "10.13.14.15:1234",
+			host:       "example.com",
+			prior:      []string{`for=_gazonk;by=_proxy`, `for="[2001:db8::1]"`},
+			expected:   `for=_gazonk;by=_proxy, for="[2001:db8::1]", for=10.13.14.15;host=example.com;proto=http`,
+		},
+		{
+			desc:       "untrusted chain is dropped",
+			remoteAddr: "10.13.14.15:1234",
+			host:       "example.com",
+			prior:      []string{"for=192.0.2.43"},
+			expected:   "for=10.13.14.15;host=example.com;proto=http",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req, err := http.NewRequest(http.MethodGet, "http://"+test.host, nil)
+			require.NoError(t, err)
+			req.RemoteAddr = test.remoteAddr
+			if test.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for _, p := range test.prior {
+				req.Header.Add(Forwarded, p)
+			}
+
+			rw := &HeaderRewriter{TrustForwardHeader: test.trust, EmitForwarded: true}
+			rw.Rewrite(req)
+
+			assert.Equal(t, test.expected, req.Header.Get(Forwarded))
+		})
+	}
+}
+
+func TestForwardedHeaderDisabled(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "10.13.14.15:1234"
+	req.Header.Set(Forwarded, "for=192.0.2.43")
+
+	rw := &HeaderRewriter{TrustForwardHeader: false}
+	rw.Rewrite(req)
+
+	assert.Equal(t, "for=192.0.2.43", req.Header.Get(Forwarded))
+}
+
+func TestMaxForwardedFor(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		trust    bool
+		entries  int
+		bytes    int
+		prior    []string
+		expected []string
+	}{
+		{
+			desc:     "no limit",
+			trust:    true,
+			prior:    []string{"10.0.0.1, 10.0.0.2", "10.0.0.3"},
+			expected: []string{"10.0.0.1, 10.0.0.2", "10.0.0.3"},
+		},
+		{
+			desc:     "entries limit keeps the closest hops",
+			trust:    true,
+			entries:  3,
+			prior:    []string{"10.0.0.1, 10.0.0.2", "10.0.0.3"},
+			expected: []string{"10.0.0.2, 10.0.0.3"},
+		},
+		{
+			desc:     "entries limit of one drops the incoming header",
+			trust:    true,
+			entries:  1,
+			prior:    []string{"10.0.0.1, 10.0.0.2"},
+			expected: nil,
+		},
+		{
+			desc:     "bytes limit",
+			trust:    true,
+			bytes:    20,
+			prior:    []string{"10.0.0.1, 10.0.0.2,10.0.0.3"},
+			expected: []string{"10.0.0.2, 10.0.0.3"},
+		},
+		{
+			desc:     "bytes limit smaller than an entry",
+			trust:    true,
+			bytes:    4,
+			prior:    []string{"10.0.0.1"},
+			expected: nil,
+		},
+		{
+			desc:     "untrusted header is removed",
+			entries:  3,
+			prior:    []string{"10.0.0.1"},
+			expected: nil,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			require.NoError(t, err)
+			req.RemoteAddr = "10.13.14.15:1234"
+			for _, p := range test.prior {
+				req.Header.Add(XForwardedFor, p)
+			}
+
+			rw := &HeaderRewriter{TrustForwardHeader: test.trust, MaxForwardedForEntries: test.entries, MaxForwardedForBytes: test.bytes}
+			rw.Rewrite(req)
+
+			assert.Equal(t, test.expected, req.Header[XForwardedFor])
+		})
+	}
+}
+
+func TestStrictForwardedProto(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		strict   bool
+		tls      bool
+		incoming string
+		expected string
+	}{
+		{desc: "permissive keeps unknown value", incoming: "httpx", expected: "httpx"},
+		{desc: "unknown value replaced", strict: true, incoming: "httpx", expected: "http"},
+		{desc: "unknown value replaced over tls", strict: true, tls: true, incoming: "javascript", expected: "https"},
+		{desc: "valid value kept", strict: true, incoming: "https", expected: "https"},
+		{desc: "valid value normalized", strict: true, incoming: " WSS ", expected: "wss"},
+		{desc: "missing value", strict: true, tls: true, expected: "https"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			require.NoError(t, err)
+			if test.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if test.incoming != "" {
+				req.Header.Set(XForwardedProto, test.incoming)
+			}
+
+			rw := &HeaderRewriter{TrustForwardHeader: true, StrictForwardedProto: test.strict}
+			rw.Rewrite(req)
+
+			assert.Equal(t, test.expected, req.Header.Get(XForwardedProto))
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	var proxies []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		proxies = append(proxies, network)
+	}
+
+	testCases := []struct {
+		desc       string
+		trust      bool
+		remoteAddr string
+		trusted    bool
+		realIP     string
+	}{
+		{desc: "ipv4 proxy", remoteAddr: "10.1.2.3:1234", trusted: true},
+		{desc: "ipv4 client", remoteAddr: "192.0.2.1:1234", realIP: "192.0.2.1"},
+		{desc: "ipv4 client with trust forward header", trust: true, remoteAddr: "192.0.2.1:1234", realIP: "192.0.2.1"},
+		{desc: "ipv6 proxy", remoteAddr: "[2001:db8::1]:1234", trusted: true},
+		{desc: "ipv6 proxy with zone", remoteAddr: "[2001:db8::1%eth0]:1234", trusted: true},
+		{desc: "ipv6 client", remoteAddr: "[2001:db9::1]:1234", realIP: "2001:db9::1"},
+		{desc: "ipv4 mapped ipv6 proxy", remoteAddr: "[::ffff:10.1.2.3]:1234", trusted: true},
+		{desc: "invalid remote address", remoteAddr: "unknown"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			require.NoError(t, err)
+			req.RemoteAddr = test.remoteAddr
+			req.Header.Set(XForwardedFor, "198.51.100.7")
+			req.Header.Set(XForwardedProto, "https")
+			req.Header.Set(XForwardedHost, "spoofed.example.com")
+			req.Header.Set(XRealIp, "198.51.100.7")
+
+			rw := &HeaderRewriter{TrustForwardHeader: test.trust, TrustedProxies: proxies}
+			rw.Rewrite(req)
+
+			if test.trusted {
+				assert.Equal(t, "198.51.100.7", req.Header.Get(XForwardedFor))
+				assert.Equal(t, "https", req.Header.Get(XForwardedProto))
+				assert.Equal(t, "spoofed.example.com", req.Header.Get(XForwardedHost))
+				assert.Equal(t, "198.51.100.7", req.Header.Get(XRealIp))
+			} else {
+				assert.Empty(t, req.Header.Get(XForwardedFor))
+				assert.Equal(t, "http", req.Header.Get(XForwardedProto))
+				assert.Equal(t, "example.com", req.Header.Get(XForwardedHost))
+				// the spoofed X-Real-Ip is replaced by the client IP, if any
+				assert.Equal(t, test.realIP, req.Header.Get(XRealIp))
+			}
+		})
+	}
+}
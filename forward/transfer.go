@@ -0,0 +1,94 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// TransferObserver sets a callback called with the number of bytes of the request and response bodies
+// once a request completes. The counts are taken on the copies to and from the client, so they are accurate
+// for chunked and streamed bodies. For websocket connections and CONNECT tunnels the callback is called once
+// the connection is closed with the bytes copied in each direction, the payloads of the text and binary
+// messages for websockets. Nothing is counted when it is unset.
+func TransferObserver(fn func(req *http.Request, reqBytes, respBytes int64)) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.transferObserver = fn
+		return nil
+	}
+}
+
+// countTransfer wraps the request body and the response writer to count the bytes copied,
+// done reports the counts to the transfer observer
+func (f *httpForwarder) countTransfer(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	body := &countingBody{}
+	if req.Body != nil && req.Body != http.NoBody {
+		body.ReadCloser = req.Body
+		outReq := *req
+		outReq.Body = body
+		req = &outReq
+	}
+	cw := &countingWriter{ResponseWriter: w}
+
+	return cw, req, func() {
+		f.transferObserver(req, atomic.LoadInt64(&body.n), atomic.LoadInt64(&cw.n))
+	}
+}
+
+// countingBody counts the bytes read from a request body, the transport may read it from another goroutine
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes of the response body written to the client
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// Flush implements http.Flusher, streamed responses are flushed through the wrapper
+func (c *countingWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// CloseNotify implements http.CloseNotifier
+func (c *countingWriter) CloseNotify() <-chan bool {
+	if notifier, ok := c.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack implements http.Hijacker
+func (c *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := c.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T doesn't implement http.Hijacker", c.ResponseWriter)
+}
+
+// Push implements http.Pusher so that AllowServerPush keeps working
+func (c *countingWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := c.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
@@ -0,0 +1,68 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// unixScheme is the upstream URL scheme used to forward requests to a unix domain socket,
+// the path of the URL is the path of the socket, e.g. unix:///var/run/app.sock
+const unixScheme = "unix"
+
+const defaultUnixSocketHost = "localhost"
+
+// unixRoundTripper sends requests targeting unix sockets through a transport dialing the socket
+// and all the other requests through the regular round tripper
+type unixRoundTripper struct {
+	http.RoundTripper
+	// base is cloned to create the transport of each socket
+	base *http.Transport
+	// transports are keyed by socket path, so idle connections are never shared between sockets
+	transports sync.Map
+}
+
+func newUnixRoundTripper(rt http.RoundTripper) *unixRoundTripper {
+	base, ok := rt.(*http.Transport)
+	if !ok {
+		base, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok {
+		base = &http.Transport{}
+	}
+	return &unixRoundTripper{RoundTripper: rt, base: base}
+}
+
+func (u *unixRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	socket, ok := req.Context().Value(unixSocketKey).(string)
+	if !ok {
+		return u.RoundTripper.RoundTrip(req)
+	}
+	return u.transport(socket).RoundTrip(req)
+}
+
+func (u *unixRoundTripper) transport(socket string) *http.Transport {
+	if t, ok := u.transports.Load(socket); ok {
+		return t.(*http.Transport)
+	}
+
+	t := u.base.Clone()
+	t.Proxy = nil
+	t.DialTLS = nil
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+
+	actual, _ := u.transports.LoadOrStore(socket, t)
+	return actual.(*http.Transport)
+}
+
+// closeIdleConnections closes the idle connections to the sockets
+func (u *unixRoundTripper) closeIdleConnections() {
+	u.transports.Range(func(_, t interface{}) bool {
+		t.(*http.Transport).CloseIdleConnections()
+		return true
+	})
+}
@@ -0,0 +1,209 @@
+package forward
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// UpstreamTLSConfig sets the TLS configuration used to connect to HTTPS upstreams, e.g. to verify or pin
+// their certificates with RootCAs or VerifyPeerCertificate.
+// It only applies when the Forwarder owns its transport, i.e. when no RoundTripper is set.
+func UpstreamTLSConfig(cfg *tls.Config) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.upstreamTLS.config = cfg.Clone()
+		return nil
+	}
+}
+
+// UpstreamTLSServerName sets the server name sent with SNI and verified against the certificates of the HTTPS
+// upstreams, for upstreams addressed by IP. It only applies when no RoundTripper is set.
+func UpstreamTLSServerName(name string) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.upstreamTLS.serverName = name
+		return nil
+	}
+}
+
+// UpstreamTLSServerNameFunc sets a callback returning the server name of each request, an empty name falls
+// back to UpstreamTLSServerName or to the upstream host. It only applies when no RoundTripper is set.
+func UpstreamTLSServerNameFunc(fn func(req *http.Request) string) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.upstreamTLS.serverNameFunc = fn
+		return nil
+	}
+}
+
+// upstreamTLS holds the TLS options of the transport owned by the forwarder
+type upstreamTLS struct {
+	config         *tls.Config
+	serverName     string
+	serverNameFunc func(req *http.Request) string
+}
+
+func (u upstreamTLS) isSet() bool {
+	return u.config != nil || u.serverName != "" || u.serverNameFunc != nil
+}
+
+// configure applies the upstream TLS options to the transport owned by the forwarder
+func (u upstreamTLS) configure(t *http.Transport) http.RoundTripper {
+	t.TLSClientConfig = u.config
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	if u.serverName != "" {
+		t.TLSClientConfig.ServerName = u.serverName
+	}
+
+	if u.serverNameFunc == nil {
+		return t
+	}
+	return &serverNameRoundTripper{Transport: t, serverName: u.serverNameFunc}
+}
+
+// maxServerNameTransports bounds the transports of the serverNameRoundTripper, the least recently used one
+// is evicted beyond
+const maxServerNameTransports = 256
+
+// serverNameRoundTripper sends the requests through a transport per server name,
+// so the connections established with a server name are never reused for another one
+type serverNameRoundTripper struct {
+	*http.Transport
+	serverName func(req *http.Request) string
+
+	mutex      sync.Mutex
+	transports map[string]*list.Element
+	lru        list.List
+}
+
+type serverNameTransport struct {
+	name      string
+	transport *http.Transport
+	// inFlight counts the round trips whose response body isn't closed yet
+	inFlight int
+	evicted  bool
+}
+
+func (s *serverNameRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	name, ok := req.Context().Value(serverNameKey).(string)
+	if !ok || name == "" {
+		return s.Transport.RoundTrip(req)
+	}
+
+	e := s.acquire(name)
+	resp, err := e.transport.RoundTrip(req)
+	if err != nil {
+		s.release(e)
+		return nil, err
+	}
+	resp.Body = newReleasingBody(resp.Body, func() { s.release(e) })
+	return resp, nil
+}
+
+// transport returns the transport of the server name, creating it if needed
+func (s *serverNameRoundTripper) transport(name string) *http.Transport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.entry(name).transport
+}
+
+// acquire returns the transport of the server name for a round trip, it is released when the response body is closed
+func (s *serverNameRoundTripper) acquire(name string) *serverNameTransport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e := s.entry(name)
+	e.inFlight++
+	return e
+}
+
+// release ends a round trip, the connections of an evicted transport are closed once its last round trip is done
+func (s *serverNameRoundTripper) release(e *serverNameTransport) {
+	s.mutex.Lock()
+	e.inFlight--
+	drained := e.evicted && e.inFlight == 0
+	s.mutex.Unlock()
+
+	if drained {
+		e.transport.CloseIdleConnections()
+	}
+}
+
+// entry returns the transport of the server name, creating it and evicting the least recently used one if needed
+func (s *serverNameRoundTripper) entry(name string) *serverNameTransport {
+	if e, ok := s.transports[name]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*serverNameTransport)
+	}
+
+	if s.transports == nil {
+		s.transports = make(map[string]*list.Element)
+	}
+	if s.lru.Len() >= maxServerNameTransports {
+		// the connections of the round trips in flight are closed when they are released
+		oldest := s.lru.Remove(s.lru.Back()).(*serverNameTransport)
+		delete(s.transports, oldest.name)
+		oldest.evicted = true
+		if oldest.inFlight == 0 {
+			oldest.transport.CloseIdleConnections()
+		}
+	}
+
+	t := s.Transport.Clone()
+	t.TLSClientConfig.ServerName = name
+	e := &serverNameTransport{name: name, transport: t}
+	s.transports[name] = s.lru.PushFront(e)
+	return e
+}
+
+// releasingBody calls release once the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// releasingReadWriteBody keeps the body of the switching protocols responses writable
+type releasingReadWriteBody struct {
+	*releasingBody
+	io.Writer
+}
+
+func newReleasingBody(body io.ReadCloser, release func()) io.ReadCloser {
+	b := &releasingBody{ReadCloser: body, release: release}
+	if w, ok := body.(io.ReadWriteCloser); ok {
+		return &releasingReadWriteBody{releasingBody: b, Writer: w}
+	}
+	return b
+}
+
+// CloseIdleConnections closes the idle connections of the transports of all the server names
+func (s *serverNameRoundTripper) CloseIdleConnections() {
+	s.Transport.CloseIdleConnections()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*serverNameTransport).transport.CloseIdleConnections()
+	}
+}
+
+// withServerName stores the server name of the request for the round tripper
+func (u upstreamTLS) withServerName(req *http.Request) {
+	if u.serverNameFunc == nil {
+		return
+	}
+	if name := u.serverNameFunc(req); name != "" {
+		*req = *req.WithContext(context.WithValue(req.Context(), serverNameKey, name))
+	}
+}
@@ -0,0 +1,22 @@
+package forward
+
+import "net/http"
+
+// DefaultUserAgent sets the User-Agent sent upstream when the client sends none, instead of the
+// "Go-http-client" one added by the transports. An empty string sends no User-Agent at all.
+func DefaultUserAgent(userAgent string) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.defaultUserAgent = userAgent
+		f.httpForwarder.setUserAgent = true
+		return nil
+	}
+}
+
+// withDefaultUserAgent sets the default User-Agent on requests without one, an empty
+// header value prevents net/http from adding its own
+func (f *httpForwarder) withDefaultUserAgent(outReq *http.Request) {
+	if !f.setUserAgent || outReq.Header.Get(UserAgent) != "" {
+		return
+	}
+	outReq.Header[UserAgent] = []string{f.defaultUserAgent}
+}
@@ -0,0 +1,55 @@
+package forward
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSConnEventType is the type of a websocket connection event
+type WSConnEventType int
+
+// Websocket connection event types
+const (
+	// WSConnOpened the connection has been upgraded on both the client and the upstream side
+	WSConnOpened WSConnEventType = iota
+	// WSConnClosed both sides of the connection are closed
+	WSConnClosed
+)
+
+// String returns the name of the event type
+func (t WSConnEventType) String() string {
+	switch t {
+	case WSConnOpened:
+		return "ws-opened"
+	case WSConnClosed:
+		return "ws-closed"
+	default:
+		return "unknown"
+	}
+}
+
+// WSConnEvent describes the lifecycle of a proxied websocket connection
+type WSConnEvent struct {
+	Type WSConnEventType
+	// Request is the upgrade request received from the client
+	Request *http.Request
+	Opened  time.Time
+	// Closed is zero for WSConnOpened events
+	Closed time.Time
+	// BytesToUpstream and BytesToClient count the payloads of the text and binary messages
+	// copied in each direction, including partially copied messages
+	BytesToUpstream int64
+	BytesToClient   int64
+	// Err is the error that ended the connection, nil on a normal closure
+	Err error
+}
+
+// closeError returns the error reported on close, normal closures are not errors
+func closeError(err error) error {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return nil
+	}
+	return err
+}
@@ -1,6 +1,7 @@
 package memmetrics
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -78,7 +79,8 @@ func (c *RollingCounter) Clone() *RollingCounter {
 	return other
 }
 
-// Reset reset a counter
+// Reset zeroes all the buckets of the counter.
+// Like the other methods, it is not safe for concurrent use, callers sharing a counter have to lock it.
 func (c *RollingCounter) Reset() {
 	c.lastBucket = -1
 	c.countedBuckets = 0
@@ -88,6 +90,92 @@ func (c *RollingCounter) Reset() {
 	}
 }
 
+// Export returns a copy of the bucket counts ordered from the oldest bucket to the current one,
+// buckets past the rolling window read as zero.
+func (c *RollingCounter) Export() []int {
+	c.cleanup()
+	now := c.clock.UtcNow()
+	out := make([]int, len(c.values))
+	for i := range out {
+		t := now.Add(time.Duration(i-len(out)+1) * c.resolution)
+		out[i] = c.values[c.getBucket(t)]
+	}
+	return out
+}
+
+type counterJSON struct {
+	Resolution     time.Duration `json:"resolution"`
+	Values         []int         `json:"values"`
+	CountedBuckets int           `json:"countedBuckets"`
+	LastBucket     int           `json:"lastBucket"`
+	LastUpdated    time.Time     `json:"lastUpdated"`
+}
+
+// MarshalJSON encodes the buckets of the counter and the time of its last update
+func (c *RollingCounter) MarshalJSON() ([]byte, error) {
+	c.cleanup()
+	return json.Marshal(counterJSON{
+		Resolution:     c.resolution,
+		Values:         c.values,
+		CountedBuckets: c.countedBuckets,
+		LastBucket:     c.lastBucket,
+		LastUpdated:    c.lastUpdated,
+	})
+}
+
+// UnmarshalJSON restores a counter encoded by MarshalJSON, buckets that are past the rolling window are discarded.
+// The clock of the counter is kept, it defaults to the real time.
+func (c *RollingCounter) UnmarshalJSON(data []byte) error {
+	var in counterJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if len(in.Values) == 0 {
+		return fmt.Errorf("Buckets should be >= 0")
+	}
+	if in.Resolution < time.Second {
+		return fmt.Errorf("Resolution should be larger than a second")
+	}
+
+	if c.clock == nil {
+		c.clock = &timetools.RealTime{}
+	}
+	c.resolution = in.Resolution
+	c.values = in.Values
+	c.countedBuckets = in.CountedBuckets
+	c.lastBucket = in.LastBucket
+	c.lastUpdated = in.LastUpdated
+	c.cleanup()
+	return nil
+}
+
+// compatible returns an error if o doesn't have the same buckets as c
+func (c *RollingCounter) compatible(o *RollingCounter) error {
+	if len(c.values) != len(o.values) || c.resolution != o.resolution {
+		return fmt.Errorf("counters don't match: %d buckets of %v, got %d buckets of %v",
+			len(c.values), c.resolution, len(o.values), o.resolution)
+	}
+	return nil
+}
+
+// merge adds the buckets of o to the buckets of c, aligning the current buckets of both counters
+func (c *RollingCounter) merge(o *RollingCounter) {
+	c.cleanup()
+	now := c.clock.UtcNow()
+	values := o.Export()
+	for i, v := range values {
+		if v == 0 {
+			continue
+		}
+		t := now.Add(time.Duration(i-len(values)+1) * c.resolution)
+		c.values[c.getBucket(t)] += v
+		c.lastUpdated = now
+	}
+	if o.countedBuckets > c.countedBuckets {
+		c.countedBuckets = o.countedBuckets
+	}
+}
+
 // CountedBuckets gets counted buckets
 func (c *RollingCounter) CountedBuckets() int {
 	return c.countedBuckets
@@ -145,9 +233,9 @@ func (c *RollingCounter) getBucket(t time.Time) int {
 func (c *RollingCounter) cleanup() {
 	now := c.clock.UtcNow()
 	for i := 0; i < len(c.values); i++ {
-		now = now.Add(time.Duration(-1*i) * c.resolution)
-		if now.Truncate(c.resolution).After(c.lastUpdated.Truncate(c.resolution)) {
-			c.values[c.getBucket(now)] = 0
+		t := now.Add(time.Duration(-1*i) * c.resolution)
+		if t.Truncate(c.resolution).After(c.lastUpdated.Truncate(c.resolution)) {
+			c.values[c.getBucket(t)] = 0
 		} else {
 			break
 		}
@@ -1,6 +1,7 @@
 package memmetrics
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -30,3 +31,88 @@ func TestCloneExpired(t *testing.T) {
 
 	assert.EqualValues(t, 2, out.Count())
 }
+
+func TestCounterExport(t *testing.T) {
+	clockTest := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	cnt, err := NewCounter(4, time.Second, CounterClock(clockTest))
+	require.NoError(t, err)
+
+	cnt.Inc(1)
+	clockTest.Sleep(time.Second)
+	cnt.Inc(2)
+	clockTest.Sleep(time.Second)
+	cnt.Inc(3)
+	assert.Equal(t, []int{0, 1, 2, 3}, cnt.Export())
+
+	// buckets that rotated out of the window read as zero
+	clockTest.Sleep(2 * time.Second)
+	cnt.Inc(4)
+	assert.Equal(t, []int{2, 3, 0, 4}, cnt.Export())
+
+	clockTest.Sleep(3 * time.Second)
+	assert.Equal(t, []int{4, 0, 0, 0}, cnt.Export())
+	assert.EqualValues(t, 4, cnt.Count())
+
+	clockTest.Sleep(time.Minute)
+	assert.Equal(t, []int{0, 0, 0, 0}, cnt.Export())
+	assert.EqualValues(t, 0, cnt.Count())
+
+	// the export is a copy
+	cnt.Inc(5)
+	out := cnt.Export()
+	out[3] = 0
+	assert.EqualValues(t, 5, cnt.Count())
+
+	cnt.Reset()
+	assert.Equal(t, []int{0, 0, 0, 0}, cnt.Export())
+	assert.Equal(t, 0, cnt.CountedBuckets())
+}
+
+func TestCounterCleanupSkippedBuckets(t *testing.T) {
+	clockTest := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	cnt, err := NewCounter(10, time.Second, CounterClock(clockTest))
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		cnt.Inc(1)
+		clockTest.Sleep(time.Second)
+	}
+	// the last update was 3 seconds ago, the 3 most recent buckets have rotated
+	clockTest.Sleep(2 * time.Second)
+	assert.EqualValues(t, 7, cnt.Count())
+}
+
+func TestCounterJSON(t *testing.T) {
+	clockTest := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	cnt, err := NewCounter(3, time.Second, CounterClock(clockTest))
+	require.NoError(t, err)
+
+	cnt.Inc(1)
+	clockTest.Sleep(time.Second)
+	cnt.Inc(2)
+
+	data, err := json.Marshal(cnt)
+	require.NoError(t, err)
+
+	restored := &RollingCounter{clock: clockTest}
+	require.NoError(t, json.Unmarshal(data, restored))
+	assert.Equal(t, []int{0, 1, 2}, restored.Export())
+	assert.Equal(t, cnt.CountedBuckets(), restored.CountedBuckets())
+	assert.Equal(t, time.Second, restored.Resolution())
+
+	clockTest.Sleep(2 * time.Second)
+	restored = &RollingCounter{clock: clockTest}
+	require.NoError(t, json.Unmarshal(data, restored))
+	assert.Equal(t, []int{2, 0, 0}, restored.Export())
+
+	assert.Error(t, json.Unmarshal([]byte(`{"resolution": 1000000, "values": [1]}`), restored))
+}
@@ -1,6 +1,7 @@
 package memmetrics
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -91,6 +92,9 @@ func RollingClock(clock timetools.TimeProvider) rhOptSetter {
 
 // RollingHDRHistogram holds multiple histograms and rotates every period.
 // It provides resulting histogram as a result of a call of 'Merged' function.
+//
+// The histograms are rotated when a value is recorded, once per period elapsed since the last rotation,
+// so that the values older than the window are dropped after an idle gap.
 type RollingHDRHistogram struct {
 	idx         int
 	lastRoll    time.Time
@@ -170,6 +174,124 @@ func (r *RollingHDRHistogram) Append(o *RollingHDRHistogram) error {
 	return nil
 }
 
+type rollingHistogramJSON struct {
+	Period   time.Duration            `json:"period"`
+	Low      int64                    `json:"low"`
+	High     int64                    `json:"high"`
+	Sigfigs  int                      `json:"sigfigs"`
+	Index    int                      `json:"index"`
+	LastRoll time.Time                `json:"lastRoll"`
+	Buckets  []*hdrhistogram.Snapshot `json:"buckets"`
+}
+
+// MarshalJSON encodes the sub-histograms along with the time of the last rotation
+func (r *RollingHDRHistogram) MarshalJSON() ([]byte, error) {
+	out := rollingHistogramJSON{
+		Period:   r.period,
+		Low:      r.low,
+		High:     r.high,
+		Sigfigs:  r.sigfigs,
+		Index:    r.idx,
+		LastRoll: r.lastRoll,
+		Buckets:  make([]*hdrhistogram.Snapshot, len(r.buckets)),
+	}
+	for i, b := range r.buckets {
+		out.Buckets[i] = b.h.Export()
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON restores a histogram encoded by MarshalJSON, sub-histograms that have rotated
+// out since the last rotation are discarded. The clock of the histogram is kept, it defaults to the real time.
+func (r *RollingHDRHistogram) UnmarshalJSON(data []byte) error {
+	var in rollingHistogramJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if len(in.Buckets) == 0 || in.Index < 0 || in.Index >= len(in.Buckets) {
+		return fmt.Errorf("invalid buckets, index %d of %d buckets", in.Index, len(in.Buckets))
+	}
+	if in.Period <= 0 {
+		return fmt.Errorf("period should be > 0, got %v", in.Period)
+	}
+
+	buckets := make([]*HDRHistogram, len(in.Buckets))
+	for i, snapshot := range in.Buckets {
+		h, err := importHistogram(snapshot, in.Low, in.High, in.Sigfigs)
+		if err != nil {
+			return err
+		}
+		buckets[i] = h
+	}
+
+	if r.clock == nil {
+		r.clock = &timetools.RealTime{}
+	}
+	r.period = in.Period
+	r.low = in.Low
+	r.high = in.High
+	r.sigfigs = in.Sigfigs
+	r.bucketCount = len(buckets)
+	r.buckets = buckets
+	r.idx = in.Index
+	r.lastRoll = in.LastRoll
+
+	// rotate the sub-histograms for the periods elapsed since the last rotation
+	if elapsed := r.clock.UtcNow().Sub(r.lastRoll); elapsed >= r.period {
+		for i := int64(0); i < int64(elapsed/r.period) && i < int64(len(r.buckets)); i++ {
+			r.rotate()
+		}
+		r.lastRoll = r.clock.UtcNow()
+	}
+	return nil
+}
+
+// importHistogram creates a histogram from a snapshot, checking it matches the expected bounds
+func importHistogram(s *hdrhistogram.Snapshot, low, high int64, sigfigs int) (*HDRHistogram, error) {
+	if s == nil || s.LowestTrackableValue != low || s.HighestTrackableValue != high || s.SignificantFigures != int64(sigfigs) {
+		return nil, fmt.Errorf("histogram snapshot doesn't match [%d, %d] with %d sigfigs", low, high, sigfigs)
+	}
+	h, err := NewHDRHistogram(low, high, sigfigs)
+	if err != nil {
+		return nil, err
+	}
+	// hdrhistogram.Import doesn't check the number of counts
+	if expected := len(h.h.Export().Counts); len(s.Counts) != expected {
+		return nil, fmt.Errorf("histogram snapshot has %d counts, expected %d", len(s.Counts), expected)
+	}
+	h.h = hdrhistogram.Import(s)
+	return h, nil
+}
+
+// compatible returns an error if o doesn't have the same buckets as r
+func (r *RollingHDRHistogram) compatible(o *RollingHDRHistogram) error {
+	if r.bucketCount != o.bucketCount || r.period != o.period || r.low != o.low || r.high != o.high || r.sigfigs != o.sigfigs {
+		return fmt.Errorf("histograms don't match: %d buckets of %v [%d, %d] with %d sigfigs, got %d buckets of %v [%d, %d] with %d sigfigs",
+			r.bucketCount, r.period, r.low, r.high, r.sigfigs, o.bucketCount, o.period, o.low, o.high, o.sigfigs)
+	}
+	return nil
+}
+
+// merge merges the buckets of o into the buckets of r, aligning them on the period they were recorded in:
+// both histograms are brought to the current time, and the buckets of o that fall out of the window are dropped
+func (r *RollingHDRHistogram) merge(o *RollingHDRHistogram) error {
+	if err := r.compatible(o); err != nil {
+		return err
+	}
+	r.getHist()
+	shift := 0
+	if elapsed := r.clock.UtcNow().Sub(o.lastRoll); elapsed > 0 {
+		shift = int(elapsed / o.period)
+	}
+	n := len(r.buckets)
+	for i := 0; i+shift < n; i++ {
+		if err := r.buckets[(r.idx-i-shift+2*n)%n].Merge(o.buckets[(o.idx-i+n)%n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Reset reset a RollingHDRHistogram
 func (r *RollingHDRHistogram) Reset() {
 	r.idx = 0
@@ -198,9 +320,44 @@ func (r *RollingHDRHistogram) Merged() (*HDRHistogram, error) {
 	return m, nil
 }
 
+// MergedWithin gets the histogram merged over the sub-histograms covering the last d of the window,
+// d is rounded up to a multiple of the rolling period and capped to the window. Sub-histograms
+// that are older than d because no values were recorded since are left out.
+func (r *RollingHDRHistogram) MergedWithin(d time.Duration) (*HDRHistogram, error) {
+	if d <= 0 {
+		return nil, fmt.Errorf("duration should be > 0, got %v", d)
+	}
+	m, err := NewHDRHistogram(r.low, r.high, r.sigfigs)
+	if err != nil {
+		return m, err
+	}
+
+	count := int((d + r.period - 1) / r.period)
+	if count > len(r.buckets) {
+		count = len(r.buckets)
+	}
+	// the rotations that would have happened since the last recorded value
+	missed := int(r.clock.UtcNow().Sub(r.lastRoll) / r.period)
+	if missed < 0 {
+		missed = 0
+	}
+
+	n := len(r.buckets)
+	for i := 0; i+missed < count; i++ {
+		if errMerge := m.Merge(r.buckets[(r.idx-i+n)%n]); errMerge != nil {
+			return nil, errMerge
+		}
+	}
+	return m, nil
+}
+
 func (r *RollingHDRHistogram) getHist() *HDRHistogram {
-	if r.clock.UtcNow().Sub(r.lastRoll) >= r.period {
-		r.rotate()
+	if elapsed := r.clock.UtcNow().Sub(r.lastRoll); elapsed >= r.period {
+		// one rotation per elapsed period, so that the sub-histograms stay consecutive periods
+		// and the values recorded before an idle gap longer than the window are dropped
+		for i := int64(0); i < int64(elapsed/r.period) && i < int64(len(r.buckets)); i++ {
+			r.rotate()
+		}
 		r.lastRoll = r.clock.UtcNow()
 	}
 	return r.buckets[r.idx]
@@ -78,6 +78,134 @@ func TestRotation(t *testing.T) {
 	assert.EqualValues(t, 2, m.ValueAtQuantile(100))
 }
 
+func TestRotationAfterIdle(t *testing.T) {
+	clock := testutils.GetClock()
+
+	h, err := NewRollingHDRHistogram(1, 3600000, 3, time.Second, 3, RollingClock(clock))
+	require.NoError(t, err)
+
+	require.NoError(t, h.RecordValues(5, 1))
+
+	// an idle gap shorter than the window keeps the values
+	clock.CurrentTime = clock.CurrentTime.Add(2 * time.Second)
+	require.NoError(t, h.RecordValues(2, 1))
+
+	m, err := h.Merged()
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, m.ValueAtQuantile(100))
+	assert.EqualValues(t, 2, m.h.TotalCount())
+
+	// one more period drops the first value
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	require.NoError(t, h.RecordValues(1, 1))
+
+	m, err = h.Merged()
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, m.ValueAtQuantile(100))
+	assert.EqualValues(t, 2, m.h.TotalCount())
+
+	// an idle gap longer than the window drops all the values
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	require.NoError(t, h.RecordValues(3, 1))
+
+	m, err = h.Merged()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, m.ValueAtQuantile(100))
+	assert.EqualValues(t, 1, m.h.TotalCount())
+}
+
+func TestRollingMergeAlignsLastRoll(t *testing.T) {
+	clock := testutils.GetClock()
+
+	a, err := NewRollingHDRHistogram(1, 3600000, 3, time.Second, 2, RollingClock(clock))
+	require.NoError(t, err)
+	b, err := NewRollingHDRHistogram(1, 3600000, 3, time.Second, 2, RollingClock(clock))
+	require.NoError(t, err)
+
+	require.NoError(t, a.RecordValues(5, 1))
+	require.NoError(t, b.RecordValues(1, 1))
+
+	// a rotates, b keeps the last roll of the previous period
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	require.NoError(t, a.RecordValues(2, 1))
+
+	require.NoError(t, a.merge(b))
+
+	m, err := a.Merged()
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, m.ValueAtQuantile(100))
+	assert.EqualValues(t, 3, m.h.TotalCount())
+
+	// the value of b was recorded in the previous period and leaves the window with the first value of a
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	require.NoError(t, a.RecordValues(3, 1))
+
+	m, err = a.Merged()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, m.ValueAtQuantile(100))
+	assert.EqualValues(t, 2, m.h.TotalCount())
+
+	// the buckets of b older than the window are dropped
+	c, err := NewRollingHDRHistogram(1, 3600000, 3, time.Second, 2, RollingClock(clock))
+	require.NoError(t, err)
+	require.NoError(t, c.RecordValues(7, 1))
+	clock.CurrentTime = clock.CurrentTime.Add(3 * time.Second)
+
+	require.NoError(t, a.merge(c))
+
+	m, err = a.Merged()
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, m.h.TotalCount())
+}
+
+func TestMergedWithin(t *testing.T) {
+	clock := testutils.GetClock()
+
+	h, err := NewRollingHDRHistogram(1, 3600000000, 3, time.Second, 10, RollingClock(clock))
+	require.NoError(t, err)
+
+	// a slow trend followed by a recent burst of fast requests
+	require.NoError(t, h.RecordLatencies(500*time.Millisecond, 1000))
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	for i := 1; i <= 100; i++ {
+		require.NoError(t, h.RecordLatencies(time.Duration(i)*time.Millisecond, 1))
+	}
+
+	// 3 significant figures
+	precision := func(d time.Duration) float64 { return float64(d) / 1000 }
+
+	recent, err := h.MergedWithin(time.Second)
+	require.NoError(t, err)
+	assert.InDelta(t, float64(99*time.Millisecond), float64(recent.LatencyAtQuantile(99)), precision(99*time.Millisecond))
+	assert.InDelta(t, float64(50*time.Millisecond), float64(recent.LatencyAtQuantile(50)), precision(50*time.Millisecond))
+
+	// rounded up to 2 periods, the previous one is empty
+	recent, err = h.MergedWithin(1500 * time.Millisecond)
+	require.NoError(t, err)
+	assert.InDelta(t, float64(99*time.Millisecond), float64(recent.LatencyAtQuantile(99)), precision(99*time.Millisecond))
+
+	all, err := h.Merged()
+	require.NoError(t, err)
+	window, err := h.MergedWithin(time.Minute)
+	require.NoError(t, err)
+	assert.InDelta(t, float64(500*time.Millisecond), float64(window.LatencyAtQuantile(99)), precision(500*time.Millisecond))
+	assert.Equal(t, all.LatencyAtQuantile(99), window.LatencyAtQuantile(99))
+	assert.Equal(t, all.LatencyAtQuantile(5), window.LatencyAtQuantile(5))
+
+	// nothing was recorded in the last 3 seconds
+	clock.CurrentTime = clock.CurrentTime.Add(3 * time.Second)
+	recent, err = h.MergedWithin(2 * time.Second)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, recent.ValueAtQuantile(100))
+
+	recent, err = h.MergedWithin(5 * time.Second)
+	require.NoError(t, err)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(recent.LatencyAtQuantile(100)), precision(100*time.Millisecond))
+
+	_, err = h.MergedWithin(0)
+	assert.Error(t, err)
+}
+
 func TestReset(t *testing.T) {
 	clock := testutils.GetClock()
 
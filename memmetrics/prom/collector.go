@@ -0,0 +1,124 @@
+// Package prom exposes memmetrics round trip metrics to Prometheus.
+//
+// It is a separate module so that depending on oxy doesn't pull the Prometheus client.
+//
+// Example of a collector:
+//
+//	metrics, _ := memmetrics.NewRTMetrics()
+//	collector, _ := prom.NewCollector(metrics, "backend-1")
+//	prometheus.MustRegister(collector)
+//
+// The values cover the rolling window of the metrics, they are exported as gauges.
+package prom
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+const defaultNamespace = "oxy"
+
+var defaultQuantiles = []float64{50, 90, 99}
+
+// Collector is a prometheus.Collector exposing the counts and latencies of an RTMetrics,
+// the name of the backend is set as the "backend" label
+type Collector struct {
+	metrics   *memmetrics.RTMetrics
+	backend   string
+	namespace string
+	quantiles []float64
+
+	requests      *prometheus.Desc
+	responses     *prometheus.Desc
+	networkErrors *prometheus.Desc
+	latency       *prometheus.Desc
+}
+
+// CollectorOption represents an option you can pass to NewCollector
+type CollectorOption func(*Collector) error
+
+// Namespace sets the prefix of the metric names, defaults to "oxy"
+func Namespace(namespace string) CollectorOption {
+	return func(c *Collector) error {
+		c.namespace = namespace
+		return nil
+	}
+}
+
+// Quantiles sets the latency quantiles exposed, in percents, defaults to 50, 90 and 99
+func Quantiles(quantiles ...float64) CollectorOption {
+	return func(c *Collector) error {
+		for _, q := range quantiles {
+			if q <= 0 || q > 100 {
+				return fmt.Errorf("quantile should be in (0, 100], got %v", q)
+			}
+		}
+		c.quantiles = quantiles
+		return nil
+	}
+}
+
+// NewCollector creates a collector of the metrics of the backend
+func NewCollector(metrics *memmetrics.RTMetrics, backend string, options ...CollectorOption) (*Collector, error) {
+	if metrics == nil {
+		return nil, fmt.Errorf("metrics can not be nil")
+	}
+
+	c := &Collector{
+		metrics:   metrics,
+		backend:   backend,
+		namespace: defaultNamespace,
+		quantiles: defaultQuantiles,
+	}
+	for _, o := range options {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	labels := prometheus.Labels{"backend": backend}
+	c.requests = prometheus.NewDesc(prometheus.BuildFQName(c.namespace, "", "requests"),
+		"Number of requests in the rolling window.", nil, labels)
+	c.responses = prometheus.NewDesc(prometheus.BuildFQName(c.namespace, "", "responses"),
+		"Number of responses in the rolling window by status code class.", []string{"code_class"}, labels)
+	c.networkErrors = prometheus.NewDesc(prometheus.BuildFQName(c.namespace, "", "network_errors"),
+		"Number of network errors (502 and 504 responses) in the rolling window.", nil, labels)
+	c.latency = prometheus.NewDesc(prometheus.BuildFQName(c.namespace, "", "latency_seconds"),
+		"Latency at quantile over the rolling window.", []string{"quantile"}, labels)
+	return c, nil
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requests
+	ch <- c.responses
+	ch <- c.networkErrors
+	ch <- c.latency
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.requests, prometheus.GaugeValue, float64(c.metrics.TotalCount()))
+	ch <- prometheus.MustNewConstMetric(c.networkErrors, prometheus.GaugeValue, float64(c.metrics.NetworkErrorCount()))
+
+	classes := make(map[string]int64)
+	for code, count := range c.metrics.StatusCodesCounts() {
+		classes[strconv.Itoa(code/100)+"xx"] += count
+	}
+	for class, count := range classes {
+		ch <- prometheus.MustNewConstMetric(c.responses, prometheus.GaugeValue, float64(count), class)
+	}
+
+	h, err := c.metrics.LatencyHistogram()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.latency, err)
+		return
+	}
+	for _, q := range c.quantiles {
+		ch <- prometheus.MustNewConstMetric(c.latency, prometheus.GaugeValue,
+			h.LatencyAtQuantile(q).Seconds(), strconv.FormatFloat(q/100, 'f', -1, 64))
+	}
+}
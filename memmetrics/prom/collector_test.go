@@ -0,0 +1,77 @@
+package prom
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestCollector(t *testing.T) {
+	metrics, err := memmetrics.NewRTMetrics(memmetrics.RTClock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	for i := 1; i <= 10; i++ {
+		metrics.Record(http.StatusOK, time.Duration(i)*time.Millisecond)
+	}
+	metrics.Record(http.StatusNotFound, time.Millisecond)
+	metrics.Record(http.StatusBadGateway, time.Second)
+	metrics.Record(http.StatusGatewayTimeout, time.Second)
+
+	collector, err := NewCollector(metrics, "backend-1", Quantiles(50, 100))
+	require.NoError(t, err)
+
+	// latencies are rounded to the precision of the histogram
+	expected := `
+# HELP oxy_latency_seconds Latency at quantile over the rolling window.
+# TYPE oxy_latency_seconds gauge
+oxy_latency_seconds{backend="backend-1",quantile="0.5"} 0.006015
+oxy_latency_seconds{backend="backend-1",quantile="1"} 1.003519
+# HELP oxy_network_errors Number of network errors (502 and 504 responses) in the rolling window.
+# TYPE oxy_network_errors gauge
+oxy_network_errors{backend="backend-1"} 2
+# HELP oxy_requests Number of requests in the rolling window.
+# TYPE oxy_requests gauge
+oxy_requests{backend="backend-1"} 13
+# HELP oxy_responses Number of responses in the rolling window by status code class.
+# TYPE oxy_responses gauge
+oxy_responses{backend="backend-1",code_class="2xx"} 10
+oxy_responses{backend="backend-1",code_class="4xx"} 1
+oxy_responses{backend="backend-1",code_class="5xx"} 2
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+}
+
+func TestCollectorBackends(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	for _, backend := range []string{"a", "b"} {
+		metrics, err := memmetrics.NewRTMetrics()
+		require.NoError(t, err)
+		metrics.Record(http.StatusOK, time.Millisecond)
+
+		collector, err := NewCollector(metrics, backend, Namespace("proxy"))
+		require.NoError(t, err)
+		require.NoError(t, registry.Register(collector))
+	}
+
+	count, err := testutil.GatherAndCount(registry, "proxy_requests")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestCollectorInvalidOptions(t *testing.T) {
+	_, err := NewCollector(nil, "backend")
+	assert.Error(t, err)
+
+	metrics, err := memmetrics.NewRTMetrics()
+	require.NoError(t, err)
+	_, err = NewCollector(metrics, "backend", Quantiles(0))
+	assert.Error(t, err)
+}
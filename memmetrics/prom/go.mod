@@ -0,0 +1,11 @@
+module github.com/vulcand/oxy/memmetrics/prom
+
+go 1.13
+
+require (
+	github.com/prometheus/client_golang v1.11.1
+	github.com/stretchr/testify v1.5.1
+	github.com/vulcand/oxy v1.1.0
+)
+
+replace github.com/vulcand/oxy => ../../
@@ -1,7 +1,9 @@
 package memmetrics
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
@@ -25,6 +27,17 @@ type RTMetrics struct {
 	newCounter NewCounterFn
 	newHist    NewRollingHistogramFn
 	clock      timetools.TimeProvider
+
+	// latency histogram bounds in microseconds
+	histLow     int64
+	histHigh    int64
+	histSigfigs int
+
+	// geometry of the rolling windows
+	counterBuckets    int
+	counterResolution time.Duration
+	histBuckets       int
+	histPeriod        time.Duration
 }
 
 type rrOptSetter func(r *RTMetrics) error
@@ -54,6 +67,49 @@ func RTHistogram(fn NewRollingHistogramFn) rrOptSetter {
 	}
 }
 
+// RTHistogramBounds sets the lowest and highest latencies tracked by the latency histogram and its precision
+// in significant figures, it is ignored when a builder function is set with RTHistogram.
+// Latencies are recorded with microsecond precision, defaults are 1 microsecond, 1 hour and 2 significant figures.
+func RTHistogramBounds(min, max time.Duration, sigfigs int) rrOptSetter {
+	return func(r *RTMetrics) error {
+		if min < time.Microsecond {
+			return fmt.Errorf("histogram min should be >= 1µs, got %v", min)
+		}
+		if min >= max {
+			return fmt.Errorf("histogram min should be < max, got %v and %v", min, max)
+		}
+		if sigfigs < 1 || sigfigs > 5 {
+			return fmt.Errorf("histogram significant figures should be in [1, 5], got %d", sigfigs)
+		}
+		r.histLow = int64(min / time.Microsecond)
+		r.histHigh = int64(max / time.Microsecond)
+		r.histSigfigs = sigfigs
+		return nil
+	}
+}
+
+// RTWindow sets the rolling window of the counters to buckets of resolution, defaults to 10 buckets of 1 second.
+// The latency histogram covers the same window with up to 6 sub-histograms, so its memory use stays bounded.
+// It is ignored for the counters and the histogram whose builder functions are set with RTCounter and RTHistogram.
+func RTWindow(buckets int, resolution time.Duration) rrOptSetter {
+	return func(r *RTMetrics) error {
+		if buckets < 1 {
+			return fmt.Errorf("window buckets should be >= 1, got %d", buckets)
+		}
+		if resolution < time.Second {
+			return fmt.Errorf("window resolution should be >= 1s, got %v", resolution)
+		}
+		r.counterBuckets = buckets
+		r.counterResolution = resolution
+		r.histBuckets = buckets
+		if r.histBuckets > histBuckets {
+			r.histBuckets = histBuckets
+		}
+		r.histPeriod = time.Duration(buckets) * resolution / time.Duration(r.histBuckets)
+		return nil
+	}
+}
+
 // RTClock sets a clock
 func RTClock(clock timetools.TimeProvider) rrOptSetter {
 	return func(r *RTMetrics) error {
@@ -67,6 +123,15 @@ func NewRTMetrics(settings ...rrOptSetter) (*RTMetrics, error) {
 	m := &RTMetrics{
 		statusCodes:     make(map[int]*RollingCounter),
 		statusCodesLock: sync.RWMutex{},
+
+		histLow:     histMin,
+		histHigh:    histMax,
+		histSigfigs: histSignificantFigures,
+
+		counterBuckets:    counterBuckets,
+		counterResolution: counterResolution,
+		histBuckets:       histBuckets,
+		histPeriod:        histPeriod,
 	}
 	for _, s := range settings {
 		if err := s(m); err != nil {
@@ -74,41 +139,118 @@ func NewRTMetrics(settings ...rrOptSetter) (*RTMetrics, error) {
 		}
 	}
 
+	m.setDefaults()
+
+	h, err := m.newHist()
+	if err != nil {
+		return nil, err
+	}
+
+	netErrors, err := m.newCounter()
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := m.newCounter()
+	if err != nil {
+		return nil, err
+	}
+
+	m.histogram = h
+	m.netErrors = netErrors
+	m.total = total
+	return m, nil
+}
+
+// setDefaults sets the clock and the builder functions that have not been set
+func (m *RTMetrics) setDefaults() {
 	if m.clock == nil {
 		m.clock = &timetools.RealTime{}
 	}
 
 	if m.newCounter == nil {
 		m.newCounter = func() (*RollingCounter, error) {
-			return NewCounter(counterBuckets, counterResolution, CounterClock(m.clock))
+			return NewCounter(m.counterBuckets, m.counterResolution, CounterClock(m.clock))
 		}
 	}
 
 	if m.newHist == nil {
 		m.newHist = func() (*RollingHDRHistogram, error) {
-			return NewRollingHDRHistogram(histMin, histMax, histSignificantFigures, histPeriod, histBuckets, RollingClock(m.clock))
+			return NewRollingHDRHistogram(m.histLow, m.histHigh, m.histSigfigs, m.histPeriod, m.histBuckets, RollingClock(m.clock))
 		}
 	}
+}
 
-	h, err := m.newHist()
-	if err != nil {
-		return nil, err
+type rtMetricsJSON struct {
+	Total       *RollingCounter         `json:"total"`
+	NetErrors   *RollingCounter         `json:"netErrors"`
+	StatusCodes map[int]*RollingCounter `json:"statusCodes"`
+	Histogram   *RollingHDRHistogram    `json:"histogram"`
+}
+
+// MarshalJSON encodes the buckets of the counters and of the latency histogram along with their timestamps
+func (m *RTMetrics) MarshalJSON() ([]byte, error) {
+	copied := m.Export()
+	return json.Marshal(rtMetricsJSON{
+		Total:       copied.total,
+		NetErrors:   copied.netErrors,
+		StatusCodes: copied.statusCodes,
+		Histogram:   copied.histogram,
+	})
+}
+
+// UnmarshalJSON restores metrics encoded by MarshalJSON, buckets that are past the rolling windows are discarded.
+// The clock of m is kept, it defaults to the real time.
+func (m *RTMetrics) UnmarshalJSON(data []byte) error {
+	m.statusCodesLock.Lock()
+	defer m.statusCodesLock.Unlock()
+	m.histogramLock.Lock()
+	defer m.histogramLock.Unlock()
+
+	if m.clock == nil {
+		m.clock = &timetools.RealTime{}
 	}
 
-	netErrors, err := m.newCounter()
-	if err != nil {
-		return nil, err
+	in := struct {
+		Total       json.RawMessage         `json:"total"`
+		NetErrors   json.RawMessage         `json:"netErrors"`
+		StatusCodes map[int]json.RawMessage `json:"statusCodes"`
+		Histogram   json.RawMessage         `json:"histogram"`
+	}{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
 	}
 
-	total, err := m.newCounter()
-	if err != nil {
-		return nil, err
+	total := &RollingCounter{clock: m.clock}
+	if err := json.Unmarshal(in.Total, total); err != nil {
+		return err
+	}
+	netErrors := &RollingCounter{clock: m.clock}
+	if err := json.Unmarshal(in.NetErrors, netErrors); err != nil {
+		return err
+	}
+	statusCodes := make(map[int]*RollingCounter, len(in.StatusCodes))
+	for code, raw := range in.StatusCodes {
+		c := &RollingCounter{clock: m.clock}
+		if err := json.Unmarshal(raw, c); err != nil {
+			return err
+		}
+		statusCodes[code] = c
+	}
+	histogram := &RollingHDRHistogram{clock: m.clock}
+	if err := json.Unmarshal(in.Histogram, histogram); err != nil {
+		return err
 	}
 
-	m.histogram = h
-	m.netErrors = netErrors
 	m.total = total
-	return m, nil
+	m.netErrors = netErrors
+	m.statusCodes = statusCodes
+	m.histogram = histogram
+	m.histLow, m.histHigh, m.histSigfigs = histogram.low, histogram.high, histogram.sigfigs
+	m.counterBuckets, m.counterResolution = len(total.values), total.resolution
+	m.histBuckets, m.histPeriod = histogram.bucketCount, histogram.period
+	m.setDefaults()
+	return nil
 }
 
 // Export Returns a new RTMetrics which is a copy of the current one
@@ -134,6 +276,13 @@ func (m *RTMetrics) Export() *RTMetrics {
 	export.newCounter = m.newCounter
 	export.newHist = m.newHist
 	export.clock = m.clock
+	export.histLow = m.histLow
+	export.histHigh = m.histHigh
+	export.histSigfigs = m.histSigfigs
+	export.counterBuckets = m.counterBuckets
+	export.counterResolution = m.counterResolution
+	export.histBuckets = m.histBuckets
+	export.histPeriod = m.histPeriod
 
 	return export
 }
@@ -206,6 +355,55 @@ func (m *RTMetrics) Append(other *RTMetrics) error {
 	return m.histogram.Append(copied.histogram)
 }
 
+// Merge combines the counters and the latency histogram of other into m bucket by bucket,
+// aligning the most recent buckets of both metrics. It returns an error and leaves m untouched
+// if the metrics don't share the same buckets geometry.
+func (m *RTMetrics) Merge(other *RTMetrics) error {
+	if m == other {
+		return errors.New("RTMetrics cannot merge with self")
+	}
+
+	copied := other.Export()
+
+	m.statusCodesLock.Lock()
+	defer m.statusCodesLock.Unlock()
+	m.histogramLock.Lock()
+	defer m.histogramLock.Unlock()
+
+	if err := m.total.compatible(copied.total); err != nil {
+		return err
+	}
+	if err := m.netErrors.compatible(copied.netErrors); err != nil {
+		return err
+	}
+	if err := m.histogram.compatible(copied.histogram); err != nil {
+		return err
+	}
+
+	statusCodes := make(map[int]*RollingCounter, len(copied.statusCodes))
+	for code, c := range copied.statusCodes {
+		o, ok := m.statusCodes[code]
+		if !ok {
+			var err error
+			if o, err = m.newCounter(); err != nil {
+				return err
+			}
+		}
+		if err := o.compatible(c); err != nil {
+			return err
+		}
+		statusCodes[code] = o
+	}
+
+	m.total.merge(copied.total)
+	m.netErrors.merge(copied.netErrors)
+	for code, c := range copied.statusCodes {
+		statusCodes[code].merge(c)
+		m.statusCodes[code] = statusCodes[code]
+	}
+	return m.histogram.merge(copied.histogram)
+}
+
 // Record records a metric
 func (m *RTMetrics) Record(code int, duration time.Duration) {
 	m.total.Inc(1)
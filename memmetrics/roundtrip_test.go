@@ -1,6 +1,7 @@
 package memmetrics
 
 import (
+	"encoding/json"
 	"runtime"
 	"sync"
 	"testing"
@@ -74,6 +75,249 @@ func TestAppend(t *testing.T) {
 	assert.EqualValues(t, 3, h.LatencyAtQuantile(100)/time.Second)
 }
 
+func TestRTMetricsMerge(t *testing.T) {
+	clock := testutils.GetClock()
+
+	rr, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	rr2, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	all, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+
+	for i := 1; i <= 100; i++ {
+		rr.Record(200, time.Duration(i)*time.Millisecond)
+		all.Record(200, time.Duration(i)*time.Millisecond)
+	}
+	clock.Sleep(time.Second)
+	for i := 101; i <= 200; i++ {
+		code := 200
+		if i%10 == 0 {
+			code = 502
+		}
+		rr2.Record(code, time.Duration(i)*time.Millisecond)
+		all.Record(code, time.Duration(i)*time.Millisecond)
+	}
+
+	require.NoError(t, rr.Merge(rr2))
+	assert.EqualValues(t, 200, rr.TotalCount())
+	assert.EqualValues(t, 10, rr.NetworkErrorCount())
+	assert.Equal(t, map[int]int64{200: 190, 502: 10}, rr.StatusCodesCounts())
+
+	// the merged histogram gives the same quantiles as recording all the latencies in one place
+	h, err := rr.LatencyHistogram()
+	require.NoError(t, err)
+	expected, err := all.LatencyHistogram()
+	require.NoError(t, err)
+	for _, q := range []float64{50, 90, 99, 99.9, 100} {
+		assert.Equal(t, expected.LatencyAtQuantile(q), h.LatencyAtQuantile(q), "quantile %v", q)
+	}
+	assert.InDelta(t, 100*time.Millisecond, h.LatencyAtQuantile(50), float64(time.Millisecond))
+	assert.InDelta(t, 198*time.Millisecond, h.LatencyAtQuantile(99), float64(2*time.Millisecond))
+
+	// merged buckets keep their age and expire with the window
+	clock.Sleep(counterBuckets*counterResolution - time.Second)
+	assert.EqualValues(t, 100, rr.TotalCount())
+
+	// the merged metrics are untouched
+	assert.EqualValues(t, 100, rr2.TotalCount())
+	assert.Error(t, rr.Merge(rr))
+}
+
+func TestRTMetricsMergeMismatch(t *testing.T) {
+	clock := testutils.GetClock()
+
+	rr, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	rr.Record(200, time.Second)
+
+	counter, err := NewRTMetrics(RTClock(clock), RTCounter(func() (*RollingCounter, error) {
+		return NewCounter(5, time.Second, CounterClock(clock))
+	}))
+	require.NoError(t, err)
+	counter.Record(200, time.Second)
+	assert.Error(t, rr.Merge(counter))
+
+	hist, err := NewRTMetrics(RTClock(clock), RTHistogram(func() (*RollingHDRHistogram, error) {
+		return NewRollingHDRHistogram(histMin, histMax, 3, histPeriod, histBuckets, RollingClock(clock))
+	}))
+	require.NoError(t, err)
+	hist.Record(200, time.Second)
+	assert.Error(t, rr.Merge(hist))
+
+	// failed merges leave the metrics untouched
+	assert.EqualValues(t, 1, rr.TotalCount())
+	assert.Equal(t, map[int]int64{200: 1}, rr.StatusCodesCounts())
+}
+
+func TestRTHistogramBounds(t *testing.T) {
+	clock := testutils.GetClock()
+
+	rr, err := NewRTMetrics(RTClock(clock), RTHistogramBounds(time.Microsecond, 3*time.Hour, 3))
+	require.NoError(t, err)
+
+	rr.Record(200, 1234*time.Microsecond)
+	rr.Record(200, 2*time.Hour)
+
+	h, err := rr.LatencyHistogram()
+	require.NoError(t, err)
+	assert.InDelta(t, 1234*time.Microsecond, h.LatencyAtQuantile(50), float64(2*time.Microsecond))
+	assert.InDelta(t, 2*time.Hour, h.LatencyAtQuantile(100), float64(10*time.Second))
+
+	// rotated sub-histograms share the same bounds
+	for i := 0; i < histBuckets+1; i++ {
+		clock.Sleep(histPeriod)
+		rr.Record(200, time.Millisecond)
+	}
+	for _, b := range rr.histogram.buckets {
+		assert.EqualValues(t, 1, b.low)
+		assert.EqualValues(t, int64(3*time.Hour/time.Microsecond), b.high)
+		assert.Equal(t, 3, b.sigfigs)
+	}
+	assert.Equal(t, 3, rr.Export().histSigfigs)
+
+	// defaults are unchanged
+	rr, err = NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	assert.EqualValues(t, histMin, rr.histogram.low)
+	assert.EqualValues(t, histMax, rr.histogram.high)
+	assert.EqualValues(t, histSignificantFigures, rr.histogram.sigfigs)
+}
+
+func TestRTHistogramBoundsValidation(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		min, max time.Duration
+		sigfigs  int
+	}{
+		{desc: "min below a microsecond", min: time.Nanosecond, max: time.Second, sigfigs: 2},
+		{desc: "min equal to max", min: time.Second, max: time.Second, sigfigs: 2},
+		{desc: "min above max", min: time.Minute, max: time.Second, sigfigs: 2},
+		{desc: "no significant figures", min: time.Microsecond, max: time.Second, sigfigs: 0},
+		{desc: "too many significant figures", min: time.Microsecond, max: time.Second, sigfigs: 6},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := NewRTMetrics(RTHistogramBounds(test.min, test.max, test.sigfigs))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRTWindow(t *testing.T) {
+	clock := testutils.GetClock()
+
+	rr, err := NewRTMetrics(RTClock(clock), RTWindow(3, time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 3*time.Second, rr.CounterWindowSize())
+	assert.Equal(t, 3, rr.histogram.bucketCount)
+	assert.Equal(t, time.Second, rr.histogram.period)
+
+	rr.Record(200, time.Millisecond)
+	rr.Record(502, time.Millisecond)
+	clock.Sleep(2 * time.Second)
+	assert.EqualValues(t, 2, rr.TotalCount())
+	assert.EqualValues(t, 1, rr.NetworkErrorCount())
+
+	// the requests are out of the window
+	clock.Sleep(time.Second)
+	assert.EqualValues(t, 0, rr.TotalCount())
+	assert.Empty(t, rr.StatusCodesCounts())
+
+	// long windows keep the histogram to a bounded number of sub-histograms
+	rr, err = NewRTMetrics(RTClock(clock), RTWindow(120, time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, rr.CounterWindowSize())
+	assert.Equal(t, histBuckets, rr.histogram.bucketCount)
+	assert.Equal(t, 20*time.Second, rr.histogram.period)
+	assert.Equal(t, 2*time.Minute, rr.Export().counterResolution*time.Duration(rr.Export().counterBuckets))
+
+	_, err = NewRTMetrics(RTWindow(0, time.Second))
+	assert.Error(t, err)
+	_, err = NewRTMetrics(RTWindow(10, time.Millisecond))
+	assert.Error(t, err)
+}
+
+func TestRTMetricsJSON(t *testing.T) {
+	clock := testutils.GetClock()
+
+	rr, err := NewRTMetrics(RTClock(clock), RTHistogramBounds(time.Microsecond, time.Hour, 3))
+	require.NoError(t, err)
+
+	for i := 1; i <= 100; i++ {
+		code := 200
+		if i%4 == 0 {
+			code = 502
+		}
+		rr.Record(code, time.Duration(i)*time.Millisecond)
+		if i%25 == 0 {
+			clock.Sleep(time.Second)
+		}
+	}
+
+	data, err := json.Marshal(rr)
+	require.NoError(t, err)
+
+	restored, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, restored))
+
+	assert.EqualValues(t, 100, restored.TotalCount())
+	assert.EqualValues(t, 25, restored.NetworkErrorCount())
+	assert.Equal(t, rr.NetworkErrorRatio(), restored.NetworkErrorRatio())
+	assert.Equal(t, rr.StatusCodesCounts(), restored.StatusCodesCounts())
+	assert.Equal(t, rr.ResponseCodeRatio(500, 600, 0, 600), restored.ResponseCodeRatio(500, 600, 0, 600))
+
+	expected, err := rr.LatencyHistogram()
+	require.NoError(t, err)
+	h, err := restored.LatencyHistogram()
+	require.NoError(t, err)
+	for _, q := range []float64{50, 90, 99, 100} {
+		assert.Equal(t, expected.LatencyAtQuantile(q), h.LatencyAtQuantile(q), "quantile %v", q)
+	}
+
+	// the restored metrics keep recording with the restored geometry
+	restored.Record(500, time.Millisecond)
+	assert.EqualValues(t, 101, restored.TotalCount())
+	assert.Equal(t, 3, restored.histSigfigs)
+
+	// buckets past the window are discarded
+	clock.Sleep(counterBuckets*counterResolution - 2*time.Second)
+	restored, err = NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, restored))
+	assert.EqualValues(t, 25, restored.TotalCount())
+
+	clock.Sleep(histPeriod * histBuckets)
+	restored, err = NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, restored))
+	assert.EqualValues(t, 0, restored.TotalCount())
+	assert.Equal(t, map[int]int64{}, restored.StatusCodesCounts())
+	h, err = restored.LatencyHistogram()
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), h.LatencyAtQuantile(100))
+}
+
+func TestRTMetricsJSONInvalid(t *testing.T) {
+	rr, err := NewRTMetrics(RTClock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	assert.Error(t, json.Unmarshal([]byte(`{}`), rr))
+	assert.Error(t, json.Unmarshal([]byte(`{"total": {"resolution": 1000000000, "values": []}}`), rr))
+
+	data, err := json.Marshal(rr)
+	require.NoError(t, err)
+	var in map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &in))
+	in["histogram"].(map[string]interface{})["sigfigs"] = 3
+	data, err = json.Marshal(in)
+	require.NoError(t, err)
+	assert.Error(t, json.Unmarshal(data, rr))
+}
+
 func TestConcurrentRecords(t *testing.T) {
 	// This test asserts a race condition which requires parallelism
 	runtime.GOMAXPROCS(100)
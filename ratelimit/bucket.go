@@ -90,6 +90,8 @@ func (tb *tokenBucket) update(rate *rate) error {
 	if rate.period != tb.period {
 		return fmt.Errorf("period mismatch: %v != %v", tb.period, rate.period)
 	}
+	// credit the tokens refilled so far at the previous rate before switching to the new one
+	tb.updateAvailableTokens()
 	tb.timePerToken = time.Duration(int64(tb.period) / rate.average)
 	tb.burst = rate.burst
 	if tb.availableTokens > rate.burst {
@@ -105,6 +107,18 @@ func (tb *tokenBucket) timeTillAvailable(tokens int64) time.Duration {
 	return time.Duration(missingTokens) * tb.timePerToken
 }
 
+// timeTillFull returns the time until the bucket is refilled up to its burst
+func (tb *tokenBucket) timeTillFull() time.Duration {
+	if tb.availableTokens >= tb.burst {
+		return 0
+	}
+	d := tb.timeTillAvailable(tb.burst) - tb.clock.UtcNow().Sub(tb.lastRefresh)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
 // updateAvailableTokens updates the number of tokens available for consumption.
 // It is calculated based on the refill rate, the time passed since last refresh,
 // and is limited by the bucket capacity.
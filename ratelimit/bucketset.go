@@ -54,6 +54,13 @@ func (tbs *TokenBucketSet) Update(rates *RateSet) {
 	}
 }
 
+// rollback gives back the tokens of the last successful Consume
+func (tbs *TokenBucketSet) rollback() {
+	for _, bucket := range tbs.buckets {
+		bucket.rollback()
+	}
+}
+
 // Consume consume tokens
 func (tbs *TokenBucketSet) Consume(tokens int64) (time.Duration, error) {
 	var maxDelay time.Duration = UndefinedDelay
@@ -81,6 +88,44 @@ func (tbs *TokenBucketSet) Consume(tokens int64) (time.Duration, error) {
 	return maxDelay, firstErr
 }
 
+// status returns the burst and the available tokens of the most restrictive bucket,
+// along with the time until one more token becomes available in it.
+func (tbs *TokenBucketSet) status() (limit int64, remaining int64, refill time.Duration) {
+	current := tbs.mostRestrictive()
+	if current == nil {
+		return 0, 0, 0
+	}
+	if current.availableTokens < 1 {
+		refill = current.timeTillAvailable(1)
+	}
+	return current.burst, current.availableTokens, refill
+}
+
+// peek refreshes the buckets without consuming tokens, it returns the available tokens of the most
+// restrictive bucket along with the time until it is full again.
+func (tbs *TokenBucketSet) peek() (remaining int64, reset time.Duration) {
+	for _, tokenBucket := range tbs.buckets {
+		tokenBucket.updateAvailableTokens()
+	}
+	current := tbs.mostRestrictive()
+	if current == nil {
+		return 0, 0
+	}
+	return current.availableTokens, current.timeTillFull()
+}
+
+// mostRestrictive returns the bucket with the fewest available tokens, or the lowest burst on a tie
+func (tbs *TokenBucketSet) mostRestrictive() *tokenBucket {
+	var current *tokenBucket
+	for _, tokenBucket := range tbs.buckets {
+		if current == nil || tokenBucket.availableTokens < current.availableTokens ||
+			(tokenBucket.availableTokens == current.availableTokens && tokenBucket.burst < current.burst) {
+			current = tokenBucket
+		}
+	}
+	return current
+}
+
 // GetMaxPeriod returns the max period
 func (tbs *TokenBucketSet) GetMaxPeriod() time.Duration {
 	return tbs.maxPeriod
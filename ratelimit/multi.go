@@ -0,0 +1,199 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// RuleHeader names the rule that rejected a request of a MultiLimiter
+const RuleHeader = "X-RateLimit-Rule"
+
+// Rule is a dimension of a MultiLimiter, the requests are limited per source returned by Extract to Rates
+type Rule struct {
+	// Name identifies the rule in the responses of the rejected requests, e.g. "ip" or "api-key"
+	Name    string
+	Extract utils.SourceExtractor
+	Rates   *RateSet
+}
+
+// MultiLimiter implements rate limiting middleware over several rules, e.g. by client IP and by API key
+// with different rates. A request is let through when every rule allows it and is only counted then:
+// the tokens taken from the buckets of the other rules are given back when a rule rejects it.
+type MultiLimiter struct {
+	rules      []*multiRule
+	clock      timetools.TimeProvider
+	mutex      sync.Mutex
+	errHandler utils.ErrorHandler
+	capacity   int
+	next       http.Handler
+
+	log *log.Logger
+}
+
+// multiRule is a rule with the token buckets of its sources
+type multiRule struct {
+	Rule
+	bucketSets *ttlmap.TtlMap
+}
+
+// MultiLimiterOption multi limiter option type
+type MultiLimiterOption func(l *MultiLimiter) error
+
+// NewMulti constructs a `MultiLimiter` middleware instance evaluating rules in order.
+func NewMulti(next http.Handler, rules []Rule, opts ...MultiLimiterOption) (*MultiLimiter, error) {
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("provide rules")
+	}
+
+	ml := &MultiLimiter{
+		next: next,
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(ml); err != nil {
+			return nil, err
+		}
+	}
+	if ml.capacity <= 0 {
+		ml.capacity = DefaultCapacity
+	}
+	if ml.clock == nil {
+		ml.clock = &timetools.RealTime{}
+	}
+	if ml.errHandler == nil {
+		ml.errHandler = defaultErrHandler
+	}
+
+	names := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.Name == "" || names[rule.Name] {
+			return nil, fmt.Errorf("provide a unique name for every rule, got %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Extract == nil {
+			return nil, fmt.Errorf("provide extract function for rule %q", rule.Name)
+		}
+		if rule.Rates == nil || len(rule.Rates.m) == 0 {
+			return nil, fmt.Errorf("provide rates for rule %q", rule.Name)
+		}
+		bucketSets, err := ttlmap.NewMapWithProvider(ml.capacity, ml.clock)
+		if err != nil {
+			return nil, err
+		}
+		ml.rules = append(ml.rules, &multiRule{Rule: rule, bucketSets: bucketSets})
+	}
+	return ml, nil
+}
+
+// MultiLogger defines the logger the multi limiter will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func MultiLogger(l *log.Logger) MultiLimiterOption {
+	return func(ml *MultiLimiter) error {
+		ml.log = l
+		return nil
+	}
+}
+
+// MultiErrorHandler sets error handler of the server
+func MultiErrorHandler(h utils.ErrorHandler) MultiLimiterOption {
+	return func(ml *MultiLimiter) error {
+		ml.errHandler = h
+		return nil
+	}
+}
+
+// MultiClock sets the clock
+func MultiClock(clock timetools.TimeProvider) MultiLimiterOption {
+	return func(ml *MultiLimiter) error {
+		ml.clock = clock
+		return nil
+	}
+}
+
+// MultiCapacity sets the capacity of every rule
+func MultiCapacity(cap int) MultiLimiterOption {
+	return func(ml *MultiLimiter) error {
+		if cap <= 0 {
+			return fmt.Errorf("bad capacity: %v", cap)
+		}
+		ml.capacity = cap
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by multi limiter handler.
+func (ml *MultiLimiter) Wrap(next http.Handler) {
+	ml.next = next
+}
+
+func (ml *MultiLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	sources := make([]string, len(ml.rules))
+	amounts := make([]int64, len(ml.rules))
+	for i, rule := range ml.rules {
+		source, amount, err := rule.Extract.Extract(req)
+		if err != nil {
+			ml.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		sources[i], amounts[i] = source, amount
+	}
+
+	status, err := ml.consume(sources, amounts)
+	status.writeHeaders(w, err)
+	if err != nil {
+		ml.log.Warnf("limiting request %v %v, limit: %v", req.Method, req.URL, err)
+		ml.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	ml.next.ServeHTTP(w, req)
+}
+
+// consume takes the tokens of every rule or none, the status is the one of the most restrictive rule
+// or of the rule rejecting the request
+func (ml *MultiLimiter) consume(sources []string, amounts []int64) (rateStatus, error) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	var status rateStatus
+	consumed := make([]*TokenBucketSet, 0, len(ml.rules))
+	for i, rule := range ml.rules {
+		var bucketSet *TokenBucketSet
+		if bucketSetI, exists := rule.bucketSets.Get(sources[i]); exists {
+			bucketSet = bucketSetI.(*TokenBucketSet)
+		} else {
+			bucketSet = NewTokenBucketSet(rule.Rates, ml.clock)
+			// We set ttl as 10 times rate period, see TokenLimiter
+			rule.bucketSets.Set(sources[i], bucketSet, int(bucketSet.maxPeriod/time.Second)*10+1)
+		}
+
+		delay, err := bucketSet.Consume(amounts[i])
+		var current rateStatus
+		current.limit, current.remaining, current.retryAfter = bucketSet.status()
+		if err != nil || delay > 0 {
+			// the set rolled itself back, give the tokens back to the rules already charged
+			for _, set := range consumed {
+				set.rollback()
+			}
+			if err != nil {
+				return current, err
+			}
+			current.retryAfter = delay
+			return current, &MaxRateError{delay: delay, rule: rule.Name}
+		}
+		consumed = append(consumed, bucketSet)
+		if i == 0 || current.remaining < status.remaining {
+			status = current
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func newMultiRules(t *testing.T) []Rule {
+	ipRates := NewRateSet()
+	require.NoError(t, ipRates.Add(time.Second, 1, 3))
+	keyRates := NewRateSet()
+	require.NoError(t, keyRates.Add(time.Second, 1, 2))
+
+	return []Rule{
+		{Name: "ip", Extract: utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+			return req.Header.Get("Ip"), 1, nil
+		}), Rates: ipRates},
+		{Name: "api-key", Extract: utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+			return req.Header.Get("Api-Key"), 1, nil
+		}), Rates: keyRates},
+	}
+}
+
+func TestMultiLimiter(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+	l, err := NewMulti(handler, newMultiRules(t), MultiClock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	get := func(ip, key string) *http.Response {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Ip", ip), testutils.Header("Api-Key", key))
+		require.NoError(t, err)
+		return re
+	}
+
+	// the api key allows 2 requests
+	assert.Equal(t, http.StatusOK, get("10.0.0.1", "k1").StatusCode)
+	re := get("10.0.0.2", "k1")
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "0", re.Header.Get(RemainingHeader))
+
+	re = get("10.0.0.1", "k1")
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "api-key", re.Header.Get(RuleHeader))
+
+	// the ip was not charged for the rejected request, it allows 3 requests
+	assert.Equal(t, http.StatusOK, get("10.0.0.1", "k2").StatusCode)
+	assert.Equal(t, http.StatusOK, get("10.0.0.1", "k3").StatusCode)
+	re = get("10.0.0.1", "k4")
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "ip", re.Header.Get(RuleHeader))
+
+	// the api key was not charged when the ip rejected the request
+	assert.Equal(t, http.StatusOK, get("10.0.0.3", "k4").StatusCode)
+	assert.Equal(t, http.StatusOK, get("10.0.0.3", "k4").StatusCode)
+
+	clock.Sleep(time.Second)
+	assert.Equal(t, http.StatusOK, get("10.0.0.1", "k1").StatusCode)
+}
+
+func TestMultiLimiterExtractorError(t *testing.T) {
+	rules := newMultiRules(t)
+	rules[1].Extract = faultyExtract
+
+	l, err := NewMulti(http.NotFoundHandler(), rules)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Ip", "10.0.0.1"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+}
+
+func TestMultiLimiterInvalidRules(t *testing.T) {
+	valid := newMultiRules(t)
+
+	testCases := []struct {
+		desc  string
+		rules []Rule
+	}{
+		{desc: "no rules"},
+		{desc: "no name", rules: []Rule{{Extract: headerLimit, Rates: valid[0].Rates}}},
+		{desc: "duplicate name", rules: []Rule{valid[0], valid[0]}},
+		{desc: "no extractor", rules: []Rule{{Name: "ip", Rates: valid[0].Rates}}},
+		{desc: "no rates", rules: []Rule{{Name: "ip", Extract: headerLimit, Rates: NewRateSet()}}},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := NewMulti(http.NotFoundHandler(), test.rules)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := NewMulti(http.NotFoundHandler(), valid, MultiCapacity(0))
+	assert.Error(t, err)
+}
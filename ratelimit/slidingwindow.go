@@ -0,0 +1,284 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// SlidingWindowLimiter implements rate limiting middleware using a sliding window counter.
+// Each rate of the RateSet allows at most `average` requests per `period`, the burst is ignored.
+// Requests are counted in fixed windows and the count of the previous window is weighted
+// by its overlap with the sliding window, which smooths bursts at window boundaries.
+type SlidingWindowLimiter struct {
+	defaultRates *RateSet
+	extract      utils.SourceExtractor
+	extractRates RateExtractor
+	clock        timetools.TimeProvider
+	mutex        sync.Mutex
+	counters     *ttlmap.TtlMap
+	errHandler   utils.ErrorHandler
+	capacity     int
+	next         http.Handler
+
+	log *log.Logger
+}
+
+// SlidingWindowOption sliding window limiter option type
+type SlidingWindowOption func(l *SlidingWindowLimiter) error
+
+// NewSlidingWindowLimiter constructs a `SlidingWindowLimiter` middleware instance.
+func NewSlidingWindowLimiter(next http.Handler, extract utils.SourceExtractor, defaultRates *RateSet, opts ...SlidingWindowOption) (*SlidingWindowLimiter, error) {
+	if defaultRates == nil || len(defaultRates.m) == 0 {
+		return nil, fmt.Errorf("provide default rates")
+	}
+	if extract == nil {
+		return nil, fmt.Errorf("provide extract function")
+	}
+	sl := &SlidingWindowLimiter{
+		next:         next,
+		defaultRates: defaultRates,
+		extract:      extract,
+
+		log: log.StandardLogger(),
+	}
+
+	for _, o := range opts {
+		if err := o(sl); err != nil {
+			return nil, err
+		}
+	}
+	if sl.capacity <= 0 {
+		sl.capacity = DefaultCapacity
+	}
+	if sl.clock == nil {
+		sl.clock = &timetools.RealTime{}
+	}
+	if sl.errHandler == nil {
+		sl.errHandler = defaultErrHandler
+	}
+
+	counters, err := ttlmap.NewMapWithProvider(sl.capacity, sl.clock)
+	if err != nil {
+		return nil, err
+	}
+	sl.counters = counters
+	return sl, nil
+}
+
+// SlidingWindowLogger defines the logger the sliding window limiter will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func SlidingWindowLogger(l *log.Logger) SlidingWindowOption {
+	return func(sl *SlidingWindowLimiter) error {
+		sl.log = l
+		return nil
+	}
+}
+
+// SlidingWindowErrorHandler sets error handler of the server
+func SlidingWindowErrorHandler(h utils.ErrorHandler) SlidingWindowOption {
+	return func(sl *SlidingWindowLimiter) error {
+		sl.errHandler = h
+		return nil
+	}
+}
+
+// SlidingWindowExtractRates sets the rate extractor
+func SlidingWindowExtractRates(e RateExtractor) SlidingWindowOption {
+	return func(sl *SlidingWindowLimiter) error {
+		sl.extractRates = e
+		return nil
+	}
+}
+
+// SlidingWindowClock sets the clock
+func SlidingWindowClock(clock timetools.TimeProvider) SlidingWindowOption {
+	return func(sl *SlidingWindowLimiter) error {
+		sl.clock = clock
+		return nil
+	}
+}
+
+// SlidingWindowCapacity sets the capacity
+func SlidingWindowCapacity(cap int) SlidingWindowOption {
+	return func(sl *SlidingWindowLimiter) error {
+		if cap <= 0 {
+			return fmt.Errorf("bad capacity: %v", cap)
+		}
+		sl.capacity = cap
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by sliding window limiter handler.
+func (sl *SlidingWindowLimiter) Wrap(next http.Handler) {
+	sl.next = next
+}
+
+func (sl *SlidingWindowLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	source, amount, err := sl.extract.Extract(req)
+	if err != nil {
+		sl.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	remaining, err := sl.consume(req, source, amount)
+	w.Header().Set(RemainingHeader, strconv.FormatInt(remaining, 10))
+	if err != nil {
+		sl.log.Warnf("limiting request %v %v, limit: %v", req.Method, req.URL, err)
+		sl.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	sl.next.ServeHTTP(w, req)
+}
+
+// consume counts the request if every rate allows it and returns the number of requests left.
+func (sl *SlidingWindowLimiter) consume(req *http.Request, source string, amount int64) (int64, error) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	rates := sl.resolveRates(req)
+	now := sl.clock.UtcNow()
+
+	var set *windowCounterSet
+	if setI, exists := sl.counters.Get(source); exists {
+		set = setI.(*windowCounterSet)
+		set.update(rates)
+	} else {
+		set = newWindowCounterSet(rates)
+	}
+	// Counters of the previous window are needed during the current one, so keep them for two periods
+	// after the last request, the TTL is refreshed as Get doesn't
+	sl.counters.Set(source, set, int(set.maxPeriod/time.Second)*2+1)
+
+	remaining := int64(math.MaxInt64)
+	var maxDelay time.Duration
+	for _, counter := range set.counters {
+		counter.advance(now)
+		left, delay := counter.check(now, amount)
+		if left < remaining {
+			remaining = left
+		}
+		if delay > maxDelay {
+			maxDelay = delay
+		}
+	}
+
+	if maxDelay > 0 {
+		return 0, &MaxRateError{delay: maxDelay}
+	}
+
+	for _, counter := range set.counters {
+		counter.current += amount
+	}
+	return remaining, nil
+}
+
+// resolveRates retrieves rates to be applied to the request.
+func (sl *SlidingWindowLimiter) resolveRates(req *http.Request) *RateSet {
+	if sl.extractRates == nil {
+		return sl.defaultRates
+	}
+
+	rates, err := sl.extractRates.Extract(req)
+	if err != nil {
+		sl.log.Errorf("Failed to retrieve rates: %v", err)
+		return sl.defaultRates
+	}
+
+	// If the returned rate set is empty then used the default one.
+	if len(rates.m) == 0 {
+		return sl.defaultRates
+	}
+
+	return rates
+}
+
+// windowCounterSet holds the counters of a source, one per rate period
+type windowCounterSet struct {
+	counters  map[time.Duration]*windowCounter
+	maxPeriod time.Duration
+}
+
+func newWindowCounterSet(rates *RateSet) *windowCounterSet {
+	set := &windowCounterSet{counters: make(map[time.Duration]*windowCounter)}
+	set.update(rates)
+	return set
+}
+
+// update updates the limits of the existing counters, keeping their counts.
+func (s *windowCounterSet) update(rates *RateSet) {
+	for period := range s.counters {
+		if _, ok := rates.m[period]; !ok {
+			delete(s.counters, period)
+		}
+	}
+	s.maxPeriod = 0
+	for period, rate := range rates.m {
+		counter, ok := s.counters[period]
+		if !ok {
+			counter = &windowCounter{period: period}
+			s.counters[period] = counter
+		}
+		counter.limit = rate.average
+		s.maxPeriod = maxDuration(s.maxPeriod, period)
+	}
+}
+
+// windowCounter counts requests in the current and the previous fixed windows
+type windowCounter struct {
+	period   time.Duration
+	limit    int64
+	start    time.Time
+	previous int64
+	current  int64
+}
+
+// advance moves the counter to the window containing now.
+func (c *windowCounter) advance(now time.Time) {
+	start := now.Truncate(c.period)
+	if start.Equal(c.start) {
+		return
+	}
+	if start.Sub(c.start) == c.period {
+		c.previous = c.current
+	} else {
+		c.previous = 0
+	}
+	c.current = 0
+	c.start = start
+}
+
+// check returns the number of requests left once amount has been counted,
+// or the delay to wait for if amount would exceed the limit.
+func (c *windowCounter) check(now time.Time, amount int64) (int64, time.Duration) {
+	elapsed := now.Sub(c.start)
+	weight := float64(c.period-elapsed) / float64(c.period)
+	estimate := float64(c.previous)*weight + float64(c.current+amount)
+
+	if estimate <= float64(c.limit) {
+		return int64(float64(c.limit) - estimate), 0
+	}
+
+	// The previous window must weigh less, or be over, before the request fits
+	if c.previous > 0 {
+		allowed := float64(c.limit - c.current - amount)
+		if allowed >= 0 {
+			wait := time.Duration(float64(c.period)*(1-allowed/float64(c.previous))) - elapsed
+			if wait > 0 {
+				return 0, wait
+			}
+		}
+	}
+	return 0, c.period - elapsed
+}
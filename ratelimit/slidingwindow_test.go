@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestSlidingWindowHitLimit(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(time.Second, 2, 1)
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+
+	l, err := NewSlidingWindowLimiter(handler, headerLimit, rates, SlidingWindowClock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "1", re.Header.Get(RemainingHeader))
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "0", re.Header.Get(RemainingHeader))
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "0", re.Header.Get(RemainingHeader))
+
+	// Other sources are not affected
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+}
+
+func TestSlidingWindowSmoothsBoundary(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(time.Second, 4, 1)
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+
+	l, err := NewSlidingWindowLimiter(handler, headerLimit, rates, SlidingWindowClock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	for i := 0; i < 4; i++ {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+
+	// Half way through the next window, the previous one still weighs 2 requests
+	clock.Sleep(time.Second + 500*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.NotEmpty(t, re.Header.Get("X-Retry-In"))
+
+	// Once the previous window is over, the full limit is available again
+	clock.Sleep(2 * time.Second)
+
+	for i := 0; i < 4; i++ {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+}
+
+func TestSlidingWindowKeepsBusySources(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(time.Minute, 10, 1)
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+
+	l, err := NewSlidingWindowLimiter(handler, headerLimit, rates, SlidingWindowClock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	get := func() int {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		return re.StatusCode
+	}
+
+	// the counters are created by the first request
+	assert.Equal(t, http.StatusOK, get())
+	clock.Sleep(115 * time.Second)
+	for i := 0; i < 9; i++ {
+		assert.Equal(t, http.StatusOK, get())
+	}
+
+	// past the TTL of the first request, the counters of the previous window are still there
+	clock.Sleep(7 * time.Second)
+	var allowed int
+	for i := 0; i < 10; i++ {
+		if get() == http.StatusOK {
+			allowed++
+		}
+	}
+	assert.True(t, allowed <= 2, "allowed %d requests", allowed)
+}
+
+func TestSlidingWindowInvalidParams(t *testing.T) {
+	rates := NewRateSet()
+	err := rates.Add(time.Second, 1, 1)
+	require.NoError(t, err)
+
+	_, err = NewSlidingWindowLimiter(nil, nil, rates)
+	require.Error(t, err)
+
+	_, err = NewSlidingWindowLimiter(nil, headerLimit, nil)
+	require.Error(t, err)
+
+	_, err = NewSlidingWindowLimiter(nil, headerLimit, rates, SlidingWindowCapacity(-1))
+	require.Error(t, err)
+}
@@ -0,0 +1,255 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// DefaultStoreTimeout bounds the calls made to the LimiterStore for a request
+const DefaultStoreTimeout = 100 * time.Millisecond
+
+// LimiterStore keeps the counters of a TokenLimiter, so that the replicas of a proxy share the same rates,
+// e.g. with a Redis backed implementation. Implementations must be safe for concurrent use.
+type LimiterStore interface {
+	// Incr adds amount to the counter of key and returns its new value. A counter that doesn't exist
+	// or has expired is created with the ttl. amount is negative to roll back a request that is rejected.
+	Incr(ctx context.Context, key string, amount int64, ttl time.Duration) (int64, error)
+	// GetAndReset returns the value of the counter of key and deletes it, 0 if it doesn't exist
+	GetAndReset(ctx context.Context, key string) (int64, error)
+}
+
+// Store makes the limiter count the requests in store instead of its in-memory token buckets, MemoryStore is
+// the in-memory implementation. The in-memory token buckets stay the default as the store can't model their burst.
+//
+// Each rate of the RateSet then allows at most `average` requests per fixed window of `period` aligned on the clock,
+// and its burst must equal its average: requests at the end of a window and at the start of the next one can
+// reach twice the average. Rates with another burst are rejected by New and UpdateRates, and the requests
+// they are extracted or returned by SetRateSetForKey for are handled as failures of the store.
+// The windows are shared by the limiters using the same store as long as their clocks are in sync.
+//
+// Every request costs a round trip to the store per rate, and another one per rate when it is rejected,
+// all bounded by the StoreTimeout. The counts are not transactional: concurrent requests near the limit
+// may all be rejected, and a request is counted twice if the rollback of a rejected request fails.
+// Requests are passed to the error handler when the store fails, unless FailOpen is set.
+// The counts of the store can't be peeked, Peek returns ErrPeekUnsupported.
+func Store(store LimiterStore) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if store == nil {
+			return fmt.Errorf("limiter store can not be nil")
+		}
+		cl.store = store
+		return nil
+	}
+}
+
+// StoreTimeout sets the time allowed for the calls to the LimiterStore made for a request, defaults to 100ms.
+func StoreTimeout(d time.Duration) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if d <= 0 {
+			return fmt.Errorf("store timeout should be > 0, got %v", d)
+		}
+		cl.storeTimeout = d
+		return nil
+	}
+}
+
+// storeError is a failure of the store, the limiter could not make a decision
+type storeError struct {
+	err error
+}
+
+func (e *storeError) Error() string {
+	return fmt.Sprintf("limiter store: %v", e.err)
+}
+
+// storeCount is a counter incremented for a request
+type storeCount struct {
+	key string
+	ttl time.Duration
+}
+
+// consumeStore counts the request in the windows of every rate and rolls it back if any of them is over the limit
+func (tl *TokenLimiter) consumeStore(req *http.Request, source string, amount int64) (rateStatus, error) {
+	tl.mutex.Lock()
+	rates := tl.resolveRates(req, source)
+	tl.mutex.Unlock()
+
+	status := rateStatus{remaining: -1}
+	if err := checkStoreRates(rates); err != nil {
+		return status, &storeError{err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), tl.storeTimeout)
+	defer cancel()
+
+	now := tl.clock.UtcNow()
+	var counted []storeCount
+	var maxDelay time.Duration
+	for _, rate := range rates.m {
+		start := now.Truncate(rate.period)
+		key := storeKey(source, rate.period, start)
+		count, err := tl.store.Incr(ctx, key, amount, rate.period)
+		if err != nil {
+			tl.rollbackStore(ctx, counted, amount)
+			return status, &storeError{err: err}
+		}
+		counted = append(counted, storeCount{key: key, ttl: rate.period})
+
+		remaining := rate.average - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		reset := start.Add(rate.period).Sub(now)
+		if status.remaining == -1 || remaining < status.remaining {
+			status.limit, status.remaining, status.retryAfter = rate.average, remaining, reset
+		}
+		if count > rate.average && reset > maxDelay {
+			maxDelay = reset
+		}
+	}
+
+	if maxDelay > 0 {
+		tl.rollbackStore(ctx, counted, amount)
+		status.retryAfter = maxDelay
+		return status, &MaxRateError{delay: maxDelay}
+	}
+	return status, nil
+}
+
+// rollbackStore uncounts a request that is not let through
+func (tl *TokenLimiter) rollbackStore(ctx context.Context, counted []storeCount, amount int64) {
+	for _, c := range counted {
+		if _, err := tl.store.Incr(ctx, c.key, -amount, c.ttl); err != nil {
+			tl.log.Errorf("Failed to roll back the limiter store counter %v: %v", c.key, err)
+		}
+	}
+}
+
+// checkStoreRates rejects the rates with a burst, the windows of the store only allow the average
+func checkStoreRates(rates *RateSet) error {
+	for _, r := range rates.m {
+		if r.burst != r.average {
+			return fmt.Errorf("%v: the burst should equal the average with a limiter store", r)
+		}
+	}
+	return nil
+}
+
+// ResetStore resets the counters of the current windows of the per key rates or the default rates of source
+// in the Store, e.g. to unblock a client. The in-memory token buckets are not resettable.
+func (tl *TokenLimiter) ResetStore(source string) error {
+	if tl.store == nil {
+		return fmt.Errorf("no limiter store set")
+	}
+
+	tl.mutex.Lock()
+	rates := tl.defaultRates
+	if tl.keyRates != nil {
+		if keyRates := tl.keyRates(source); keyRates != nil && len(keyRates.m) != 0 {
+			rates = keyRates
+		}
+	}
+	tl.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), tl.storeTimeout)
+	defer cancel()
+
+	now := tl.clock.UtcNow()
+	for period := range rates.m {
+		if _, err := tl.store.GetAndReset(ctx, storeKey(source, period, now.Truncate(period))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeKey is the key of the counter of a source in the window of a rate starting at start
+func storeKey(source string, period time.Duration, start time.Time) string {
+	return source + "|" + period.String() + "|" + strconv.FormatInt(start.UnixNano(), 10)
+}
+
+// memoryStoreSweep is the number of increments between two sweeps of the expired counters
+const memoryStoreSweep = 1024
+
+// MemoryStore is a LimiterStore keeping the counters in memory, they are local to the process.
+// It is meant for a single instance and for tests, distributed deployments need a shared store.
+type MemoryStore struct {
+	mutex    sync.Mutex
+	clock    timetools.TimeProvider
+	counters map[string]*memoryCounter
+	incrs    int
+}
+
+type memoryCounter struct {
+	value   int64
+	expires time.Time
+}
+
+// MemoryStoreOption represents an option you can pass to NewMemoryStore
+type MemoryStoreOption func(s *MemoryStore)
+
+// MemoryStoreClock sets the clock the counters expire on, defaults to the real time.
+// Intended for unit tests.
+func MemoryStoreClock(clock timetools.TimeProvider) MemoryStoreOption {
+	return func(s *MemoryStore) {
+		s.clock = clock
+	}
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore(options ...MemoryStoreOption) *MemoryStore {
+	s := &MemoryStore{
+		clock:    &timetools.RealTime{},
+		counters: make(map[string]*memoryCounter),
+	}
+	for _, o := range options {
+		o(s)
+	}
+	return s
+}
+
+// Incr adds amount to the counter of key and returns its new value
+func (s *MemoryStore) Incr(_ context.Context, key string, amount int64, ttl time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.UtcNow()
+	s.incrs++
+	if s.incrs%memoryStoreSweep == 0 {
+		for k, c := range s.counters {
+			if !now.Before(c.expires) {
+				delete(s.counters, k)
+			}
+		}
+	}
+
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expires) {
+		c = &memoryCounter{expires: now.Add(ttl)}
+		s.counters[key] = c
+	}
+	c.value += amount
+	return c.value, nil
+}
+
+// GetAndReset returns the value of the counter of key and deletes it
+func (s *MemoryStore) GetAndReset(_ context.Context, key string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok {
+		return 0, nil
+	}
+	delete(s.counters, key)
+	if !s.clock.UtcNow().Before(c.expires) {
+		return 0, nil
+	}
+	return c.value, nil
+}
@@ -0,0 +1,284 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestStoreSharedAcrossLimiters(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 2, 2))
+
+	clock := testutils.GetClock()
+	store := NewMemoryStore(MemoryStoreClock(clock))
+
+	// two replicas of the proxy share the rates through the store
+	var urls []string
+	for i := 0; i < 2; i++ {
+		l, err := New(handler, headerLimit, rates, Clock(clock), Store(store))
+		require.NoError(t, err)
+		srv := httptest.NewServer(l)
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+
+	re, _, err := testutils.Get(urls[0], testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "2", re.Header.Get(LimitHeader))
+	assert.Equal(t, "1", re.Header.Get(RemainingHeader))
+
+	re, _, err = testutils.Get(urls[1], testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "0", re.Header.Get(RemainingHeader))
+
+	// the window allows the average only
+	for _, u := range urls {
+		re, _, err = testutils.Get(u, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+		assert.Equal(t, "1", re.Header.Get("Retry-After"))
+	}
+
+	// other sources have their own counters
+	re, _, err = testutils.Get(urls[0], testutils.Header("Source", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// rejected requests are not counted, the next window starts afresh
+	clock.Sleep(time.Second)
+	for _, u := range urls {
+		re, _, err = testutils.Get(u, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	re, _, err = testutils.Get(urls[0], testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+}
+
+func TestStoreMultipleRates(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 2, 2))
+	require.NoError(t, rates.Add(time.Minute, 3, 3))
+
+	clock := testutils.GetClock()
+	store := NewMemoryStore(MemoryStoreClock(clock))
+
+	l, err := New(handler, headerLimit, rates, Clock(clock), Store(store))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	for _, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, expected, re.StatusCode)
+	}
+
+	// the rejected request was rolled back from the minute window too
+	clock.Sleep(time.Second)
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "0", re.Header.Get(RemainingHeader))
+
+	clock.Sleep(time.Second)
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	// the minute window is exhausted until its end
+	now := clock.UtcNow()
+	assert.Equal(t, retryAfterSeconds(now.Truncate(time.Minute).Add(time.Minute).Sub(now)), re.Header.Get("Retry-After"))
+}
+
+type failingStore struct {
+	err error
+}
+
+func (s *failingStore) Incr(ctx context.Context, key string, amount int64, ttl time.Duration) (int64, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (s *failingStore) GetAndReset(ctx context.Context, key string) (int64, error) {
+	return 0, s.err
+}
+
+func TestStoreFailure(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	testCases := []struct {
+		desc     string
+		store    *failingStore
+		options  []TokenLimiterOption
+		expected int
+	}{
+		{desc: "store error", store: &failingStore{err: errors.New("connection refused")}, expected: http.StatusInternalServerError},
+		{desc: "store timeout", store: &failingStore{}, options: []TokenLimiterOption{StoreTimeout(10 * time.Millisecond)}, expected: http.StatusGatewayTimeout},
+		{desc: "store error fails open", store: &failingStore{err: errors.New("connection refused")}, options: []TokenLimiterOption{FailOpen(true)}, expected: http.StatusOK},
+		{desc: "store timeout fails open", store: &failingStore{}, options: []TokenLimiterOption{StoreTimeout(10 * time.Millisecond), FailOpen(true)}, expected: http.StatusOK},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			l, err := New(handler, headerLimit, rates, append(test.options, Store(test.store))...)
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(l)
+			defer srv.Close()
+
+			re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, re.StatusCode)
+		})
+	}
+
+	_, err := New(handler, headerLimit, rates, Store(nil))
+	assert.Error(t, err)
+	_, err = New(handler, headerLimit, rates, StoreTimeout(0))
+	assert.Error(t, err)
+}
+
+func TestStoreBurst(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+	burst := NewRateSet()
+	require.NoError(t, burst.Add(time.Second, 1, 10))
+
+	// the store can't model a burst
+	_, err := New(handler, headerLimit, burst, Store(NewMemoryStore()))
+	assert.Error(t, err)
+
+	l, err := New(handler, headerLimit, rates, Store(NewMemoryStore()))
+	require.NoError(t, err)
+	assert.Error(t, l.UpdateRates(burst))
+
+	l.SetRateSetForKey(func(key string) *RateSet {
+		if key == "b" {
+			return burst
+		}
+		return nil
+	})
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+
+	// the bursts are fine in memory
+	_, err = New(handler, headerLimit, burst)
+	assert.NoError(t, err)
+}
+
+func TestResetStore(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Minute, 1, 1))
+
+	clock := testutils.GetClock()
+	store := NewMemoryStore(MemoryStoreClock(clock))
+
+	l, err := New(handler, headerLimit, rates, Clock(clock), Store(store))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	// the counts of the store can't be peeked
+	_, _, err = l.Peek("a")
+	assert.Equal(t, ErrPeekUnsupported, err)
+
+	require.NoError(t, l.ResetStore("a"))
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	l, err = New(handler, headerLimit, rates)
+	require.NoError(t, err)
+	assert.Error(t, l.ResetStore("a"))
+}
+
+func TestMemoryStore(t *testing.T) {
+	clock := testutils.GetClock()
+	store := NewMemoryStore(MemoryStoreClock(clock))
+	ctx := context.Background()
+
+	v, err := store.Incr(ctx, "a", 2, time.Second)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, v)
+	v, err = store.Incr(ctx, "a", -1, time.Second)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, v)
+
+	// the ttl is set on creation only
+	clock.Sleep(time.Second)
+	v, err = store.Incr(ctx, "a", 1, time.Second)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, v)
+
+	v, err = store.GetAndReset(ctx, "a")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, v)
+	v, err = store.GetAndReset(ctx, "a")
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, v)
+
+	// expired counters are swept
+	for i := 0; i < memoryStoreSweep; i++ {
+		_, err = store.Incr(ctx, "b", 1, time.Second)
+		require.NoError(t, err)
+	}
+	clock.Sleep(time.Second)
+	for i := 0; i < memoryStoreSweep; i++ {
+		_, err = store.Incr(ctx, "c", 1, time.Second)
+		require.NoError(t, err)
+	}
+	assert.Len(t, store.counters, 1)
+}
@@ -2,8 +2,11 @@
 package ratelimit
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -16,6 +19,12 @@ import (
 // DefaultCapacity default capacity
 const DefaultCapacity = 65536
 
+// Rate limit response headers
+const (
+	LimitHeader     = "X-RateLimit-Limit"
+	RemainingHeader = "X-RateLimit-Remaining"
+)
+
 // RateSet maintains a set of rates. It can contain only one rate per period at a time.
 type RateSet struct {
 	m map[time.Duration]*rate
@@ -66,12 +75,20 @@ type TokenLimiter struct {
 	defaultRates *RateSet
 	extract      utils.SourceExtractor
 	extractRates RateExtractor
+	keyRates     func(key string) *RateSet
 	clock        timetools.TimeProvider
 	mutex        sync.Mutex
 	bucketSets   *ttlmap.TtlMap
 	errHandler   utils.ErrorHandler
 	capacity     int
 	next         http.Handler
+	// skipHeaders disables the rate limit response headers
+	skipHeaders bool
+	// failOpen lets the requests through when the limiter can't make a decision
+	failOpen bool
+	// store counts the requests instead of the token buckets when set
+	store        LimiterStore
+	storeTimeout time.Duration
 
 	log *log.Logger
 }
@@ -98,6 +115,11 @@ func New(next http.Handler, extract utils.SourceExtractor, defaultRates *RateSet
 		}
 	}
 	setDefaults(tl)
+	if tl.store != nil {
+		if err := checkStoreRates(defaultRates); err != nil {
+			return nil, err
+		}
+	}
 	bucketSets, err := ttlmap.NewMapWithProvider(tl.capacity, tl.clock)
 	if err != nil {
 		return nil, err
@@ -116,6 +138,58 @@ func Logger(l *log.Logger) TokenLimiterOption {
 	}
 }
 
+// SetRateSetForKey sets a callback returning the rates of a given key, e.g. to grant a higher burst to some clients.
+// It is consulted on every request before the rate extractor and the default rates, a nil or empty RateSet
+// falls back to them. The callback is called with the limiter lock held and should return quickly.
+func (tl *TokenLimiter) SetRateSetForKey(fn func(key string) *RateSet) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	tl.keyRates = fn
+}
+
+// UpdateRates replaces the default rates, e.g. on a configuration reload. The existing buckets are kept:
+// their available tokens carry over, capped by the new burst, and refill at the new rates from now on.
+func (tl *TokenLimiter) UpdateRates(defaults *RateSet) error {
+	if defaults == nil || len(defaults.m) == 0 {
+		return fmt.Errorf("provide default rates")
+	}
+	if tl.store != nil {
+		if err := checkStoreRates(defaults); err != nil {
+			return err
+		}
+	}
+
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	tl.defaultRates = defaults
+	return nil
+}
+
+// ErrNoActivity is returned by Peek for a key without bucket, i.e. without recent requests
+var ErrNoActivity = errors.New("no activity for the key")
+
+// ErrPeekUnsupported is returned by Peek when the requests are counted in a Store
+var ErrPeekUnsupported = errors.New("peek is not supported with a store")
+
+// Peek returns the tokens left for the key in its most restrictive bucket and the time at which that
+// bucket will be full again, without consuming a token nor creating a bucket for the key.
+// It only knows of the in-memory buckets and returns ErrPeekUnsupported when a Store is set.
+func (tl *TokenLimiter) Peek(key string) (remaining int64, resetAt time.Time, err error) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	if tl.store != nil {
+		return 0, time.Time{}, ErrPeekUnsupported
+	}
+
+	bucketSetI, exists := tl.bucketSets.Get(key)
+	if !exists {
+		return 0, time.Time{}, ErrNoActivity
+	}
+	remaining, reset := bucketSetI.(*TokenBucketSet).peek()
+	return remaining, tl.clock.UtcNow().Add(reset), nil
+}
+
 // Wrap sets the next handler to be called by token limiter handler.
 func (tl *TokenLimiter) Wrap(next http.Handler) {
 	tl.next = next
@@ -124,11 +198,35 @@ func (tl *TokenLimiter) Wrap(next http.Handler) {
 func (tl *TokenLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	source, amount, err := tl.extract.Extract(req)
 	if err != nil {
+		if tl.failOpen {
+			tl.log.Warnf("failed to extract the source of request %v %v, letting it through: %v", req.Method, req.URL, err)
+			tl.next.ServeHTTP(w, req)
+			return
+		}
 		tl.errHandler.ServeHTTP(w, req, err)
 		return
 	}
 
-	if err := tl.consumeRates(req, source, amount); err != nil {
+	var status rateStatus
+	if tl.store != nil {
+		status, err = tl.consumeStore(req, source, amount)
+	} else {
+		status, err = tl.consumeRates(req, source, amount)
+	}
+	if serr, ok := err.(*storeError); ok {
+		if tl.failOpen {
+			tl.log.Warnf("failed to count request %v %v, letting it through: %v", req.Method, req.URL, serr)
+			tl.next.ServeHTTP(w, req)
+			return
+		}
+		tl.log.Errorf("failed to count request %v %v: %v", req.Method, req.URL, serr)
+		tl.errHandler.ServeHTTP(w, req, serr.err)
+		return
+	}
+	if !tl.skipHeaders {
+		status.writeHeaders(w, err)
+	}
+	if err != nil {
 		tl.log.Warnf("limiting request %v %v, limit: %v", req.Method, req.URL, err)
 		tl.errHandler.ServeHTTP(w, req, err)
 		return
@@ -137,11 +235,11 @@ func (tl *TokenLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	tl.next.ServeHTTP(w, req)
 }
 
-func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount int64) error {
+func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount int64) (rateStatus, error) {
 	tl.mutex.Lock()
 	defer tl.mutex.Unlock()
 
-	effectiveRates := tl.resolveRates(req)
+	effectiveRates := tl.resolveRates(req, source)
 	bucketSetI, exists := tl.bucketSets.Get(source)
 	var bucketSet *TokenBucketSet
 
@@ -155,17 +253,51 @@ func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount in
 		tl.bucketSets.Set(source, bucketSet, int(bucketSet.maxPeriod/time.Second)*10+1)
 	}
 	delay, err := bucketSet.Consume(amount)
+
+	var status rateStatus
+	status.limit, status.remaining, status.retryAfter = bucketSet.status()
+
 	if err != nil {
-		return err
+		return status, err
 	}
 	if delay > 0 {
-		return &MaxRateError{delay: delay}
+		status.retryAfter = delay
+		return status, &MaxRateError{delay: delay}
 	}
-	return nil
+	return status, nil
 }
 
-// effectiveRates retrieves rates to be applied to the request.
-func (tl *TokenLimiter) resolveRates(req *http.Request) *RateSet {
+// rateStatus is the state of the most restrictive rate of a source
+type rateStatus struct {
+	limit      int64
+	remaining  int64
+	retryAfter time.Duration
+}
+
+// writeHeaders sets the rate limit headers, Retry-After is only relevant when
+// no token is left or the request has been rejected.
+func (s rateStatus) writeHeaders(w http.ResponseWriter, err error) {
+	w.Header().Set(LimitHeader, strconv.FormatInt(s.limit, 10))
+	w.Header().Set(RemainingHeader, strconv.FormatInt(s.remaining, 10))
+	if _, ok := err.(*MaxRateError); ok || s.remaining == 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(s.retryAfter))
+	}
+}
+
+// retryAfterSeconds rounds up the delay so clients don't retry too early
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// resolveRates retrieves rates to be applied to the request.
+func (tl *TokenLimiter) resolveRates(req *http.Request, source string) *RateSet {
+	// Per key rates take precedence, the existing buckets of the key are updated in place.
+	if tl.keyRates != nil {
+		if rates := tl.keyRates(source); rates != nil && len(rates.m) != 0 {
+			return rates
+		}
+	}
+
 	// If configuration mapper is not specified for this instance, then return
 	// the default bucket specs.
 	if tl.extractRates == nil {
@@ -189,9 +321,14 @@ func (tl *TokenLimiter) resolveRates(req *http.Request) *RateSet {
 // MaxRateError max rate error
 type MaxRateError struct {
 	delay time.Duration
+	// rule is the name of the MultiLimiter rule that rejected the request
+	rule string
 }
 
 func (m *MaxRateError) Error() string {
+	if m.rule != "" {
+		return fmt.Sprintf("max rate reached for %v: retry-in %v", m.rule, m.delay)
+	}
 	return fmt.Sprintf("max rate reached: retry-in %v", m.delay)
 }
 
@@ -200,8 +337,11 @@ type RateErrHandler struct{}
 
 func (e *RateErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
 	if rerr, ok := err.(*MaxRateError); ok {
-		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", rerr.delay.Seconds()))
+		w.Header().Set("Retry-After", retryAfterSeconds(rerr.delay))
 		w.Header().Set("X-Retry-In", rerr.delay.String())
+		if rerr.rule != "" {
+			w.Header().Set(RuleHeader, rerr.rule)
+		}
 		w.WriteHeader(http.StatusTooManyRequests)
 		w.Write([]byte(err.Error()))
 		return
@@ -228,6 +368,25 @@ func ExtractRates(e RateExtractor) TokenLimiterOption {
 	}
 }
 
+// RateLimitHeaders toggles the X-RateLimit-Limit, X-RateLimit-Remaining and Retry-After
+// response headers, they are emitted by default.
+func RateLimitHeaders(enabled bool) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		cl.skipHeaders = !enabled
+		return nil
+	}
+}
+
+// FailOpen controls the requests for which the limiter can't make a decision, e.g. when the source extractor
+// or the Store fails: they are let through when failOpen is true, favoring availability over protection, and passed to the
+// error handler otherwise, which is the default. Requests over the rates are rejected either way.
+func FailOpen(failOpen bool) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		cl.failOpen = failOpen
+		return nil
+	}
+}
+
 // Clock sets the clock
 func Clock(clock timetools.TimeProvider) TokenLimiterOption {
 	return func(cl *TokenLimiter) error {
@@ -259,4 +418,7 @@ func setDefaults(tl *TokenLimiter) {
 	if tl.errHandler == nil {
 		tl.errHandler = defaultErrHandler
 	}
+	if tl.storeTimeout == 0 {
+		tl.storeTimeout = DefaultStoreTimeout
+	}
 }
@@ -209,6 +209,143 @@ func TestExtractRates(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 }
 
+func TestRateSetForKey(t *testing.T) {
+	rates := NewRateSet()
+	err := rates.Add(time.Second, 1, 1)
+	require.NoError(t, err)
+
+	premium := NewRateSet()
+	err = premium.Add(time.Second, 1, 3)
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+
+	tl, err := New(handler, headerLimit, rates, Clock(clock))
+	require.NoError(t, err)
+
+	tl.SetRateSetForKey(func(key string) *RateSet {
+		if key == "premium" {
+			return premium
+		}
+		return nil
+	})
+
+	srv := httptest.NewServer(tl)
+	defer srv.Close()
+
+	// premium key gets a burst of 3
+	for i := 0; i < 3; i++ {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "premium"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "premium"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	// other keys use the default rates
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "other"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "other"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	// changing the rate of a key updates its buckets instead of recreating them, consumed tokens are kept
+	err = premium.Add(time.Second, 1, 4)
+	require.NoError(t, err)
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "premium"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	rates := NewRateSet()
+	err := rates.Add(time.Second, 1, 2)
+	require.NoError(t, err)
+
+	premium := NewRateSet()
+	err = premium.Add(time.Second, 1, 5)
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+
+	tl, err := New(handler, headerLimit, rates, Clock(clock))
+	require.NoError(t, err)
+
+	tl.SetRateSetForKey(func(key string) *RateSet {
+		if key == "premium" {
+			return premium
+		}
+		return nil
+	})
+
+	srv := httptest.NewServer(tl)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "2", re.Header.Get(LimitHeader))
+	assert.Equal(t, "1", re.Header.Get(RemainingHeader))
+	assert.Empty(t, re.Header.Get("Retry-After"))
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "0", re.Header.Get(RemainingHeader))
+	assert.Equal(t, "1", re.Header.Get("Retry-After"))
+
+	clock.Sleep(300 * time.Millisecond)
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "2", re.Header.Get(LimitHeader))
+	assert.Equal(t, "0", re.Header.Get(RemainingHeader))
+	// 700ms left before the next token, rounded up
+	assert.Equal(t, "1", re.Header.Get("Retry-After"))
+
+	// the per key rates are reported
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "premium"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "5", re.Header.Get(LimitHeader))
+	assert.Equal(t, "4", re.Header.Get(RemainingHeader))
+}
+
+func TestRateLimitHeadersDisabled(t *testing.T) {
+	rates := NewRateSet()
+	err := rates.Add(time.Second, 1, 1)
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	tl, err := New(handler, headerLimit, rates, Clock(testutils.GetClock()), RateLimitHeaders(false))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tl)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Empty(t, re.Header.Get(LimitHeader))
+	assert.Empty(t, re.Header.Get(RemainingHeader))
+}
+
 // If configMapper returns error, then the default rate is applied.
 func TestBadRateExtractor(t *testing.T) {
 	// Given
@@ -337,6 +474,60 @@ func TestOptions(t *testing.T) {
 	assert.Equal(t, http.StatusTeapot, re.StatusCode)
 }
 
+func TestFailOpen(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(time.Second, 1, 1)
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+
+	testCases := []struct {
+		desc     string
+		options  []TokenLimiterOption
+		expected int
+	}{
+		{desc: "fails closed by default", expected: http.StatusInternalServerError},
+		{desc: "fails closed", options: []TokenLimiterOption{FailOpen(false)}, expected: http.StatusInternalServerError},
+		{desc: "fails open", options: []TokenLimiterOption{FailOpen(true)}, expected: http.StatusOK},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			l, err := New(handler, faultyExtract, rates, append(test.options, Clock(clock))...)
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(l)
+			defer srv.Close()
+
+			for i := 0; i < 3; i++ {
+				re, _, err := testutils.Get(srv.URL)
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, re.StatusCode)
+			}
+		})
+	}
+
+	// requests over the rates are still rejected when failing open
+	l, err := New(handler, headerLimit, rates, Clock(clock), FailOpen(true))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+}
+
 func headerLimiter(req *http.Request) (string, int64, error) {
 	return req.Header.Get("Source"), 1, nil
 }
@@ -347,3 +538,116 @@ func faultyExtractor(_ *http.Request) (string, int64, error) {
 
 var headerLimit = utils.ExtractorFunc(headerLimiter)
 var faultyExtract = utils.ExtractorFunc(faultyExtractor)
+
+func TestUpdateRates(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 10, 10))
+
+	clock := testutils.GetClock()
+
+	l, err := New(handler, headerLimit, rates, Clock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	allowed := func() int {
+		n := 0
+		for i := 0; i < 200; i++ {
+			re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+			require.NoError(t, err)
+			if re.StatusCode != http.StatusOK {
+				break
+			}
+			n++
+		}
+		return n
+	}
+
+	assert.Equal(t, 10, allowed())
+
+	// a higher burst doesn't refill the consumed bucket
+	newRates := NewRateSet()
+	require.NoError(t, newRates.Add(time.Second, 100, 100))
+	require.NoError(t, l.UpdateRates(newRates))
+	assert.Equal(t, 0, allowed())
+
+	// the bucket refills at the new rate
+	clock.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 10, allowed())
+
+	clock.Sleep(time.Second)
+	assert.Equal(t, 100, allowed())
+
+	// the tokens left are capped by a lower burst
+	clock.Sleep(time.Second)
+	lowerRates := NewRateSet()
+	require.NoError(t, lowerRates.Add(time.Second, 5, 5))
+	require.NoError(t, l.UpdateRates(lowerRates))
+	assert.Equal(t, 5, allowed())
+
+	assert.Error(t, l.UpdateRates(nil))
+	assert.Error(t, l.UpdateRates(NewRateSet()))
+}
+
+func TestPeek(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 2, 4))
+	require.NoError(t, rates.Add(time.Minute, 10, 10))
+
+	clock := testutils.GetClock()
+
+	l, err := New(handler, headerLimit, rates, Clock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	// peeking doesn't create a bucket
+	_, _, err = l.Peek("a")
+	assert.Equal(t, ErrNoActivity, err)
+	assert.Equal(t, 0, l.bucketSets.Len())
+
+	for i := 0; i < 3; i++ {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+
+	remaining, resetAt, err := l.Peek("a")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, remaining)
+	assert.Equal(t, clock.UtcNow().Add(1500*time.Millisecond), resetAt)
+
+	// peeking doesn't consume tokens
+	remaining, _, err = l.Peek("a")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, remaining)
+
+	// the bucket of the second is full again
+	clock.Sleep(2 * time.Second)
+	remaining, resetAt, err = l.Peek("a")
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, remaining)
+	assert.Equal(t, clock.UtcNow(), resetAt)
+
+	// the bucket of the minute becomes the most restrictive, a token is added every 6 seconds
+	for i := 0; i < 4; i++ {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	clock.Sleep(2 * time.Second)
+	remaining, resetAt, err = l.Peek("a")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, remaining)
+	assert.Equal(t, clock.UtcNow().Add(38*time.Second), resetAt)
+}
@@ -0,0 +1,288 @@
+package roundrobin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+const defaultVirtualNodes = 160
+
+// ConsistentHashOption provides options for the consistent hash load balancer
+type ConsistentHashOption func(*ConsistentHash) error
+
+// VirtualNodes sets the number of points each server of weight 1 gets on the hash ring, defaults to 160.
+// More points spread the keys more evenly at the cost of memory and lookup time.
+func VirtualNodes(n int) ConsistentHashOption {
+	return func(c *ConsistentHash) error {
+		if n < 1 {
+			return fmt.Errorf("virtual nodes should be >= 1, got %v", n)
+		}
+		c.virtualNodes = n
+		return nil
+	}
+}
+
+// ConsistentHashErrorHandler sets the error handler of the consistent hash load balancer
+func ConsistentHashErrorHandler(h utils.ErrorHandler) ConsistentHashOption {
+	return func(c *ConsistentHash) error {
+		c.errHandler = h
+		return nil
+	}
+}
+
+// ConsistentHashLogger defines the logger the consistent hash load balancer will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func ConsistentHashLogger(l *log.Logger) ConsistentHashOption {
+	return func(c *ConsistentHash) error {
+		c.log = l
+		return nil
+	}
+}
+
+// HashKeyHeader extracts the hash key from the value of a request header
+func HashKeyHeader(name string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+// HashKeyQuery extracts the hash key from the value of a query parameter
+func HashKeyQuery(name string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		return req.URL.Query().Get(name)
+	}
+}
+
+// HashKeyPath uses the request path as the hash key
+func HashKeyPath() func(*http.Request) string {
+	return func(req *http.Request) string {
+		return req.URL.Path
+	}
+}
+
+// ConsistentHash is a load balancer routing requests with the same key to the same server, e.g. for cache affinity.
+// Servers are placed on a hash ring with virtual nodes (ketama style), proportionally to their weight,
+// so adding or removing a server only remaps the keys of the ring segments it gains or loses.
+// Requests without a key are spread over the servers in turn.
+type ConsistentHash struct {
+	mutex        sync.RWMutex
+	next         http.Handler
+	errHandler   utils.ErrorHandler
+	extract      func(*http.Request) string
+	virtualNodes int
+	servers      []*server
+	ring         []ringNode
+	index        int
+
+	log *log.Logger
+}
+
+// ringNode is a point of the hash ring owned by a server
+type ringNode struct {
+	hash   uint64
+	server *server
+}
+
+// NewConsistentHash creates a consistent hash load balancer using the key returned by extract,
+// see HashKeyHeader, HashKeyQuery and HashKeyPath
+func NewConsistentHash(next http.Handler, extract func(*http.Request) string, opts ...ConsistentHashOption) (*ConsistentHash, error) {
+	if extract == nil {
+		return nil, fmt.Errorf("key extractor can not be nil")
+	}
+
+	c := &ConsistentHash{
+		next:         next,
+		extract:      extract,
+		virtualNodes: defaultVirtualNodes,
+		index:        -1,
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.errHandler == nil {
+		c.errHandler = utils.DefaultHandler
+	}
+	return c, nil
+}
+
+// Next returns the next handler
+func (c *ConsistentHash) Next() http.Handler {
+	return c.next
+}
+
+func (c *ConsistentHash) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if c.log.Level >= log.DebugLevel {
+		logEntry := c.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/roundrobin/consistenthash: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/roundrobin/consistenthash: completed ServeHttp on request")
+	}
+
+	var u *url.URL
+	var err error
+	if key := c.extract(req); key != "" {
+		u, err = c.ServerFor(key)
+	} else {
+		u, err = c.NextServer()
+	}
+	if err != nil {
+		c.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	newReq.URL = u
+
+	if c.log.Level >= log.DebugLevel {
+		c.log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": newReq.URL}).Debugf("vulcand/oxy/roundrobin/consistenthash: Forwarding this request to URL")
+	}
+
+	c.next.ServeHTTP(w, &newReq)
+}
+
+// ServerFor returns the server the key maps to
+func (c *ConsistentHash) ServerFor(key string) (*url.URL, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if len(c.ring) == 0 {
+		return nil, fmt.Errorf("no servers in the pool")
+	}
+
+	h := hashKey(key)
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return utils.CopyURL(c.ring[i].server.url), nil
+}
+
+// NextServer gets the next server with a non zero weight in turn, it is used for the requests without a key
+func (c *ConsistentHash) NextServer() (*url.URL, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for range c.servers {
+		c.index = (c.index + 1) % len(c.servers)
+		if srv := c.servers[c.index]; srv.weight > 0 {
+			return utils.CopyURL(srv.url), nil
+		}
+	}
+	return nil, fmt.Errorf("no servers in the pool")
+}
+
+// RemoveServer removes a server, only the keys it owned are remapped
+func (c *ConsistentHash) RemoveServer(u *url.URL) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, index := c.findServer(u)
+	if index == -1 {
+		return fmt.Errorf("server not found")
+	}
+	c.servers = append(c.servers[:index], c.servers[index+1:]...)
+	c.rebuild()
+	return nil
+}
+
+// Servers gets servers URL
+func (c *ConsistentHash) Servers() []*url.URL {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	out := make([]*url.URL, len(c.servers))
+	for i, srv := range c.servers {
+		out[i] = srv.url
+	}
+	return out
+}
+
+// ServerWeight gets the server weight
+func (c *ConsistentHash) ServerWeight(u *url.URL) (int, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if srv, _ := c.findServer(u); srv != nil {
+		return srv.weight, true
+	}
+	return -1, false
+}
+
+// UpsertServer adds a server or updates its weight, a server gets weight times the virtual nodes on the ring.
+// A new server with a zero weight gets the default weight, an existing server updated to a zero weight gets no node
+func (c *ConsistentHash) UpsertServer(u *url.URL, options ...ServerOption) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if u == nil {
+		return fmt.Errorf("server URL can't be nil")
+	}
+
+	if s, _ := c.findServer(u); s != nil {
+		for _, o := range options {
+			if err := o(s); err != nil {
+				return err
+			}
+		}
+		c.rebuild()
+		return nil
+	}
+
+	srv := &server{url: utils.CopyURL(u)}
+	for _, o := range options {
+		if err := o(srv); err != nil {
+			return err
+		}
+	}
+
+	if srv.weight == 0 {
+		srv.weight = defaultWeight
+	}
+
+	c.servers = append(c.servers, srv)
+	c.rebuild()
+	return nil
+}
+
+func (c *ConsistentHash) findServer(u *url.URL) (*server, int) {
+	for i, srv := range c.servers {
+		if sameURL(u, srv.url) {
+			return srv, i
+		}
+	}
+	return nil, -1
+}
+
+// rebuild places the virtual nodes of the servers on the ring, the points of a server only depend
+// on its URL and weight so that they don't move when other servers change
+func (c *ConsistentHash) rebuild() {
+	var ring []ringNode
+	for _, srv := range c.servers {
+		name := srv.url.String()
+		for i := 0; i < srv.weight*c.virtualNodes; i++ {
+			ring = append(ring, ringNode{hash: hashKey(name + "#" + strconv.Itoa(i)), server: srv})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	c.ring = ring
+	c.index = -1
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return mix64(h.Sum64())
+}
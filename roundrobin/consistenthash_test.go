@@ -0,0 +1,158 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestConsistentHash(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := NewConsistentHash(fwd, HashKeyQuery("key"))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL + "?key=k")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	bodies := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, first, err := testutils.Get(proxy.URL + "?key=" + key)
+		require.NoError(t, err)
+		for j := 0; j < 3; j++ {
+			_, body, err := testutils.Get(proxy.URL + "?key=" + key)
+			require.NoError(t, err)
+			assert.Equal(t, string(first), string(body))
+		}
+		bodies[string(first)] = true
+	}
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, bodies)
+
+	// requests without a key are spread in turn
+	for _, expected := range []string{"a", "b", "a"} {
+		_, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(body))
+	}
+}
+
+func TestConsistentHashRemap(t *testing.T) {
+	lb, err := NewConsistentHash(http.NotFoundHandler(), HashKeyPath())
+	require.NoError(t, err)
+
+	const servers = 5
+	for i := 0; i < servers; i++ {
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI(fmt.Sprintf("http://10.0.0.%d:8080", i))))
+	}
+
+	const keys = 10000
+	before := make(map[string]string)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("/objects/%d", i)
+		u, err := lb.ServerFor(key)
+		require.NoError(t, err)
+		before[key] = u.String()
+	}
+
+	removed := "http://10.0.0.2:8080"
+	require.NoError(t, lb.RemoveServer(testutils.ParseURI(removed)))
+
+	remapped := 0
+	for key, server := range before {
+		u, err := lb.ServerFor(key)
+		require.NoError(t, err)
+		if u.String() == server {
+			continue
+		}
+		remapped++
+		// only the keys of the removed server move
+		assert.Equal(t, removed, server)
+	}
+	// the removed server owned about 1/N of the keys, modulo hashing would remap most of them
+	assert.NotZero(t, remapped)
+	assert.Less(t, remapped, keys*11/(servers*10))
+
+	// adding the server back restores the original mapping
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(removed)))
+	for key, server := range before {
+		u, err := lb.ServerFor(key)
+		require.NoError(t, err)
+		assert.Equal(t, server, u.String())
+	}
+}
+
+func TestConsistentHashWeights(t *testing.T) {
+	lb, err := NewConsistentHash(http.NotFoundHandler(), HashKeyHeader("X-Key"), VirtualNodes(100))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a:80")))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://b:80"), Weight(3)))
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		u, err := lb.ServerFor(fmt.Sprintf("key-%d", i))
+		require.NoError(t, err)
+		counts[u.Host]++
+	}
+	assert.InDelta(t, 7500, counts["b:80"], 750)
+
+	// servers with a zero weight get no keys
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://b:80"), Weight(0)))
+	for i := 0; i < 100; i++ {
+		u, err := lb.ServerFor(fmt.Sprintf("key-%d", i))
+		require.NoError(t, err)
+		assert.Equal(t, "a:80", u.Host)
+	}
+	u, err := lb.NextServer()
+	require.NoError(t, err)
+	assert.Equal(t, "a:80", u.Host)
+
+	_, err = NewConsistentHash(http.NotFoundHandler(), HashKeyPath(), VirtualNodes(0))
+	assert.Error(t, err)
+}
+
+func TestConsistentHashUpsertServer(t *testing.T) {
+	lb, err := NewConsistentHash(http.NotFoundHandler(), HashKeyPath(), VirtualNodes(10))
+	require.NoError(t, err)
+
+	// an invalid option doesn't add the server
+	require.Error(t, lb.UpsertServer(testutils.ParseURI("http://a:80"), Weight(-1)))
+	assert.Empty(t, lb.Servers())
+	_, err = lb.NextServer()
+	assert.Error(t, err)
+
+	// a new server with a zero weight gets the default weight
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a:80"), Weight(0)))
+	w, ok := lb.ServerWeight(testutils.ParseURI("http://a:80"))
+	require.True(t, ok)
+	assert.Equal(t, defaultWeight, w)
+	u, err := lb.ServerFor("key")
+	require.NoError(t, err)
+	assert.Equal(t, "a:80", u.Host)
+
+	// an invalid option keeps the weight of an existing server
+	require.Error(t, lb.UpsertServer(testutils.ParseURI("http://a:80"), Weight(-1)))
+	w, ok = lb.ServerWeight(testutils.ParseURI("http://a:80"))
+	require.True(t, ok)
+	assert.Equal(t, defaultWeight, w)
+}
@@ -0,0 +1,60 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// debugHeader names the server that handled the request in a response header
+type debugHeader struct {
+	// response is the response header naming the server, nothing is added if it is empty
+	response string
+	// request is the request header the response header is gated by, if set
+	request string
+}
+
+// DebugServerHeader is a functional argument that adds a response header named headerName with the URL of
+// the server that handled the request, including servers picked by sticky sessions or the selector.
+// It exposes the topology of the backends, see DebugRequestHeader to only add it to debug requests.
+func DebugServerHeader(headerName string) LBOption {
+	return func(s *RoundRobin) error {
+		s.debugHeader.response = headerName
+		return nil
+	}
+}
+
+// DebugRequestHeader is a functional argument that only adds the DebugServerHeader to the responses
+// of the requests carrying the given header.
+func DebugRequestHeader(headerName string) LBOption {
+	return func(s *RoundRobin) error {
+		s.debugHeader.request = headerName
+		return nil
+	}
+}
+
+// RebalancerDebugServerHeader is the Rebalancer counterpart of DebugServerHeader
+func RebalancerDebugServerHeader(headerName string) RebalancerOption {
+	return func(r *Rebalancer) error {
+		r.debugHeader.response = headerName
+		return nil
+	}
+}
+
+// RebalancerDebugRequestHeader is the Rebalancer counterpart of DebugRequestHeader
+func RebalancerDebugRequestHeader(headerName string) RebalancerOption {
+	return func(r *Rebalancer) error {
+		r.debugHeader.request = headerName
+		return nil
+	}
+}
+
+func (d debugHeader) set(w http.ResponseWriter, req *http.Request, server *url.URL) {
+	if d.response == "" || (d.request != "" && req.Header.Get(d.request) == "") {
+		return
+	}
+	u := utils.CopyURL(server)
+	u.User = nil
+	w.Header().Set(d.response, u.String())
+}
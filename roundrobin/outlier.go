@@ -0,0 +1,363 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// OutlierDetectorOption - functional option setter for outlier detector
+type OutlierDetectorOption func(*OutlierDetector) error
+
+// OutlierDetector ejects a server from the rotation after a number of consecutive errors
+// by setting its weight to 0, the server is reinstated with its original weight once the
+// ejection duration has elapsed. Errors are responses with a 5xx status code, which includes
+// the connection errors reported by the forwarder. It is designed as a wrapper on top of the roundrobin.
+type OutlierDetector struct {
+	mtx   *sync.Mutex
+	clock timetools.TimeProvider
+	// next is internal load balancer next in chain
+	next balancerHandler
+	// errHandler is HTTP handler called in case of errors
+	errHandler utils.ErrorHandler
+
+	consecutiveErrors  int
+	ejectionDuration   time.Duration
+	maxEjectionPercent int
+
+	servers []*odServer
+
+	onEjected    func(*url.URL)
+	onReinstated func(*url.URL)
+
+	log *log.Logger
+}
+
+// odServer keeps the error count and ejection state of a server
+type odServer struct {
+	url          *url.URL
+	errors       int
+	ejected      bool
+	ejectedUntil time.Time
+	// weight of the server before it was ejected
+	origWeight int
+}
+
+// OutlierConsecutiveErrors sets the number of consecutive errors after which a server is ejected, defaults to 5
+func OutlierConsecutiveErrors(n int) OutlierDetectorOption {
+	return func(d *OutlierDetector) error {
+		if n < 1 {
+			return fmt.Errorf("consecutive errors should be >= 1, got %v", n)
+		}
+		d.consecutiveErrors = n
+		return nil
+	}
+}
+
+// OutlierEjectionDuration sets how long a server stays ejected, defaults to 30 seconds
+func OutlierEjectionDuration(duration time.Duration) OutlierDetectorOption {
+	return func(d *OutlierDetector) error {
+		if duration <= 0 {
+			return fmt.Errorf("ejection duration should be > 0, got %v", duration)
+		}
+		d.ejectionDuration = duration
+		return nil
+	}
+}
+
+// OutlierMaxEjectionPercent sets the maximum percentage of servers that can be ejected at the same time,
+// defaults to 10. One server can always be ejected as long as another one stays in the rotation.
+func OutlierMaxEjectionPercent(percent int) OutlierDetectorOption {
+	return func(d *OutlierDetector) error {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("max ejection percent should be in [0, 100], got %v", percent)
+		}
+		d.maxEjectionPercent = percent
+		return nil
+	}
+}
+
+// OutlierClock sets a clock
+func OutlierClock(clock timetools.TimeProvider) OutlierDetectorOption {
+	return func(d *OutlierDetector) error {
+		d.clock = clock
+		return nil
+	}
+}
+
+// OutlierErrorHandler is a functional argument that sets error handler of the server
+func OutlierErrorHandler(h utils.ErrorHandler) OutlierDetectorOption {
+	return func(d *OutlierDetector) error {
+		d.errHandler = h
+		return nil
+	}
+}
+
+// OutlierLogger defines the logger the outlier detector will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func OutlierLogger(l *log.Logger) OutlierDetectorOption {
+	return func(d *OutlierDetector) error {
+		d.log = l
+		return nil
+	}
+}
+
+// OnServerEjected sets a callback called when a server is ejected
+func OnServerEjected(fn func(*url.URL)) OutlierDetectorOption {
+	return func(d *OutlierDetector) error {
+		d.onEjected = fn
+		return nil
+	}
+}
+
+// OnServerReinstated sets a callback called when an ejected server is back in the rotation
+func OnServerReinstated(fn func(*url.URL)) OutlierDetectorOption {
+	return func(d *OutlierDetector) error {
+		d.onReinstated = fn
+		return nil
+	}
+}
+
+// NewOutlierDetector creates a new OutlierDetector
+func NewOutlierDetector(handler balancerHandler, opts ...OutlierDetectorOption) (*OutlierDetector, error) {
+	d := &OutlierDetector{
+		mtx:                &sync.Mutex{},
+		next:               handler,
+		consecutiveErrors:  5,
+		ejectionDuration:   30 * time.Second,
+		maxEjectionPercent: 10,
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(d); err != nil {
+			return nil, err
+		}
+	}
+	if d.clock == nil {
+		d.clock = &timetools.RealTime{}
+	}
+	if d.errHandler == nil {
+		d.errHandler = utils.DefaultHandler
+	}
+	return d, nil
+}
+
+// Next returns the next handler
+func (d *OutlierDetector) Next() http.Handler {
+	return d.next.Next()
+}
+
+// NextServer gets the next server
+func (d *OutlierDetector) NextServer() (*url.URL, error) {
+	return d.next.NextServer()
+}
+
+// Servers gets all servers
+func (d *OutlierDetector) Servers() []*url.URL {
+	return d.next.Servers()
+}
+
+// ServerWeight gets the server weight, an ejected server has a weight of 0
+func (d *OutlierDetector) ServerWeight(u *url.URL) (int, bool) {
+	return d.next.ServerWeight(u)
+}
+
+// Ejected returns the servers currently ejected
+func (d *OutlierDetector) Ejected() []*url.URL {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	var out []*url.URL
+	for _, s := range d.servers {
+		if s.ejected {
+			out = append(out, utils.CopyURL(s.url))
+		}
+	}
+	return out
+}
+
+func (d *OutlierDetector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if d.log.Level >= log.DebugLevel {
+		logEntry := d.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/roundrobin/outlier: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/roundrobin/outlier: completed ServeHttp on request")
+	}
+
+	d.reinstateServers()
+
+	tracker, ok := d.next.(inFlightTracker)
+	if ok && !tracker.tracksInFlight() {
+		tracker = nil
+	}
+
+	var fwdURL *url.URL
+	var err error
+	if tracker != nil {
+		var tracked *server
+		if tracked, err = tracker.acquireServer(); err == nil {
+			fwdURL = utils.CopyURL(tracked.url)
+			// released on every exit path, including panics and hijacked connections once the handler returns
+			defer tracker.release(tracked)
+		}
+	} else {
+		fwdURL, err = d.next.NextServer()
+	}
+	if err != nil {
+		d.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	newReq.URL = fwdURL
+
+	pw := utils.NewProxyWriterWithLogger(w, d.log)
+	d.next.Next().ServeHTTP(pw, &newReq)
+
+	d.recordResult(fwdURL, pw.StatusCode())
+}
+
+// UpsertServer upsert a server, the weight of an ejected server is applied once it is reinstated
+func (d *OutlierDetector) UpsertServer(u *url.URL, options ...ServerOption) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if s, _ := d.findServer(u); s != nil && s.ejected {
+		srv := &server{url: u, weight: s.origWeight}
+		for _, o := range options {
+			if err := o(srv); err != nil {
+				return err
+			}
+		}
+		s.origWeight = srv.weight
+		return nil
+	}
+	return d.next.UpsertServer(u, options...)
+}
+
+// RemoveServer remove a server
+func (d *OutlierDetector) RemoveServer(u *url.URL) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if _, i := d.findServer(u); i != -1 {
+		d.servers = append(d.servers[:i], d.servers[i+1:]...)
+	}
+	return d.next.RemoveServer(u)
+}
+
+// recordResult counts consecutive errors of the server and ejects it once the threshold is reached
+func (d *OutlierDetector) recordResult(u *url.URL, code int) {
+	var ejected bool
+	defer func() {
+		if ejected && d.onEjected != nil {
+			d.onEjected(u)
+		}
+	}()
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	s, _ := d.findServer(u)
+	if code < http.StatusInternalServerError {
+		if s != nil {
+			s.errors = 0
+		}
+		return
+	}
+
+	if s == nil {
+		s = &odServer{url: utils.CopyURL(u)}
+		d.servers = append(d.servers, s)
+	}
+	s.errors++
+	if s.ejected || s.errors < d.consecutiveErrors || !d.canEject() {
+		return
+	}
+
+	weight, ok := d.next.ServerWeight(u)
+	if !ok || weight == 0 {
+		return
+	}
+	if err := d.next.UpsertServer(u, Weight(0)); err != nil {
+		d.log.Errorf("vulcand/oxy/roundrobin/outlier: failed to eject %v: %v", u, err)
+		return
+	}
+	s.ejected = true
+	s.ejectedUntil = d.clock.UtcNow().Add(d.ejectionDuration)
+	s.origWeight = weight
+	ejected = true
+	d.log.Warnf("vulcand/oxy/roundrobin/outlier: ejected %v after %d consecutive errors", u, s.errors)
+}
+
+// canEject checks whether one more server can be ejected. It has to be called with the mutex held.
+func (d *OutlierDetector) canEject() bool {
+	active, ejected := 0, 0
+	for _, u := range d.next.Servers() {
+		if weight, _ := d.next.ServerWeight(u); weight > 0 {
+			active++
+		}
+	}
+	for _, s := range d.servers {
+		if s.ejected {
+			ejected++
+		}
+	}
+	if active <= 1 {
+		return false
+	}
+	return ejected == 0 || (ejected+1)*100 <= (active+ejected)*d.maxEjectionPercent
+}
+
+// reinstateServers puts back the servers whose ejection duration has elapsed
+func (d *OutlierDetector) reinstateServers() {
+	var reinstated []*url.URL
+	defer func() {
+		if d.onReinstated != nil {
+			for _, u := range reinstated {
+				d.onReinstated(u)
+			}
+		}
+	}()
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := d.clock.UtcNow()
+	for i := len(d.servers) - 1; i >= 0; i-- {
+		s := d.servers[i]
+		if !s.ejected || now.Before(s.ejectedUntil) {
+			continue
+		}
+		// the server has been removed from the load balancer in the meantime
+		if _, ok := d.next.ServerWeight(s.url); !ok {
+			d.servers = append(d.servers[:i], d.servers[i+1:]...)
+			continue
+		}
+		if err := d.next.UpsertServer(s.url, Weight(s.origWeight)); err != nil {
+			d.log.Errorf("vulcand/oxy/roundrobin/outlier: failed to reinstate %v: %v", s.url, err)
+			continue
+		}
+		s.ejected = false
+		s.errors = 0
+		reinstated = append(reinstated, utils.CopyURL(s.url))
+		d.log.Infof("vulcand/oxy/roundrobin/outlier: reinstated %v", s.url)
+	}
+}
+
+func (d *OutlierDetector) findServer(u *url.URL) (*odServer, int) {
+	for i, s := range d.servers {
+		if sameURL(u, s.url) {
+			return s, i
+		}
+	}
+	return nil, -1
+}
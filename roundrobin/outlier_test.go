@@ -0,0 +1,177 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// failingHosts returns a handler answering 502 for the given hosts and 200 for the others
+func failingHosts(hosts ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, h := range hosts {
+			if req.URL.Host == h {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+		}
+		w.Write([]byte(req.URL.Host))
+	})
+}
+
+func TestOutlierDetector(t *testing.T) {
+	lb, err := New(failingHosts("localhost:5001"))
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+	var ejected, reinstated []string
+	od, err := NewOutlierDetector(lb,
+		OutlierClock(clock),
+		OutlierConsecutiveErrors(2),
+		OutlierEjectionDuration(10*time.Second),
+		OutlierMaxEjectionPercent(50),
+		OnServerEjected(func(u *url.URL) { ejected = append(ejected, u.Host) }),
+		OnServerReinstated(func(u *url.URL) { reinstated = append(reinstated, u.Host) }),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, od.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+	require.NoError(t, od.UpsertServer(testutils.ParseURI("http://localhost:5001"), Weight(3)))
+
+	codes := make(map[int]int)
+	for i := 0; i < 8; i++ {
+		rw := httptest.NewRecorder()
+		od.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+		codes[rw.Code]++
+	}
+	// the failing server is ejected after its second error
+	assert.Equal(t, map[int]int{http.StatusOK: 6, http.StatusBadGateway: 2}, codes)
+	assert.Equal(t, []string{"localhost:5001"}, ejected)
+	require.Len(t, od.Ejected(), 1)
+	assert.Equal(t, "localhost:5001", od.Ejected()[0].Host)
+
+	weight, ok := lb.ServerWeight(testutils.ParseURI("http://localhost:5001"))
+	assert.True(t, ok)
+	assert.Equal(t, 0, weight)
+
+	// the server is reinstated with its original weight after the ejection duration
+	clock.CurrentTime = clock.CurrentTime.Add(10 * time.Second)
+	od.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	assert.Equal(t, []string{"localhost:5001"}, reinstated)
+	assert.Empty(t, od.Ejected())
+
+	weight, _ = lb.ServerWeight(testutils.ParseURI("http://localhost:5001"))
+	assert.Equal(t, 3, weight)
+}
+
+func TestOutlierDetectorLeastConnections(t *testing.T) {
+	unblock := make(chan struct{})
+	blocked := make(chan struct{})
+	lb, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Host == "localhost:5000" {
+			close(blocked)
+			<-unblock
+		}
+		w.Write([]byte(req.URL.Host))
+	}), LeastConnections())
+	require.NoError(t, err)
+
+	od, err := NewOutlierDetector(lb)
+	require.NoError(t, err)
+
+	require.NoError(t, od.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+	require.NoError(t, od.UpsertServer(testutils.ParseURI("http://localhost:5001")))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		od.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	}()
+	<-blocked
+
+	// the requests forwarded by the outlier detector are counted
+	stats := lb.ServerStats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, 1, stats[0].InFlight)
+	assert.Equal(t, 0, stats[1].InFlight)
+
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		od.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+		assert.Equal(t, "localhost:5001", rw.Body.String())
+	}
+
+	close(unblock)
+	<-done
+
+	for _, stat := range lb.ServerStats() {
+		assert.Equal(t, 0, stat.InFlight)
+	}
+}
+
+func TestOutlierDetectorKeepsLastServer(t *testing.T) {
+	lb, err := New(failingHosts("localhost:5000", "localhost:5001"))
+	require.NoError(t, err)
+
+	od, err := NewOutlierDetector(lb, OutlierClock(testutils.GetClock()), OutlierConsecutiveErrors(1), OutlierMaxEjectionPercent(100))
+	require.NoError(t, err)
+
+	require.NoError(t, od.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+	require.NoError(t, od.UpsertServer(testutils.ParseURI("http://localhost:5001")))
+
+	for i := 0; i < 10; i++ {
+		od.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	}
+	assert.Len(t, od.Ejected(), 1)
+}
+
+func TestOutlierDetectorMaxEjectionPercent(t *testing.T) {
+	lb, err := New(failingHosts("localhost:5000", "localhost:5001", "localhost:5002"))
+	require.NoError(t, err)
+
+	od, err := NewOutlierDetector(lb, OutlierClock(testutils.GetClock()), OutlierConsecutiveErrors(1), OutlierMaxEjectionPercent(10))
+	require.NoError(t, err)
+
+	for _, u := range []string{"http://localhost:5000", "http://localhost:5001", "http://localhost:5002", "http://localhost:5003"} {
+		require.NoError(t, od.UpsertServer(testutils.ParseURI(u)))
+	}
+
+	for i := 0; i < 20; i++ {
+		od.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	}
+	// one server can always be ejected, then the 10% limit applies
+	assert.Len(t, od.Ejected(), 1)
+}
+
+func TestOutlierDetectorUpsertEjected(t *testing.T) {
+	lb, err := New(failingHosts("localhost:5001"))
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+	od, err := NewOutlierDetector(lb, OutlierClock(clock), OutlierConsecutiveErrors(2), OutlierMaxEjectionPercent(50))
+	require.NoError(t, err)
+
+	require.NoError(t, od.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+	require.NoError(t, od.UpsertServer(testutils.ParseURI("http://localhost:5001")))
+
+	for i := 0; i < 4; i++ {
+		od.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	}
+	require.Len(t, od.Ejected(), 1)
+
+	// the new weight of an ejected server is applied once it is reinstated
+	require.NoError(t, od.UpsertServer(testutils.ParseURI("http://localhost:5001"), Weight(4)))
+	weight, _ := lb.ServerWeight(testutils.ParseURI("http://localhost:5001"))
+	assert.Equal(t, 0, weight)
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+	od.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	weight, _ = lb.ServerWeight(testutils.ParseURI("http://localhost:5001"))
+	assert.Equal(t, 4, weight)
+}
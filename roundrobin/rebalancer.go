@@ -54,6 +54,17 @@ type Rebalancer struct {
 
 	requestRewriteListener RequestRewriteListener
 
+	// error ratio above which a server is drained after drainTicks consecutive rebalance ticks
+	drainThreshold float64
+	drainTicks     int
+	onDrained      func(*url.URL)
+
+	// bounds of the weights set by the rebalancer, unset when maxWeight is 0
+	minWeight int
+	maxWeight int
+
+	debugHeader debugHeader
+
 	log *log.Logger
 }
 
@@ -105,6 +116,44 @@ func RebalancerRequestRewriteListener(rrl RequestRewriteListener) RebalancerOpti
 	}
 }
 
+// SetDrainThreshold drains a server (sets its weight to 0) once its error ratio stays above ratio
+// for the given number of consecutive rebalance ticks. A drained server is restored
+// with the lowest weight once its error ratio goes back below ratio.
+func SetDrainThreshold(ratio float64, ticks int) RebalancerOption {
+	return func(r *Rebalancer) error {
+		if ratio <= 0 || ratio > 1 {
+			return fmt.Errorf("drain ratio should be in (0, 1], got %v", ratio)
+		}
+		if ticks < 1 {
+			return fmt.Errorf("drain ticks should be >= 1, got %v", ticks)
+		}
+		r.drainThreshold = ratio
+		r.drainTicks = ticks
+		return nil
+	}
+}
+
+// OnServerDrained sets a callback called when a server is drained
+func OnServerDrained(fn func(*url.URL)) RebalancerOption {
+	return func(r *Rebalancer) error {
+		r.onDrained = fn
+		return nil
+	}
+}
+
+// SetWeightBounds keeps the weights set by the rebalancer within [min, max], so that slow servers
+// still get some traffic and fast ones aren't overloaded. Drained servers still get a weight of 0.
+func SetWeightBounds(min, max int) RebalancerOption {
+	return func(r *Rebalancer) error {
+		if min < 1 || max < min {
+			return fmt.Errorf("weight bounds should be 1 <= min <= max, got [%v, %v]", min, max)
+		}
+		r.minWeight = min
+		r.maxWeight = max
+		return nil
+	}
+}
+
 // NewRebalancer creates a new Rebalancer
 func NewRebalancer(handler balancerHandler, opts ...RebalancerOption) (*Rebalancer, error) {
 	rb := &Rebalancer{
@@ -154,6 +203,13 @@ func RebalancerLogger(l *log.Logger) RebalancerOption {
 	}
 }
 
+// Close releases the resources of the rebalancer. The weights are adjusted while serving the requests,
+// without background goroutines, so there is nothing to stop yet: it lets the callers close
+// the rebalancer along with the other middlewares of a pipeline on reload.
+func (rb *Rebalancer) Close() error {
+	return nil
+}
+
 // Servers gets all servers
 func (rb *Rebalancer) Servers() []*url.URL {
 	rb.mtx.Lock()
@@ -177,7 +233,7 @@ func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	stuck := false
 
 	if rb.stickySession != nil {
-		cookieUrl, present, err := rb.stickySession.GetBackend(&newReq, rb.Servers())
+		cookieUrl, present, err := rb.stickySession.GetBackend(&newReq, rb.stickySession.availableServers(rb.Servers(), rb.next.ServerWeight))
 
 		if err != nil {
 			log.Warnf("vulcand/oxy/roundrobin/rebalancer: error using server from cookie: %v", err)
@@ -189,8 +245,22 @@ func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	tracker, ok := rb.next.(inFlightTracker)
+	if ok && !tracker.tracksInFlight() {
+		tracker = nil
+	}
+
+	var tracked *server
 	if !stuck {
-		fwdURL, err := rb.next.NextServer()
+		var fwdURL *url.URL
+		var err error
+		if tracker != nil {
+			if tracked, err = tracker.acquireServer(); err == nil {
+				fwdURL = utils.CopyURL(tracked.url)
+			}
+		} else {
+			fwdURL, err = rb.next.NextServer()
+		}
 		if err != nil {
 			rb.errHandler.ServeHTTP(w, req, err)
 			return
@@ -206,8 +276,17 @@ func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 
 		newReq.URL = fwdURL
+	} else if tracker != nil {
+		tracked = tracker.acquire(newReq.URL)
 	}
 
+	if tracked != nil {
+		// released on every exit path, including panics and hijacked connections once the handler returns
+		defer tracker.release(tracked)
+	}
+
+	rb.debugHeader.set(w, req, newReq.URL)
+
 	// Emit event to a listener if one exists
 	if rb.requestRewriteListener != nil {
 		rb.requestRewriteListener(req, &newReq)
@@ -230,6 +309,8 @@ func (rb *Rebalancer) recordMetrics(u *url.URL, code int, latency time.Duration)
 func (rb *Rebalancer) reset() {
 	for _, s := range rb.servers {
 		s.curWeight = s.origWeight
+		s.drained = false
+		s.badTicks = 0
 		rb.next.UpsertServer(s.url, Weight(s.origWeight))
 	}
 	rb.timer = rb.clock.UtcNow().Add(-1 * time.Second)
@@ -316,6 +397,14 @@ func (rb *Rebalancer) findServer(u *url.URL) (*rbServer, int) {
 // adjustWeights Called on every load balancer ServeHTTP call, returns the suggested weights
 // on every call, can adjust weights if needed.
 func (rb *Rebalancer) adjustWeights() {
+	var drained []*url.URL
+	defer func() {
+		// callbacks are called once the mutex has been released
+		for _, u := range drained {
+			rb.onDrained(u)
+		}
+	}()
+
 	rb.mtx.Lock()
 	defer rb.mtx.Unlock()
 
@@ -330,6 +419,18 @@ func (rb *Rebalancer) adjustWeights() {
 	if !rb.timerExpired() {
 		return
 	}
+	if rb.drainThreshold > 0 {
+		var changed bool
+		drained, changed = rb.drainServers()
+		if rb.onDrained == nil {
+			drained = nil
+		}
+		if changed {
+			rb.applyWeights()
+			rb.setTimer()
+			return
+		}
+	}
 	if rb.markServers() {
 		if rb.setMarkedWeights() {
 			rb.setTimer()
@@ -341,8 +442,58 @@ func (rb *Rebalancer) adjustWeights() {
 	}
 }
 
+// drainServers drains the servers failing for too long and restores the recovered ones,
+// it returns the newly drained servers and whether any weight has changed.
+func (rb *Rebalancer) drainServers() ([]*url.URL, bool) {
+	var drained []*url.URL
+	changed := false
+
+	active := 0
+	for _, srv := range rb.servers {
+		if !srv.drained {
+			active++
+		}
+	}
+
+	for _, srv := range rb.servers {
+		rating := srv.meter.Rating()
+		if srv.drained {
+			if rating <= rb.drainThreshold {
+				rb.log.Debugf("restoring drained server %v", srv.url)
+				// start from the lowest weight, converging weights ramps the traffic back up
+				srv.drained = false
+				srv.badTicks = 0
+				srv.curWeight = rb.bound(1)
+				active++
+				changed = true
+			}
+			continue
+		}
+
+		if rating <= rb.drainThreshold {
+			srv.badTicks = 0
+			continue
+		}
+
+		srv.badTicks++
+		// never drain the last active server
+		if srv.badTicks >= rb.drainTicks && active > 1 {
+			rb.log.Warnf("vulcand/oxy/roundrobin/rebalancer: draining server %v, error ratio %v", srv.url, rating)
+			srv.drained = true
+			srv.curWeight = 0
+			active--
+			changed = true
+			drained = append(drained, utils.CopyURL(srv.url))
+		}
+	}
+	return drained, changed
+}
+
 func (rb *Rebalancer) applyWeights() {
 	for _, srv := range rb.servers {
+		if !srv.drained {
+			srv.curWeight = rb.bound(srv.curWeight)
+		}
 		rb.log.Debugf("upsert server %v, weight %v", srv.url, srv.curWeight)
 		rb.next.UpsertServer(srv.url, Weight(srv.curWeight))
 	}
@@ -352,9 +503,12 @@ func (rb *Rebalancer) setMarkedWeights() bool {
 	changed := false
 	// Increase weights on servers marked as good
 	for _, srv := range rb.servers {
-		if srv.good {
+		if srv.good && !srv.drained {
 			weight := increase(srv.curWeight)
-			if weight <= FSMMaxWeight {
+			if rb.maxWeight > 0 && weight > rb.maxWeight && srv.curWeight < rb.maxWeight {
+				weight = rb.maxWeight
+			}
+			if weight <= rb.weightLimit() {
 				rb.log.Debugf("increasing weight of %v from %v to %v", srv.url, srv.curWeight, weight)
 				srv.curWeight = weight
 				changed = true
@@ -411,11 +565,12 @@ func (rb *Rebalancer) convergeWeights() bool {
 	// If we have previously changed servers try to restore weights to the original state
 	changed := false
 	for _, s := range rb.servers {
-		if s.origWeight == s.curWeight {
+		target := rb.bound(s.origWeight)
+		if target == s.curWeight || s.drained {
 			continue
 		}
 		changed = true
-		newWeight := decrease(s.origWeight, s.curWeight)
+		newWeight := decrease(target, s.curWeight)
 		log.Debugf("decreasing weight of %v from %v to %v", s.url, s.curWeight, newWeight)
 		s.curWeight = newWeight
 	}
@@ -444,11 +599,39 @@ func (rb *Rebalancer) normalizeWeights() {
 	if gcd <= 1 {
 		return
 	}
+	for _, s := range rb.servers {
+		// normalizing would take a weight below the lower bound
+		if rb.maxWeight > 0 && !s.drained && s.curWeight/gcd < rb.minWeight {
+			return
+		}
+	}
 	for _, s := range rb.servers {
 		s.curWeight = s.curWeight / gcd
 	}
 }
 
+// weightLimit returns the highest weight the rebalancer sets
+func (rb *Rebalancer) weightLimit() int {
+	if rb.maxWeight > 0 {
+		return rb.maxWeight
+	}
+	return FSMMaxWeight
+}
+
+// bound returns the weight within the weight bounds, when they are set
+func (rb *Rebalancer) bound(weight int) int {
+	if rb.maxWeight == 0 {
+		return weight
+	}
+	if weight < rb.minWeight {
+		return rb.minWeight
+	}
+	if weight > rb.maxWeight {
+		return rb.maxWeight
+	}
+	return weight
+}
+
 func increase(weight int) int {
 	return weight * FSMGrowFactor
 }
@@ -468,6 +651,8 @@ type rbServer struct {
 	curWeight  int // current weight
 	good       bool
 	meter      Meter
+	drained    bool // weight set to 0 because of a persistent error ratio
+	badTicks   int  // consecutive rebalance ticks above the drain threshold
 }
 
 const (
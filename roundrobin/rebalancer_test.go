@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/testutils"
+	"go.uber.org/goleak"
 )
 
 func TestRebalancerNormalOperation(t *testing.T) {
@@ -38,6 +40,77 @@ func TestRebalancerNormalOperation(t *testing.T) {
 	assert.Equal(t, []string{"a", "a", "a"}, seq(t, proxy.URL, 3))
 }
 
+func TestRebalancerLeastConnections(t *testing.T) {
+	unblock := make(chan struct{})
+	blocked := make(chan struct{})
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		close(blocked)
+		<-unblock
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, LeastConnections())
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb)
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	done := make(chan string)
+	go func() {
+		_, body, _ := testutils.Get(proxy.URL)
+		done <- string(body)
+	}()
+	<-blocked
+
+	// the requests forwarded by the rebalancer are counted
+	stats := lb.ServerStats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, 1, stats[0].InFlight)
+	assert.Equal(t, 0, stats[1].InFlight)
+
+	assert.Equal(t, []string{"b", "b", "b"}, seq(t, proxy.URL, 3))
+
+	close(unblock)
+	assert.Equal(t, "a", <-done)
+
+	for _, stat := range lb.ServerStats() {
+		assert.Equal(t, 0, stat.InFlight)
+	}
+}
+
+func TestRebalancerClose(t *testing.T) {
+	// the idle connections of the other tests are kept by http.DefaultTransport
+	defer goleak.VerifyNone(t,
+		goleak.IgnoreTopFunction("net/http.(*persistConn).readLoop"),
+		goleak.IgnoreTopFunction("net/http.(*persistConn).writeLoop"))
+
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	lb, err := New(http.NotFoundHandler())
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb)
+	require.NoError(t, err)
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+
+	rb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	require.NoError(t, rb.Close())
+}
+
 func TestRebalancerNoServers(t *testing.T) {
 	fwd, err := forward.New()
 	require.NoError(t, err)
@@ -147,7 +220,148 @@ func TestRebalancerRecovery(t *testing.T) {
 	assert.Equal(t, 1, lb.servers[1].weight)
 }
 
+func TestRebalancerWeightBounds(t *testing.T) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	newMeter := func() (Meter, error) {
+		return &testMeter{}, nil
+	}
+
+	clock := testutils.GetClock()
+
+	rb, err := NewRebalancer(lb, RebalancerMeter(newMeter), RebalancerClock(clock), SetWeightBounds(5, 40))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL), Weight(5)))
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL), Weight(5)))
+
+	// server a is consistently worse than b
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	for i := 0; i < 6; i++ {
+		_, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+	}
+
+	// the weights aren't normalized below the lower bound, nor increased above the upper one
+	assert.Equal(t, 5, rb.servers[0].curWeight)
+	assert.Equal(t, 40, rb.servers[1].curWeight)
+	assert.Equal(t, 5, lb.servers[0].weight)
+	assert.Equal(t, 40, lb.servers[1].weight)
+
+	// the weights go back to the original state within the bounds
+	rb.servers[0].meter.(*testMeter).rating = 0
+
+	for i := 0; i < 6; i++ {
+		_, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+	}
+
+	assert.Equal(t, 5, lb.servers[0].weight)
+	assert.Equal(t, 5, lb.servers[1].weight)
+
+	_, err = NewRebalancer(lb, SetWeightBounds(0, 10))
+	assert.Error(t, err)
+	_, err = NewRebalancer(lb, SetWeightBounds(10, 5))
+	assert.Error(t, err)
+}
+
 // Test scenario when increaing the weight on good endpoints made it worse
+func TestRebalancerDrain(t *testing.T) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	newMeter := func() (Meter, error) {
+		return &testMeter{}, nil
+	}
+
+	clock := testutils.GetClock()
+
+	var drained []string
+	rb, err := NewRebalancer(lb, RebalancerMeter(newMeter), RebalancerClock(clock),
+		SetDrainThreshold(0.2, 2),
+		OnServerDrained(func(u *url.URL) {
+			drained = append(drained, u.String())
+		}))
+	require.NoError(t, err)
+
+	err = rb.UpsertServer(testutils.ParseURI(a.URL))
+	require.NoError(t, err)
+	err = rb.UpsertServer(testutils.ParseURI(b.URL))
+	require.NoError(t, err)
+
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	for i := 0; i < 6; i++ {
+		_, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+	}
+
+	assert.Equal(t, []string{a.URL}, drained)
+	assert.Equal(t, 0, rb.servers[0].curWeight)
+	assert.Equal(t, 0, lb.servers[0].weight)
+
+	// server a has recovered, it is restored and the weights go back to the original state
+	rb.servers[0].meter.(*testMeter).rating = 0
+
+	for i := 0; i < 8; i++ {
+		_, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+	}
+
+	assert.Equal(t, []string{a.URL}, drained)
+	assert.Equal(t, 1, lb.servers[0].weight)
+	assert.Equal(t, 1, lb.servers[1].weight)
+}
+
+func TestRebalancerDrainKeepsLastServer(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	newMeter := func() (Meter, error) {
+		return &testMeter{rating: 0.5}, nil
+	}
+
+	rb, err := NewRebalancer(lb, RebalancerMeter(newMeter), RebalancerClock(testutils.GetClock()), SetDrainThreshold(0.2, 1))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI("http://localhost:5001")))
+
+	rb.adjustWeights()
+
+	assert.Equal(t, 0, lb.servers[0].weight)
+	assert.Equal(t, 1, lb.servers[1].weight)
+}
+
 func TestRebalancerCascading(t *testing.T) {
 	a, b, d := testutils.NewResponder("a"), testutils.NewResponder("b"), testutils.NewResponder("d")
 	defer a.Close()
@@ -444,3 +658,30 @@ func (tm *testMeter) Record(int, time.Duration) {
 func (tm *testMeter) IsReady() bool {
 	return !tm.notReady
 }
+
+func TestRebalancerDebugServerHeader(t *testing.T) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb, RebalancerDebugServerHeader("X-Oxy-Server"))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	for _, expected := range []string{a.URL, b.URL} {
+		re, _, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, expected, re.Header.Get("X-Oxy-Server"))
+	}
+}
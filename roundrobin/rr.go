@@ -3,10 +3,13 @@ package roundrobin
 
 import (
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
+	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/oxy/utils"
 )
@@ -46,6 +49,59 @@ func RoundRobinRequestRewriteListener(rrl RequestRewriteListener) LBOption {
 	}
 }
 
+// LeastConnections is a functional argument that makes the load balancer pick the server
+// with the fewest in-flight requests relative to its weight instead of cycling through servers.
+// In-flight requests are tracked by RoundRobin.ServeHTTP, or by the Rebalancer when it wraps the load balancer.
+func LeastConnections() LBOption {
+	return func(s *RoundRobin) error {
+		s.leastConnections = true
+		return nil
+	}
+}
+
+// PowerOfTwoChoices is a functional argument that makes the load balancer pick two servers at random,
+// weighted, and route to the one with the fewest in-flight requests relative to its weight.
+// Unlike the round robin, it doesn't create synchronized patterns across load balancer instances.
+// In-flight requests are tracked by RoundRobin.ServeHTTP, or by the Rebalancer when it wraps the load balancer,
+// it can't be combined with LeastConnections.
+func PowerOfTwoChoices() LBOption {
+	return func(s *RoundRobin) error {
+		s.twoChoices = true
+		return nil
+	}
+}
+
+// ServerSelector is a functional argument that sets a hook consulted before the weighted selection.
+// The selector gets the request and the servers with a non zero weight, returning nil falls back
+// to the weighted selection, as does returning a server that is no longer in the pool.
+// Sticky sessions take precedence over the selector.
+func ServerSelector(selector func(req *http.Request, servers []*url.URL) *url.URL) LBOption {
+	return func(s *RoundRobin) error {
+		s.selector = selector
+		return nil
+	}
+}
+
+// RequestObserver is a functional argument that sets a callback invoked once a request completes with
+// the server that handled it, the time it took and its outcome. The error is a *ServerError when the
+// server responded with a 5xx status code. When the load balancer fails to pick a server the callback
+// gets a nil server along with the balancer error.
+func RequestObserver(observer func(server *url.URL, duration time.Duration, err error)) LBOption {
+	return func(s *RoundRobin) error {
+		s.observer = observer
+		return nil
+	}
+}
+
+// ServerError is reported to the request observer when a server responds with a 5xx status code
+type ServerError struct {
+	StatusCode int
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server responded with status %d", e.StatusCode)
+}
+
 // RoundRobin implements dynamic weighted round robin load balancer http handler
 type RoundRobin struct {
 	mutex      *sync.Mutex
@@ -57,6 +113,12 @@ type RoundRobin struct {
 	currentWeight          int
 	stickySession          *StickySession
 	requestRewriteListener RequestRewriteListener
+	leastConnections       bool
+	twoChoices             bool
+	selector               func(req *http.Request, servers []*url.URL) *url.URL
+	clock                  timetools.TimeProvider
+	observer               func(server *url.URL, duration time.Duration, err error)
+	debugHeader            debugHeader
 
 	log *log.Logger
 }
@@ -69,6 +131,7 @@ func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 		mutex:         &sync.Mutex{},
 		servers:       []*server{},
 		stickySession: nil,
+		clock:         &timetools.RealTime{},
 
 		log: log.StandardLogger(),
 	}
@@ -77,6 +140,9 @@ func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 			return nil, err
 		}
 	}
+	if rr.leastConnections && rr.twoChoices {
+		return nil, fmt.Errorf("least connections and power of two choices can not be combined")
+	}
 	if rr.errHandler == nil {
 		rr.errHandler = utils.DefaultHandler
 	}
@@ -93,6 +159,15 @@ func RoundRobinLogger(l *log.Logger) LBOption {
 	}
 }
 
+// RoundRobinClock sets the clock used to ramp up the weight of the servers added with slow start
+// and to measure the durations reported to the request observer
+func RoundRobinClock(clock timetools.TimeProvider) LBOption {
+	return func(r *RoundRobin) error {
+		r.clock = clock
+		return nil
+	}
+}
+
 // Next returns the next handler
 func (r *RoundRobin) Next() http.Handler {
 	return r.next
@@ -105,11 +180,18 @@ func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		defer logEntry.Debug("vulcand/oxy/roundrobin/rr: completed ServeHttp on request")
 	}
 
+	var pw *utils.ProxyWriter
+	start := r.clock.UtcNow()
+	if r.observer != nil {
+		pw = utils.NewProxyWriterWithLogger(w, r.log)
+		w = pw
+	}
+
 	// make shallow copy of request before chaning anything to avoid side effects
 	newReq := *req
 	stuck := false
 	if r.stickySession != nil {
-		cookieURL, present, err := r.stickySession.GetBackend(&newReq, r.Servers())
+		cookieURL, present, err := r.stickySession.GetBackend(&newReq, r.stickySession.availableServers(r.Servers(), r.ServerWeight))
 
 		if err != nil {
 			log.Warnf("vulcand/oxy/roundrobin/rr: error using server from cookie: %v", err)
@@ -121,17 +203,44 @@ func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	var tracked *server
 	if !stuck {
-		url, err := r.NextServer()
-		if err != nil {
-			r.errHandler.ServeHTTP(w, req, err)
-			return
+		var srv *server
+		if r.selector != nil {
+			srv = r.selectedServer(&newReq)
 		}
 
+		if srv == nil {
+			var err error
+			if r.tracksInFlight() {
+				srv, err = r.acquireServer()
+			} else {
+				srv, err = r.nextServer()
+			}
+			if err != nil {
+				r.errHandler.ServeHTTP(w, req, err)
+				if r.observer != nil {
+					r.observer(nil, r.clock.UtcNow().Sub(start), err)
+				}
+				return
+			}
+		}
+		if r.tracksInFlight() {
+			tracked = srv
+		}
+		url := utils.CopyURL(srv.url)
+
 		if r.stickySession != nil {
 			r.stickySession.StickBackend(url, &w)
 		}
 		newReq.URL = url
+	} else if r.tracksInFlight() {
+		tracked = r.acquire(newReq.URL)
+	}
+
+	if tracked != nil {
+		// released on every exit path, including panics and hijacked connections once the handler returns
+		defer r.release(tracked)
 	}
 
 	if r.log.Level >= log.DebugLevel {
@@ -139,12 +248,22 @@ func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		r.log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": newReq.URL}).Debugf("vulcand/oxy/roundrobin/rr: Forwarding this request to URL")
 	}
 
+	r.debugHeader.set(w, req, newReq.URL)
+
 	// Emit event to a listener if one exists
 	if r.requestRewriteListener != nil {
 		r.requestRewriteListener(req, &newReq)
 	}
 
 	r.next.ServeHTTP(w, &newReq)
+
+	if r.observer != nil {
+		var err error
+		if pw.StatusCode() >= http.StatusInternalServerError {
+			err = &ServerError{StatusCode: pw.StatusCode()}
+		}
+		r.observer(utils.CopyURL(newReq.URL), r.clock.UtcNow().Sub(start), err)
+	}
 }
 
 // NextServer gets the next server
@@ -160,6 +279,19 @@ func (r *RoundRobin) nextServer() (*server, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	return r.pickServer()
+}
+
+// pickServer returns the next server according to the selection strategy, it has to be called with the mutex held
+func (r *RoundRobin) pickServer() (*server, error) {
+	if r.leastConnections {
+		return r.leastLoadedServer()
+	}
+
+	if r.twoChoices {
+		return r.twoChoicesServer()
+	}
+
 	if len(r.servers) == 0 {
 		return nil, fmt.Errorf("no servers in the pool")
 	}
@@ -185,12 +317,192 @@ func (r *RoundRobin) nextServer() (*server, error) {
 			}
 		}
 		srv := r.servers[r.index]
-		if srv.weight >= r.currentWeight {
+		if r.effectiveWeight(srv) >= r.currentWeight {
 			return srv, nil
 		}
 	}
 }
 
+// leastLoadedServer returns the enabled server with the fewest in-flight requests relative to its weight,
+// ties are broken in a round robin fashion. It has to be called with the mutex held.
+func (r *RoundRobin) leastLoadedServer() (*server, error) {
+	if len(r.servers) == 0 {
+		return nil, fmt.Errorf("no servers in the pool")
+	}
+
+	var best *server
+	bestIndex, bestWeight := -1, 0
+	for i := 1; i <= len(r.servers); i++ {
+		index := (r.index + i) % len(r.servers)
+		srv := r.servers[index]
+		weight := r.effectiveWeight(srv)
+		if weight == 0 {
+			continue
+		}
+		if best == nil || srv.inFlight*bestWeight < best.inFlight*weight {
+			best, bestIndex, bestWeight = srv, index, weight
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("all servers have 0 weight")
+	}
+	r.index = bestIndex
+	return best, nil
+}
+
+// twoChoicesServer picks two enabled servers at random, weighted, and returns the one with the fewest
+// in-flight requests relative to its weight. It has to be called with the mutex held.
+func (r *RoundRobin) twoChoicesServer() (*server, error) {
+	if len(r.servers) == 0 {
+		return nil, fmt.Errorf("no servers in the pool")
+	}
+
+	weights := make([]int, len(r.servers))
+	total := 0
+	for i, srv := range r.servers {
+		weights[i] = r.effectiveWeight(srv)
+		total += weights[i]
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("all servers have 0 weight")
+	}
+
+	first := randomServer(weights, total, -1)
+	if total == weights[first] {
+		return r.servers[first], nil
+	}
+	second := randomServer(weights, total-weights[first], first)
+	if r.servers[second].inFlight*weights[first] < r.servers[first].inFlight*weights[second] {
+		return r.servers[second], nil
+	}
+	return r.servers[first], nil
+}
+
+// randomServer returns the index of a server picked at random with a probability proportional to its weight,
+// total is the sum of the weights of the servers other than exclude.
+func randomServer(weights []int, total int, exclude int) int {
+	n := rand.Intn(total)
+	for i, weight := range weights {
+		if i == exclude {
+			continue
+		}
+		if n < weight {
+			return i
+		}
+		n -= weight
+	}
+	return -1
+}
+
+// selectedServer returns the server picked by the selector, or nil if the selector has no preference
+// or picked a server that is not in the pool. The in-flight counter of the server is incremented
+// in least connections mode.
+func (r *RoundRobin) selectedServer(req *http.Request) *server {
+	// the selector is called without holding the mutex, it may call back into the load balancer
+	u := r.selector(req, r.liveServers())
+	if u == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	srv, _ := r.findServerByURL(u)
+	if srv == nil || srv.weight == 0 {
+		r.log.Warnf("vulcand/oxy/roundrobin/rr: selected server %v is not available, falling back to weighted selection", u)
+		return nil
+	}
+	if r.tracksInFlight() {
+		srv.inFlight++
+	}
+	return srv
+}
+
+// liveServers returns a copy of the URLs of the servers with a non zero weight
+func (r *RoundRobin) liveServers() []*url.URL {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	out := make([]*url.URL, 0, len(r.servers))
+	for _, srv := range r.servers {
+		if srv.weight > 0 {
+			out = append(out, utils.CopyURL(srv.url))
+		}
+	}
+	return out
+}
+
+// inFlightTracker is implemented by the load balancers picking servers by their in-flight requests,
+// the Rebalancer forwards the requests itself and has to count them
+type inFlightTracker interface {
+	tracksInFlight() bool
+	acquireServer() (*server, error)
+	acquire(u *url.URL) *server
+	release(srv *server)
+}
+
+// tracksInFlight returns whether the selection strategy needs the in-flight requests of the servers
+func (r *RoundRobin) tracksInFlight() bool {
+	return r.leastConnections || r.twoChoices
+}
+
+// acquireServer picks the next server and increments its in-flight counter
+func (r *RoundRobin) acquireServer() (*server, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	srv, err := r.pickServer()
+	if err != nil {
+		return nil, err
+	}
+	srv.inFlight++
+	return srv, nil
+}
+
+// acquire increments the in-flight counter of the server matching the URL
+func (r *RoundRobin) acquire(u *url.URL) *server {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	srv, _ := r.findServerByURL(u)
+	if srv != nil {
+		srv.inFlight++
+	}
+	return srv
+}
+
+// release decrements the in-flight counter of a server returned by acquire
+func (r *RoundRobin) release(srv *server) {
+	if srv == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	srv.inFlight--
+}
+
+// ServerStat holds the current state of a server
+type ServerStat struct {
+	URL      *url.URL
+	Weight   int
+	InFlight int
+}
+
+// ServerStats returns the weight and the number of in-flight requests of every server,
+// in-flight requests are only tracked in least connections and power of two choices modes.
+func (r *RoundRobin) ServerStats() []ServerStat {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	out := make([]ServerStat, len(r.servers))
+	for i, srv := range r.servers {
+		out[i] = ServerStat{URL: utils.CopyURL(srv.url), Weight: srv.weight, InFlight: srv.inFlight}
+	}
+	return out
+}
+
 // RemoveServer remove a server
 func (r *RoundRobin) RemoveServer(u *url.URL) error {
 	r.mutex.Lock()
@@ -243,6 +555,7 @@ func (r *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
 				return err
 			}
 		}
+		r.startRamp(s)
 		r.resetState()
 		return nil
 	}
@@ -257,6 +570,7 @@ func (r *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
 	if srv.weight == 0 {
 		srv.weight = defaultWeight
 	}
+	r.startRamp(srv)
 
 	r.servers = append(r.servers, srv)
 	r.resetState()
@@ -287,8 +601,8 @@ func (r *RoundRobin) findServerByURL(u *url.URL) (*server, int) {
 func (r *RoundRobin) maxWeight() int {
 	max := -1
 	for _, s := range r.servers {
-		if s.weight > max {
-			max = s.weight
+		if w := r.effectiveWeight(s); w > max {
+			max = w
 		}
 	}
 	return max
@@ -298,9 +612,9 @@ func (r *RoundRobin) weightGcd() int {
 	divisor := -1
 	for _, s := range r.servers {
 		if divisor == -1 {
-			divisor = s.weight
+			divisor = r.effectiveWeight(s)
 		} else {
-			divisor = gcd(divisor, s.weight)
+			divisor = gcd(divisor, r.effectiveWeight(s))
 		}
 	}
 	return divisor
@@ -324,6 +638,11 @@ type server struct {
 	url *url.URL
 	// Relative weight for the enpoint to other enpoints in the load balancer
 	weight int
+	// Number of requests currently forwarded to the server, tracked in least connections and power of two choices modes
+	inFlight int
+	// The effective weight of the server ramps up from rampStart for rampDuration, see UpsertServerWithSlowStart
+	rampStart    time.Time
+	rampDuration time.Duration
 }
 
 var defaultWeight = 1
@@ -1,9 +1,13 @@
 package roundrobin
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -228,6 +232,239 @@ func TestRequestRewriteListener(t *testing.T) {
 	assert.NotNil(t, lb.requestRewriteListener)
 }
 
+func TestLeastConnections(t *testing.T) {
+	unblock := make(chan struct{})
+	blocked := make(chan struct{})
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		close(blocked)
+		<-unblock
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, LeastConnections())
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	done := make(chan string)
+	go func() {
+		_, body, _ := testutils.Get(proxy.URL)
+		done <- string(body)
+	}()
+	<-blocked
+
+	stats := lb.ServerStats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, 1, stats[0].InFlight)
+	assert.Equal(t, 0, stats[1].InFlight)
+
+	// a is busy, every request goes to b
+	assert.Equal(t, []string{"b", "b", "b"}, seq(t, proxy.URL, 3))
+
+	close(unblock)
+	assert.Equal(t, "a", <-done)
+
+	for _, stat := range lb.ServerStats() {
+		assert.Equal(t, 0, stat.InFlight)
+	}
+}
+
+func TestLeastConnectionsReleaseOnPanic(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	})
+
+	lb, err := New(next, LeastConnections())
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	assert.Panics(t, func() {
+		lb.ServeHTTP(httptest.NewRecorder(), req)
+	})
+
+	stats := lb.ServerStats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, 0, stats[0].InFlight)
+}
+
+func TestServerSelector(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	var seen []*url.URL
+	selector := func(req *http.Request, servers []*url.URL) *url.URL {
+		seen = servers
+		if req.Header.Get("X-Tenant") != "b" {
+			return nil
+		}
+		for _, u := range servers {
+			if u.String() == b.URL {
+				return u
+			}
+		}
+		return nil
+	}
+
+	lb, err := New(fwd, ServerSelector(selector))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		_, body, err := testutils.Get(proxy.URL, testutils.Header("X-Tenant", "b"))
+		require.NoError(t, err)
+		assert.Equal(t, "b", string(body))
+	}
+	assert.Len(t, seen, 2)
+
+	// no preference falls back to the weighted selection
+	assert.Equal(t, []string{"a", "b", "a"}, seq(t, proxy.URL, 3))
+
+	// servers with a zero weight are not offered to the selector
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL), Weight(0)))
+	_, body, err := testutils.Get(proxy.URL, testutils.Header("X-Tenant", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(body))
+	assert.Len(t, seen, 1)
+}
+
+func TestServerSelectorRemovedServer(t *testing.T) {
+	var forwarded *url.URL
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded = req.URL
+	})
+
+	removed := testutils.ParseURI("http://localhost:5001")
+	lb, err := New(next, ServerSelector(func(req *http.Request, servers []*url.URL) *url.URL {
+		return removed
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	require.NotNil(t, forwarded)
+	assert.Equal(t, "localhost:5000", forwarded.Host)
+}
+
+func TestServerSelectorConcurrentUpdates(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	lb, err := New(next, LeastConnections(), ServerSelector(func(req *http.Request, servers []*url.URL) *url.URL {
+		if len(servers) == 0 {
+			return nil
+		}
+		return servers[len(servers)-1]
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		u := testutils.ParseURI("http://localhost:5001")
+		for i := 0; i < 100; i++ {
+			lb.UpsertServer(u)
+			lb.RemoveServer(u)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+		}
+	}()
+	wg.Wait()
+
+	for _, stat := range lb.ServerStats() {
+		assert.Equal(t, 0, stat.InFlight)
+	}
+}
+
+func TestRequestObserver(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Host == "localhost:5001" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	type observation struct {
+		server *url.URL
+		err    error
+	}
+	var observed []observation
+	lb, err := New(next, RequestObserver(func(server *url.URL, duration time.Duration, err error) {
+		assert.True(t, duration >= 0)
+		observed = append(observed, observation{server: server, err: err})
+	}))
+	require.NoError(t, err)
+
+	// no servers in the pool
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	require.Len(t, observed, 1)
+	assert.Nil(t, observed[0].server)
+	assert.Error(t, observed[0].err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:5001")))
+
+	observed = nil
+	for i := 0; i < 2; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	}
+	require.Len(t, observed, 2)
+
+	assert.Equal(t, "localhost:5000", observed[0].server.Host)
+	assert.NoError(t, observed[0].err)
+
+	assert.Equal(t, "localhost:5001", observed[1].server.Host)
+	assert.Equal(t, &ServerError{StatusCode: http.StatusBadGateway}, observed[1].err)
+}
+
+func TestRequestObserverClock(t *testing.T) {
+	clock := testutils.GetClock()
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clock.Sleep(3 * time.Second)
+		w.Write([]byte("ok"))
+	})
+
+	var durations []time.Duration
+	lb, err := New(next, RoundRobinClock(clock), RequestObserver(func(server *url.URL, duration time.Duration, err error) {
+		durations = append(durations, duration)
+	}))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	assert.Equal(t, []time.Duration{3 * time.Second}, durations)
+}
+
 func seq(t *testing.T, url string, repeat int) []string {
 	var out []string
 	for i := 0; i < repeat; i++ {
@@ -237,3 +474,132 @@ func seq(t *testing.T, url string, repeat int) []string {
 	}
 	return out
 }
+
+func TestDebugServerHeader(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	sticky := NewStickySession("test")
+	lb, err := New(fwd, EnableStickySession(sticky), DebugServerHeader("X-Oxy-Server"), DebugRequestHeader("X-Oxy-Debug"))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// the header is only added to debug requests
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Empty(t, re.Header.Get("X-Oxy-Server"))
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header("X-Oxy-Debug", "1"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(body))
+	assert.Equal(t, b.URL, re.Header.Get("X-Oxy-Server"))
+
+	// the server picked by the sticky session is reported
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Oxy-Debug", "1")
+		req.AddCookie(&http.Cookie{Name: "test", Value: a.URL})
+
+		re, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		re.Body.Close()
+		assert.Equal(t, a.URL, re.Header.Get("X-Oxy-Server"))
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, PowerOfTwoChoices())
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+	// disabled servers are never picked
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Weight(0)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// with two enabled servers both are always compared, the loaded one is avoided
+	busy := lb.acquire(testutils.ParseURI(a.URL))
+	for _, body := range seq(t, proxy.URL, 5) {
+		assert.Equal(t, "b", body)
+	}
+	lb.release(busy)
+
+	counts := make(map[string]int)
+	for _, body := range seq(t, proxy.URL, 100) {
+		counts[body]++
+	}
+	assert.Len(t, counts, 2)
+
+	for _, stat := range lb.ServerStats() {
+		assert.Equal(t, 0, stat.InFlight)
+	}
+
+	_, err = New(fwd, PowerOfTwoChoices(), LeastConnections())
+	assert.Error(t, err)
+}
+
+// BenchmarkServerSelection simulates 4 servers, one of them completing a request every 8 steps while
+// the others complete one request per step, and reports the peak of in-flight requests on a server.
+func BenchmarkServerSelection(b *testing.B) {
+	benchmarks := []struct {
+		desc string
+		opts []LBOption
+	}{
+		{desc: "RoundRobin"},
+		{desc: "PowerOfTwoChoices", opts: []LBOption{PowerOfTwoChoices()}},
+		{desc: "LeastConnections", opts: []LBOption{LeastConnections()}},
+	}
+
+	for _, bench := range benchmarks {
+		b.Run(bench.desc, func(b *testing.B) {
+			lb, err := New(nil, bench.opts...)
+			require.NoError(b, err)
+			for i := 0; i < 4; i++ {
+				require.NoError(b, lb.UpsertServer(testutils.ParseURI(fmt.Sprintf("http://localhost:%d", 5000+i))))
+			}
+
+			peak := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				srv, err := lb.acquireServer()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if srv.inFlight > peak {
+					peak = srv.inFlight
+				}
+
+				for j, s := range lb.servers {
+					if s.inFlight > 0 && (j != 0 || i%8 == 0) {
+						lb.release(s)
+					}
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-inflight")
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// slowStartScale scales the weights of the servers so that the effective weight of
+// a server ramping up can grow smoothly even when its weight is small
+const slowStartScale = 100
+
+// UpsertServerWithSlowStart upserts a server whose effective weight increases linearly from a small value
+// to weight over rampDuration, so that a cold server doesn't get its full share of the traffic at once.
+// A weight of 0 is the default weight. Updating the weight during the ramp, e.g. by a Rebalancer, changes
+// the target weight, the effective weight stays capped by the ramp.
+func (r *RoundRobin) UpsertServerWithSlowStart(u *url.URL, weight int, rampDuration time.Duration) error {
+	return r.UpsertServer(u, Weight(weight), slowStart(rampDuration))
+}
+
+// UpsertServerWithSlowStart upserts a server ramping up its weight over rampDuration,
+// see RoundRobin.UpsertServerWithSlowStart. The rebalancer adjustments are capped by the ramp.
+func (rb *Rebalancer) UpsertServerWithSlowStart(u *url.URL, weight int, rampDuration time.Duration) error {
+	return rb.UpsertServer(u, Weight(weight), slowStart(rampDuration))
+}
+
+// slowStart restarts the ramp up of the server, it starts when the server is upserted
+func slowStart(rampDuration time.Duration) ServerOption {
+	return func(s *server) error {
+		if rampDuration < 0 {
+			return fmt.Errorf("ramp duration should be >= 0, got %v", rampDuration)
+		}
+		s.rampStart = time.Time{}
+		s.rampDuration = rampDuration
+		return nil
+	}
+}
+
+// startRamp starts the ramp up of a server upserted with slow start
+func (r *RoundRobin) startRamp(srv *server) {
+	if srv.rampDuration > 0 && srv.rampStart.IsZero() {
+		srv.rampStart = r.clock.UtcNow()
+	}
+}
+
+// effectiveWeight returns the scaled weight used to pick the server, it has to be called with the mutex held
+func (r *RoundRobin) effectiveWeight(srv *server) int {
+	weight := srv.weight * slowStartScale
+	if srv.rampDuration == 0 {
+		return weight
+	}
+
+	elapsed := r.clock.UtcNow().Sub(srv.rampStart)
+	if elapsed >= srv.rampDuration {
+		// the ramp is over, the server behaves normally
+		srv.rampDuration = 0
+		return weight
+	}
+
+	ramped := int(float64(weight) * float64(elapsed) / float64(srv.rampDuration))
+	if ramped < 1 && weight > 0 {
+		ramped = 1
+	}
+	return ramped
+}
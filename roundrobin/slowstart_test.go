@@ -0,0 +1,73 @@
+package roundrobin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func countNextServers(t *testing.T, lb *RoundRobin, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+		counts[u.Host]++
+	}
+	return counts
+}
+
+func TestUpsertServerWithSlowStart(t *testing.T) {
+	clock := testutils.GetClock()
+	lb, err := New(nil, RoundRobinClock(clock))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:5000")))
+	require.NoError(t, lb.UpsertServerWithSlowStart(testutils.ParseURI("http://localhost:5001"), 1, 10*time.Second))
+
+	// the new server starts with a small share of the traffic
+	counts := countNextServers(t, lb, 101)
+	assert.Equal(t, map[string]int{"localhost:5000": 100, "localhost:5001": 1}, counts)
+
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	counts = countNextServers(t, lb, 300)
+	assert.Equal(t, map[string]int{"localhost:5000": 200, "localhost:5001": 100}, counts)
+
+	// after the ramp the server gets its full share
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	counts = countNextServers(t, lb, 100)
+	assert.Equal(t, map[string]int{"localhost:5000": 50, "localhost:5001": 50}, counts)
+
+	weight, ok := lb.ServerWeight(testutils.ParseURI("http://localhost:5001"))
+	assert.True(t, ok)
+	assert.Equal(t, 1, weight)
+
+	assert.Error(t, lb.UpsertServerWithSlowStart(testutils.ParseURI("http://localhost:5002"), 1, -time.Second))
+}
+
+func TestUpsertServerWithSlowStartWeightUpdate(t *testing.T) {
+	clock := testutils.GetClock()
+	lb, err := New(nil, RoundRobinClock(clock))
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb, RebalancerClock(clock))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI("http://localhost:5000"), Weight(4)))
+	require.NoError(t, rb.UpsertServerWithSlowStart(testutils.ParseURI("http://localhost:5001"), 2, 10*time.Second))
+
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	counts := countNextServers(t, lb, 500)
+	assert.Equal(t, map[string]int{"localhost:5000": 400, "localhost:5001": 100}, counts)
+
+	// weight updates, as done by the rebalancer, are capped by the ramp which isn't restarted
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:5001"), Weight(8)))
+	counts = countNextServers(t, lb, 400)
+	assert.Equal(t, map[string]int{"localhost:5000": 200, "localhost:5001": 200}, counts)
+
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	counts = countNextServers(t, lb, 300)
+	assert.Equal(t, map[string]int{"localhost:5000": 100, "localhost:5001": 200}, counts)
+}
@@ -0,0 +1,227 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SRVResolver resolves SRV records, it is implemented by *net.Resolver
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// SRVServerPoolOption provides options for the SRV server pool
+type SRVServerPoolOption func(*SRVServerPool) error
+
+// SRVScheme sets the scheme of the server URLs, it defaults to http
+func SRVScheme(scheme string) SRVServerPoolOption {
+	return func(p *SRVServerPool) error {
+		if scheme == "" {
+			return fmt.Errorf("scheme can't be empty")
+		}
+		p.scheme = scheme
+		return nil
+	}
+}
+
+// SRVLogger defines the logger the SRV server pool will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func SRVLogger(l *log.Logger) SRVServerPoolOption {
+	return func(p *SRVServerPool) error {
+		p.log = l
+		return nil
+	}
+}
+
+// SRVServerPool keeps the servers of a load balancer in sync with the targets of a SRV record.
+// Only the targets with the lowest priority are added to the load balancer, using the SRV weight
+// as server weight, higher priorities are used once the lower ones disappear from the record.
+// Servers that were not added by the pool are left untouched, even when they are targets of the record.
+// The weight of a server added by the pool is only updated when its SRV weight changes, so that the weights
+// set by an outlier detector or a rebalancer are kept between refreshes.
+// A failed lookup, or one returning no targets, keeps the current servers.
+type SRVServerPool struct {
+	lb       balancerHandler
+	name     string
+	resolver SRVResolver
+	interval time.Duration
+	scheme   string
+
+	mutex sync.Mutex
+	// managed are the servers added by the pool, with their last SRV weight
+	managed map[string]srvTarget
+	stop    chan struct{}
+	done    chan struct{}
+
+	log *log.Logger
+}
+
+// NewSRVServerPool creates a pool resolving the SRV record name every interval
+func NewSRVServerPool(lb balancerHandler, name string, resolver SRVResolver, interval time.Duration, opts ...SRVServerPoolOption) (*SRVServerPool, error) {
+	if lb == nil {
+		return nil, fmt.Errorf("provide a load balancer")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("provide a SRV name")
+	}
+	if resolver == nil {
+		return nil, fmt.Errorf("provide a resolver")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("refresh interval should be > 0, got %v", interval)
+	}
+
+	p := &SRVServerPool{
+		lb:       lb,
+		name:     name,
+		resolver: resolver,
+		interval: interval,
+		scheme:   "http",
+		managed:  make(map[string]srvTarget),
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Start resolves the SRV record and keeps refreshing it in the background until Stop is called
+func (p *SRVServerPool) Start() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.run(p.stop, p.done)
+}
+
+// Stop stops refreshing the SRV record and waits for an ongoing refresh to complete
+func (p *SRVServerPool) Stop() {
+	p.mutex.Lock()
+	stop, done := p.stop, p.done
+	p.stop, p.done = nil, nil
+	p.mutex.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// Close stops refreshing the SRV record, see Stop
+func (p *SRVServerPool) Close() error {
+	p.Stop()
+	return nil
+}
+
+func (p *SRVServerPool) run(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+		if err := p.Refresh(ctx); err != nil {
+			p.log.Warnf("vulcand/oxy/roundrobin/srv: failed to refresh servers of %v, keeping the current ones: %v", p.name, err)
+		}
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh resolves the SRV record once and reconciles the servers of the load balancer
+func (p *SRVServerPool) Refresh(ctx context.Context) error {
+	_, records, err := p.resolver.LookupSRV(ctx, "", "", p.name)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no targets found for %v", p.name)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	wanted := p.targets(records)
+	for key, target := range p.managed {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		if err := p.lb.RemoveServer(target.url); err != nil {
+			p.log.Warnf("vulcand/oxy/roundrobin/srv: failed to remove server %v: %v", target.url, err)
+		}
+		delete(p.managed, key)
+	}
+
+	for key, target := range wanted {
+		if current, ok := p.managed[key]; ok {
+			if current.weight == target.weight {
+				continue
+			}
+		} else if _, exists := p.lb.ServerWeight(target.url); exists {
+			// added by hand or by another pool
+			continue
+		}
+		if err := p.lb.UpsertServer(target.url, Weight(target.weight)); err != nil {
+			return err
+		}
+		p.managed[key] = target
+	}
+	return nil
+}
+
+type srvTarget struct {
+	url    *url.URL
+	weight int
+}
+
+// targets returns the targets with the lowest priority keyed by URL
+func (p *SRVServerPool) targets(records []*net.SRV) map[string]srvTarget {
+	priority := records[0].Priority
+	for _, r := range records {
+		if r.Priority < priority {
+			priority = r.Priority
+		}
+	}
+
+	out := make(map[string]srvTarget)
+	for _, r := range records {
+		if r.Priority != priority {
+			continue
+		}
+		u := &url.URL{
+			Scheme: p.scheme,
+			Host:   net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))),
+		}
+		// a zero SRV weight still gets a small share of the traffic
+		weight := int(r.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		out[u.String()] = srvTarget{url: u, weight: weight}
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+package roundrobin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"go.uber.org/goleak"
+)
+
+type fakeResolver struct {
+	mutex   sync.Mutex
+	records []*net.SRV
+	err     error
+	lookups int
+}
+
+func (f *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.lookups++
+	return name, f.records, f.err
+}
+
+func (f *fakeResolver) set(records []*net.SRV, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.records, f.err = records, err
+}
+
+func (f *fakeResolver) lookupCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.lookups
+}
+
+func TestSRVServerPool(t *testing.T) {
+	lb, err := New(http.NotFoundHandler())
+	require.NoError(t, err)
+
+	// servers added by hand are left untouched
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://static:80")))
+
+	resolver := &fakeResolver{}
+	pool, err := NewSRVServerPool(lb, "_http._tcp.example.com", resolver, time.Minute)
+	require.NoError(t, err)
+
+	resolver.set([]*net.SRV{
+		{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 3},
+		{Target: "b.example.com.", Port: 8080, Priority: 10, Weight: 0},
+		{Target: "backup.example.com.", Port: 8080, Priority: 20, Weight: 5},
+	}, nil)
+	require.NoError(t, pool.Refresh(context.Background()))
+	assert.Equal(t, map[string]int{
+		"http://static:80":          1,
+		"http://a.example.com:8080": 3,
+		"http://b.example.com:8080": 1,
+	}, serverWeights(lb))
+
+	resolver.set([]*net.SRV{
+		{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 1},
+		{Target: "c.example.com.", Port: 9090, Priority: 10, Weight: 2},
+	}, nil)
+	require.NoError(t, pool.Refresh(context.Background()))
+	assert.Equal(t, map[string]int{
+		"http://static:80":          1,
+		"http://a.example.com:8080": 1,
+		"http://c.example.com:9090": 2,
+	}, serverWeights(lb))
+
+	// transient failures keep the current servers
+	resolver.set(nil, errors.New("temporary failure"))
+	assert.Error(t, pool.Refresh(context.Background()))
+	resolver.set(nil, nil)
+	assert.Error(t, pool.Refresh(context.Background()))
+	assert.Len(t, lb.Servers(), 3)
+
+	// the backups are used once the primaries are gone
+	resolver.set([]*net.SRV{
+		{Target: "backup.example.com.", Port: 8080, Priority: 20, Weight: 5},
+	}, nil)
+	require.NoError(t, pool.Refresh(context.Background()))
+	assert.Equal(t, map[string]int{
+		"http://static:80":               1,
+		"http://backup.example.com:8080": 5,
+	}, serverWeights(lb))
+}
+
+func TestSRVServerPoolOwnership(t *testing.T) {
+	lb, err := New(http.NotFoundHandler())
+	require.NoError(t, err)
+
+	// a server added by hand that is also a target of the record
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://static.example.com:8080"), Weight(4)))
+
+	resolver := &fakeResolver{}
+	pool, err := NewSRVServerPool(lb, "_http._tcp.example.com", resolver, time.Minute)
+	require.NoError(t, err)
+
+	resolver.set([]*net.SRV{
+		{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 3},
+		{Target: "static.example.com.", Port: 8080, Priority: 10, Weight: 1},
+	}, nil)
+	require.NoError(t, pool.Refresh(context.Background()))
+	assert.Equal(t, map[string]int{
+		"http://static.example.com:8080": 4,
+		"http://a.example.com:8080":      3,
+	}, serverWeights(lb))
+
+	// the weights set by others are kept while the SRV weights don't change
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a.example.com:8080"), Weight(1)))
+	require.NoError(t, pool.Refresh(context.Background()))
+	assert.Equal(t, map[string]int{
+		"http://static.example.com:8080": 4,
+		"http://a.example.com:8080":      1,
+	}, serverWeights(lb))
+
+	resolver.set([]*net.SRV{
+		{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 5},
+	}, nil)
+	require.NoError(t, pool.Refresh(context.Background()))
+	assert.Equal(t, map[string]int{
+		"http://static.example.com:8080": 4,
+		"http://a.example.com:8080":      5,
+	}, serverWeights(lb))
+}
+
+func TestSRVServerPoolStartStop(t *testing.T) {
+	lb, err := New(http.NotFoundHandler())
+	require.NoError(t, err)
+
+	resolver := &fakeResolver{records: []*net.SRV{{Target: "a.example.com.", Port: 443, Priority: 1, Weight: 1}}}
+	pool, err := NewSRVServerPool(lb, "_https._tcp.example.com", resolver, 10*time.Millisecond, SRVScheme("https"))
+	require.NoError(t, err)
+
+	pool.Start()
+	assert.Eventually(t, func() bool {
+		return resolver.lookupCount() >= 3
+	}, time.Second, 5*time.Millisecond)
+	pool.Stop()
+
+	lookups := resolver.lookupCount()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, lookups, resolver.lookupCount())
+
+	servers := lb.Servers()
+	require.Len(t, servers, 1)
+	assert.Equal(t, "https://a.example.com:443", servers[0].String())
+
+	// stopping twice is a no-op
+	pool.Stop()
+}
+
+func TestSRVServerPoolClose(t *testing.T) {
+	// the idle connections of the other tests are kept by http.DefaultTransport
+	defer goleak.VerifyNone(t,
+		goleak.IgnoreTopFunction("net/http.(*persistConn).readLoop"),
+		goleak.IgnoreTopFunction("net/http.(*persistConn).writeLoop"))
+
+	lb, err := New(http.NotFoundHandler())
+	require.NoError(t, err)
+
+	resolver := &fakeResolver{records: []*net.SRV{{Target: "a.example.com.", Port: 443, Priority: 1, Weight: 1}}}
+	pool, err := NewSRVServerPool(lb, "_https._tcp.example.com", resolver, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	pool.Start()
+	assert.Eventually(t, func() bool {
+		return resolver.lookupCount() >= 1
+	}, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, pool.Close())
+	require.NoError(t, pool.Close())
+}
+
+func TestNewSRVServerPoolValidation(t *testing.T) {
+	lb, err := New(http.NotFoundHandler())
+	require.NoError(t, err)
+
+	_, err = NewSRVServerPool(lb, "", &fakeResolver{}, time.Second)
+	assert.Error(t, err)
+
+	_, err = NewSRVServerPool(lb, "_http._tcp.example.com", nil, time.Second)
+	assert.Error(t, err)
+
+	_, err = NewSRVServerPool(lb, "_http._tcp.example.com", &fakeResolver{}, 0)
+	assert.Error(t, err)
+
+	_, err = NewSRVServerPool(lb, "_http._tcp.example.com", &fakeResolver{}, time.Second, SRVScheme(""))
+	assert.Error(t, err)
+}
+
+func serverWeights(lb *RoundRobin) map[string]int {
+	out := make(map[string]int)
+	for _, u := range lb.Servers() {
+		weight, _ := lb.ServerWeight(u)
+		out[u.String()] = weight
+	}
+	return out
+}
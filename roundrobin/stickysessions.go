@@ -1,9 +1,18 @@
 package roundrobin
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/vulcand/oxy/utils"
 )
 
 // CookieOptions has all the options one would like to set on the affinity cookie
@@ -19,10 +28,23 @@ type CookieOptions struct {
 	SameSite http.SameSite
 }
 
-// StickySession is a mixin for load balancers that implements layer 7 (http cookie) session affinity
+// stickySource is where the affinity key of a StickySession is read from
+type stickySource int
+
+const (
+	stickyCookie stickySource = iota
+	stickyHeader
+	stickyQuery
+)
+
+// StickySession is a mixin for load balancers that implements layer 7 (http cookie, header or query parameter) session affinity
 type StickySession struct {
-	cookieName string
-	options    CookieOptions
+	source         stickySource
+	keyName        string
+	cookieName     string
+	options        CookieOptions
+	fallbackToNext bool
+	aead           cipher.AEAD
 }
 
 // NewStickySession creates a new StickySession
@@ -36,8 +58,51 @@ func NewStickySessionWithOptions(cookieName string, options CookieOptions) *Stic
 	return &StickySession{cookieName: cookieName, options: options}
 }
 
+// NewStickySessionWithHeader creates a new StickySession keyed on the value of a request header, e.g. "X-Session-ID",
+// for clients that can't hold cookies. Requests sharing a value are mapped to the same backend while the server list
+// doesn't change, requests without the header are load balanced as usual.
+func NewStickySessionWithHeader(name string) *StickySession {
+	return &StickySession{source: stickyHeader, keyName: http.CanonicalHeaderKey(name)}
+}
+
+// NewStickySessionWithQuery creates a new StickySession keyed on the value of a query parameter,
+// it maps requests to backends the same way as NewStickySessionWithHeader.
+func NewStickySessionWithQuery(name string) *StickySession {
+	return &StickySession{source: stickyQuery, keyName: name}
+}
+
+// SetFallbackToNext when enabled, servers with a zero weight are considered down as well as removed ones,
+// clients pinned to them are moved to the next server picked by the load balancer and their cookie is rewritten.
+func (s *StickySession) SetFallbackToNext(b bool) {
+	s.fallbackToNext = b
+}
+
+// SetCipher encrypts and authenticates the backend stored in the cookie with AES-GCM, key must be 16, 24 or 32 bytes long.
+// Clients can neither read the backend URLs nor pin themselves to a backend of their choosing:
+// cookies that fail to decrypt are ignored and the load balancer picks a new backend.
+func (s *StickySession) SetCipher(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("invalid sticky session key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	s.aead = aead
+	return nil
+}
+
 // GetBackend returns the backend URL stored in the sticky cookie, iff the backend is still in the valid list of servers.
+// Header and query parameter sessions return the server their key maps to.
 func (s *StickySession) GetBackend(req *http.Request, servers []*url.URL) (*url.URL, bool, error) {
+	switch s.source {
+	case stickyHeader:
+		return hashedBackend(req.Header.Get(s.keyName), servers)
+	case stickyQuery:
+		return hashedBackend(req.URL.Query().Get(s.keyName), servers)
+	}
+
 	cookie, err := req.Cookie(s.cookieName)
 	switch err {
 	case nil:
@@ -47,7 +112,15 @@ func (s *StickySession) GetBackend(req *http.Request, servers []*url.URL) (*url.
 		return nil, false, err
 	}
 
-	serverURL, err := url.Parse(cookie.Value)
+	value := cookie.Value
+	if s.aead != nil {
+		if value, err = s.decrypt(value); err != nil {
+			// forged or stale cookies are not errors, the client gets a new backend
+			return nil, false, nil
+		}
+	}
+
+	serverURL, err := url.Parse(value)
 	if err != nil {
 		return nil, false, err
 	}
@@ -58,8 +131,12 @@ func (s *StickySession) GetBackend(req *http.Request, servers []*url.URL) (*url.
 	return nil, false, nil
 }
 
-// StickBackend creates and sets the cookie
+// StickBackend creates and sets the cookie, header and query parameter sessions have nothing to set
 func (s *StickySession) StickBackend(backend *url.URL, w *http.ResponseWriter) {
+	if s.source != stickyCookie {
+		return
+	}
+
 	opt := s.options
 
 	cp := "/"
@@ -67,9 +144,17 @@ func (s *StickySession) StickBackend(backend *url.URL, w *http.ResponseWriter) {
 		cp = opt.Path
 	}
 
+	value := backend.String()
+	if s.aead != nil {
+		var err error
+		if value, err = s.encrypt(value); err != nil {
+			return
+		}
+	}
+
 	cookie := &http.Cookie{
 		Name:     s.cookieName,
-		Value:    backend.String(),
+		Value:    value,
 		Path:     cp,
 		Domain:   opt.Domain,
 		Expires:  opt.Expires,
@@ -81,6 +166,81 @@ func (s *StickySession) StickBackend(backend *url.URL, w *http.ResponseWriter) {
 	http.SetCookie(*w, cookie)
 }
 
+func (s *StickySession) encrypt(value string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(value)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(value), []byte(s.cookieName))), nil
+}
+
+func (s *StickySession) decrypt(value string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < s.aead.NonceSize() {
+		return "", errors.New("sticky cookie too short")
+	}
+	nonce, sealed := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, sealed, []byte(s.cookieName))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// hashedBackend maps the key to one of the servers with rendezvous hashing,
+// only the keys of a removed server move when the list changes
+func hashedBackend(key string, servers []*url.URL) (*url.URL, bool, error) {
+	if key == "" || len(servers) == 0 {
+		return nil, false, nil
+	}
+
+	var best *url.URL
+	var bestScore uint64
+	for _, serverURL := range servers {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(serverURL.String()))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(key))
+		if score := mix64(h.Sum64()); best == nil || score > bestScore {
+			best, bestScore = serverURL, score
+		}
+	}
+	return utils.CopyURL(best), true, nil
+}
+
+// mix64 is the splitmix64 finalizer, FNV alone spreads URLs differing by a port poorly
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// availableServers returns the servers a client can stay pinned to. Without fallbackToNext the cookies keep
+// pinning clients to servers with a zero weight, but the header and query keys are not mapped to them
+// unless all the servers have a zero weight.
+func (s *StickySession) availableServers(servers []*url.URL, weight func(*url.URL) (int, bool)) []*url.URL {
+	if !s.fallbackToNext && s.source == stickyCookie {
+		return servers
+	}
+
+	var available []*url.URL
+	for _, serverURL := range servers {
+		if w, ok := weight(serverURL); ok && w > 0 {
+			available = append(available, serverURL)
+		}
+	}
+	if len(available) == 0 && !s.fallbackToNext {
+		return servers
+	}
+	return available
+}
+
 func (s *StickySession) isBackendAlive(needle *url.URL, haystack []*url.URL) bool {
 	if len(haystack) == 0 {
 		return false
@@ -411,3 +411,264 @@ func TestBadCookieVal(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 }
+
+func TestStickyFallbackToNext(t *testing.T) {
+	a := testutils.NewResponder("a")
+	b := testutils.NewResponder("b")
+
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	sticky := NewStickySession("test")
+	sticky.SetFallbackToNext(true)
+
+	lb, err := New(fwd, EnableStickySession(sticky))
+	require.NoError(t, err)
+
+	err = lb.UpsertServer(testutils.ParseURI(a.URL))
+	require.NoError(t, err)
+	err = lb.UpsertServer(testutils.ParseURI(b.URL))
+	require.NoError(t, err)
+
+	// disable the pinned server
+	err = lb.UpsertServer(testutils.ParseURI(a.URL), Weight(0))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "test", Value: a.URL})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(body))
+
+	require.Len(t, resp.Cookies(), 1)
+	assert.Equal(t, b.URL, resp.Cookies()[0].Value)
+}
+
+func TestStickyFallbackToNextBackendError(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	// a server that is not listening anymore
+	down := testutils.NewResponder("down")
+	down.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	sticky := NewStickySession("test")
+	sticky.SetFallbackToNext(true)
+
+	lb, err := New(fwd, EnableStickySession(sticky))
+	require.NoError(t, err)
+
+	err = lb.UpsertServer(testutils.ParseURI(down.URL))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "test", Value: a.URL})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	require.Len(t, resp.Cookies(), 1)
+	assert.Equal(t, down.URL, resp.Cookies()[0].Value)
+}
+
+func TestStickyCipher(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	sticky := NewStickySession("test")
+	require.Error(t, sticky.SetCipher([]byte("short")))
+	key := []byte("0123456789abcdef0123456789abcdef")
+	require.NoError(t, sticky.SetCipher(key))
+
+	lb, err := New(fwd, EnableStickySession(sticky))
+	require.NoError(t, err)
+
+	err = lb.UpsertServer(testutils.ParseURI(a.URL))
+	require.NoError(t, err)
+	err = lb.UpsertServer(testutils.ParseURI(b.URL))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	get := func(value string) (string, *http.Cookie) {
+		req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		require.NoError(t, err)
+		if value != "" {
+			req.AddCookie(&http.Cookie{Name: "test", Value: value})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		if len(resp.Cookies()) == 0 {
+			return string(body), nil
+		}
+		return string(body), resp.Cookies()[0]
+	}
+
+	body, cookie := get("")
+	assert.Equal(t, "a", body)
+	require.NotNil(t, cookie)
+	assert.NotContains(t, cookie.Value, "127.0.0.1")
+
+	// the encrypted cookie keeps the client on its backend
+	for i := 0; i < 3; i++ {
+		body, newCookie := get(cookie.Value)
+		assert.Equal(t, "a", body)
+		assert.Nil(t, newCookie)
+	}
+
+	// a tampered cookie is ignored and replaced
+	tampered := []byte(cookie.Value)
+	tampered[len(tampered)/2] ^= 1
+	body, newCookie := get(string(tampered))
+	assert.Equal(t, "b", body)
+	require.NotNil(t, newCookie)
+
+	// so is a plaintext backend URL chosen by the client
+	body, newCookie = get(b.URL)
+	assert.Equal(t, "a", body)
+	require.NotNil(t, newCookie)
+
+	// and a cookie encrypted with another key
+	other := NewStickySession("test")
+	require.NoError(t, other.SetCipher([]byte("fedcba9876543210")))
+	forged, err := other.encrypt(a.URL)
+	require.NoError(t, err)
+	body, newCookie = get(forged)
+	assert.Equal(t, "b", body)
+	require.NotNil(t, newCookie)
+}
+
+func TestStickyHeaderAndQuery(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+	b := testutils.NewResponder("b")
+	defer b.Close()
+	c := testutils.NewResponder("c")
+	defer c.Close()
+
+	testCases := []struct {
+		desc    string
+		sticky  *StickySession
+		withKey func(req *http.Request, key string)
+	}{
+		{
+			desc:   "header",
+			sticky: NewStickySessionWithHeader("x-session-id"),
+			withKey: func(req *http.Request, key string) {
+				req.Header.Set("X-Session-ID", key)
+			},
+		},
+		{
+			desc:   "query",
+			sticky: NewStickySessionWithQuery("session"),
+			withKey: func(req *http.Request, key string) {
+				req.URL.RawQuery = "session=" + key
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			fwd, err := forward.New()
+			require.NoError(t, err)
+
+			lb, err := New(fwd, EnableStickySession(test.sticky))
+			require.NoError(t, err)
+
+			for _, srv := range []*httptest.Server{a, b, c} {
+				require.NoError(t, lb.UpsertServer(testutils.ParseURI(srv.URL)))
+			}
+
+			proxy := httptest.NewServer(lb)
+			defer proxy.Close()
+
+			get := func(key string) string {
+				req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+				require.NoError(t, err)
+				if key != "" {
+					test.withKey(req, key)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				assert.Empty(t, resp.Cookies())
+				body, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+				return string(body)
+			}
+
+			backends := make(map[string]string)
+			for i := 0; i < 30; i++ {
+				key := fmt.Sprintf("session-%d", i)
+				backends[key] = get(key)
+				for j := 0; j < 3; j++ {
+					assert.Equal(t, backends[key], get(key))
+				}
+			}
+
+			used := make(map[string]bool)
+			for _, backend := range backends {
+				used[backend] = true
+			}
+			assert.Len(t, used, 3)
+
+			// requests without a key are load balanced
+			assert.Equal(t, "a", get(""))
+			assert.Equal(t, "b", get(""))
+
+			// only the sessions of a removed server move
+			require.NoError(t, lb.RemoveServer(testutils.ParseURI(c.URL)))
+			for key, backend := range backends {
+				if backend != "c" {
+					assert.Equal(t, backend, get(key))
+				} else {
+					assert.NotEqual(t, "c", get(key))
+				}
+			}
+
+			// the keys are not mapped to servers with a zero weight
+			require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL), Weight(0)))
+			for key := range backends {
+				assert.Equal(t, "a", get(key))
+			}
+
+			// unless all the servers have a zero weight
+			require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL), Weight(0)))
+			used = make(map[string]bool)
+			for key := range backends {
+				used[get(key)] = true
+			}
+			assert.Len(t, used, 2)
+		})
+	}
+}
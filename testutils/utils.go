@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mailgun/timetools"
@@ -181,3 +182,64 @@ func GetClock() *timetools.FreezedTime {
 		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
 	}
 }
+
+// FakeClock is a timetools.TimeProvider safe for concurrent use whose time only moves when advanced,
+// the channels returned by After receive once the time has been advanced past their deadline.
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewFakeClock gets a FakeClock set to the time of GetClock
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: GetClock().CurrentTime}
+}
+
+// UtcNow returns the current time of the clock
+func (c *FakeClock) UtcNow() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Sleep advances the clock by d, like FreezedTime does
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// After returns a channel receiving the time once the clock has been advanced by d
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{deadline: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d and fires the channels of After whose deadline has passed
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = waiters
+}
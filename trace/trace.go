@@ -6,10 +6,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/oxy/utils"
 )
@@ -41,6 +45,72 @@ func ResponseHeaders(headers ...string) Option {
 	}
 }
 
+// MeasureBodySizes sets whether the bytes of the request body read by the next handler and the bytes of
+// the response body written by it are counted, defaults to true. Disabling it saves wrapping the request
+// body for performance-sensitive deployments, the sizes announced by the Content-Length headers are still recorded.
+func MeasureBodySizes(enabled bool) Option {
+	return func(t *Tracer) error {
+		t.measureBodySizes = enabled
+		return nil
+	}
+}
+
+// DefaultSampleHeader is the header forcing the sampling decision of a request, see SampleHeader
+const DefaultSampleHeader = "X-Oxy-Trace"
+
+// SampleRate sets the fraction of requests producing a record, from 0 to 1, defaults to 1.
+func SampleRate(rate float64) Option {
+	return func(t *Tracer) error {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("sample rate should be in [0, 1], got %v", rate)
+		}
+		t.sampleRate = rate
+		return nil
+	}
+}
+
+// ShouldSample sets a callback deciding whether a request produces a record, it replaces the SampleRate.
+func ShouldSample(fn func(*http.Request) bool) Option {
+	return func(t *Tracer) error {
+		t.shouldSample = fn
+		return nil
+	}
+}
+
+// SampleHeader sets the header forcing the sampling decision, defaults to DefaultSampleHeader.
+// A request carrying the header is always recorded, unless its value is a false boolean (e.g. "0" or "false")
+// in which case the sampling decision is made as for the other requests, so a request can be traced across
+// a chain of proxies.
+func SampleHeader(name string) Option {
+	return func(t *Tracer) error {
+		t.sampleHeader = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
+// redacted replaces the values of the redacted headers and query parameters in the records
+const redacted = "***"
+
+// RedactHeaders replaces the values of the named request and response headers with "***"
+// in the records, names are matched case-insensitively.
+func RedactHeaders(headers []string) Option {
+	return func(t *Tracer) error {
+		for _, h := range headers {
+			t.redactHeaders = append(t.redactHeaders, http.CanonicalHeaderKey(h))
+		}
+		return nil
+	}
+}
+
+// RedactQueryParams replaces the values of the named query parameters with "***" in the
+// recorded URL, names are matched case-insensitively. The request itself is not modified.
+func RedactQueryParams(params []string) Option {
+	return func(t *Tracer) error {
+		t.redactParams = append(t.redactParams, params...)
+		return nil
+	}
+}
+
 // Tracer records request and response emitting JSON structured data to the output
 type Tracer struct {
 	errHandler  utils.ErrorHandler
@@ -49,7 +119,17 @@ type Tracer struct {
 	respHeaders []string
 	writer      io.Writer
 
-	log *log.Logger
+	measureBodySizes bool
+
+	sampleRate   float64
+	shouldSample func(*http.Request) bool
+	sampleHeader string
+
+	redactHeaders []string
+	redactParams  []string
+
+	clock timetools.TimeProvider
+	log   *log.Logger
 }
 
 // New creates a new Tracer middleware that emits all the request/response information in structured format
@@ -57,10 +137,14 @@ type Tracer struct {
 // see RequestHeaders and ResponseHeaders options for details.
 func New(next http.Handler, writer io.Writer, opts ...Option) (*Tracer, error) {
 	t := &Tracer{
-		writer: writer,
-		next:   next,
+		writer:           writer,
+		next:             next,
+		measureBodySizes: true,
+		sampleRate:       1,
+		sampleHeader:     DefaultSampleHeader,
 
-		log: log.StandardLogger(),
+		clock: &timetools.RealTime{},
+		log:   log.StandardLogger(),
 	}
 	for _, o := range opts {
 		if err := o(t); err != nil {
@@ -73,6 +157,15 @@ func New(next http.Handler, writer io.Writer, opts ...Option) (*Tracer, error) {
 	return t, nil
 }
 
+// Clock sets the clock the requests are timed with, defaults to the real time.
+// Intended for unit tests.
+func Clock(clock timetools.TimeProvider) Option {
+	return func(t *Tracer) error {
+		t.clock = clock
+		return nil
+	}
+}
+
 // Logger defines the logger the tracer will use.
 //
 // It defaults to logrus.StandardLogger(), the global logger used by logrus.
@@ -84,30 +177,96 @@ func Logger(l *log.Logger) Option {
 }
 
 func (t *Tracer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	start := time.Now()
-	pw := utils.NewProxyWriterWithLogger(w, t.log)
-	t.next.ServeHTTP(pw, req)
+	if !t.sampled(req) {
+		t.next.ServeHTTP(w, req)
+		return
+	}
 
-	l := t.newRecord(req, pw, time.Since(start))
+	m := Measure(t.next, w, req, t.measureBodySizes, t.clock, t.log)
+
+	l := t.newRecord(req, m)
+	if t.measureBodySizes {
+		l.Request.BodyBytesRead = m.BodyBytesRead
+		l.Response.BodyBytesWritten = m.BodyBytesWritten
+	}
 	if err := json.NewEncoder(t.writer).Encode(l); err != nil {
 		t.log.Errorf("Failed to marshal request: %v", err)
 	}
 }
 
-func (t *Tracer) newRecord(req *http.Request, pw *utils.ProxyWriter, diff time.Duration) *Record {
+// Measurement is what is measured of a request served by a handler, see Measure
+type Measurement struct {
+	// Request is the request passed to the handler, handlers setting its URL to the upstream are reflected
+	Request        *http.Request
+	Start          time.Time
+	Duration       time.Duration
+	StatusCode     int
+	ResponseHeader http.Header
+	// BodyBytesRead is the number of bytes of the request body read by the handler, when measured
+	BodyBytesRead int64
+	// BodyBytesWritten is the number of bytes of the response body written by the handler
+	BodyBytesWritten int64
+}
+
+// Measure serves the request with next and returns its Measurement, it is the instrumentation of the Tracer
+// for other loggers such as the accesslog package. The request body is only wrapped to count the bytes read
+// when measureBody is set, the request is timed with clock and l logs the failures to write the response.
+func Measure(next http.Handler, w http.ResponseWriter, req *http.Request, measureBody bool, clock timetools.TimeProvider, l *log.Logger) *Measurement {
+	start := clock.UtcNow()
+	pw := utils.NewProxyWriterWithLogger(w, l)
+
+	var body *countingReader
+	served := req
+	if measureBody && req.Body != nil && req.Body != http.NoBody {
+		body = &countingReader{ReadCloser: req.Body}
+		newReq := *req
+		newReq.Body = body
+		served = &newReq
+	}
+	next.ServeHTTP(pw, served)
+
+	m := &Measurement{
+		Request:          served,
+		Start:            start,
+		Duration:         clock.UtcNow().Sub(start),
+		StatusCode:       pw.StatusCode(),
+		ResponseHeader:   pw.Header(),
+		BodyBytesWritten: pw.GetLength(),
+	}
+	if body != nil {
+		m.BodyBytesRead = body.n
+	}
+	return m
+}
+
+// sampled decides whether the request produces a record
+func (t *Tracer) sampled(req *http.Request) bool {
+	if values, ok := req.Header[t.sampleHeader]; ok && t.sampleHeader != "" {
+		// the clients can only force the sampling on, not hide their requests from the records
+		if force, err := strconv.ParseBool(values[0]); err != nil || force {
+			return true
+		}
+	}
+	if t.shouldSample != nil {
+		return t.shouldSample(req)
+	}
+	return t.sampleRate >= 1 || rand.Float64() < t.sampleRate
+}
+
+func (t *Tracer) newRecord(req *http.Request, m *Measurement) *Record {
 	return &Record{
 		Request: Request{
 			Method:    req.Method,
-			URL:       req.URL.String(),
+			URL:       t.redactURL(req.URL),
 			TLS:       newTLS(req),
 			BodyBytes: bodyBytes(req.Header),
-			Headers:   captureHeaders(req.Header, t.reqHeaders),
+			Headers:   t.redact(captureHeaders(req.Header, t.reqHeaders)),
 		},
 		Response: Response{
-			Code:      pw.StatusCode(),
-			BodyBytes: bodyBytes(pw.Header()),
-			Roundtrip: float64(diff) / float64(time.Millisecond),
-			Headers:   captureHeaders(pw.Header(), t.respHeaders),
+			Code:      m.StatusCode,
+			BodyBytes: bodyBytes(m.ResponseHeader),
+			Roundtrip: float64(m.Duration) / float64(time.Millisecond),
+			Headers:   t.redact(captureHeaders(m.ResponseHeader, t.respHeaders)),
 		},
 	}
 }
@@ -141,6 +300,43 @@ func captureHeaders(in http.Header, headers []string) http.Header {
 	return out
 }
 
+// redact replaces the values of the redacted headers of the captured headers
+func (t *Tracer) redact(h http.Header) http.Header {
+	for _, name := range t.redactHeaders {
+		for i := range h[name] {
+			h[name][i] = redacted
+		}
+	}
+	return h
+}
+
+// redactURL returns the URL with the values of the redacted query parameters replaced,
+// the order and the encoding of the other parameters is kept.
+func (t *Tracer) redactURL(u *url.URL) string {
+	if len(t.redactParams) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+
+	params := strings.Split(u.RawQuery, "&")
+	for i, p := range params {
+		key := strings.SplitN(p, "=", 2)[0]
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		for _, r := range t.redactParams {
+			if strings.EqualFold(name, r) {
+				params[i] = key + "=" + redacted
+				break
+			}
+		}
+	}
+
+	out := *u
+	out.RawQuery = strings.Join(params, "&")
+	return out.String()
+}
+
 // Record represents a structured request and response record
 type Record struct {
 	Request  Request  `json:"request"`
@@ -149,19 +345,21 @@ type Record struct {
 
 // Request contains information about an HTTP request
 type Request struct {
-	Method    string      `json:"method"`            // Method - request method
-	BodyBytes int64       `json:"body_bytes"`        // BodyBytes - size of request body in bytes
-	URL       string      `json:"url"`               // URL - Request URL
-	Headers   http.Header `json:"headers,omitempty"` // Headers - optional request headers, will be recorded if configured
-	TLS       *TLS        `json:"tls,omitempty"`     // TLS - optional TLS record, will be recorded if it's a TLS connection
+	Method        string      `json:"method"`                    // Method - request method
+	BodyBytes     int64       `json:"body_bytes"`                // BodyBytes - size of request body in bytes
+	BodyBytesRead int64       `json:"body_bytes_read,omitempty"` // BodyBytesRead - bytes of the request body read by the handler, if measured
+	URL           string      `json:"url"`                       // URL - Request URL
+	Headers       http.Header `json:"headers,omitempty"`         // Headers - optional request headers, will be recorded if configured
+	TLS           *TLS        `json:"tls,omitempty"`             // TLS - optional TLS record, will be recorded if it's a TLS connection
 }
 
 // Response contains information about HTTP response
 type Response struct {
-	Code      int         `json:"code"`              // Code - response status code
-	Roundtrip float64     `json:"roundtrip"`         // Roundtrip - round trip time in milliseconds
-	Headers   http.Header `json:"headers,omitempty"` // Headers - optional headers, will be recorded if configured
-	BodyBytes int64       `json:"body_bytes"`        // BodyBytes - size of response body in bytes
+	Code             int         `json:"code"`                         // Code - response status code
+	Roundtrip        float64     `json:"roundtrip"`                    // Roundtrip - round trip time in milliseconds
+	Headers          http.Header `json:"headers,omitempty"`            // Headers - optional headers, will be recorded if configured
+	BodyBytes        int64       `json:"body_bytes"`                   // BodyBytes - size of response body in bytes
+	BodyBytesWritten int64       `json:"body_bytes_written,omitempty"` // BodyBytesWritten - bytes of the response body written by the handler, if measured
 }
 
 // TLS contains information about this TLS connection
@@ -182,6 +380,8 @@ func versionToString(v uint16) string {
 		return "TLS11"
 	case tls.VersionTLS12:
 		return "TLS12"
+	case tls.VersionTLS13:
+		return "TLS13"
 	}
 	return fmt.Sprintf("unknown: %x", v)
 }
@@ -214,6 +414,20 @@ func csToString(cs uint16) string {
 		return "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
 	case tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:
 		return "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"
+	case tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:
+		return "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"
+	case tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:
+		return "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	case tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:
+		return "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305"
+	case tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+		return "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305"
+	case tls.TLS_AES_128_GCM_SHA256:
+		return "TLS_AES_128_GCM_SHA256"
+	case tls.TLS_AES_256_GCM_SHA384:
+		return "TLS_AES_256_GCM_SHA384"
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		return "TLS_CHACHA20_POLY1305_SHA256"
 	}
 	return fmt.Sprintf("unknown: %x", cs)
 }
@@ -229,3 +443,15 @@ func bodyBytes(h http.Header) int64 {
 	}
 	return 0
 }
+
+// countingReader counts the bytes read from the request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
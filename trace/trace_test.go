@@ -6,10 +6,13 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -45,6 +48,24 @@ func TestTraceSimple(t *testing.T) {
 	assert.EqualValues(t, 5, r.Response.BodyBytes)
 }
 
+func TestTraceClock(t *testing.T) {
+	clock := testutils.GetClock()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clock.Sleep(1500 * time.Millisecond)
+		w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace, Clock(clock))
+	require.NoError(t, err)
+
+	tr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hello", nil))
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, float64(1500), r.Response.Roundtrip)
+}
+
 func TestTraceCaptureHeaders(t *testing.T) {
 	respHeaders := http.Header{
 		"X-Re-1": []string{"6", "7"},
@@ -108,4 +129,146 @@ func TestTraceTLS(t *testing.T) {
 	var r *Record
 	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
 	assert.Equal(t, versionToString(state.Version), r.Request.TLS.Version)
+	assert.NotContains(t, r.Request.TLS.Version, "unknown")
+	assert.Equal(t, csToString(state.CipherSuite), r.Request.TLS.CipherSuite)
+	assert.NotContains(t, r.Request.TLS.CipherSuite, "unknown")
+}
+
+func TestTraceBodySizes(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+		w.Write(body)
+	})
+
+	testCases := []struct {
+		desc    string
+		measure bool
+	}{
+		{desc: "measured", measure: true},
+		{desc: "not measured", measure: false},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			trace := &bytes.Buffer{}
+			tr, err := New(handler, trace, MeasureBodySizes(test.measure))
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(tr)
+			defer srv.Close()
+
+			// the request and the response are chunked, no Content-Length announces their sizes
+			resp, err := http.Post(srv.URL, "text/plain", ioutil.NopCloser(strings.NewReader("123456")))
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			assert.Equal(t, "123456123456", string(body))
+
+			var r *Record
+			require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+			assert.EqualValues(t, 0, r.Request.BodyBytes)
+			if test.measure {
+				assert.EqualValues(t, 6, r.Request.BodyBytesRead)
+				assert.EqualValues(t, 12, r.Response.BodyBytesWritten)
+			} else {
+				assert.NotContains(t, trace.String(), "body_bytes_read")
+				assert.NotContains(t, trace.String(), "body_bytes_written")
+			}
+		})
+	}
+}
+
+func TestTraceSampling(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	testCases := []struct {
+		desc     string
+		options  []Option
+		header   http.Header
+		expected int
+	}{
+		{desc: "default", expected: 10},
+		{desc: "rate 0", options: []Option{SampleRate(0)}, expected: 0},
+		{desc: "rate 0 forced by header", options: []Option{SampleRate(0)}, header: http.Header{DefaultSampleHeader: {"1"}}, expected: 10},
+		{desc: "rate 1 not disabled by header", options: []Option{SampleRate(1)}, header: http.Header{DefaultSampleHeader: {"false"}}, expected: 10},
+		{desc: "rate 0 not forced by false header", options: []Option{SampleRate(0)}, header: http.Header{DefaultSampleHeader: {"0"}}, expected: 0},
+		{desc: "custom header", options: []Option{SampleRate(0), SampleHeader("x-debug")}, header: http.Header{"X-Debug": {"yes"}}, expected: 10},
+		{
+			desc: "callback",
+			options: []Option{ShouldSample(func(req *http.Request) bool {
+				return req.URL.Query().Get("i") == "3"
+			})},
+			expected: 1,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			trace := &bytes.Buffer{}
+			tr, err := New(handler, trace, test.options...)
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(tr)
+			defer srv.Close()
+
+			for i := 0; i < 10; i++ {
+				re, body, err := testutils.Get(fmt.Sprintf("%s?i=%d", srv.URL, i), testutils.Headers(test.header))
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusOK, re.StatusCode)
+				assert.Equal(t, "hello", string(body))
+			}
+			assert.Equal(t, test.expected, strings.Count(trace.String(), "\n"))
+		})
+	}
+
+	_, err := New(handler, &bytes.Buffer{}, SampleRate(1.5))
+	assert.Error(t, err)
+}
+
+func TestTraceRedaction(t *testing.T) {
+	var outAuth, outQuery string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		outAuth, outQuery = req.Header.Get("Authorization"), req.URL.RawQuery
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("X-Public", "visible")
+		w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace,
+		RequestHeaders("Authorization", "X-Public"),
+		ResponseHeaders("Set-Cookie", "X-Public"),
+		RedactHeaders([]string{"authorization", "SET-COOKIE"}),
+		RedactQueryParams([]string{"Token"}),
+	)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL+"/hello?b=2&token=secret&a=1",
+		testutils.Header("Authorization", "Bearer secret"),
+		testutils.Header("X-Public", "visible"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the request passed downstream is untouched
+	assert.Equal(t, "Bearer secret", outAuth)
+	assert.Equal(t, "b=2&token=secret&a=1", outQuery)
+
+	assert.NotContains(t, trace.String(), "secret")
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, "/hello?b=2&token=***&a=1", r.Request.URL)
+	assert.Equal(t, []string{"***"}, r.Request.Headers["Authorization"])
+	assert.Equal(t, []string{"visible"}, r.Request.Headers["X-Public"])
+	assert.Equal(t, []string{"***"}, r.Response.Headers["Set-Cookie"])
+	assert.Equal(t, []string{"visible"}, r.Response.Headers["X-Public"])
 }
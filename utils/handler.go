@@ -2,9 +2,13 @@ package utils
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -27,23 +31,93 @@ var DefaultHandler ErrorHandler = &StdHandler{}
 type StdHandler struct{}
 
 func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	statusCode := errorStatusCode(err)
+
+	w.WriteHeader(statusCode)
+	w.Write([]byte(statusText(statusCode)))
+	log.Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
+}
+
+// JSONHandler error handler rendering the errors as a JSON envelope: {"error":"Bad Gateway","code":502}
+type JSONHandler struct {
+	// StatusCodes maps errors to status codes, they are matched with errors.Is in order before the default mapping,
+	// the first match wins
+	StatusCodes []ErrorStatusCode
+	// ContentType of the responses, defaults to application/json
+	ContentType string
+}
+
+// ErrorStatusCode is the status code answered for the errors matching Err
+type ErrorStatusCode struct {
+	Err  error
+	Code int
+}
+
+// JSONErrorHandler creates a JSONHandler, without statusCodes only the default mapping is used
+func JSONErrorHandler(statusCodes ...ErrorStatusCode) *JSONHandler {
+	return &JSONHandler{StatusCodes: statusCodes}
+}
+
+type jsonError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+func (e *JSONHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	statusCode := 0
+	for _, sc := range e.StatusCodes {
+		if errors.Is(err, sc.Err) {
+			statusCode = sc.Code
+			break
+		}
+	}
+	if statusCode == 0 {
+		statusCode = errorStatusCode(err)
+	}
+
+	contentType := e.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	body, _ := json.Marshal(jsonError{Error: statusText(statusCode), Code: statusCode})
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(statusCode)
+	w.Write(body)
+	log.Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
+}
+
+// statusCoder is implemented by the errors that know the status code to answer with
+type statusCoder interface {
+	StatusCode() int
+}
+
+// errorStatusCode returns the status code reported for an error of the upstream, wrapped errors are unwrapped
+func errorStatusCode(err error) int {
+	var coder statusCoder
+	if errors.As(err, &coder) {
+		return coder.StatusCode()
+	}
+
 	statusCode := http.StatusInternalServerError
 
-	if e, ok := err.(net.Error); ok {
-		if e.Timeout() {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) {
+		statusCode = http.StatusGatewayTimeout
+	} else if errors.As(err, &netErr) {
+		if netErr.Timeout() {
 			statusCode = http.StatusGatewayTimeout
 		} else {
 			statusCode = http.StatusBadGateway
 		}
-	} else if err == io.EOF {
+	} else if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNREFUSED) {
 		statusCode = http.StatusBadGateway
-	} else if err == context.Canceled {
+	} else if errors.Is(err, context.Canceled) {
 		statusCode = StatusClientClosedRequest
 	}
-
-	w.WriteHeader(statusCode)
-	w.Write([]byte(statusText(statusCode)))
-	log.Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
+	return statusCode
 }
 
 func statusText(statusCode int) string {
@@ -2,9 +2,14 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -30,3 +35,79 @@ func TestDefaultHandlerErrors(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadGateway, w.Code)
 }
+
+var errQuota = errors.New("quota exceeded")
+
+// errQuotaTimeout matches both itself and context.DeadlineExceeded
+var errQuotaTimeout = fmt.Errorf("quota: %w", context.DeadlineExceeded)
+
+func TestJSONErrorHandler(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		handler      *JSONHandler
+		err          error
+		expectedCode int
+		expectedType string
+	}{
+		{
+			desc:         "deadline",
+			handler:      JSONErrorHandler(),
+			err:          fmt.Errorf("round trip: %w", context.DeadlineExceeded),
+			expectedCode: http.StatusGatewayTimeout,
+			expectedType: "application/json",
+		},
+		{
+			desc:         "connection refused",
+			handler:      JSONErrorHandler(),
+			err:          &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED},
+			expectedCode: http.StatusBadGateway,
+			expectedType: "application/json",
+		},
+		{
+			desc:         "unknown error",
+			handler:      &JSONHandler{},
+			err:          errors.New("boom"),
+			expectedCode: http.StatusInternalServerError,
+			expectedType: "application/json",
+		},
+		{
+			desc:         "custom mapping and content type",
+			handler:      &JSONHandler{StatusCodes: []ErrorStatusCode{{Err: errQuota, Code: http.StatusTooManyRequests}}, ContentType: "application/problem+json"},
+			err:          fmt.Errorf("upstream: %w", errQuota),
+			expectedCode: http.StatusTooManyRequests,
+			expectedType: "application/problem+json",
+		},
+		{
+			desc: "first matching mapping",
+			handler: JSONErrorHandler(
+				ErrorStatusCode{Err: errQuotaTimeout, Code: http.StatusTooManyRequests},
+				ErrorStatusCode{Err: context.DeadlineExceeded, Code: http.StatusServiceUnavailable},
+			),
+			err:          fmt.Errorf("upstream: %w", errQuotaTimeout),
+			expectedCode: http.StatusTooManyRequests,
+			expectedType: "application/json",
+		},
+		{
+			desc: "first matching mapping reversed",
+			handler: JSONErrorHandler(
+				ErrorStatusCode{Err: context.DeadlineExceeded, Code: http.StatusServiceUnavailable},
+				ErrorStatusCode{Err: errQuotaTimeout, Code: http.StatusTooManyRequests},
+			),
+			err:          fmt.Errorf("upstream: %w", errQuotaTimeout),
+			expectedCode: http.StatusServiceUnavailable,
+			expectedType: "application/json",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			test.handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost", nil), test.err)
+
+			assert.Equal(t, test.expectedCode, rw.Code)
+			assert.Equal(t, test.expectedType, rw.Header().Get("Content-Type"))
+			assert.JSONEq(t, fmt.Sprintf(`{"error":%q,"code":%d}`, http.StatusText(test.expectedCode), test.expectedCode), rw.Body.String())
+		})
+	}
+}
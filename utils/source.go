@@ -2,10 +2,13 @@ package utils
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 )
 
+const forwardedFor = "X-Forwarded-For"
+
 // SourceExtractor extracts the source from the request, e.g. that may be client ip, or particular header that
 // identifies the source. amount stands for amount of connections the source consumes, usually 1 for connection limiters
 // error should be returned when source can not be identified
@@ -42,6 +45,78 @@ func NewExtractor(variable string) (SourceExtractor, error) {
 	return nil, fmt.Errorf("unsupported limiting variable: '%s'", variable)
 }
 
+// NewForwardedForExtractor creates a SourceExtractor returning the client IP found in the X-Forwarded-For header
+// when the requests go through trusted proxies. The header is walked from the right, trustedHops is the number of
+// addresses appended by the trusted proxies after the one of the client, so 0 takes the rightmost address, i.e. the
+// one added by the proxy connecting to this server. The addresses on the left of the client one can be spoofed.
+// The remote address of the request is used when the header is absent or shorter than expected.
+func NewForwardedForExtractor(trustedHops int) (SourceExtractor, error) {
+	if trustedHops < 0 {
+		return nil, fmt.Errorf("trusted hops should be >= 0, got %v", trustedHops)
+	}
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		var addrs []string
+		for _, value := range req.Header[forwardedFor] {
+			for _, addr := range strings.Split(value, ",") {
+				addrs = append(addrs, strings.TrimSpace(addr))
+			}
+		}
+
+		i := len(addrs) - 1 - trustedHops
+		if i < 0 {
+			return extractClientIP(req)
+		}
+		ip := net.ParseIP(addrs[i])
+		if ip == nil {
+			return "", 0, fmt.Errorf("failed to parse client IP from %s: %q", forwardedFor, addrs[i])
+		}
+		return ip.String(), 1, nil
+	}), nil
+}
+
+// TokenExtractor is a SourceExtractor keying the requests by an arbitrary token, e.g. an API key or a tenant
+// read from a header, with a per request amount used as its cost by the limiters.
+type TokenExtractor struct {
+	// Token returns the token of the request, a missing (empty) or malformed (error) token maps to DefaultToken
+	Token func(req *http.Request) (string, error)
+	// Amount returns the amount the request consumes, defaults to 1, a zero amount isn't counted
+	Amount func(req *http.Request, token string) int64
+	// DefaultToken is the bucket shared by the requests without a valid token,
+	// if it is empty these requests are rejected with an error.
+	DefaultToken string
+}
+
+// NewHeaderTokenExtractor creates a TokenExtractor keying the requests by the value of the header,
+// the requests without the header use defaultToken.
+func NewHeaderTokenExtractor(header, defaultToken string) *TokenExtractor {
+	return &TokenExtractor{
+		Token: func(req *http.Request) (string, error) {
+			return req.Header.Get(header), nil
+		},
+		DefaultToken: defaultToken,
+	}
+}
+
+// Extract extracts the token and the amount of the request
+func (e *TokenExtractor) Extract(req *http.Request) (string, int64, error) {
+	token, err := e.Token(req)
+	if err != nil || token == "" {
+		if e.DefaultToken == "" {
+			if err == nil {
+				err = fmt.Errorf("missing token")
+			}
+			return "", 0, err
+		}
+		token = e.DefaultToken
+	}
+
+	amount := int64(1)
+	if e.Amount != nil {
+		amount = e.Amount(req, token)
+	}
+	return token, amount, nil
+}
+
 func extractClientIP(req *http.Request) (string, int64, error) {
 	vals := strings.SplitN(req.RemoteAddr, ":", 2)
 	if len(vals[0]) == 0 {
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardedForExtractor(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		trustedHops int
+		xff         []string
+		expected    string
+		expectedErr bool
+	}{
+		{desc: "no header", trustedHops: 1, expected: "10.0.0.1"},
+		{desc: "rightmost", trustedHops: 0, xff: []string{"1.1.1.1, 2.2.2.2"}, expected: "2.2.2.2"},
+		{desc: "skips trusted hops", trustedHops: 1, xff: []string{"6.6.6.6, 1.1.1.1, 2.2.2.2"}, expected: "1.1.1.1"},
+		{desc: "several header lines", trustedHops: 2, xff: []string{"6.6.6.6, 1.1.1.1", "2.2.2.2", "3.3.3.3"}, expected: "1.1.1.1"},
+		{desc: "shorter than trusted hops", trustedHops: 2, xff: []string{"2.2.2.2"}, expected: "10.0.0.1"},
+		{desc: "ipv6", trustedHops: 0, xff: []string{"2001:db8::1"}, expected: "2001:db8::1"},
+		{desc: "invalid address", trustedHops: 0, xff: []string{"1.1.1.1, unknown"}, expectedErr: true},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			extractor, err := NewForwardedForExtractor(test.trustedHops)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = "10.0.0.1:4567"
+			req.Header["X-Forwarded-For"] = test.xff
+
+			token, amount, err := extractor.Extract(req)
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, token)
+			assert.EqualValues(t, 1, amount)
+		})
+	}
+
+	_, err := NewForwardedForExtractor(-1)
+	assert.Error(t, err)
+}
+
+func TestTokenExtractor(t *testing.T) {
+	extractor := NewHeaderTokenExtractor("X-Api-Key", "anonymous")
+	extractor.Amount = func(req *http.Request, token string) int64 {
+		if req.Method == http.MethodPost {
+			return 2
+		}
+		return 1
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost", nil)
+	req.Header.Set("X-Api-Key", "key-1")
+	token, amount, err := extractor.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "key-1", token)
+	assert.EqualValues(t, 2, amount)
+
+	// missing tokens map to the default bucket
+	token, amount, err = extractor.Extract(httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", token)
+	assert.EqualValues(t, 1, amount)
+
+	// malformed tokens too
+	extractor.Token = func(req *http.Request) (string, error) {
+		return "", errors.New("malformed")
+	}
+	token, _, err = extractor.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", token)
+
+	// they are rejected without a default bucket
+	extractor.DefaultToken = ""
+	_, _, err = extractor.Extract(req)
+	assert.Error(t, err)
+
+	_, _, err = NewHeaderTokenExtractor("X-Api-Key", "").Extract(httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	assert.Error(t, err)
+}